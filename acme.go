@@ -0,0 +1,783 @@
+package testutils
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ACMEEndpoint identifies an endpoint served by the ACMEServer.
+type ACMEEndpoint string
+
+const (
+	ACMEEndpointDirectory     ACMEEndpoint = "directory"
+	ACMEEndpointNewNonce      ACMEEndpoint = "new-nonce"
+	ACMEEndpointNewAccount    ACMEEndpoint = "new-account"
+	ACMEEndpointAccount       ACMEEndpoint = "account"
+	ACMEEndpointOrders        ACMEEndpoint = "orders"
+	ACMEEndpointNewOrder      ACMEEndpoint = "new-order"
+	ACMEEndpointOrder         ACMEEndpoint = "order"
+	ACMEEndpointAuthorization ACMEEndpoint = "authz"
+	ACMEEndpointChallenge     ACMEEndpoint = "challenge"
+	ACMEEndpointFinalize      ACMEEndpoint = "finalize"
+	ACMEEndpointCertificate   ACMEEndpoint = "cert"
+)
+
+// ACME problem types, as registered in RFC 8555 section 6.7.
+const (
+	ACMEProblemBadNonce            = "urn:ietf:params:acme:error:badNonce"
+	ACMEProblemMalformed           = "urn:ietf:params:acme:error:malformed"
+	ACMEProblemUnauthorized        = "urn:ietf:params:acme:error:unauthorized"
+	ACMEProblemAccountDoesNotExist = "urn:ietf:params:acme:error:accountDoesNotExist"
+	ACMEProblemRateLimited         = "urn:ietf:params:acme:error:rateLimited"
+	ACMEProblemServerInternal      = "urn:ietf:params:acme:error:serverInternal"
+	ACMEProblemOrderNotReady       = "urn:ietf:params:acme:error:orderNotReady"
+	ACMEProblemBadCSR              = "urn:ietf:params:acme:error:badCSR"
+	ACMEProblemRejectedIdentifier  = "urn:ietf:params:acme:error:rejectedIdentifier"
+	ACMEProblemIncorrectResponse   = "urn:ietf:params:acme:error:incorrectResponse"
+	ACMEProblemConnection          = "urn:ietf:params:acme:error:connection"
+)
+
+// ACMEProblem is an RFC 7807 problem document returned by the ACMEServer.
+type ACMEProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status,omitempty"`
+	// RetryAfter is sent in the Retry-After header when set, typically with rate limits.
+	RetryAfter time.Duration `json:"-"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeAccount struct {
+	id                   string
+	key                  JSONWebKey
+	publicKey            crypto.PublicKey
+	Status               string   `json:"status"`
+	Contact              []string `json:"contact,omitempty"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed,omitempty"`
+	Orders               string   `json:"orders"`
+}
+
+type acmeChallenge struct {
+	id        string
+	authzID   string
+	Type      string       `json:"type"`
+	URL       string       `json:"url"`
+	Token     string       `json:"token"`
+	Status    string       `json:"status"`
+	Validated string       `json:"validated,omitempty"`
+	Error     *ACMEProblem `json:"error,omitempty"`
+}
+
+type acmeAuthorization struct {
+	id         string
+	accountID  string
+	Identifier acmeIdentifier   `json:"identifier"`
+	Status     string           `json:"status"`
+	Expires    string           `json:"expires"`
+	Challenges []*acmeChallenge `json:"challenges"`
+}
+
+type acmeOrder struct {
+	id             string
+	accountID      string
+	authzIDs       []string
+	certificateID  string
+	Status         string           `json:"status"`
+	Expires        string           `json:"expires"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate,omitempty"`
+	Error          *ACMEProblem     `json:"error,omitempty"`
+}
+
+// ACMEServer is a minimal in-process RFC 8555 server issuing certificates signed by a test CertificateAuthority.
+//
+// It supports account creation, orders for DNS identifiers, HTTP-01 challenges, finalization and certificate download.
+//
+//	acmeServer := testutils.NewACMEServer(t)
+//	acmeServer.ChallengeAddress = challengeServer.Listener.Addr().String()
+//	client := &acme.Client{DirectoryURL: acmeServer.DirectoryURL(), HTTPClient: acmeServer.Client()}
+type ACMEServer struct {
+	Server *httptest.Server
+	// CA signs the issued certificates and the server certificate.
+	CA *CertificateAuthority
+	// ChallengeAddress is the host:port HTTP-01 validation requests are sent to, whatever the validated domain.
+	// When empty, validation requests are sent to port 80 of the domain.
+	ChallengeAddress string
+
+	mu             sync.Mutex
+	nextID         int
+	nonces         map[string]bool
+	accounts       map[string]*acmeAccount
+	orders         map[string]*acmeOrder
+	authorizations map[string]*acmeAuthorization
+	challenges     map[string]*acmeChallenge
+	certificates   map[string][]byte
+	problems       map[ACMEEndpoint][]ACMEProblem
+}
+
+// NewACMEServer starts an ACME server over TLS.
+//
+// Use Client or CA to trust the server and the certificates it issues.
+func NewACMEServer(t CleanupTest) *ACMEServer {
+	t.Helper()
+	s := &ACMEServer{
+		CA:             NewCertificateAuthority(t, afero.NewMemMapFs(), "/ca"),
+		nonces:         map[string]bool{},
+		accounts:       map[string]*acmeAccount{},
+		orders:         map[string]*acmeOrder{},
+		authorizations: map[string]*acmeAuthorization{},
+		challenges:     map[string]*acmeChallenge{},
+		certificates:   map[string][]byte{},
+		problems:       map[ACMEEndpoint][]ACMEProblem{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", s.handle(ACMEEndpointDirectory, s.serveDirectory))
+	mux.HandleFunc("/new-nonce", s.handle(ACMEEndpointNewNonce, s.serveNewNonce))
+	mux.HandleFunc("POST /new-account", s.handle(ACMEEndpointNewAccount, s.serveNewAccount))
+	mux.HandleFunc("GET /terms", s.serveTerms)
+	mux.HandleFunc("POST /account/{id}", s.handle(ACMEEndpointAccount, s.serveAccount))
+	mux.HandleFunc("POST /account/{id}/orders", s.handle(ACMEEndpointOrders, s.serveOrders))
+	mux.HandleFunc("POST /new-order", s.handle(ACMEEndpointNewOrder, s.serveNewOrder))
+	mux.HandleFunc("POST /order/{id}", s.handle(ACMEEndpointOrder, s.serveOrder))
+	mux.HandleFunc("POST /authz/{id}", s.handle(ACMEEndpointAuthorization, s.serveAuthorization))
+	mux.HandleFunc("POST /challenge/{id}", s.handle(ACMEEndpointChallenge, s.serveChallenge))
+	mux.HandleFunc("POST /finalize/{id}", s.handle(ACMEEndpointFinalize, s.serveFinalize))
+	mux.HandleFunc("POST /cert/{id}", s.handle(ACMEEndpointCertificate, s.serveCertificate))
+	s.Server = s.CA.NewTLSServer(t, mux)
+	return s
+}
+
+// DirectoryURL returns the URL ACME clients are configured with.
+func (s *ACMEServer) DirectoryURL() string {
+	return s.url(ACMEEndpointDirectory, "")
+}
+
+// Client returns an HTTP client trusting the server certificate.
+func (s *ACMEServer) Client() *http.Client {
+	return s.Server.Client()
+}
+
+// InjectError makes the next request to the endpoint fail with the problem.
+//
+// Several problems can be queued for the same endpoint, each of them being returned once.
+// When the problem has no status, 400 Bad Request is used.
+func (s *ACMEServer) InjectError(endpoint ACMEEndpoint, problem ACMEProblem) *ACMEServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if problem.Status == 0 {
+		problem.Status = http.StatusBadRequest
+	}
+	s.problems[endpoint] = append(s.problems[endpoint], problem)
+	return s
+}
+
+// IssuedCertificates returns the leaf certificates issued so far.
+func (s *ACMEServer) IssuedCertificates() []*x509.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for id := range s.certificates {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	certs := []*x509.Certificate{}
+	for _, id := range ids {
+		block, _ := pem.Decode(s.certificates[id])
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+func (s *ACMEServer) url(endpoint ACMEEndpoint, id string) string {
+	if id == "" {
+		return s.Server.URL + "/" + string(endpoint)
+	}
+	return s.Server.URL + "/" + string(endpoint) + "/" + id
+}
+
+func (s *ACMEServer) newID() string {
+	s.nextID++
+	return strconv.Itoa(s.nextID)
+}
+
+func (s *ACMEServer) newNonce() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nonce := randomToken()
+	s.nonces[nonce] = true
+	return nonce
+}
+
+func (s *ACMEServer) consumeNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.nonces[nonce] {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return true
+}
+
+func (s *ACMEServer) handle(endpoint ACMEEndpoint, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", s.newNonce())
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="index"`, s.DirectoryURL()))
+		s.mu.Lock()
+		var problem *ACMEProblem
+		if problems := s.problems[endpoint]; len(problems) > 0 {
+			problem = &problems[0]
+			s.problems[endpoint] = problems[1:]
+		}
+		s.mu.Unlock()
+		if problem != nil {
+			writeACMEProblem(w, *problem)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeACMEProblem(w http.ResponseWriter, problem ACMEProblem) {
+	if problem.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(problem.RetryAfter.Seconds())))
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func writeACMEResource(w http.ResponseWriter, status int, location string, resource interface{}) {
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resource)
+}
+
+func (s *ACMEServer) serveDirectory(w http.ResponseWriter, r *http.Request) {
+	writeACMEResource(w, http.StatusOK, "", map[string]interface{}{
+		"newNonce":   s.url(ACMEEndpointNewNonce, ""),
+		"newAccount": s.url(ACMEEndpointNewAccount, ""),
+		"newOrder":   s.url(ACMEEndpointNewOrder, ""),
+		"meta": map[string]interface{}{
+			"termsOfService": s.Server.URL + "/terms",
+		},
+	})
+}
+
+func (s *ACMEServer) serveTerms(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "Terms of service of the test ACME server: certificates are issued for tests only.\n")
+}
+
+func (s *ACMEServer) serveNewNonce(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type acmeJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type acmeProtectedHeader struct {
+	Algorithm string      `json:"alg"`
+	Nonce     string      `json:"nonce"`
+	URL       string      `json:"url"`
+	JWK       *JSONWebKey `json:"jwk"`
+	KeyID     string      `json:"kid"`
+}
+
+type acmeRequest struct {
+	payload []byte
+	jwk     *JSONWebKey
+	account *acmeAccount
+}
+
+// verify authenticates the JWS request body. The request must be signed by the key embedded in the JWS
+// when withJWK is true, and by a registered account otherwise.
+func (s *ACMEServer) verify(w http.ResponseWriter, r *http.Request, withJWK bool) (*acmeRequest, bool) {
+	malformed := func(detail string) (*acmeRequest, bool) {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: detail, Status: http.StatusBadRequest})
+		return nil, false
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return malformed(err.Error())
+	}
+	jws := acmeJWS{}
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return malformed("the request body is not a flattened JWS: " + err.Error())
+	}
+	header := acmeProtectedHeader{}
+	if err := decodeJWTPart(jws.Protected, &header); err != nil {
+		return malformed("invalid JWS protected header: " + err.Error())
+	}
+	if !s.consumeNonce(header.Nonce) {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemBadNonce, Detail: "unknown or already used nonce", Status: http.StatusBadRequest})
+		return nil, false
+	}
+	if header.URL != s.Server.URL+r.URL.Path {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemUnauthorized, Detail: fmt.Sprintf("the JWS url %s does not match the request URL", header.URL), Status: http.StatusUnauthorized})
+		return nil, false
+	}
+	req := &acmeRequest{}
+	var pub crypto.PublicKey
+	switch {
+	case withJWK && header.JWK != nil && header.KeyID == "":
+		pub, err = header.JWK.PublicKey()
+		if err != nil {
+			return malformed(err.Error())
+		}
+		req.jwk = header.JWK
+	case !withJWK && header.JWK == nil && header.KeyID != "":
+		s.mu.Lock()
+		req.account = s.accounts[strings.TrimPrefix(header.KeyID, s.url(ACMEEndpointAccount, "")+"/")]
+		s.mu.Unlock()
+		if req.account == nil {
+			writeACMEProblem(w, ACMEProblem{Type: ACMEProblemAccountDoesNotExist, Detail: "unknown account " + header.KeyID, Status: http.StatusBadRequest})
+			return nil, false
+		}
+		pub = req.account.publicKey
+	case withJWK:
+		return malformed("the JWS must contain a jwk and no kid")
+	default:
+		return malformed("the JWS must contain a kid and no jwk")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || !verifySignature(pub, JWTAlgorithm(header.Algorithm), []byte(jws.Protected+"."+jws.Payload), signature) {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: "invalid JWS signature", Status: http.StatusBadRequest})
+		return nil, false
+	}
+	req.payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return malformed("invalid JWS payload: " + err.Error())
+	}
+	return req, true
+}
+
+func (s *ACMEServer) serveNewAccount(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, true)
+	if !ok {
+		return
+	}
+	payload := struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	thumbprint := req.jwk.Thumbprint()
+	for _, account := range s.accounts {
+		if account.key.Thumbprint() == thumbprint {
+			writeACMEResource(w, http.StatusOK, s.url(ACMEEndpointAccount, account.id), account)
+			return
+		}
+	}
+	if payload.OnlyReturnExisting {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemAccountDoesNotExist, Detail: "no account exists for this key", Status: http.StatusBadRequest})
+		return
+	}
+	pub, _ := req.jwk.PublicKey()
+	id := s.newID()
+	account := &acmeAccount{
+		id:                   id,
+		key:                  *req.jwk,
+		publicKey:            pub,
+		Status:               "valid",
+		Contact:              payload.Contact,
+		TermsOfServiceAgreed: payload.TermsOfServiceAgreed,
+		Orders:               s.url(ACMEEndpointAccount, id) + "/orders",
+	}
+	s.accounts[id] = account
+	writeACMEResource(w, http.StatusCreated, s.url(ACMEEndpointAccount, id), account)
+}
+
+func (s *ACMEServer) serveAccount(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	if req.account.id != r.PathValue("id") {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemUnauthorized, Detail: "the account does not belong to the requester", Status: http.StatusUnauthorized})
+		return
+	}
+	if len(req.payload) > 0 {
+		update := struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}{}
+		if err := json.Unmarshal(req.payload, &update); err != nil {
+			writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: err.Error(), Status: http.StatusBadRequest})
+			return
+		}
+		s.mu.Lock()
+		if update.Contact != nil {
+			req.account.Contact = update.Contact
+		}
+		if update.Status == "deactivated" {
+			req.account.Status = update.Status
+		}
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeACMEResource(w, http.StatusOK, "", req.account)
+}
+
+func (s *ACMEServer) serveOrders(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	if req.account.id != r.PathValue("id") {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemUnauthorized, Detail: "the account does not belong to the requester", Status: http.StatusUnauthorized})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []int{}
+	for _, order := range s.orders {
+		if order.accountID == req.account.id {
+			id, _ := strconv.Atoi(order.id)
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	orders := []string{}
+	for _, id := range ids {
+		orders = append(orders, s.url(ACMEEndpointOrder, strconv.Itoa(id)))
+	}
+	writeACMEResource(w, http.StatusOK, "", map[string][]string{"orders": orders})
+}
+
+func (s *ACMEServer) serveNewOrder(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	payload := struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: "the order must contain identifiers", Status: http.StatusBadRequest})
+		return
+	}
+	for _, identifier := range payload.Identifiers {
+		if identifier.Type != "dns" {
+			writeACMEProblem(w, ACMEProblem{Type: ACMEProblemRejectedIdentifier, Detail: "only dns identifiers are supported", Status: http.StatusBadRequest})
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	order := &acmeOrder{
+		id:          s.newID(),
+		accountID:   req.account.id,
+		Status:      "pending",
+		Expires:     expires,
+		Identifiers: payload.Identifiers,
+	}
+	order.Finalize = s.url(ACMEEndpointFinalize, order.id)
+	for _, identifier := range payload.Identifiers {
+		authz := &acmeAuthorization{
+			id:         s.newID(),
+			accountID:  req.account.id,
+			Identifier: identifier,
+			Status:     "pending",
+			Expires:    expires,
+		}
+		challenge := &acmeChallenge{
+			id:      s.newID(),
+			authzID: authz.id,
+			Type:    "http-01",
+			Token:   randomToken(),
+			Status:  "pending",
+		}
+		challenge.URL = s.url(ACMEEndpointChallenge, challenge.id)
+		authz.Challenges = []*acmeChallenge{challenge}
+		s.authorizations[authz.id] = authz
+		s.challenges[challenge.id] = challenge
+		order.authzIDs = append(order.authzIDs, authz.id)
+		order.Authorizations = append(order.Authorizations, s.url(ACMEEndpointAuthorization, authz.id))
+	}
+	s.orders[order.id] = order
+	writeACMEResource(w, http.StatusCreated, s.url(ACMEEndpointOrder, order.id), order)
+}
+
+// updateOrders moves the orders to the ready or invalid status once their authorizations are validated.
+// It must be called with the lock held.
+func (s *ACMEServer) updateOrders() {
+	for _, order := range s.orders {
+		if order.Status != "pending" {
+			continue
+		}
+		ready := true
+		for _, id := range order.authzIDs {
+			switch s.authorizations[id].Status {
+			case "invalid":
+				order.Status = "invalid"
+				order.Error = s.authorizations[id].Challenges[0].Error
+			case "valid":
+			default:
+				ready = false
+			}
+		}
+		if ready && order.Status == "pending" {
+			order.Status = "ready"
+		}
+	}
+}
+
+func (s *ACMEServer) serveOrder(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.orders[r.PathValue("id")]
+	if order == nil || order.accountID != req.account.id {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: "unknown order", Status: http.StatusNotFound})
+		return
+	}
+	writeACMEResource(w, http.StatusOK, "", order)
+}
+
+func (s *ACMEServer) serveAuthorization(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	authz := s.authorizations[r.PathValue("id")]
+	if authz == nil || authz.accountID != req.account.id {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: "unknown authorization", Status: http.StatusNotFound})
+		return
+	}
+	writeACMEResource(w, http.StatusOK, "", authz)
+}
+
+func (s *ACMEServer) serveChallenge(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	challenge := s.challenges[r.PathValue("id")]
+	var authz *acmeAuthorization
+	if challenge != nil {
+		authz = s.authorizations[challenge.authzID]
+	}
+	if challenge == nil || authz.accountID != req.account.id {
+		s.mu.Unlock()
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: "unknown challenge", Status: http.StatusNotFound})
+		return
+	}
+	// the challenge is processing while it is validated, so that concurrent responses don't validate it again
+	validate := len(req.payload) > 0 && challenge.Status == "pending"
+	if validate {
+		challenge.Status = "processing"
+	}
+	s.mu.Unlock()
+	if validate {
+		problem := s.validateHTTP01(r.Context(), authz.Identifier.Value, challenge.Token, req.account.key.Thumbprint())
+		s.mu.Lock()
+		if problem == nil {
+			challenge.Status = "valid"
+			challenge.Validated = time.Now().UTC().Format(time.RFC3339)
+			authz.Status = "valid"
+		} else {
+			challenge.Status = "invalid"
+			challenge.Error = problem
+			authz.Status = "invalid"
+		}
+		s.updateOrders()
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Add("Link", fmt.Sprintf(`<%s>;rel="up"`, s.url(ACMEEndpointAuthorization, authz.id)))
+	writeACMEResource(w, http.StatusOK, "", challenge)
+}
+
+func (s *ACMEServer) validateHTTP01(ctx context.Context, domain, token, thumbprint string) *ACMEProblem {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if s.ChallengeAddress != "" {
+					addr = s.ChallengeAddress
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+domain+"/.well-known/acme-challenge/"+token, nil)
+	if err != nil {
+		return &ACMEProblem{Type: ACMEProblemMalformed, Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &ACMEProblem{Type: ACMEProblemConnection, Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return &ACMEProblem{Type: ACMEProblemConnection, Detail: err.Error(), Status: http.StatusBadRequest}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &ACMEProblem{Type: ACMEProblemUnauthorized, Detail: fmt.Sprintf("the challenge response has status %d", resp.StatusCode), Status: http.StatusForbidden}
+	}
+	expected := token + "." + thumbprint
+	if strings.TrimSpace(string(body)) != expected {
+		return &ACMEProblem{Type: ACMEProblemIncorrectResponse, Detail: fmt.Sprintf("expected key authorization %q but got %q", expected, string(body)), Status: http.StatusForbidden}
+	}
+	return nil
+}
+
+func (s *ACMEServer) serveFinalize(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := s.orders[r.PathValue("id")]
+	if order == nil || order.accountID != req.account.id {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: "unknown order", Status: http.StatusNotFound})
+		return
+	}
+	if order.Status != "ready" {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemOrderNotReady, Detail: "the order is " + order.Status, Status: http.StatusForbidden})
+		return
+	}
+	payload := struct {
+		CSR string `json:"csr"`
+	}{}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+	csr, err := s.parseCSR(payload.CSR, order)
+	if err != nil {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemBadCSR, Detail: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+	names := []string{}
+	for _, identifier := range order.Identifiers {
+		names = append(names, identifier.Value)
+	}
+	der, err := s.CA.issue(certificateTemplate(0, names), csr.PublicKey)
+	if err != nil {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemServerInternal, Detail: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	order.certificateID = s.newID()
+	s.certificates[order.certificateID] = append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		s.CA.PEM()...,
+	)
+	order.Status = "valid"
+	order.Certificate = s.url(ACMEEndpointCertificate, order.certificateID)
+	writeACMEResource(w, http.StatusOK, s.url(ACMEEndpointOrder, order.id), order)
+}
+
+func (s *ACMEServer) parseCSR(encoded string, order *acmeOrder) (*x509.CertificateRequest, error) {
+	der, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	requested := map[string]bool{}
+	for _, name := range csr.DNSNames {
+		requested[name] = true
+	}
+	if csr.Subject.CommonName != "" {
+		requested[csr.Subject.CommonName] = true
+	}
+	ordered := map[string]bool{}
+	for _, identifier := range order.Identifiers {
+		ordered[identifier.Value] = true
+	}
+	for name := range requested {
+		if !ordered[name] {
+			return nil, fmt.Errorf("the CSR requests %s which is not part of the order", name)
+		}
+	}
+	if len(requested) != len(ordered) {
+		return nil, errors.New("the CSR does not request all the identifiers of the order")
+	}
+	return csr, nil
+}
+
+func (s *ACMEServer) serveCertificate(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.verify(w, r, false)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var chain []byte
+	for _, order := range s.orders {
+		if order.certificateID == r.PathValue("id") && order.accountID == req.account.id {
+			chain = s.certificates[order.certificateID]
+		}
+	}
+	if chain == nil {
+		writeACMEProblem(w, ACMEProblem{Type: ACMEProblemMalformed, Detail: "unknown certificate", Status: http.StatusNotFound})
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(chain)
+}
@@ -0,0 +1,285 @@
+package testutils_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+type http01Responder struct {
+	mu        sync.Mutex
+	responses map[string]string
+}
+
+func (h *http01Responder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	response, ok := h.responses[r.Host+r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write([]byte(response))
+}
+
+func (h *http01Responder) set(host, path, response string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.responses[host+path] = response
+}
+
+func newACMETestClient(t *testing.T, server *testutils.ACMEServer) *acme.Client {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &acme.Client{
+		Key:          key,
+		DirectoryURL: server.DirectoryURL(),
+		HTTPClient:   server.Client(),
+		RetryBackoff: func(n int, r *http.Request, resp *http.Response) time.Duration {
+			if n > 3 {
+				return -1
+			}
+			return time.Millisecond
+		},
+	}
+}
+
+// postAsGet sends an RFC 8555 POST-as-GET request signed by the client account key.
+func postAsGet(t *testing.T, server *testutils.ACMEServer, client *acme.Client, accountURL, url string) *http.Response {
+	resp, err := server.Client().Head(server.Server.URL + "/new-nonce")
+	require.NoError(t, err)
+	resp.Body.Close()
+	protected, err := json.Marshal(map[string]string{"alg": "ES256", "kid": accountURL, "nonce": resp.Header.Get("Replay-Nonce"), "url": url})
+	require.NoError(t, err)
+	encodedProtected := base64.RawURLEncoding.EncodeToString(protected)
+	digest := sha256.Sum256([]byte(encodedProtected + "."))
+	r, sig, err := ecdsa.Sign(rand.Reader, client.Key.(*ecdsa.PrivateKey), digest[:])
+	require.NoError(t, err)
+	signature := append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	body, err := json.Marshal(map[string]string{"protected": encodedProtected, "payload": "", "signature": base64.RawURLEncoding.EncodeToString(signature)})
+	require.NoError(t, err)
+	resp, err = server.Client().Post(url, "application/jose+json", bytes.NewReader(body))
+	require.NoError(t, err)
+	return resp
+}
+
+func csrFor(t *testing.T, names ...string) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	require.NoError(t, err)
+	return csr, key
+}
+
+func TestACMEServerIssuesCertificates(t *testing.T) {
+	ctx := context.Background()
+	server := testutils.NewACMEServer(t)
+	responder := &http01Responder{responses: map[string]string{}}
+	challengeServer := httptest.NewServer(responder)
+	defer challengeServer.Close()
+	server.ChallengeAddress = challengeServer.Listener.Addr().String()
+
+	client := newACMETestClient(t, server)
+	account, err := client.Register(ctx, &acme.Account{Contact: []string{"mailto:ops@example.com"}}, acme.AcceptTOS)
+	require.NoError(t, err)
+	assert.Equal(t, acme.StatusValid, account.Status)
+	assert.Equal(t, []string{"mailto:ops@example.com"}, account.Contact)
+	assert.Equal(t, account.URI+"/orders", account.OrdersURL)
+
+	directory, err := client.Discover(ctx)
+	require.NoError(t, err)
+	resp, err := server.Client().Get(directory.Terms)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	assert.ErrorIs(t, err, acme.ErrAccountAlreadyExists)
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.com", "www.example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, acme.StatusPending, order.Status)
+	require.Len(t, order.AuthzURLs, 2)
+
+	resp = postAsGet(t, server, client, account.URI, account.OrdersURL)
+	orders := struct{ Orders []string }{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&orders))
+	resp.Body.Close()
+	assert.Equal(t, []string{order.URI}, orders.Orders)
+
+	for _, url := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, url)
+		require.NoError(t, err)
+		require.Len(t, authz.Challenges, 1)
+		challenge := authz.Challenges[0]
+		assert.Equal(t, "http-01", challenge.Type)
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		require.NoError(t, err)
+		responder.set(authz.Identifier.Value, client.HTTP01ChallengePath(challenge.Token), response)
+		_, err = client.Accept(ctx, challenge)
+		require.NoError(t, err)
+		_, err = client.WaitAuthorization(ctx, url)
+		require.NoError(t, err)
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	require.NoError(t, err)
+	assert.Equal(t, acme.StatusReady, order.Status)
+
+	csr, _ := csrFor(t, "example.com", "www.example.com")
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	require.NoError(t, err)
+	require.Len(t, chain, 2)
+	leaf, err := x509.ParseCertificate(chain[0])
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"example.com", "www.example.com"}, leaf.DNSNames)
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: server.CA.CertPool()})
+	assert.NoError(t, err)
+
+	issued := server.IssuedCertificates()
+	require.Len(t, issued, 1)
+	assert.Equal(t, leaf.Raw, issued[0].Raw)
+}
+
+func TestACMEServerValidatesChallengesOnce(t *testing.T) {
+	ctx := context.Background()
+	server := testutils.NewACMEServer(t)
+	responder := &http01Responder{responses: map[string]string{}}
+	mu := sync.Mutex{}
+	validations := 0
+	challengeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		validations++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		responder.ServeHTTP(w, r)
+	}))
+	defer challengeServer.Close()
+	server.ChallengeAddress = challengeServer.Listener.Addr().String()
+
+	client := newACMETestClient(t, server)
+	_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	require.NoError(t, err)
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+	require.NoError(t, err)
+	require.Len(t, order.AuthzURLs, 1)
+	authz, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+	require.NoError(t, err)
+	require.Len(t, authz.Challenges, 1)
+	challenge := authz.Challenges[0]
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	require.NoError(t, err)
+	responder.set("example.com", client.HTTP01ChallengePath(challenge.Token), response)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Accept(ctx, challenge)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	_, err = client.WaitAuthorization(ctx, order.AuthzURLs[0])
+	require.NoError(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, validations)
+}
+
+func TestACMEServerRejectsInvalidRequests(t *testing.T) {
+	ctx := context.Background()
+	server := testutils.NewACMEServer(t)
+	responder := &http01Responder{responses: map[string]string{}}
+	challengeServer := httptest.NewServer(responder)
+	defer challengeServer.Close()
+	server.ChallengeAddress = challengeServer.Listener.Addr().String()
+
+	client := newACMETestClient(t, server)
+	_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	require.NoError(t, err)
+
+	t.Run("When the challenge response is wrong", func(t *testing.T) {
+		order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("wrong.example.com"))
+		require.NoError(t, err)
+		authz, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+		require.NoError(t, err)
+		responder.set("wrong.example.com", client.HTTP01ChallengePath(authz.Challenges[0].Token), "not-the-key-authorization")
+		_, err = client.Accept(ctx, authz.Challenges[0])
+		require.NoError(t, err)
+		_, err = client.WaitAuthorization(ctx, authz.URI)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "incorrectResponse")
+
+		order, err = client.GetOrder(ctx, order.URI)
+		require.NoError(t, err)
+		assert.Equal(t, acme.StatusInvalid, order.Status)
+	})
+
+	t.Run("When the order is finalized before being ready", func(t *testing.T) {
+		order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("pending.example.com"))
+		require.NoError(t, err)
+		csr, _ := csrFor(t, "pending.example.com")
+		_, _, err = client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "orderNotReady")
+	})
+
+	t.Run("When a rate limit is injected", func(t *testing.T) {
+		server.InjectError(testutils.ACMEEndpointNewOrder, testutils.ACMEProblem{
+			Type:       testutils.ACMEProblemRateLimited,
+			Detail:     "too many orders",
+			Status:     http.StatusTooManyRequests,
+			RetryAfter: time.Hour,
+		})
+		client := newACMETestClient(t, server)
+		client.RetryBackoff = func(int, *http.Request, *http.Response) time.Duration { return -1 }
+		_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+		require.NoError(t, err)
+		_, err = client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+		require.Error(t, err)
+		acmeErr := &acme.Error{}
+		require.ErrorAs(t, err, &acmeErr)
+		assert.Equal(t, http.StatusTooManyRequests, acmeErr.StatusCode)
+		assert.Equal(t, testutils.ACMEProblemRateLimited, acmeErr.ProblemType)
+		assert.Equal(t, "3600", acmeErr.Header.Get("Retry-After"))
+
+		_, err = client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("When a bad nonce is injected the client retries", func(t *testing.T) {
+		server.InjectError(testutils.ACMEEndpointNewOrder, testutils.ACMEProblem{Type: testutils.ACMEProblemBadNonce})
+		_, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("When the request is not signed by a registered account", func(t *testing.T) {
+		other := newACMETestClient(t, server)
+		_, err := other.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "the JWS must contain a kid and no jwk")
+
+		other.KID = acme.KeyID(server.Server.URL + "/account/404")
+		_, err = other.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "accountDoesNotExist")
+	})
+}
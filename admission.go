@@ -0,0 +1,612 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// AdmissionOperation is the operation being admitted.
+type AdmissionOperation string
+
+const (
+	AdmissionCreate  AdmissionOperation = "CREATE"
+	AdmissionUpdate  AdmissionOperation = "UPDATE"
+	AdmissionDelete  AdmissionOperation = "DELETE"
+	AdmissionConnect AdmissionOperation = "CONNECT"
+)
+
+// The admission types mirror the JSON representation of the admission.k8s.io/v1 API,
+// so webhooks can be tested without depending on the kubernetes modules.
+
+type GroupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+type GroupVersionResource struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+}
+
+type AdmissionUserInfo struct {
+	Username string   `json:"username,omitempty"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+type AdmissionRequest struct {
+	UID         string               `json:"uid"`
+	Kind        GroupVersionKind     `json:"kind"`
+	Resource    GroupVersionResource `json:"resource"`
+	SubResource string               `json:"subResource,omitempty"`
+	Name        string               `json:"name,omitempty"`
+	Namespace   string               `json:"namespace,omitempty"`
+	Operation   AdmissionOperation   `json:"operation"`
+	UserInfo    AdmissionUserInfo    `json:"userInfo"`
+	Object      json.RawMessage      `json:"object,omitempty"`
+	OldObject   json.RawMessage      `json:"oldObject,omitempty"`
+	DryRun      *bool                `json:"dryRun,omitempty"`
+}
+
+type AdmissionStatus struct {
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Code    int32  `json:"code,omitempty"`
+}
+
+type AdmissionResponse struct {
+	UID              string            `json:"uid"`
+	Allowed          bool              `json:"allowed"`
+	Result           *AdmissionStatus  `json:"status,omitempty"`
+	Patch            []byte            `json:"patch,omitempty"`
+	PatchType        *string           `json:"patchType,omitempty"`
+	AuditAnnotations map[string]string `json:"auditAnnotations,omitempty"`
+	Warnings         []string          `json:"warnings,omitempty"`
+}
+
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+// JSONPatchOperation is an operation of an RFC 6902 JSON patch.
+type JSONPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// AdmissionWebhookHarness serves an admission webhook over TLS and sends it AdmissionReview requests,
+// as the kubernetes API server would.
+//
+//	harness := testutils.NewAdmissionWebhookHarness(t, webhook.Handler())
+//	result := harness.NewReview(t, fs, "/manifests/pod.yaml").WithPath("/mutate").Send(t)
+//	result.AssertAllowed(t)
+//	result.AssertPatchedObject(t, fs, "/manifests/pod-mutated.yaml")
+type AdmissionWebhookHarness struct {
+	Server *httptest.Server
+	CA     *CertificateAuthority
+	nextID int
+}
+
+// NewAdmissionWebhookHarness serves the webhook handler with a certificate issued by a dedicated authority.
+func NewAdmissionWebhookHarness(t CleanupTest, handler http.Handler) *AdmissionWebhookHarness {
+	t.Helper()
+	ca := NewCertificateAuthority(t, afero.NewMemMapFs(), "/ca")
+	return &AdmissionWebhookHarness{
+		Server: ca.NewTLSServer(t, handler),
+		CA:     ca,
+	}
+}
+
+// CABundle returns the PEM encoded authority certificate, as set in the webhook configuration caBundle field.
+func (h *AdmissionWebhookHarness) CABundle() []byte {
+	return h.CA.PEM()
+}
+
+func readYAMLObject(t require.TestingT, fs afero.Fs, path string) map[string]interface{} {
+	if th, ok := t.(TestHelper); ok {
+		th.Helper()
+	}
+	data, err := afero.ReadFile(fs, path)
+	require.NoError(t, err)
+	object := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal(data, &object))
+	// normalise the YAML types to the ones produced by encoding/json
+	normalised, err := json.Marshal(object)
+	require.NoError(t, err)
+	object = map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(normalised, &object))
+	return object
+}
+
+func resourceForKind(kind string) string {
+	resource := strings.ToLower(kind)
+	switch {
+	case strings.HasSuffix(resource, "y") && !strings.HasSuffix(resource, "ey"):
+		return strings.TrimSuffix(resource, "y") + "ies"
+	case strings.HasSuffix(resource, "s"), strings.HasSuffix(resource, "x"), strings.HasSuffix(resource, "ch"):
+		return resource + "es"
+	default:
+		return resource + "s"
+	}
+}
+
+// NewReview builds an AdmissionReview request creating the object stored as YAML in path.
+//
+// The kind, resource, name and namespace of the request are derived from the object.
+func (h *AdmissionWebhookHarness) NewReview(t require.TestingT, fs afero.Fs, path string) *AdmissionReviewBuilder {
+	if th, ok := t.(TestHelper); ok {
+		th.Helper()
+	}
+	h.nextID++
+	object := readYAMLObject(t, fs, path)
+	b := &AdmissionReviewBuilder{
+		harness: h,
+		object:  object,
+		request: &AdmissionRequest{
+			UID:       fmt.Sprintf("00000000-0000-0000-0000-%012d", h.nextID),
+			Operation: AdmissionCreate,
+			UserInfo:  AdmissionUserInfo{Username: "kubernetes-admin", Groups: []string{"system:masters", "system:authenticated"}},
+		},
+	}
+	apiVersion, _ := object["apiVersion"].(string)
+	group, version := "", apiVersion
+	if i := strings.Index(apiVersion, "/"); i >= 0 {
+		group, version = apiVersion[:i], apiVersion[i+1:]
+	}
+	kind, _ := object["kind"].(string)
+	b.request.Kind = GroupVersionKind{Group: group, Version: version, Kind: kind}
+	b.request.Resource = GroupVersionResource{Group: group, Version: version, Resource: resourceForKind(kind)}
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		b.request.Name, _ = metadata["name"].(string)
+		b.request.Namespace, _ = metadata["namespace"].(string)
+	}
+	return b
+}
+
+// AdmissionReviewBuilder builds and sends an AdmissionReview to the webhook under test.
+type AdmissionReviewBuilder struct {
+	harness   *AdmissionWebhookHarness
+	request   *AdmissionRequest
+	object    map[string]interface{}
+	oldObject map[string]interface{}
+	path      string
+}
+
+// WithPath sets the URL path the review is sent to.
+func (b *AdmissionReviewBuilder) WithPath(path string) *AdmissionReviewBuilder {
+	b.path = path
+	return b
+}
+
+func (b *AdmissionReviewBuilder) WithOperation(operation AdmissionOperation) *AdmissionReviewBuilder {
+	b.request.Operation = operation
+	return b
+}
+
+func (b *AdmissionReviewBuilder) WithNamespace(namespace string) *AdmissionReviewBuilder {
+	b.request.Namespace = namespace
+	return b
+}
+
+func (b *AdmissionReviewBuilder) WithResource(resource GroupVersionResource) *AdmissionReviewBuilder {
+	b.request.Resource = resource
+	return b
+}
+
+func (b *AdmissionReviewBuilder) WithSubResource(subResource string) *AdmissionReviewBuilder {
+	b.request.SubResource = subResource
+	return b
+}
+
+func (b *AdmissionReviewBuilder) WithUser(username string, groups ...string) *AdmissionReviewBuilder {
+	b.request.UserInfo = AdmissionUserInfo{Username: username, Groups: groups}
+	return b
+}
+
+func (b *AdmissionReviewBuilder) WithDryRun(dryRun bool) *AdmissionReviewBuilder {
+	b.request.DryRun = &dryRun
+	return b
+}
+
+// WithOldObject sets the object stored as YAML in path as the object being replaced and makes the review an update.
+func (b *AdmissionReviewBuilder) WithOldObject(t require.TestingT, fs afero.Fs, path string) *AdmissionReviewBuilder {
+	if th, ok := t.(TestHelper); ok {
+		th.Helper()
+	}
+	b.oldObject = readYAMLObject(t, fs, path)
+	b.request.Operation = AdmissionUpdate
+	return b
+}
+
+// Build returns the AdmissionReview sent to the webhook.
+func (b *AdmissionReviewBuilder) Build(t require.TestingT) *AdmissionReview {
+	if th, ok := t.(TestHelper); ok {
+		th.Helper()
+	}
+	request := *b.request
+	var err error
+	if b.request.Operation == AdmissionDelete {
+		request.OldObject, err = json.Marshal(b.object)
+		require.NoError(t, err)
+	} else {
+		request.Object, err = json.Marshal(b.object)
+		require.NoError(t, err)
+		if b.oldObject != nil {
+			request.OldObject, err = json.Marshal(b.oldObject)
+			require.NoError(t, err)
+		}
+	}
+	return &AdmissionReview{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview", Request: &request}
+}
+
+// Send posts the review to the webhook and decodes its response.
+func (b *AdmissionReviewBuilder) Send(t require.TestingT) *AdmissionResult {
+	if th, ok := t.(TestHelper); ok {
+		th.Helper()
+	}
+	review := b.Build(t)
+	body, err := json.Marshal(review)
+	require.NoError(t, err)
+	resp, err := b.harness.Server.Client().Post(b.harness.Server.URL+b.path, "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, "the webhook must answer admission reviews with 200 OK")
+	result := &AdmissionResult{Request: review.Request}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result.Review))
+	require.NotNil(t, result.Review.Response, "the webhook answered without response")
+	require.Equal(t, review.Request.UID, result.Review.Response.UID, "the response UID must match the request UID")
+	return result
+}
+
+// AdmissionResult is the webhook answer to an AdmissionReview.
+type AdmissionResult struct {
+	Request *AdmissionRequest
+	Review  AdmissionReview
+}
+
+func (r *AdmissionResult) message() string {
+	if r.Review.Response.Result == nil {
+		return ""
+	}
+	return r.Review.Response.Result.Message
+}
+
+func (r *AdmissionResult) AssertAllowed(t assert.TestingT, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if !r.Review.Response.Allowed {
+		return assert.Fail(t, fmt.Sprintf("Expecting the webhook to allow the request but it was denied with: %q", r.message()), msgAndArgs...)
+	}
+	return true
+}
+
+func (r *AdmissionResult) RequireAllowed(t require.TestingT, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertAllowed(t, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertDenied asserts the webhook denied the request with a message containing the expected one.
+func (r *AdmissionResult) AssertDenied(t assert.TestingT, expectedMessage string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.Review.Response.Allowed {
+		return assert.Fail(t, "Expecting the webhook to deny the request but it was allowed", msgAndArgs...)
+	}
+	return assert.Contains(t, r.message(), expectedMessage, msgAndArgs...)
+}
+
+func (r *AdmissionResult) RequireDenied(t require.TestingT, expectedMessage string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertDenied(t, expectedMessage, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertWarnings asserts the webhook returned exactly the expected warnings, in any order.
+func (r *AdmissionResult) AssertWarnings(t assert.TestingT, expected []string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	return assert.ElementsMatch(t, expected, r.Review.Response.Warnings, msgAndArgs...)
+}
+
+func (r *AdmissionResult) RequireWarnings(t require.TestingT, expected []string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertWarnings(t, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// Patch decodes the JSON patch returned by the webhook.
+func (r *AdmissionResult) Patch() ([]JSONPatchOperation, error) {
+	operations := []JSONPatchOperation{}
+	if len(r.Review.Response.Patch) == 0 {
+		return operations, nil
+	}
+	if r.Review.Response.PatchType == nil || *r.Review.Response.PatchType != "JSONPatch" {
+		return nil, fmt.Errorf("the webhook returned a patch without the JSONPatch patchType")
+	}
+	if err := json.Unmarshal(r.Review.Response.Patch, &operations); err != nil {
+		return nil, err
+	}
+	return operations, nil
+}
+
+// PatchedObject applies the patch returned by the webhook to the reviewed object,
+// which is the old object for deletions.
+func (r *AdmissionResult) PatchedObject() (map[string]interface{}, error) {
+	data := r.Request.Object
+	if len(data) == 0 {
+		data = r.Request.OldObject
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("the %s review has no object to patch", r.Request.Operation)
+	}
+	object := map[string]interface{}{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	operations, err := r.Patch()
+	if err != nil {
+		return nil, err
+	}
+	patched, err := ApplyJSONPatch(object, operations)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the patched object is a %T", patched)
+	}
+	return result, nil
+}
+
+// AssertPatchedObject asserts that the reviewed object, once patched by the webhook,
+// equals the object stored as YAML in expectedPath.
+func (r *AdmissionResult) AssertPatchedObject(t assert.TestingT, fs afero.Fs, expectedPath string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	patched, err := r.PatchedObject()
+	if err != nil {
+		return assert.NoError(t, err, msgAndArgs...)
+	}
+	data, err := afero.ReadFile(fs, expectedPath)
+	if err != nil {
+		return assert.NoError(t, err, msgAndArgs...)
+	}
+	expected := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &expected); err != nil {
+		return assert.NoError(t, err, msgAndArgs...)
+	}
+	expectedJSON, err := json.Marshal(expected)
+	if err != nil {
+		return assert.NoError(t, err, msgAndArgs...)
+	}
+	actualJSON, err := json.Marshal(patched)
+	if err != nil {
+		return assert.NoError(t, err, msgAndArgs...)
+	}
+	return assert.JSONEq(t, string(expectedJSON), string(actualJSON), msgAndArgs...)
+}
+
+func (r *AdmissionResult) RequirePatchedObject(t require.TestingT, fs afero.Fs, expectedPath string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertPatchedObject(t, fs, expectedPath, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// ApplyJSONPatch applies the RFC 6902 operations to a document decoded by encoding/json.
+//
+// The document is modified in place when possible, the patched document is returned.
+func ApplyJSONPatch(document interface{}, operations []JSONPatchOperation) (interface{}, error) {
+	var err error
+	for _, operation := range operations {
+		switch operation.Op {
+		case "add":
+			document, err = jsonPointerSet(document, operation.Path, deepCopyJSON(operation.Value), true)
+		case "remove":
+			document, _, err = jsonPointerRemove(document, operation.Path)
+		case "replace":
+			if _, err = jsonPointerGet(document, operation.Path); err == nil {
+				document, err = jsonPointerSet(document, operation.Path, deepCopyJSON(operation.Value), false)
+			}
+		case "move":
+			var value interface{}
+			document, value, err = jsonPointerRemove(document, operation.From)
+			if err == nil {
+				document, err = jsonPointerSet(document, operation.Path, value, true)
+			}
+		case "copy":
+			var value interface{}
+			value, err = jsonPointerGet(document, operation.From)
+			if err == nil {
+				document, err = jsonPointerSet(document, operation.Path, deepCopyJSON(value), true)
+			}
+		case "test":
+			var value interface{}
+			value, err = jsonPointerGet(document, operation.Path)
+			if err == nil && !assert.ObjectsAreEqual(deepCopyJSON(operation.Value), value) {
+				err = fmt.Errorf("test operation failed: %s is %v", operation.Path, value)
+			}
+		default:
+			err = fmt.Errorf("unsupported JSON patch operation %q", operation.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply %s %s: %w", operation.Op, operation.Path, err)
+		}
+	}
+	return document, nil
+}
+
+// deepCopyJSON returns a copy of the value using the types produced by encoding/json.
+func deepCopyJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var copied interface{}
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return value
+	}
+	return copied
+}
+
+func splitJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (!allowEnd && i == length) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func jsonPointerGet(document interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	current := document
+	for _, token := range tokens {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("missing key %q", token)
+			}
+			current = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[i]
+		default:
+			return nil, fmt.Errorf("can't traverse %T with %q", current, token)
+		}
+	}
+	return current, nil
+}
+
+// jsonPointerSet sets the value at the pointer. When insert is true, values are inserted in arrays
+// instead of replacing the existing element.
+func jsonPointerSet(document interface{}, pointer string, value interface{}, insert bool) (interface{}, error) {
+	tokens, err := splitJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(document, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return document, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), insert)
+		if err != nil {
+			return nil, err
+		}
+		if !insert {
+			node[i] = value
+			return document, nil
+		}
+		node = append(node[:i], append([]interface{}{value}, node[i:]...)...)
+		return jsonPointerSet(document, parentPointer, node, false)
+	default:
+		return nil, fmt.Errorf("can't set %q in %T", last, parent)
+	}
+}
+
+func jsonPointerRemove(document interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := splitJSONPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, document, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(document, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("missing key %q", last)
+		}
+		delete(node, last)
+		return document, value, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[i]
+		node = append(node[:i:i], node[i+1:]...)
+		document, err = jsonPointerSet(document, parentPointer, node, false)
+		return document, value, err
+	default:
+		return nil, nil, fmt.Errorf("can't remove %q from %T", last, parent)
+	}
+}
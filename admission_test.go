@@ -0,0 +1,241 @@
+package testutils_test
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func teamLabelWebhook(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", func(w http.ResponseWriter, r *http.Request) {
+		review := testutils.AdmissionReview{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&review))
+		pod := struct {
+			Metadata struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		}{}
+		require.NoError(t, json.Unmarshal(review.Request.Object, &pod))
+		response := &testutils.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+		if pod.Metadata.Labels["team"] == "" {
+			response.Allowed = false
+			response.Result = &testutils.AdmissionStatus{Message: "pods must have a team label", Code: http.StatusForbidden}
+		} else {
+			patchType := "JSONPatch"
+			response.PatchType = &patchType
+			response.Patch, _ = json.Marshal([]testutils.JSONPatchOperation{
+				{Op: "add", Path: "/metadata/annotations", Value: map[string]string{"owner": pod.Metadata.Labels["team"]}},
+				{Op: "replace", Path: "/spec/containers/0/image", Value: "registry.example.com/nginx:1.25"},
+			})
+			response.Warnings = []string{"the image registry was rewritten"}
+		}
+		review.Response = response
+		review.Request = nil
+		json.NewEncoder(w).Encode(review)
+	})
+	mux.HandleFunc("/allow", func(w http.ResponseWriter, r *http.Request) {
+		review := testutils.AdmissionReview{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&review))
+		review.Response = &testutils.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+		review.Request = nil
+		json.NewEncoder(w).Encode(review)
+	})
+	return mux
+}
+
+func TestAdmissionWebhookHarness(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	testutils.EnsureFileContent(t, fs, "/pod.yaml", `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: nginx
+  namespace: web
+  labels:
+    team: platform
+spec:
+  containers:
+  - name: nginx
+    image: nginx:1.25
+    ports:
+    - containerPort: 80
+`)
+	testutils.EnsureFileContent(t, fs, "/pod-mutated.yaml", `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: nginx
+  namespace: web
+  labels:
+    team: platform
+  annotations:
+    owner: platform
+spec:
+  containers:
+  - name: nginx
+    image: registry.example.com/nginx:1.25
+    ports:
+    - containerPort: 80
+`)
+	testutils.EnsureFileContent(t, fs, "/unlabelled.yaml", `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: nginx
+spec:
+  containers: []
+`)
+
+	harness := testutils.NewAdmissionWebhookHarness(t, teamLabelWebhook(t))
+
+	block, _ := pem.Decode(harness.CABundle())
+	require.NotNil(t, block)
+	ca, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.True(t, ca.IsCA)
+
+	t.Run("When the review is built from a YAML object", func(t *testing.T) {
+		review := harness.NewReview(t, fs, "/pod.yaml").WithUser("alice", "devs").Build(t)
+		assert.Equal(t, "admission.k8s.io/v1", review.APIVersion)
+		assert.Equal(t, testutils.GroupVersionKind{Version: "v1", Kind: "Pod"}, review.Request.Kind)
+		assert.Equal(t, testutils.GroupVersionResource{Version: "v1", Resource: "pods"}, review.Request.Resource)
+		assert.Equal(t, "nginx", review.Request.Name)
+		assert.Equal(t, "web", review.Request.Namespace)
+		assert.Equal(t, testutils.AdmissionCreate, review.Request.Operation)
+		assert.Equal(t, testutils.AdmissionUserInfo{Username: "alice", Groups: []string{"devs"}}, review.Request.UserInfo)
+		assert.Empty(t, review.Request.OldObject)
+
+		review = harness.NewReview(t, fs, "/pod.yaml").WithOldObject(t, fs, "/unlabelled.yaml").Build(t)
+		assert.Equal(t, testutils.AdmissionUpdate, review.Request.Operation)
+		assert.JSONEq(t, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"nginx"},"spec":{"containers":[]}}`, string(review.Request.OldObject))
+	})
+
+	t.Run("When the webhook mutates the object", func(t *testing.T) {
+		result := harness.NewReview(t, fs, "/pod.yaml").WithPath("/mutate").Send(t)
+		result.RequireAllowed(t)
+		result.AssertWarnings(t, []string{"the image registry was rewritten"})
+		result.AssertPatchedObject(t, fs, "/pod-mutated.yaml")
+
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, result.AssertPatchedObject(fakeT, fs, "/pod.yaml"))
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "registry.example.com/nginx:1.25")
+
+		fakeT = &testutils.FakeTest{}
+		result.RequireDenied(fakeT, "")
+		assert.True(t, fakeT.Failed)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Expecting the webhook to deny the request but it was allowed")
+	})
+
+	t.Run("When the webhook reviews a deletion", func(t *testing.T) {
+		result := harness.NewReview(t, fs, "/pod.yaml").WithOperation(testutils.AdmissionDelete).WithPath("/allow").Send(t)
+		result.RequireAllowed(t)
+		assert.Empty(t, result.Request.Object)
+		result.AssertPatchedObject(t, fs, "/pod.yaml")
+
+		result = harness.NewReview(t, fs, "/pod.yaml").WithOperation(testutils.AdmissionConnect).WithPath("/allow").Send(t)
+		result.Request.Object = nil
+		_, err := result.PatchedObject()
+		assert.EqualError(t, err, "the CONNECT review has no object to patch")
+	})
+
+	t.Run("When the webhook denies the object", func(t *testing.T) {
+		result := harness.NewReview(t, fs, "/unlabelled.yaml").WithPath("/mutate").Send(t)
+		result.AssertDenied(t, "must have a team label")
+		result.AssertWarnings(t, nil)
+
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, result.AssertAllowed(fakeT))
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], `Expecting the webhook to allow the request but it was denied with: "pods must have a team label"`)
+	})
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	for name, tc := range map[string]struct {
+		document   string
+		operations string
+		expected   string
+		err        string
+	}{
+		"adding an object member": {
+			document:   `{"foo":"bar"}`,
+			operations: `[{"op":"add","path":"/baz","value":"qux"}]`,
+			expected:   `{"baz":"qux","foo":"bar"}`,
+		},
+		"adding an array element": {
+			document:   `{"foo":["bar","baz"]}`,
+			operations: `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			expected:   `{"foo":["bar","qux","baz"]}`,
+		},
+		"appending an array element": {
+			document:   `{"foo":["bar"]}`,
+			operations: `[{"op":"add","path":"/foo/-","value":{"a":1}}]`,
+			expected:   `{"foo":["bar",{"a":1}]}`,
+		},
+		"removing an array element": {
+			document:   `{"foo":["bar","qux","baz"]}`,
+			operations: `[{"op":"remove","path":"/foo/1"}]`,
+			expected:   `{"foo":["bar","baz"]}`,
+		},
+		"replacing a value": {
+			document:   `{"baz":"qux","foo":"bar"}`,
+			operations: `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			expected:   `{"baz":"boo","foo":"bar"}`,
+		},
+		"moving a value": {
+			document:   `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			operations: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			expected:   `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		"copying a value": {
+			document:   `{"foo":{"bar":1}}`,
+			operations: `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`,
+			expected:   `{"foo":{"bar":1},"baz":{"bar":2}}`,
+		},
+		"escaping keys": {
+			document:   `{"metadata":{"labels":{}}}`,
+			operations: `[{"op":"add","path":"/metadata/labels/app.kubernetes.io~1name","value":"nginx"}]`,
+			expected:   `{"metadata":{"labels":{"app.kubernetes.io/name":"nginx"}}}`,
+		},
+		"testing a value": {
+			document:   `{"baz":"qux"}`,
+			operations: `[{"op":"test","path":"/baz","value":"bar"}]`,
+			err:        "failed to apply test /baz: test operation failed: /baz is qux",
+		},
+		"replacing a missing value": {
+			document:   `{"baz":"qux"}`,
+			operations: `[{"op":"replace","path":"/foo","value":"bar"}]`,
+			err:        `failed to apply replace /foo: missing key "foo"`,
+		},
+		"adding to a missing parent": {
+			document:   `{}`,
+			operations: `[{"op":"add","path":"/foo/bar","value":"bar"}]`,
+			err:        `failed to apply add /foo/bar: missing key "foo"`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var document interface{}
+			require.NoError(t, json.Unmarshal([]byte(tc.document), &document))
+			operations := []testutils.JSONPatchOperation{}
+			require.NoError(t, json.Unmarshal([]byte(tc.operations), &operations))
+			patched, err := testutils.ApplyJSONPatch(document, operations)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			actual, err := json.Marshal(patched)
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(actual))
+		})
+	}
+}
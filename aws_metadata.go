@@ -0,0 +1,370 @@
+package testutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWSMetadataEndpoint identifies an endpoint served by the AWSMetadataServer.
+type AWSMetadataEndpoint string
+
+const (
+	IMDSEndpointToken       AWSMetadataEndpoint = "imds-token"
+	IMDSEndpointMetadata    AWSMetadataEndpoint = "imds-metadata"
+	IMDSEndpointCredentials AWSMetadataEndpoint = "imds-credentials"
+	IMDSEndpointIdentity    AWSMetadataEndpoint = "imds-identity"
+	ECSEndpointCredentials  AWSMetadataEndpoint = "ecs-credentials"
+	ECSEndpointMetadata     AWSMetadataEndpoint = "ecs-metadata"
+)
+
+const imdsMaxTokenTTL = 21600
+
+// AWSMetadataFailure makes a request to the AWSMetadataServer fail or slow down.
+type AWSMetadataFailure struct {
+	// Status answers the request with the status, like 429 Too Many Requests when throttling
+	// or 403 Forbidden for tokens when IMDSv2 is unavailable. When zero, the request is answered normally.
+	Status int
+	// Delay delays the response, to exceed the timeouts of the clients.
+	Delay time.Duration
+}
+
+// InstanceIdentityDocument is the identity document of the EC2 instance.
+type InstanceIdentityDocument struct {
+	AccountID        string    `json:"accountId"`
+	Architecture     string    `json:"architecture"`
+	AvailabilityZone string    `json:"availabilityZone"`
+	ImageID          string    `json:"imageId"`
+	InstanceID       string    `json:"instanceId"`
+	InstanceType     string    `json:"instanceType"`
+	PendingTime      time.Time `json:"pendingTime"`
+	PrivateIP        string    `json:"privateIp"`
+	Region           string    `json:"region"`
+	Version          string    `json:"version"`
+}
+
+// AWSMetadataServer stands in for the EC2 instance metadata service (IMDSv2) and the ECS credentials
+// and task metadata v4 endpoints, the sources of the AWS SDK credential chains.
+//
+// Configure the clients with the environment variables of IMDSEnv or ECSEnv:
+//
+//	metadata := testutils.NewAWSMetadataServer(t)
+//	metadata.SetCredentials("app", credentials, time.Now().Add(time.Minute))
+//	for name, value := range metadata.IMDSEnv() {
+//		t.Setenv(name, value)
+//	}
+type AWSMetadataServer struct {
+	Server *httptest.Server
+	// Identity is the instance identity document, also used for the instance metadata.
+	Identity InstanceIdentityDocument
+	// Task and Container are the ECS task metadata v4 documents. The task lists the container.
+	Task      map[string]interface{}
+	Container map[string]interface{}
+	// AuthorizationToken is required in the Authorization header of the ECS credentials requests.
+	AuthorizationToken string
+	// AllowIMDSv1 accepts the instance metadata requests without session token.
+	AllowIMDSv1 bool
+
+	containerID   string
+	credentialsID string
+
+	mu          sync.Mutex
+	role        string
+	credentials AWSCredentials
+	expiration  time.Time
+	tokens      map[string]time.Time
+	failures    map[AWSMetadataEndpoint][]AWSMetadataFailure
+	calls       map[AWSMetadataEndpoint]int
+}
+
+// NewAWSMetadataServer starts a metadata server with a "test-role" role and random credentials expiring in 6 hours.
+func NewAWSMetadataServer(t CleanupTest) *AWSMetadataServer {
+	t.Helper()
+	s := &AWSMetadataServer{
+		Identity: InstanceIdentityDocument{
+			AccountID:        "123456789012",
+			Architecture:     "x86_64",
+			AvailabilityZone: "us-east-1a",
+			ImageID:          "ami-0123456789abcdef0",
+			InstanceID:       "i-0123456789abcdef0",
+			InstanceType:     "t3.micro",
+			PendingTime:      time.Now().UTC().Truncate(time.Second),
+			PrivateIP:        "10.0.0.10",
+			Region:           "us-east-1",
+			Version:          "2017-09-30",
+		},
+		AuthorizationToken: randomToken(),
+		containerID:        randomToken()[:32],
+		credentialsID:      randomToken()[:32],
+		tokens:             map[string]time.Time{},
+		failures:           map[AWSMetadataEndpoint][]AWSMetadataFailure{},
+		calls:              map[AWSMetadataEndpoint]int{},
+	}
+	s.Container = map[string]interface{}{
+		"DockerId":      s.containerID,
+		"Name":          "app",
+		"DockerName":    "ecs-test-app",
+		"Image":         "app:latest",
+		"Labels":        map[string]string{"com.amazonaws.ecs.cluster": "test-cluster"},
+		"DesiredStatus": "RUNNING",
+		"KnownStatus":   "RUNNING",
+		"Type":          "NORMAL",
+	}
+	s.Task = map[string]interface{}{
+		"Cluster":          "test-cluster",
+		"TaskARN":          "arn:aws:ecs:us-east-1:123456789012:task/test-cluster/" + s.containerID,
+		"Family":           "test",
+		"Revision":         "1",
+		"DesiredStatus":    "RUNNING",
+		"KnownStatus":      "RUNNING",
+		"AvailabilityZone": "us-east-1a",
+		"LaunchType":       "FARGATE",
+	}
+	s.SetCredentials("test-role", AWSCredentials{
+		AccessKeyID:     "ASIA" + strings.ToUpper(randomToken()[:16]),
+		SecretAccessKey: randomToken(),
+		SessionToken:    randomToken(),
+	}, time.Now().Add(6*time.Hour))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /latest/api/token", s.handle(IMDSEndpointToken, s.serveToken))
+	mux.HandleFunc("GET /latest/meta-data/", s.handle(IMDSEndpointMetadata, s.imds(s.serveMetadata)))
+	mux.HandleFunc("GET /latest/meta-data/iam/security-credentials/", s.handle(IMDSEndpointCredentials, s.imds(s.serveIMDSCredentials)))
+	mux.HandleFunc("GET /latest/dynamic/instance-identity/document", s.handle(IMDSEndpointIdentity, s.imds(s.serveIdentity)))
+	mux.HandleFunc("GET /v2/credentials/{id}", s.handle(ECSEndpointCredentials, s.serveECSCredentials))
+	mux.HandleFunc("GET /v4/{container}", s.handle(ECSEndpointMetadata, s.serveContainer))
+	mux.HandleFunc("GET /v4/{container}/task", s.handle(ECSEndpointMetadata, s.serveTask))
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Server.Close)
+	return s
+}
+
+// IMDSEnv returns the environment variables pointing the AWS SDKs to the instance metadata service.
+func (s *AWSMetadataServer) IMDSEnv() map[string]string {
+	return map[string]string{
+		"AWS_EC2_METADATA_SERVICE_ENDPOINT": s.Server.URL + "/",
+		"AWS_EC2_METADATA_DISABLED":         "false",
+	}
+}
+
+// ECSEnv returns the environment variables of an ECS container, pointing to the credentials and task metadata endpoints.
+func (s *AWSMetadataServer) ECSEnv() map[string]string {
+	return map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI": s.Server.URL + "/v2/credentials/" + s.credentialsID,
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":  s.AuthorizationToken,
+		"ECS_CONTAINER_METADATA_URI_V4":      s.Server.URL + "/v4/" + s.containerID,
+	}
+}
+
+// SetCredentials sets the role and the credentials served from now on, like when they are rotated.
+func (s *AWSMetadataServer) SetCredentials(role string, credentials AWSCredentials, expiration time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.role = role
+	s.credentials = credentials
+	s.expiration = expiration
+}
+
+// ExpireTokens invalidates the IMDSv2 session tokens issued so far.
+func (s *AWSMetadataServer) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = map[string]time.Time{}
+}
+
+// InjectFailure makes the next request to the endpoint fail or slow down.
+//
+// Several failures can be queued for the same endpoint, each of them being applied once.
+func (s *AWSMetadataServer) InjectFailure(endpoint AWSMetadataEndpoint, failure AWSMetadataFailure) *AWSMetadataServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[endpoint] = append(s.failures[endpoint], failure)
+	return s
+}
+
+// Calls returns the number of requests received by the endpoint, including the failed ones.
+func (s *AWSMetadataServer) Calls(endpoint AWSMetadataEndpoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[endpoint]
+}
+
+func (s *AWSMetadataServer) handle(endpoint AWSMetadataEndpoint, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.calls[endpoint]++
+		var failure *AWSMetadataFailure
+		if failures := s.failures[endpoint]; len(failures) > 0 {
+			failure = &failures[0]
+			s.failures[endpoint] = failures[1:]
+		}
+		s.mu.Unlock()
+		if failure != nil {
+			if failure.Delay > 0 {
+				select {
+				case <-time.After(failure.Delay):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			if failure.Status != 0 {
+				http.Error(w, http.StatusText(failure.Status), failure.Status)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func (s *AWSMetadataServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	ttl, err := strconv.Atoi(r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+	if err != nil || ttl < 1 || ttl > imdsMaxTokenTTL {
+		http.Error(w, "invalid X-aws-ec2-metadata-token-ttl-seconds header", http.StatusBadRequest)
+		return
+	}
+	token := randomToken()
+	s.mu.Lock()
+	s.tokens[token] = time.Now().Add(time.Duration(ttl) * time.Second)
+	s.mu.Unlock()
+	w.Header().Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(ttl))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+}
+
+// imds rejects the instance metadata requests without a valid session token, unless IMDSv1 is allowed.
+func (s *AWSMetadataServer) imds(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-aws-ec2-metadata-token")
+		if token == "" && s.AllowIMDSv1 {
+			handler(w, r)
+			return
+		}
+		s.mu.Lock()
+		expiration, ok := s.tokens[token]
+		s.mu.Unlock()
+		if !ok || time.Now().After(expiration) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeMetadataText(w http.ResponseWriter, lines ...string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strings.Join(lines, "\n")))
+}
+
+func writeMetadataJSON(w http.ResponseWriter, document interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(document)
+}
+
+func (s *AWSMetadataServer) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	role := s.role
+	s.mu.Unlock()
+	identity := s.Identity
+	switch strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/latest/meta-data/"), "/") {
+	case "":
+		writeMetadataText(w, "ami-id", "iam/", "instance-id", "instance-type", "local-ipv4", "placement/")
+	case "ami-id":
+		writeMetadataText(w, identity.ImageID)
+	case "instance-id":
+		writeMetadataText(w, identity.InstanceID)
+	case "instance-type":
+		writeMetadataText(w, identity.InstanceType)
+	case "local-ipv4":
+		writeMetadataText(w, identity.PrivateIP)
+	case "placement":
+		writeMetadataText(w, "availability-zone", "region")
+	case "placement/availability-zone":
+		writeMetadataText(w, identity.AvailabilityZone)
+	case "placement/region":
+		writeMetadataText(w, identity.Region)
+	case "iam":
+		writeMetadataText(w, "info", "security-credentials/")
+	case "iam/info":
+		writeMetadataJSON(w, map[string]string{
+			"Code":               "Success",
+			"LastUpdated":        time.Now().UTC().Format(time.RFC3339),
+			"InstanceProfileArn": fmt.Sprintf("arn:aws:iam::%s:instance-profile/%s", identity.AccountID, role),
+			"InstanceProfileId":  "AIPA" + strings.ToUpper(s.credentialsID[:16]),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *AWSMetadataServer) serveIMDSCredentials(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	role, credentials, expiration := s.role, s.credentials, s.expiration
+	s.mu.Unlock()
+	switch strings.TrimPrefix(r.URL.Path, "/latest/meta-data/iam/security-credentials/") {
+	case "":
+		writeMetadataText(w, role)
+	case role:
+		writeMetadataJSON(w, map[string]string{
+			"Code":            "Success",
+			"LastUpdated":     time.Now().UTC().Format(time.RFC3339),
+			"Type":            "AWS-HMAC",
+			"AccessKeyId":     credentials.AccessKeyID,
+			"SecretAccessKey": credentials.SecretAccessKey,
+			"Token":           credentials.SessionToken,
+			"Expiration":      expiration.UTC().Format(time.RFC3339),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *AWSMetadataServer) serveIdentity(w http.ResponseWriter, r *http.Request) {
+	writeMetadataJSON(w, s.Identity)
+}
+
+func (s *AWSMetadataServer) serveECSCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("id") != s.credentialsID {
+		http.NotFound(w, r)
+		return
+	}
+	if s.AuthorizationToken != "" && r.Header.Get("Authorization") != s.AuthorizationToken {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	role, credentials, expiration := s.role, s.credentials, s.expiration
+	s.mu.Unlock()
+	writeMetadataJSON(w, map[string]string{
+		"RoleArn":         fmt.Sprintf("arn:aws:iam::%s:role/%s", s.Identity.AccountID, role),
+		"AccessKeyId":     credentials.AccessKeyID,
+		"SecretAccessKey": credentials.SecretAccessKey,
+		"Token":           credentials.SessionToken,
+		"Expiration":      expiration.UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *AWSMetadataServer) serveContainer(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("container") != s.containerID {
+		http.NotFound(w, r)
+		return
+	}
+	writeMetadataJSON(w, s.Container)
+}
+
+func (s *AWSMetadataServer) serveTask(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("container") != s.containerID {
+		http.NotFound(w, r)
+		return
+	}
+	task := map[string]interface{}{}
+	for name, value := range s.Task {
+		task[name] = value
+	}
+	task["Containers"] = []interface{}{s.Container}
+	writeMetadataJSON(w, task)
+}
@@ -0,0 +1,144 @@
+package testutils_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func metadataRequest(t *testing.T, method, url string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestAWSMetadataServerIMDS(t *testing.T) {
+	metadata := testutils.NewAWSMetadataServer(t)
+	expiration := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	metadata.SetCredentials("app", testutils.AWSCredentials{AccessKeyID: "ASIAEXAMPLE", SecretAccessKey: "secret", SessionToken: "session"}, expiration)
+	endpoint := metadata.IMDSEnv()["AWS_EC2_METADATA_SERVICE_ENDPOINT"]
+	assert.Equal(t, metadata.Server.URL+"/", endpoint)
+
+	resp, _ := metadataRequest(t, http.MethodPut, endpoint+"latest/api/token")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, token := metadataRequest(t, http.MethodPut, endpoint+"latest/api/token", "X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEmpty(t, token)
+
+	resp, _ = metadataRequest(t, http.MethodGet, endpoint+"latest/meta-data/instance-id")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = metadataRequest(t, http.MethodGet, endpoint+"latest/meta-data/instance-id", "X-aws-ec2-metadata-token", "invalid")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, body := metadataRequest(t, http.MethodGet, endpoint+"latest/meta-data/instance-id", "X-aws-ec2-metadata-token", token)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "i-0123456789abcdef0", body)
+	_, body = metadataRequest(t, http.MethodGet, endpoint+"latest/meta-data/placement/region", "X-aws-ec2-metadata-token", token)
+	assert.Equal(t, "us-east-1", body)
+
+	_, body = metadataRequest(t, http.MethodGet, endpoint+"latest/meta-data/iam/security-credentials/", "X-aws-ec2-metadata-token", token)
+	assert.Equal(t, "app", body)
+	resp, body = metadataRequest(t, http.MethodGet, endpoint+"latest/meta-data/iam/security-credentials/app", "X-aws-ec2-metadata-token", token)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	credentials := map[string]string{}
+	require.NoError(t, json.Unmarshal([]byte(body), &credentials))
+	assert.Equal(t, "Success", credentials["Code"])
+	assert.Equal(t, "ASIAEXAMPLE", credentials["AccessKeyId"])
+	assert.Equal(t, "secret", credentials["SecretAccessKey"])
+	assert.Equal(t, "session", credentials["Token"])
+	assert.Equal(t, expiration.Format(time.RFC3339), credentials["Expiration"])
+	assert.Equal(t, 2, metadata.Calls(testutils.IMDSEndpointCredentials))
+
+	resp, body = metadataRequest(t, http.MethodGet, endpoint+"latest/dynamic/instance-identity/document", "X-aws-ec2-metadata-token", token)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	identity := testutils.InstanceIdentityDocument{}
+	require.NoError(t, json.Unmarshal([]byte(body), &identity))
+	assert.Equal(t, metadata.Identity, identity)
+
+	metadata.ExpireTokens()
+	resp, _ = metadataRequest(t, http.MethodGet, endpoint+"latest/meta-data/instance-id", "X-aws-ec2-metadata-token", token)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	metadata.AllowIMDSv1 = true
+	resp, _ = metadataRequest(t, http.MethodGet, endpoint+"latest/meta-data/instance-id")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAWSMetadataServerECS(t *testing.T) {
+	metadata := testutils.NewAWSMetadataServer(t)
+	env := metadata.ECSEnv()
+
+	resp, _ := metadataRequest(t, http.MethodGet, env["AWS_CONTAINER_CREDENTIALS_FULL_URI"])
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, body := metadataRequest(t, http.MethodGet, env["AWS_CONTAINER_CREDENTIALS_FULL_URI"], "Authorization", env["AWS_CONTAINER_AUTHORIZATION_TOKEN"])
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	credentials := map[string]string{}
+	require.NoError(t, json.Unmarshal([]byte(body), &credentials))
+	assert.Equal(t, "arn:aws:iam::123456789012:role/test-role", credentials["RoleArn"])
+	assert.Regexp(t, "^ASIA[0-9A-F]{16}$", credentials["AccessKeyId"])
+	expiration, err := time.Parse(time.RFC3339, credentials["Expiration"])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(6*time.Hour), expiration, time.Minute)
+
+	metadata.Container["Name"] = "worker"
+	resp, body = metadataRequest(t, http.MethodGet, env["ECS_CONTAINER_METADATA_URI_V4"])
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	container := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &container))
+	assert.Equal(t, "worker", container["Name"])
+
+	resp, body = metadataRequest(t, http.MethodGet, env["ECS_CONTAINER_METADATA_URI_V4"]+"/task")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	task := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &task))
+	assert.Equal(t, "test-cluster", task["Cluster"])
+	require.Len(t, task["Containers"], 1)
+	assert.Equal(t, "worker", task["Containers"].([]interface{})[0].(map[string]interface{})["Name"])
+
+	resp, _ = metadataRequest(t, http.MethodGet, metadata.Server.URL+"/v4/unknown/task")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAWSMetadataServerFailures(t *testing.T) {
+	metadata := testutils.NewAWSMetadataServer(t).
+		InjectFailure(testutils.IMDSEndpointToken, testutils.AWSMetadataFailure{Status: http.StatusForbidden}).
+		InjectFailure(testutils.IMDSEndpointToken, testutils.AWSMetadataFailure{Status: http.StatusTooManyRequests}).
+		InjectFailure(testutils.ECSEndpointCredentials, testutils.AWSMetadataFailure{Delay: time.Second})
+	tokenURL := metadata.Server.URL + "/latest/api/token"
+
+	resp, _ := metadataRequest(t, http.MethodPut, tokenURL, "X-aws-ec2-metadata-token-ttl-seconds", "60")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = metadataRequest(t, http.MethodPut, tokenURL, "X-aws-ec2-metadata-token-ttl-seconds", "60")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	resp, _ = metadataRequest(t, http.MethodPut, tokenURL, "X-aws-ec2-metadata-token-ttl-seconds", "60")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 3, metadata.Calls(testutils.IMDSEndpointToken))
+
+	env := metadata.ECSEnv()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, env["AWS_CONTAINER_CREDENTIALS_FULL_URI"], nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", env["AWS_CONTAINER_AUTHORIZATION_TOKEN"])
+	_, err = http.DefaultClient.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	resp, _ = metadataRequest(t, http.MethodGet, env["AWS_CONTAINER_CREDENTIALS_FULL_URI"], "Authorization", env["AWS_CONTAINER_AUTHORIZATION_TOKEN"])
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -1,29 +1,72 @@
 package testutils
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"log"
 	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 )
 
+// KeyAlgorithm identifies the kind of private key generated by the toolkit helpers.
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	KeyAlgorithmECDSAP384 KeyAlgorithm = "ecdsa-p384"
+	KeyAlgorithmECDSAP521 KeyAlgorithm = "ecdsa-p521"
+	KeyAlgorithmRSA2048   KeyAlgorithm = "rsa-2048"
+	KeyAlgorithmRSA4096   KeyAlgorithm = "rsa-4096"
+	KeyAlgorithmEd25519   KeyAlgorithm = "ed25519"
+)
+
+func generatePrivateKey(algorithm KeyAlgorithm) (crypto.Signer, error) {
+	switch algorithm {
+	case KeyAlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgorithmECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyAlgorithmECDSAP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case KeyAlgorithmRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyAlgorithmRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyAlgorithmEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q", algorithm)
+	}
+}
+
 func publicKey(priv interface{}) interface{} {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
 		return &k.PublicKey
 	case *ecdsa.PrivateKey:
 		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
 	default:
 		return nil
 	}
@@ -40,6 +83,13 @@ func pemBlockForKey(priv interface{}) *pem.Block {
 			os.Exit(2)
 		}
 		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	case ed25519.PrivateKey:
+		b, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to marshal Ed25519 private key: %v", err)
+			os.Exit(2)
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: b}
 	default:
 		return nil
 	}
@@ -54,7 +104,7 @@ func NewSelfSignedCertificate(t require.TestingT, fs afero.Fs, destinationFolder
 		h.Helper()
 	}
 	require.NoError(t, fs.MkdirAll(destinationFolder, 0755))
-	priv, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	priv, err := generatePrivateKey(KeyAlgorithmECDSAP521)
 	require.NoError(t, err)
 	template := x509.Certificate{
 		SerialNumber: big.NewInt(1),
@@ -81,3 +131,146 @@ func NewSelfSignedCertificate(t require.TestingT, fs afero.Fs, destinationFolder
 	defer keyFD.Close()
 	require.NoError(t, pem.Encode(keyFD, pemBlockForKey(priv)))
 }
+
+func certificateTemplate(serial int64, hosts []string) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{
+			Organization: []string{"adevinta-toolkit-integration-tests"},
+		},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 180),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return template
+}
+
+func writePEM(t require.TestingT, fs afero.Fs, path string, blocks ...*pem.Block) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	fd, err := fs.Create(path)
+	require.NoError(t, err)
+	defer fd.Close()
+	for _, block := range blocks {
+		require.NoError(t, pem.Encode(fd, block))
+	}
+}
+
+// CertificateAuthority issues certificates trusted by the clients having its certificate in their root CAs.
+type CertificateAuthority struct {
+	Certificate *x509.Certificate
+	key         crypto.Signer
+	mu          sync.Mutex
+	serial      int64
+}
+
+// NewCertificateAuthority generates a new certificate authority in the destination folder.
+//
+// The certificate is stored in destinationFolder/ca.crt
+// The private key in destinationFolder/ca.key
+func NewCertificateAuthority(t require.TestingT, fs afero.Fs, destinationFolder string) *CertificateAuthority {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	require.NoError(t, fs.MkdirAll(destinationFolder, 0755))
+	priv, err := generatePrivateKey(KeyAlgorithmECDSAP256)
+	require.NoError(t, err)
+	template := certificateTemplate(1, nil)
+	template.Subject.CommonName = "adevinta-toolkit-integration-tests CA"
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = nil
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, publicKey(priv), priv)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(derBytes)
+	require.NoError(t, err)
+
+	writePEM(t, fs, filepath.Join(destinationFolder, "ca.crt"), &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	writePEM(t, fs, filepath.Join(destinationFolder, "ca.key"), pemBlockForKey(priv))
+	return &CertificateAuthority{Certificate: cert, key: priv, serial: 1}
+}
+
+// PEM returns the PEM encoded certificate of the authority, as expected in CA bundles.
+func (ca *CertificateAuthority) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw})
+}
+
+// CertPool returns a pool trusting the authority.
+func (ca *CertificateAuthority) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+func (ca *CertificateAuthority) issue(template *x509.Certificate, pub interface{}) ([]byte, error) {
+	ca.mu.Lock()
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	ca.mu.Unlock()
+	return x509.CreateCertificate(rand.Reader, template, ca.Certificate, pub, ca.key)
+}
+
+// TLSCertificate issues a certificate for the hosts, ready to be used in a tls.Config.
+//
+// Hosts can be DNS names or IP addresses.
+func (ca *CertificateAuthority) TLSCertificate(t require.TestingT, hosts ...string) tls.Certificate {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	priv, err := generatePrivateKey(KeyAlgorithmECDSAP256)
+	require.NoError(t, err)
+	derBytes, err := ca.issue(certificateTemplate(0, hosts), publicKey(priv))
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(derBytes)
+	require.NoError(t, err)
+	return tls.Certificate{
+		Certificate: [][]byte{derBytes, ca.Certificate.Raw},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}
+}
+
+// NewCertificate issues a certificate for the hosts in the destination folder.
+//
+// The files follow the layout of kubernetes TLS secrets:
+// The certificate is stored in destinationFolder/tls.crt
+// The private key in destinationFolder/tls.key
+// The authority certificate in destinationFolder/ca.crt
+func (ca *CertificateAuthority) NewCertificate(t require.TestingT, fs afero.Fs, destinationFolder string, hosts ...string) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	require.NoError(t, fs.MkdirAll(destinationFolder, 0755))
+	cert := ca.TLSCertificate(t, hosts...)
+	writePEM(t, fs, filepath.Join(destinationFolder, "tls.crt"), &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	writePEM(t, fs, filepath.Join(destinationFolder, "tls.key"), pemBlockForKey(cert.PrivateKey))
+	writePEM(t, fs, filepath.Join(destinationFolder, "ca.crt"), &pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw})
+}
+
+// NewTLSServer starts an httptest server using a certificate issued by the authority for localhost and 127.0.0.1.
+//
+// The server client trusts the authority.
+func (ca *CertificateAuthority) NewTLSServer(t CleanupTest, handler http.Handler) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	// clients not trusting the authority are expected in tests, do not log their handshake errors
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{ca.TLSCertificate(t, "localhost", "127.0.0.1", "::1")}}
+	server.StartTLS()
+	server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs = ca.CertPool()
+	t.Cleanup(server.Close)
+	return server
+}
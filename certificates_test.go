@@ -4,6 +4,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"io"
+	"net/http"
 	"testing"
 
 	"github.com/spf13/afero"
@@ -40,3 +41,52 @@ func TestNewSelfSignedCertificate(t *testing.T) {
 	assert.Empty(t, rest)
 	assert.Equal(t, "EC PRIVATE KEY", p.Type)
 }
+
+func TestCertificateAuthority(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	ca := NewCertificateAuthority(t, fs, "/ca")
+	AssertFileContents(t, fs, "/ca/ca.crt", ca.PEM())
+	AssertFileExists(t, fs, "/ca/ca.key")
+	assert.True(t, ca.Certificate.IsCA)
+
+	ca.NewCertificate(t, fs, "/certs", "my.domain.tld", "10.0.0.1")
+	AssertFileContents(t, fs, "/certs/ca.crt", ca.PEM())
+
+	data, err := afero.ReadFile(fs, "/certs/tls.crt")
+	require.NoError(t, err)
+	p, _ := pem.Decode(data)
+	require.NotNil(t, p)
+	cert, err := x509.ParseCertificate(p.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"my.domain.tld"}, cert.DNSNames)
+	require.Len(t, cert.IPAddresses, 1)
+	assert.Equal(t, "10.0.0.1", cert.IPAddresses[0].String())
+	_, err = cert.Verify(x509.VerifyOptions{DNSName: "my.domain.tld", Roots: ca.CertPool()})
+	assert.NoError(t, err)
+	_, err = cert.Verify(x509.VerifyOptions{DNSName: "other.domain.tld", Roots: ca.CertPool()})
+	assert.Error(t, err)
+
+	other := NewCertificateAuthority(t, fs, "/other")
+	_, err = cert.Verify(x509.VerifyOptions{DNSName: "my.domain.tld", Roots: other.CertPool()})
+	assert.Error(t, err)
+}
+
+func TestCertificateAuthorityTLSServer(t *testing.T) {
+	ca := NewCertificateAuthority(t, afero.NewMemMapFs(), "/ca")
+	server := ca.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+
+	resp, err := server.Client().Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	require.NotNil(t, resp.TLS)
+	assert.Equal(t, ca.Certificate.Raw, resp.TLS.PeerCertificates[1].Raw)
+
+	_, err = http.Get(server.URL)
+	assert.Error(t, err)
+}
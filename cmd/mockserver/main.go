@@ -0,0 +1,239 @@
+// Command mockserver serves the routes of a mock configuration file over HTTP or HTTPS,
+// for tests not written in Go.
+//
+//	mockserver -config routes.yaml -addr :8443 -tls -certs ./certs -record requests.jsonl
+//
+// The configuration format is described in testutils.MockConfig. Requests matching no route get a 404 response,
+// routes answering an error get a 502 response.
+//
+// The admin endpoints inspect and reset the server:
+//
+//	GET  /__admin/requests  lists the last received requests, up to -max-requests
+//	GET  /__admin/routes    lists the number of calls of each route
+//	POST /__admin/reset     forgets the received requests and reloads the configuration
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+)
+
+const adminPrefix = "/__admin/"
+
+type recordedRequest struct {
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"headers,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	Status int         `json:"status"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type server struct {
+	fs         afero.Fs
+	configPath string
+	scheme     string
+	record     io.Writer
+	// maxRequests is the number of requests kept in memory, 0 for all of them
+	maxRequests int
+
+	mu       sync.Mutex
+	mock     *testutils.MockTransport
+	requests []recordedRequest
+}
+
+func newServer(fs afero.Fs, configPath, scheme string, record io.Writer, maxRequests int) (*server, error) {
+	s := &server{fs: fs, configPath: configPath, scheme: scheme, record: record, maxRequests: maxRequests}
+	return s, s.reset()
+}
+
+// reset reloads the configuration, so that the routes call counts and sequences start again.
+func (s *server) reset() error {
+	config, err := testutils.ReadMockConfig(s.fs, s.configPath)
+	if err != nil {
+		return err
+	}
+	mock := testutils.NewMockTransport(nil).WithMaxUnmatched(s.maxRequests)
+	mock.Configure(s.fs, config)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mock = mock
+	s.requests = []recordedRequest{}
+	return nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, adminPrefix) {
+		s.serveAdmin(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.URL.Scheme = s.scheme
+	req.URL.Host = r.Host
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	s.mu.Lock()
+	mock := s.mock
+	s.mu.Unlock()
+	resp, err := mock.RoundTrip(req)
+
+	recorded := recordedRequest{
+		Time:   time.Now(),
+		Method: r.Method,
+		URL:    req.URL.String(),
+		Header: r.Header,
+		Body:   string(body),
+	}
+	switch {
+	case errors.Is(err, testutils.ErrNoMockRoute):
+		recorded.Status = http.StatusNotFound
+		recorded.Error = err.Error()
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		recorded.Status = http.StatusBadGateway
+		recorded.Error = err.Error()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		defer resp.Body.Close()
+		recorded.Status = resp.StatusCode
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+	s.recordRequest(recorded)
+}
+
+func (s *server) recordRequest(recorded recordedRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, recorded)
+	if s.maxRequests > 0 && len(s.requests) > s.maxRequests {
+		s.requests = append([]recordedRequest{}, s.requests[len(s.requests)-s.maxRequests:]...)
+	}
+	if s.record != nil {
+		if err := json.NewEncoder(s.record).Encode(recorded); err != nil {
+			log.Printf("unable to record %s %s: %s", recorded.Method, recorded.URL, err)
+		}
+	}
+}
+
+func (s *server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == adminPrefix+"requests" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		requests := append([]recordedRequest{}, s.requests...)
+		s.mu.Unlock()
+		writeJSON(w, requests)
+	case r.URL.Path == adminPrefix+"routes" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		mock := s.mock
+		s.mu.Unlock()
+		writeJSON(w, mock.CallCounts())
+	case r.URL.Path == adminPrefix+"reset" && r.Method == http.MethodPost:
+		if err := s.reset(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// exitOnFailure reports the failures of the toolkit helpers expecting a test, and exits.
+type exitOnFailure struct{}
+
+func (exitOnFailure) Errorf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func (exitOnFailure) FailNow() {
+	os.Exit(1)
+}
+
+func main() {
+	configPath := flag.String("config", "mockserver.yaml", "the route configuration file")
+	addr := flag.String("addr", ":8080", "the address to listen on")
+	useTLS := flag.Bool("tls", false, "serve HTTPS with a certificate issued by a generated authority")
+	certs := flag.String("certs", "mockserver-certs", "the folder receiving the generated authority certificate, ca.crt, when serving HTTPS")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "the comma separated hosts of the HTTPS certificate")
+	recordPath := flag.String("record", "", "the file receiving the requests, one JSON document per line")
+	maxRequests := flag.Int("max-requests", 1000, "the number of requests kept in memory for the admin endpoints, 0 for all of them")
+	flag.Parse()
+
+	fs := afero.NewOsFs()
+	var record io.Writer
+	if *recordPath != "" {
+		f, err := os.OpenFile(*recordPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("unable to open the record file: %s", err)
+		}
+		defer f.Close()
+		record = f
+	}
+	scheme := "http"
+	if *useTLS {
+		scheme = "https"
+	}
+	handler, err := newServer(fs, *configPath, scheme, record, *maxRequests)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: handler}
+	if *useTLS {
+		ca := testutils.NewCertificateAuthority(exitOnFailure{}, fs, *certs)
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{ca.TLSCertificate(exitOnFailure{}, strings.Split(*hosts, ",")...)}}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	log.Printf("serving %s on %s://%s", *configPath, scheme, *addr)
+	if *useTLS {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
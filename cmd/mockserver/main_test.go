@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockServer(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	testutils.EnsureFileContent(t, fs, "/routes.yaml", `
+routes:
+  - method: GET
+    path: /health
+    response:
+      body: ok
+  - method: POST
+    path: /jobs
+    times: 1
+    response:
+      status: 202
+  - method: GET
+    path: /broken
+    response:
+      error: connection refused
+`)
+	record := &bytes.Buffer{}
+	handler, err := newServer(fs, "/routes.yaml", "http", record, 0)
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/health")
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusOK)
+	testutils.AssertResponseBodyMatches(t, resp, "^ok$")
+
+	for _, expected := range []int{http.StatusAccepted, http.StatusNotFound} {
+		resp, err = http.Post(server.URL+"/jobs", "application/json", strings.NewReader(`{"id": 1}`))
+		require.NoError(t, err)
+		testutils.AssertResponseStatus(t, resp, expected)
+	}
+	testutils.AssertResponseBodyMatches(t, resp, "no mock route matches POST")
+
+	resp, err = http.Get(server.URL + "/broken")
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusBadGateway)
+
+	resp, err = http.Get(server.URL + "/__admin/requests")
+	require.NoError(t, err)
+	testutils.AssertResponseJSONPath(t, resp, "$[*].status", []int{200, 202, 404, 502})
+	testutils.AssertResponseJSONPath(t, resp, "$[1].body", `{"id": 1}`)
+	testutils.AssertResponseJSONPath(t, resp, "$[2].error", "no mock route matches POST "+server.URL+"/jobs")
+	resp, err = http.Get(server.URL + "/__admin/routes")
+	require.NoError(t, err)
+	testutils.AssertResponseJSONPath(t, resp, "$['POST /jobs']", 1)
+
+	lines := strings.Split(strings.TrimSpace(record.String()), "\n")
+	require.Len(t, lines, 4)
+	recorded := recordedRequest{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &recorded))
+	assert.Equal(t, http.MethodGet, recorded.Method)
+	assert.Equal(t, server.URL+"/health", recorded.URL)
+
+	resp, err = http.Post(server.URL+"/__admin/reset", "", nil)
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusNoContent)
+	resp, err = http.Post(server.URL+"/jobs", "application/json", nil)
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusAccepted)
+	resp, err = http.Get(server.URL + "/__admin/requests")
+	require.NoError(t, err)
+	testutils.AssertResponseJSONPath(t, resp, "$[*].url", []string{server.URL + "/jobs"})
+
+	resp, err = http.Get(server.URL + "/__admin/unknown")
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusNotFound)
+}
+
+func TestMockServerMaxRequests(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	testutils.EnsureFileContent(t, fs, "/routes.yaml", "routes:\n  - path: /health\n")
+	handler, err := newServer(fs, "/routes.yaml", "http", nil, 2)
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, path := range []string{"/health", "/a", "/b"} {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	resp, err := http.Get(server.URL + "/__admin/requests")
+	require.NoError(t, err)
+	testutils.AssertResponseJSONPath(t, resp, "$[*].url", []string{server.URL + "/a", server.URL + "/b"})
+}
+
+func TestMockServerTLS(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	testutils.EnsureFileContent(t, fs, "/routes.yaml", "routes:\n  - path: /health\n")
+	handler, err := newServer(fs, "/routes.yaml", "https", nil, 0)
+	require.NoError(t, err)
+	ca := testutils.NewCertificateAuthority(t, fs, "/certs")
+	server := ca.NewTLSServer(t, handler)
+
+	resp, err := server.Client().Get(server.URL + "/health")
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusOK)
+	testutils.AssertFileExists(t, fs, "/certs/ca.crt")
+}
@@ -0,0 +1,406 @@
+package testutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Contract is the content of a contract file: the interactions a consumer expects from a provider.
+type Contract struct {
+	Consumer     string                `json:"consumer"`
+	Provider     string                `json:"provider"`
+	Interactions []ContractInteraction `json:"interactions"`
+}
+
+type ContractInteraction struct {
+	Description   string           `json:"description"`
+	ProviderState string           `json:"providerState,omitempty"`
+	Request       ContractRequest  `json:"request"`
+	Response      ContractResponse `json:"response"`
+}
+
+func (i ContractInteraction) String() string {
+	if i.ProviderState == "" {
+		return fmt.Sprintf("%q", i.Description)
+	}
+	return fmt.Sprintf("%q given %q", i.Description, i.ProviderState)
+}
+
+// ContractRequest is an expected request. JSON bodies are stored decoded, other bodies as strings.
+type ContractRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  url.Values  `json:"query,omitempty"`
+	Header http.Header `json:"headers,omitempty"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+// ContractResponse is an expected response. JSON bodies are stored decoded, other bodies as strings.
+type ContractResponse struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"headers,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+func readContract(fs afero.Fs, path string) (Contract, error) {
+	contract := Contract{}
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return contract, err
+	}
+	err = json.Unmarshal(data, &contract)
+	return contract, err
+}
+
+// ConsumerContract is a MockTransport recording the interactions it serves into a contract file,
+// to be verified by the provider with a ContractVerifier.
+//
+//	contract := testutils.NewConsumerContract(t, fs, "/contracts/web-users.json", "web", "users")
+//	contract.UponReceiving("a request for user 1").
+//		Given("user 1 exists").
+//		WithRequest(http.MethodGet, "/users/1").
+//		WillRespondWith(testutils.NewHTTPResponseBuilder().WithJsonBody(user))
+//	client := contract.Client()
+//
+// The contract file is written when the test completes, unless the test failed. Interactions already in
+// the file are kept, unless they have the same description and provider state as a recorded one.
+type ConsumerContract struct {
+	t        CleanupTest
+	mock     *MockTransport
+	contract Contract
+}
+
+// ConsumerContract should implement the http.RoundTripper interface
+var _ http.RoundTripper = &ConsumerContract{}
+
+func NewConsumerContract(t CleanupTest, fs afero.Fs, path, consumer, provider string) *ConsumerContract {
+	t.Helper()
+	c := &ConsumerContract{t: t, contract: Contract{Consumer: consumer, Provider: provider}}
+	// registered before the mock so that it runs once the expectations are checked
+	t.Cleanup(func() {
+		if failed, ok := t.(interface{ Failed() bool }); ok && failed.Failed() {
+			return
+		}
+		require.NoError(t, c.save(fs, path), "unable to write the contract %s", path)
+	})
+	c.mock = NewMockTransport(t)
+	return c
+}
+
+func (c *ConsumerContract) save(fs afero.Fs, path string) error {
+	recorded := map[string]bool{}
+	for _, interaction := range c.contract.Interactions {
+		recorded[interaction.String()] = true
+	}
+	contract := Contract{Consumer: c.contract.Consumer, Provider: c.contract.Provider}
+	if existing, err := readContract(fs, path); err == nil {
+		for _, interaction := range existing.Interactions {
+			if !recorded[interaction.String()] {
+				contract.Interactions = append(contract.Interactions, interaction)
+			}
+		}
+	}
+	contract.Interactions = append(contract.Interactions, c.contract.Interactions...)
+	data, err := json.MarshalIndent(contract, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, path, append(data, '\n'), 0644)
+}
+
+// UponReceiving starts the declaration of an interaction. Descriptions identify the interactions in the contract.
+func (c *ConsumerContract) UponReceiving(description string) *ContractInteractionBuilder {
+	return &ContractInteractionBuilder{
+		contract: c,
+		interaction: ContractInteraction{
+			Description: description,
+			Request:     ContractRequest{Method: http.MethodGet, Path: "/"},
+		},
+	}
+}
+
+func (c *ConsumerContract) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.mock.RoundTrip(req)
+}
+
+// Client returns an HTTP client using the contract mock.
+func (c *ConsumerContract) Client() *http.Client {
+	return &http.Client{Transport: c}
+}
+
+// Contract returns the interactions recorded by the test.
+func (c *ConsumerContract) Contract() Contract {
+	c.mock.mu.Lock()
+	defer c.mock.mu.Unlock()
+	contract := c.contract
+	contract.Interactions = append([]ContractInteraction{}, c.contract.Interactions...)
+	return contract
+}
+
+// ContractInteractionBuilder declares an interaction of a ConsumerContract.
+// The interaction is recorded, and served by the mock, when WillRespondWith is called.
+type ContractInteractionBuilder struct {
+	contract    *ConsumerContract
+	interaction ContractInteraction
+	matchers    []RequestMatcher
+}
+
+// Given sets the state the provider must be in to answer the interaction.
+func (b *ContractInteractionBuilder) Given(state string) *ContractInteractionBuilder {
+	b.interaction.ProviderState = state
+	return b
+}
+
+// WithRequest sets the method and the path of the request. The path can't be a pattern.
+func (b *ContractInteractionBuilder) WithRequest(method, path string) *ContractInteractionBuilder {
+	b.interaction.Request.Method = method
+	b.interaction.Request.Path = path
+	return b
+}
+
+func (b *ContractInteractionBuilder) WithQuery(name, value string) *ContractInteractionBuilder {
+	if b.interaction.Request.Query == nil {
+		b.interaction.Request.Query = url.Values{}
+	}
+	b.interaction.Request.Query.Add(name, value)
+	b.matchers = append(b.matchers, MatchQuery(name, value))
+	return b
+}
+
+func (b *ContractInteractionBuilder) WithHeader(name, value string) *ContractInteractionBuilder {
+	if b.interaction.Request.Header == nil {
+		b.interaction.Request.Header = http.Header{}
+	}
+	b.interaction.Request.Header.Add(name, value)
+	b.matchers = append(b.matchers, MatchHeader(name, value))
+	return b
+}
+
+func (b *ContractInteractionBuilder) WithBody(body string) *ContractInteractionBuilder {
+	b.interaction.Request.Body = body
+	b.matchers = append(b.matchers, MatchBodyString(body))
+	return b
+}
+
+// WithJsonBody sets the JSON encoded body and the application/json content type of the request.
+func (b *ContractInteractionBuilder) WithJsonBody(body interface{}) *ContractInteractionBuilder {
+	normalized, err := normalizeJSON(body)
+	if err != nil {
+		// the request can't be matched, the interaction will be reported as never called
+		normalized = err.Error()
+	}
+	b.interaction.Request.Body = normalized
+	if b.interaction.Request.Header == nil {
+		b.interaction.Request.Header = http.Header{}
+	}
+	b.interaction.Request.Header.Add("Content-Type", "application/json")
+	b.matchers = append(b.matchers, MatchJSONBody(body), matchMediaType("application/json"))
+	return b
+}
+
+// matchMediaType matches requests with the Content-Type media type, whatever its parameters like the charset.
+func matchMediaType(mediaType string) RequestMatcher {
+	return NewRequestMatcher("content type "+mediaType, func(req *http.Request) bool {
+		actual, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		return err == nil && actual == mediaType
+	})
+}
+
+// WillRespondWith records the interaction with the response built by the builder, and serves it.
+//
+// Streamed and failing bodies can't be recorded: the test fails and the interaction is served without being recorded.
+func (b *ContractInteractionBuilder) WillRespondWith(response *HTTPResponseBuilder) *MockRoute {
+	c := b.contract
+	c.t.Helper()
+	respond := response.responder()
+	body, recordable := response.staticBody()
+	b.interaction.Response = ContractResponse{
+		StatusCode: response.resp.StatusCode,
+		Header:     response.resp.Header.Clone(),
+		Body:       contractBody(response.resp.Header.Get("Content-Type"), body),
+	}
+
+	route := c.mock.On(b.interaction.Request.Method, b.interaction.Request.Path)
+	for _, matcher := range b.matchers {
+		route.Matching(matcher)
+	}
+	route.RespondWith(func(req *http.Request) (*http.Response, error) {
+		return respond(req), nil
+	})
+	if !recordable {
+		assert.Fail(c.t, fmt.Sprintf("Unable to record interaction %q: streamed and failing response bodies can't be recorded in a contract", b.interaction.Description))
+		return route
+	}
+	c.mock.mu.Lock()
+	defer c.mock.mu.Unlock()
+	c.contract.Interactions = append(c.contract.Interactions, b.interaction)
+	return route
+}
+
+// contractBody decodes JSON bodies so that contracts are readable and compared semantically.
+func contractBody(contentType string, body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if strings.Contains(mediaType, "json") {
+		var document interface{}
+		if json.Unmarshal(body, &document) == nil {
+			return document
+		}
+	}
+	return string(body)
+}
+
+// ContractVerifier replays the interactions of contract files against the provider handler.
+//
+//	verifier := testutils.NewContractVerifier(handler).
+//		WithState("user 1 exists", func() { store.Add(user) })
+//	verifier.AssertContract(t, fs, "/contracts/web-users.json")
+//
+// Responses can have more headers and more JSON object members than the contract expects.
+type ContractVerifier struct {
+	handler http.Handler
+	states  map[string]func()
+}
+
+func NewContractVerifier(handler http.Handler) *ContractVerifier {
+	return &ContractVerifier{handler: handler, states: map[string]func(){}}
+}
+
+// WithState registers the function setting the provider in the state required by interactions.
+func (v *ContractVerifier) WithState(state string, setup func()) *ContractVerifier {
+	v.states[state] = setup
+	return v
+}
+
+// AssertContract asserts that the provider answers all the interactions of the contract file as expected.
+// The test fails once for each mismatching interaction, with the differences found.
+func (v *ContractVerifier) AssertContract(t assert.TestingT, fs afero.Fs, path string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	contract, err := readContract(fs, path)
+	if err != nil {
+		return assert.Fail(t, fmt.Sprintf("Unable to read the contract %s: %s", path, err), msgAndArgs...)
+	}
+	ok := true
+	for _, interaction := range contract.Interactions {
+		if mismatches := v.verify(interaction); len(mismatches) > 0 {
+			ok = assert.Fail(t, fmt.Sprintf(
+				"Expecting %s to honour interaction %s of %s:\n\t%s",
+				contract.Provider, interaction, contract.Consumer, strings.Join(mismatches, "\n\t"),
+			), msgAndArgs...) && ok
+		}
+	}
+	return ok
+}
+
+func (v *ContractVerifier) RequireContract(t require.TestingT, fs afero.Fs, path string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if v.AssertContract(t, fs, path, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+func (v *ContractVerifier) verify(interaction ContractInteraction) []string {
+	if interaction.ProviderState != "" {
+		setup, ok := v.states[interaction.ProviderState]
+		if !ok {
+			return []string{fmt.Sprintf("unknown provider state %q", interaction.ProviderState)}
+		}
+		setup()
+	}
+
+	expected := interaction.Request
+	target := expected.Path
+	if len(expected.Query) > 0 {
+		target += "?" + expected.Query.Encode()
+	}
+	var body io.Reader
+	switch value := expected.Body.(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(value)
+	default:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return []string{fmt.Sprintf("invalid request body: %s", err)}
+		}
+		body = strings.NewReader(string(data))
+	}
+	req := httptest.NewRequest(expected.Method, target, body)
+	for name, values := range expected.Header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	resp := ServeRequest(req, v.handler)
+
+	mismatches := []string{}
+	if resp.Response.StatusCode != interaction.Response.StatusCode {
+		mismatches = append(mismatches, fmt.Sprintf("status: expected %d but got %d", interaction.Response.StatusCode, resp.Response.StatusCode))
+	}
+	for name, values := range interaction.Response.Header {
+		actual := resp.Response.Header.Values(name)
+		if strings.EqualFold(name, "Content-Type") && len(actual) == 1 && len(values) == 1 {
+			expectedType, _, _ := mime.ParseMediaType(values[0])
+			actualType, _, _ := mime.ParseMediaType(actual[0])
+			if expectedType == actualType {
+				continue
+			}
+		}
+		if !assert.ObjectsAreEqual(values, actual) {
+			mismatches = append(mismatches, fmt.Sprintf("header %s: expected %q but got %q", http.CanonicalHeaderKey(name), values, actual))
+		}
+	}
+	switch expectedBody := interaction.Response.Body.(type) {
+	case nil:
+	case string:
+		if actual := string(resp.Body); actual != expectedBody {
+			mismatches = append(mismatches, "body:\n"+unifiedDiff("contract", "provider", expectedBody, actual))
+		}
+	default:
+		var actual interface{}
+		if err := json.Unmarshal(resp.Body, &actual); err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("body: expected JSON but got %q", resp.Body))
+			break
+		}
+		if pointer, ok := jsonSubsetMismatch(expectedBody, actual, ""); !ok {
+			if pointer == "" {
+				pointer = "/"
+			}
+			expectedJSON, _ := json.MarshalIndent(expectedBody, "", "  ")
+			actualJSON, _ := json.MarshalIndent(actual, "", "  ")
+			mismatches = append(mismatches, fmt.Sprintf("body mismatch at %s:\n%s", pointer, unifiedDiff("contract", "provider", string(expectedJSON), string(actualJSON))))
+		}
+	}
+	return mismatches
+}
+
+func unifiedDiff(fromFile, toFile, expected, actual string) string {
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(expected + "\n"),
+		B:        difflib.SplitLines(actual + "\n"),
+		FromFile: fromFile,
+		ToFile:   toFile,
+		Context:  2,
+	})
+	return strings.TrimRight(diff, "\n")
+}
@@ -0,0 +1,155 @@
+package testutils_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type contractUser struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
+}
+
+func usersProvider(users map[string]contractUser) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		user, ok := users[r.PathValue("id")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(user)
+	})
+	mux.HandleFunc("POST /users", func(w http.ResponseWriter, r *http.Request) {
+		user := contractUser{}
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&user) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		user.ID = len(users) + 1
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(user)
+	})
+	return mux
+}
+
+func recordUsersContract(t *testing.T, fs afero.Fs) {
+	t.Run("consumer", func(t *testing.T) {
+		contract := testutils.NewConsumerContract(t, fs, "/contracts/web-users.json", "web", "users")
+		contract.UponReceiving("a request for user 1").
+			Given("user 1 exists").
+			WithRequest(http.MethodGet, "/users/1").
+			WithQuery("fields", "name").
+			WillRespondWith(testutils.NewHTTPResponseBuilder().WithJsonBody(contractUser{ID: 1, Name: "alice"}))
+		contract.UponReceiving("a user creation").
+			WithRequest(http.MethodPost, "/users").
+			WithJsonBody(map[string]string{"name": "bob"}).
+			WillRespondWith(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusCreated).WithJsonBody(contractUser{ID: 2, Name: "bob"}))
+
+		client := contract.Client()
+		resp, err := client.Get("http://users/users/1?fields=name")
+		require.NoError(t, err)
+		testutils.AssertResponseJSON(t, resp, `{"id": 1, "name": "alice"}`)
+		resp, err = client.Post("http://users/users", "application/json; charset=utf-8", strings.NewReader(`{"name": "bob"}`))
+		require.NoError(t, err)
+		testutils.AssertResponseStatus(t, resp, http.StatusCreated)
+
+		assert.Len(t, contract.Contract().Interactions, 2)
+	})
+}
+
+func TestContract(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	recordUsersContract(t, fs)
+	// recording again replaces the interactions instead of duplicating them
+	recordUsersContract(t, fs)
+
+	data, err := afero.ReadFile(fs, "/contracts/web-users.json")
+	require.NoError(t, err)
+	contract := testutils.Contract{}
+	require.NoError(t, json.Unmarshal(data, &contract))
+	assert.Equal(t, "web", contract.Consumer)
+	assert.Equal(t, "users", contract.Provider)
+	require.Len(t, contract.Interactions, 2)
+	assert.Equal(t, "user 1 exists", contract.Interactions[0].ProviderState)
+	assert.Equal(t, "name", contract.Interactions[0].Request.Query.Get("fields"))
+	assert.Equal(t, map[string]interface{}{"id": 1.0, "name": "alice"}, contract.Interactions[0].Response.Body)
+	assert.Equal(t, map[string]interface{}{"name": "bob"}, contract.Interactions[1].Request.Body)
+	assert.Equal(t, "application/json", contract.Interactions[1].Request.Header.Get("Content-Type"))
+
+	t.Run("provider honouring the contract", func(t *testing.T) {
+		users := map[string]contractUser{}
+		verifier := testutils.NewContractVerifier(usersProvider(users)).
+			WithState("user 1 exists", func() {
+				users["1"] = contractUser{ID: 1, Name: "alice", Email: "alice@example.com"}
+			})
+		verifier.RequireContract(t, fs, "/contracts/web-users.json")
+	})
+
+	t.Run("provider breaking the contract", func(t *testing.T) {
+		users := map[string]contractUser{}
+		verifier := testutils.NewContractVerifier(usersProvider(users)).
+			WithState("user 1 exists", func() {
+				users["1"] = contractUser{ID: 1, Name: "alicia"}
+			})
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, verifier.AssertContract(fakeT, fs, "/contracts/web-users.json"))
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], `Expecting users to honour interaction "a request for user 1" given "user 1 exists" of web:`)
+		assert.Contains(t, fakeT.ErrorMessages[0], "body mismatch at /name:")
+		assert.Contains(t, fakeT.ErrorMessages[0], "--- contract")
+		assert.Contains(t, fakeT.ErrorMessages[0], `-  "name": "alice"`)
+		assert.Contains(t, fakeT.ErrorMessages[0], `+  "name": "alicia"`)
+
+		fakeT = &testutils.FakeTest{}
+		assert.False(t, testutils.NewContractVerifier(usersProvider(users)).AssertContract(fakeT, fs, "/contracts/web-users.json"))
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], `unknown provider state "user 1 exists"`)
+
+		fakeT = &testutils.FakeTest{}
+		verifier = testutils.NewContractVerifier(http.NotFoundHandler()).WithState("user 1 exists", func() {})
+		assert.False(t, verifier.AssertContract(fakeT, fs, "/contracts/web-users.json"))
+		require.Len(t, fakeT.ErrorMessages, 2)
+		assert.Contains(t, fakeT.ErrorMessages[0], "status: expected 200 but got 404")
+		assert.Contains(t, fakeT.ErrorMessages[0], `header Content-Type: expected ["application/json"] but got ["text/plain; charset=utf-8"]`)
+		assert.Contains(t, fakeT.ErrorMessages[1], "status: expected 201 but got 404")
+
+		fakeT = &testutils.FakeTest{}
+		verifier.RequireContract(fakeT, fs, "/contracts/missing.json")
+		assert.True(t, fakeT.Failed)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Unable to read the contract /contracts/missing.json")
+	})
+
+}
+
+func TestContractRejectsUnrecordableResponses(t *testing.T) {
+	events := make(chan testutils.ServerSentEvent)
+	defer close(events)
+	for name, response := range map[string]*testutils.HTTPResponseBuilder{
+		"streamed": testutils.NewHTTPResponseBuilder().WithServerSentEvents(events),
+		"failing":  testutils.NewHTTPResponseBuilder().WithFailingBody("partial", errors.New("connection reset")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			fakeT := &testutils.FakeTest{}
+			contract := testutils.NewConsumerContract(fakeT, afero.NewMemMapFs(), "/contracts/web-events.json", "web", "events")
+			contract.UponReceiving("a request for events").
+				WithRequest(http.MethodGet, "/events").
+				WillRespondWith(response)
+			require.Len(t, fakeT.ErrorMessages, 1)
+			assert.Contains(t, fakeT.ErrorMessages[0], `Unable to record interaction "a request for events": streamed and failing response bodies can't be recorded in a contract`)
+			assert.Empty(t, contract.Contract().Interactions)
+		})
+	}
+}
@@ -4,14 +4,17 @@ go 1.22
 
 require (
 	github.com/adevinta/go-system-toolkit v0.0.0-20240912143443-133d8c380cfc
+	github.com/andybalholm/brotli v1.1.1
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/spf13/afero v1.8.2
 	github.com/stretchr/testify v1.7.1
+	golang.org/x/crypto v0.31.0
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/kr/pretty v0.2.1 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/text v0.3.8 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
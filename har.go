@@ -0,0 +1,317 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// HAR is an HTTP Archive, as exported by browsers and proxies. Only the fields used to replay
+// or display requests are supported.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// HARContent is the decoded content of a response. Binary contents are base64 encoded.
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// LoadHAR reads an HTTP Archive.
+func LoadHAR(t require.TestingT, fs afero.Fs, path string) *HAR {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	data, err := afero.ReadFile(fs, path)
+	require.NoError(t, err)
+	har := &HAR{}
+	require.NoError(t, json.Unmarshal(data, har), "invalid HAR file %s", path)
+	return har
+}
+
+// ImportHAR declares a route answering each request of the archive with its recorded response.
+//
+// Requests are matched on their method, host, path, query parameters and body. When the archive contains
+// the same request several times, the recorded responses are replayed in order and the last one is repeated.
+// The imported routes are optional, like with Maybe, as archives usually contain unrelated traffic.
+// Entries without response, like failed requests, are skipped.
+func (m *MockTransport) ImportHAR(har *HAR) []*MockRoute {
+	type group struct {
+		route   *MockRoute
+		entries []HAREntry
+	}
+	groups := []*group{}
+	index := map[string]*group{}
+	for _, entry := range har.Log.Entries {
+		if entry.Response.Status == 0 {
+			continue
+		}
+		body := ""
+		if entry.Request.PostData != nil {
+			body = entry.Request.PostData.Text
+		}
+		key := entry.Request.Method + " " + entry.Request.URL + "\n" + body
+		if g, ok := index[key]; ok {
+			g.entries = append(g.entries, entry)
+			continue
+		}
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			continue
+		}
+		route := m.On(entry.Request.Method, u.Path).MatchingHost(u.Host).Maybe()
+		for _, parameter := range harNameValues(u.Query()) {
+			route.MatchingQuery(parameter.Name, parameter.Value)
+		}
+		if body != "" {
+			route.MatchingBody(body)
+		}
+		g := &group{route: route, entries: []HAREntry{entry}}
+		index[key] = g
+		groups = append(groups, g)
+	}
+
+	routes := []*MockRoute{}
+	for _, g := range groups {
+		responders := []func(req *http.Request) *http.Response{}
+		for _, entry := range g.entries {
+			responders = append(responders, harResponseBuilder(entry.Response).responder())
+		}
+		var mu sync.Mutex
+		calls := 0
+		g.route.RespondWith(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			respond := responders[len(responders)-1]
+			if calls < len(responders) {
+				respond = responders[calls]
+			}
+			calls++
+			mu.Unlock()
+			return respond(req), nil
+		})
+		routes = append(routes, g.route)
+	}
+	return routes
+}
+
+func harResponseBuilder(response HARResponse) *HTTPResponseBuilder {
+	b := NewHTTPResponseBuilder().WithStatusCode(response.Status)
+	for _, header := range response.Headers {
+		switch http.CanonicalHeaderKey(header.Name) {
+		// the content is recorded decoded and can be truncated
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		b.WithHeader(header.Name, header.Value)
+	}
+	body := []byte(response.Content.Text)
+	if response.Content.Encoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(response.Content.Text)
+		if err == nil {
+			body = decoded
+		}
+	}
+	if len(body) > 0 {
+		b.WithBody(io.NopCloser(bytes.NewReader(body)))
+	}
+	return b
+}
+
+// harNameValues lists the values sorted by name, as maps are not ordered.
+func harNameValues(values map[string][]string) []HARNameValue {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := []HARNameValue{}
+	for _, name := range names {
+		for _, value := range values[name] {
+			list = append(list, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return list
+}
+
+func harCookies(cookies []*http.Cookie) []HARNameValue {
+	values := []HARNameValue{}
+	for _, cookie := range cookies {
+		values = append(values, HARNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return values
+}
+
+// harContent encodes the content as text when possible, and in base64 otherwise.
+func harContent(contentType string, body []byte) HARContent {
+	content := HARContent{Size: len(body), MimeType: contentType}
+	if len(body) == 0 {
+		return content
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	textual := mediaType == "" || strings.HasPrefix(mediaType, "text/") || mediaType == "application/x-www-form-urlencoded"
+	for _, suffix := range []string{"json", "xml", "javascript"} {
+		textual = textual || strings.HasSuffix(mediaType, suffix)
+	}
+	if textual && utf8.Valid(body) {
+		content.Text = string(body)
+		return content
+	}
+	content.Text = base64.StdEncoding.EncodeToString(body)
+	content.Encoding = "base64"
+	return content
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// HAR returns the recorded requests as an HTTP Archive.
+//
+// Response contents are limited to what the client read. Failed requests have a 0 status
+// and their error as comment.
+func (r *RecordingTransport) HAR() *HAR {
+	har := &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "go-testutils-toolkit", Version: "dev"},
+		Entries: []HAREntry{},
+	}}
+	for _, recorded := range r.Requests() {
+		req := recorded.Request()
+		proto := req.Proto
+		if proto == "" {
+			proto = "HTTP/1.1"
+		}
+		entry := HAREntry{
+			StartedDateTime: recorded.Start,
+			Time:            milliseconds(recorded.Duration),
+			Request: HARRequest{
+				Method:      recorded.Method,
+				URL:         recorded.URL.String(),
+				HTTPVersion: proto,
+				Cookies:     harCookies(req.Cookies()),
+				Headers:     harNameValues(recorded.Header),
+				QueryString: harNameValues(recorded.URL.Query()),
+				HeadersSize: -1,
+				BodySize:    len(recorded.Body),
+			},
+			Timings: HARTimings{Wait: milliseconds(recorded.Duration)},
+		}
+		if len(recorded.Body) > 0 {
+			entry.Request.PostData = &HARPostData{MimeType: recorded.Header.Get("Content-Type"), Text: string(recorded.Body)}
+		}
+		if recorded.Err != nil {
+			entry.Comment = recorded.Err.Error()
+		}
+		if resp := recorded.Response; resp != nil {
+			body := recorded.ResponseBody()
+			location, _ := resp.Location()
+			redirect := ""
+			if location != nil {
+				redirect = location.String()
+			}
+			entry.Response = HARResponse{
+				Status:      resp.StatusCode,
+				StatusText:  http.StatusText(resp.StatusCode),
+				HTTPVersion: resp.Proto,
+				Cookies:     harCookies(resp.Cookies()),
+				Headers:     harNameValues(resp.Header),
+				Content:     harContent(resp.Header.Get("Content-Type"), body),
+				RedirectURL: redirect,
+				HeadersSize: -1,
+				BodySize:    len(body),
+			}
+		} else {
+			entry.Response = HARResponse{Cookies: []HARNameValue{}, Headers: []HARNameValue{}, HeadersSize: -1, BodySize: -1}
+		}
+		har.Log.Entries = append(har.Log.Entries, entry)
+	}
+	return har
+}
+
+// SaveHAR writes the recorded requests as an HTTP Archive, to be opened with a HAR viewer.
+func (r *RecordingTransport) SaveHAR(t require.TestingT, fs afero.Fs, path string) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	data, err := json.MarshalIndent(r.HAR(), "", "  ")
+	require.NoError(t, err)
+	require.NoError(t, fs.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, afero.WriteFile(fs, path, data, 0644))
+}
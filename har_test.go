@@ -0,0 +1,145 @@
+package testutils_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const capturedHAR = `{
+  "log": {
+    "version": "1.2",
+    "creator": {"name": "Firefox", "version": "120.0"},
+    "entries": [
+      {
+        "startedDateTime": "2024-01-02T10:00:00.000Z",
+        "time": 42,
+        "request": {"method": "GET", "url": "https://api.example.com/orders?status=open", "httpVersion": "HTTP/2", "cookies": [], "headers": [], "queryString": [{"name": "status", "value": "open"}], "headersSize": -1, "bodySize": 0},
+        "response": {"status": 200, "statusText": "OK", "httpVersion": "HTTP/2", "cookies": [], "headers": [{"name": "content-type", "value": "application/json"}, {"name": "content-encoding", "value": "gzip"}, {"name": "content-length", "value": "12"}], "content": {"size": 13, "mimeType": "application/json", "text": "[{\"id\": 1}]"}, "redirectURL": "", "headersSize": -1, "bodySize": 12},
+        "cache": {},
+        "timings": {"send": 0, "wait": 40, "receive": 2}
+      },
+      {
+        "startedDateTime": "2024-01-02T10:00:01.000Z",
+        "time": 12,
+        "request": {"method": "POST", "url": "https://api.example.com/orders", "httpVersion": "HTTP/2", "cookies": [], "headers": [], "queryString": [], "postData": {"mimeType": "application/json", "text": "{\"item\": \"book\"}"}, "headersSize": -1, "bodySize": 16},
+        "response": {"status": 500, "statusText": "Internal Server Error", "httpVersion": "HTTP/2", "cookies": [], "headers": [], "content": {"size": 0, "mimeType": ""}, "redirectURL": "", "headersSize": -1, "bodySize": 0},
+        "cache": {},
+        "timings": {"send": 0, "wait": 12, "receive": 0}
+      },
+      {
+        "startedDateTime": "2024-01-02T10:00:02.000Z",
+        "time": 12,
+        "request": {"method": "POST", "url": "https://api.example.com/orders", "httpVersion": "HTTP/2", "cookies": [], "headers": [], "queryString": [], "postData": {"mimeType": "application/json", "text": "{\"item\": \"book\"}"}, "headersSize": -1, "bodySize": 16},
+        "response": {"status": 201, "statusText": "Created", "httpVersion": "HTTP/2", "cookies": [], "headers": [{"name": "Location", "value": "/orders/2"}], "content": {"size": 0, "mimeType": ""}, "redirectURL": "", "headersSize": -1, "bodySize": 0},
+        "cache": {},
+        "timings": {"send": 0, "wait": 12, "receive": 0}
+      },
+      {
+        "startedDateTime": "2024-01-02T10:00:03.000Z",
+        "time": 3,
+        "request": {"method": "GET", "url": "https://cdn.example.com/logo.png", "httpVersion": "HTTP/2", "cookies": [], "headers": [], "queryString": [], "headersSize": -1, "bodySize": 0},
+        "response": {"status": 200, "statusText": "OK", "httpVersion": "HTTP/2", "cookies": [], "headers": [{"name": "Content-Type", "value": "image/png"}], "content": {"size": 4, "mimeType": "image/png", "text": "iVBORw==", "encoding": "base64"}, "redirectURL": "", "headersSize": -1, "bodySize": 4},
+        "cache": {},
+        "timings": {"send": 0, "wait": 3, "receive": 0}
+      }
+    ]
+  }
+}`
+
+func TestImportHAR(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	testutils.EnsureFileContent(t, fs, "/bug-1234.har", capturedHAR)
+
+	// the expectations are checked by the test
+	mock := testutils.NewMockTransport(nil)
+	routes := mock.ImportHAR(testutils.LoadHAR(t, fs, "/bug-1234.har"))
+	require.Len(t, routes, 3)
+	client := mock.Client()
+
+	resp, err := client.Get("https://api.example.com/orders?status=open")
+	require.NoError(t, err)
+	testutils.AssertResponseJSON(t, resp, `[{"id": 1}]`)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	for _, expected := range []int{http.StatusInternalServerError, http.StatusCreated, http.StatusCreated} {
+		resp, err = client.Post("https://api.example.com/orders", "application/json", strings.NewReader(`{"item": "book"}`))
+		require.NoError(t, err)
+		assert.Equal(t, expected, resp.StatusCode)
+	}
+	assert.Equal(t, "/orders/2", resp.Header.Get("Location"))
+
+	resp, err = client.Get("https://cdn.example.com/logo.png")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x89, 'P', 'N', 'G'}, body)
+
+	_, err = client.Get("https://api.example.com/orders?status=closed")
+	assert.Error(t, err)
+	fakeT := &testutils.FakeTest{}
+	assert.False(t, mock.AssertExpectations(fakeT))
+	require.Len(t, fakeT.ErrorMessages, 1)
+	assert.Contains(t, fakeT.ErrorMessages[0], "mismatched criteria: query status=open")
+}
+
+func TestRecordingTransportHAR(t *testing.T) {
+	// a request fails on purpose
+	mock := testutils.NewMockTransport(nil)
+	mock.On(http.MethodPost, "/users").Respond(testutils.NewHTTPResponseBuilder().
+		WithStatusCode(http.StatusCreated).
+		WithCookie(&http.Cookie{Name: "session", Value: "abc"}).
+		WithJsonBody(map[string]int{"id": 1}))
+	mock.On(http.MethodGet, "/avatar").Respond(testutils.NewHTTPResponseBuilder().
+		WithHeader("Content-Type", "image/png").
+		WithBody(testutils.StringBody("\x89PNG")))
+	recorder := testutils.NewRecordingTransport(mock)
+	client := recorder.Client()
+
+	resp, err := client.Post("https://api.example.com/users?notify=true", "application/json", strings.NewReader(`{"name": "alice"}`))
+	require.NoError(t, err)
+	io.ReadAll(resp.Body)
+	resp, err = client.Get("https://api.example.com/avatar")
+	require.NoError(t, err)
+	io.ReadAll(resp.Body)
+	_, err = client.Get("https://api.example.com/missing")
+	assert.Error(t, err)
+
+	fs := afero.NewMemMapFs()
+	recorder.SaveHAR(t, fs, "/out/traffic.har")
+	har := testutils.LoadHAR(t, fs, "/out/traffic.har")
+	assert.Equal(t, "1.2", har.Log.Version)
+	require.Len(t, har.Log.Entries, 3)
+
+	entry := har.Log.Entries[0]
+	assert.Equal(t, "POST", entry.Request.Method)
+	assert.Equal(t, "https://api.example.com/users?notify=true", entry.Request.URL)
+	assert.Equal(t, []testutils.HARNameValue{{Name: "notify", Value: "true"}}, entry.Request.QueryString)
+	require.NotNil(t, entry.Request.PostData)
+	assert.Equal(t, `{"name": "alice"}`, entry.Request.PostData.Text)
+	assert.Equal(t, "application/json", entry.Request.PostData.MimeType)
+	assert.Equal(t, http.StatusCreated, entry.Response.Status)
+	assert.Equal(t, "Created", entry.Response.StatusText)
+	assert.Equal(t, []testutils.HARNameValue{{Name: "session", Value: "abc"}}, entry.Response.Cookies)
+	assert.JSONEq(t, `{"id": 1}`, entry.Response.Content.Text)
+
+	assert.Equal(t, "base64", har.Log.Entries[1].Response.Content.Encoding)
+	assert.Equal(t, "iVBORw==", har.Log.Entries[1].Response.Content.Text)
+
+	assert.Equal(t, 0, har.Log.Entries[2].Response.Status)
+	assert.Contains(t, har.Log.Entries[2].Comment, "no mock route matches GET https://api.example.com/missing")
+
+	// exported archives can be replayed
+	replay := testutils.NewMockTransport(t)
+	assert.Len(t, replay.ImportHAR(har), 2)
+	resp, err = replay.Client().Post("https://api.example.com/users?notify=true", "application/json", strings.NewReader(`{"name": "alice"}`))
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusCreated)
+	testutils.AssertResponseJSON(t, resp, `{"id": 1}`)
+}
@@ -3,13 +3,23 @@ package testutils
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 type RoundTripperFunc func(r *http.Request) (*http.Response, error)
@@ -27,6 +37,19 @@ var _ http.RoundTripper = RoundTripperFunc(nil)
 type HTTPResponseBuilder struct {
 	resp *http.Response
 	tb   testing.TB
+	// newBody creates a new reader on the body, when it can be read several times
+	newBody func() io.ReadCloser
+	// static is the body when it is known in advance, nil when it is streamed or fails
+	static []byte
+	leaks  *BodyLeakDetector
+}
+
+// MultipartFile is a file part of a multipart body.
+type MultipartFile struct {
+	FieldName   string
+	FileName    string
+	ContentType string
+	Content     []byte
 }
 
 func StringBody(body string) io.ReadCloser {
@@ -34,10 +57,49 @@ func StringBody(body string) io.ReadCloser {
 }
 
 func NewHTTPResponseBuilder() *HTTPResponseBuilder {
-	return &HTTPResponseBuilder{resp: &http.Response{}}
+	return &HTTPResponseBuilder{resp: &http.Response{Header: http.Header{}, ContentLength: -1}}
 }
 
+// Build returns the response.
+//
+// The status code defaults to 200 OK, and the status, protocol, headers and body are always set,
+// so that the response can be used as if it was returned by an http.Client.
 func (b *HTTPResponseBuilder) Build() *http.Response {
+	resp := b.build()
+	if b.leaks != nil {
+		if _, tracked := resp.Body.(*trackedBody); !tracked {
+			resp.Body = b.leaks.Track(resp.Body)
+		}
+	}
+	return resp
+}
+
+func (b *HTTPResponseBuilder) build() *http.Response {
+	if b.resp.StatusCode == 0 {
+		b.resp.StatusCode = http.StatusOK
+	}
+	b.resp.Status = fmt.Sprintf("%d %s", b.resp.StatusCode, http.StatusText(b.resp.StatusCode))
+	if b.resp.Proto == "" {
+		b.resp.Proto = "HTTP/1.1"
+		b.resp.ProtoMajor = 1
+		b.resp.ProtoMinor = 1
+	}
+	if b.resp.Header == nil {
+		b.resp.Header = http.Header{}
+	}
+	if b.resp.Body == nil {
+		if b.newBody != nil {
+			b.resp.Body = b.newBody()
+		} else {
+			b.resp.Body = http.NoBody
+			b.resp.ContentLength = 0
+		}
+	}
+	if len(b.resp.Trailer) > 0 {
+		// trailers are only sent with chunked bodies
+		b.resp.ContentLength = -1
+		b.resp.TransferEncoding = []string{"chunked"}
+	}
 	return b.resp
 }
 
@@ -46,12 +108,87 @@ func (b *HTTPResponseBuilder) WithTB(tb testing.TB) *HTTPResponseBuilder {
 	return b
 }
 
+// WithBodyLeakDetector tracks the bodies of the built responses with the detector.
+func (b *HTTPResponseBuilder) WithBodyLeakDetector(detector *BodyLeakDetector) *HTTPResponseBuilder {
+	b.leaks = detector
+	return b
+}
+
+func (b *HTTPResponseBuilder) noError(err error) {
+	if b.tb != nil {
+		b.tb.Helper()
+		assert.NoError(b.tb, err)
+	}
+}
+
 func (b *HTTPResponseBuilder) WithStatusCode(code int) *HTTPResponseBuilder {
 	b.resp.StatusCode = code
 	return b
 }
+
+// WithHeader adds the value to the header.
+func (b *HTTPResponseBuilder) WithHeader(name, value string) *HTTPResponseBuilder {
+	if b.resp.Header == nil {
+		b.resp.Header = http.Header{}
+	}
+	b.resp.Header.Add(name, value)
+	return b
+}
+
+// WithCookie adds a Set-Cookie header for the cookie.
+func (b *HTTPResponseBuilder) WithCookie(cookie *http.Cookie) *HTTPResponseBuilder {
+	return b.WithHeader("Set-Cookie", cookie.String())
+}
+
+// WithTrailer adds the value to the trailer. Responses with trailers have a chunked body.
+func (b *HTTPResponseBuilder) WithTrailer(name, value string) *HTTPResponseBuilder {
+	if b.resp.Trailer == nil {
+		b.resp.Trailer = http.Header{}
+	}
+	b.resp.Trailer.Add(name, value)
+	return b
+}
+
+// WithRequest sets the request the response answers.
+func (b *HTTPResponseBuilder) WithRequest(req *http.Request) *HTTPResponseBuilder {
+	b.resp.Request = req
+	return b
+}
+
+// WithRedirect answers with the redirection status code and the Location header.
+func (b *HTTPResponseBuilder) WithRedirect(code int, location string) *HTTPResponseBuilder {
+	b.resp.StatusCode = code
+	if b.resp.Header == nil {
+		b.resp.Header = http.Header{}
+	}
+	b.resp.Header.Set("Location", location)
+	return b
+}
+
 func (b *HTTPResponseBuilder) WithBody(body io.ReadCloser) *HTTPResponseBuilder {
 	b.resp.Body = body
+	b.resp.ContentLength = -1
+	b.resp.TransferEncoding = nil
+	b.newBody = nil
+	b.static = nil
+	return b
+}
+
+// withBytesBody sets a body known in advance, that can be read several times.
+func (b *HTTPResponseBuilder) withBytesBody(data []byte, contentType string) *HTTPResponseBuilder {
+	b.resp.Body = nil
+	b.resp.ContentLength = int64(len(data))
+	b.resp.TransferEncoding = nil
+	b.newBody = func() io.ReadCloser {
+		return io.NopCloser(bytes.NewReader(data))
+	}
+	b.static = append([]byte{}, data...)
+	if b.resp.Header == nil {
+		b.resp.Header = http.Header{}
+	}
+	if contentType != "" {
+		b.resp.Header.Set("Content-Type", contentType)
+	}
 	return b
 }
 
@@ -60,12 +197,135 @@ func (b *HTTPResponseBuilder) WithJsonBody(body interface{}) *HTTPResponseBuilde
 	err := json.NewEncoder(&data).Encode(body)
 	if b.tb != nil {
 		b.tb.Helper()
-		assert.NoError(b.tb, err)
 	}
-	b.WithBody(io.NopCloser(&data))
-	if b.resp.Header == nil {
-		b.resp.Header = http.Header{}
+	b.noError(err)
+	return b.withBytesBody(data.Bytes(), "application/json")
+}
+
+func (b *HTTPResponseBuilder) WithYAMLBody(body interface{}) *HTTPResponseBuilder {
+	data, err := yaml.Marshal(body)
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	b.noError(err)
+	return b.withBytesBody(data, "application/yaml")
+}
+
+func (b *HTTPResponseBuilder) WithXMLBody(body interface{}) *HTTPResponseBuilder {
+	data, err := xml.Marshal(body)
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	b.noError(err)
+	return b.withBytesBody(append([]byte(xml.Header), data...), "application/xml")
+}
+
+func (b *HTTPResponseBuilder) WithFormBody(values url.Values) *HTTPResponseBuilder {
+	return b.withBytesBody([]byte(values.Encode()), "application/x-www-form-urlencoded")
+}
+
+// WithMultipartBody answers with a multipart/form-data body made of the fields, in alphabetical order,
+// followed by the files.
+func (b *HTTPResponseBuilder) WithMultipartBody(fields url.Values, files ...MultipartFile) *HTTPResponseBuilder {
+	data, contentType, err := encodeMultipart(fields, files)
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	b.noError(err)
+	return b.withBytesBody(data, contentType)
+}
+
+// encodeMultipart encodes a multipart/form-data body and returns it with its content type.
+func encodeMultipart(fields url.Values, files []MultipartFile) ([]byte, string, error) {
+	data := bytes.Buffer{}
+	writer := multipart.NewWriter(&data)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range fields[name] {
+			if err := writer.WriteField(name, value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	for _, file := range files {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, file.FieldName, file.FileName))
+		contentType := file.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(file.Content); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return data.Bytes(), writer.FormDataContentType(), nil
+}
+
+// WithFileBody answers with the content of the file.
+// The content type is guessed from the file extension, or from the content when the extension is unknown.
+func (b *HTTPResponseBuilder) WithFileBody(fs afero.Fs, path string) *HTTPResponseBuilder {
+	data, err := afero.ReadFile(fs, path)
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	b.noError(err)
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return b.withBytesBody(data, contentType)
+}
+
+// responder returns a function answering requests with copies of the built response.
+// When the body can't be created again, it is read once so it can be replayed for every request.
+// staticBody returns the body without creating a reader, or false when the body is streamed or fails.
+func (b *HTTPResponseBuilder) staticBody() ([]byte, bool) {
+	if b.newBody == nil && (b.resp.Body == nil || b.resp.Body == http.NoBody) {
+		return nil, true
+	}
+	return b.static, b.static != nil
+}
+
+func (b *HTTPResponseBuilder) responder() func(req *http.Request) *http.Response {
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	resp := b.build()
+	if b.newBody == nil && resp.Body != http.NoBody {
+		// the body can only be read once, keep it to replay it
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		b.noError(err)
+		b.newBody = func() io.ReadCloser {
+			return io.NopCloser(bytes.NewReader(body))
+		}
+		b.static = body
+		resp.Body = b.newBody()
+	}
+	newBody := b.newBody
+	return func(req *http.Request) *http.Response {
+		copied := *resp
+		copied.Header = resp.Header.Clone()
+		copied.Trailer = resp.Trailer.Clone()
+		copied.Request = req
+		if newBody != nil {
+			copied.Body = newBody()
+		}
+		if b.leaks != nil {
+			copied.Body = b.leaks.Track(copied.Body)
+		}
+		return &copied
 	}
-	b.resp.Header.Set("Content-Type", "application/json")
-	return b
 }
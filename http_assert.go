@@ -0,0 +1,313 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"strings"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readResponseBody reads the response body and restores it so it can be read again.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// describeResponse returns the response in a readable form, with its body.
+func describeResponse(resp *http.Response) string {
+	s := "response"
+	if resp.Request != nil {
+		s += fmt.Sprintf(" to %s %s", resp.Request.Method, resp.Request.URL)
+	}
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return fmt.Sprintf("%s: %s (unable to dump the response: %s)", s, resp.Status, err)
+	}
+	return s + ":\n" + strings.ReplaceAll(strings.TrimRight(string(dump), "\r\n"), "\r\n", "\n")
+}
+
+func failResponse(t assert.TestingT, resp *http.Response, failure string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	return assert.Fail(t, failure+"\n"+describeResponse(resp), msgAndArgs...)
+}
+
+func responseJSON(resp *http.Response) (interface{}, error) {
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return document, nil
+}
+
+func AssertResponseStatus(t assert.TestingT, resp *http.Response, expected int, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if resp.StatusCode != expected {
+		return failResponse(t, resp, fmt.Sprintf("Expecting status %d but got %d", expected, resp.StatusCode), msgAndArgs...)
+	}
+	return true
+}
+
+func RequireResponseStatus(t require.TestingT, resp *http.Response, expected int, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if AssertResponseStatus(t, resp, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertResponseHeader asserts that one of the values of the header is expected.
+func AssertResponseHeader(t assert.TestingT, resp *http.Response, name, expected string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if actual := resp.Header.Values(name); !containsString(actual, expected) {
+		return failResponse(t, resp, fmt.Sprintf("Expecting header %s to be %q but got %q", http.CanonicalHeaderKey(name), expected, actual), msgAndArgs...)
+	}
+	return true
+}
+
+func RequireResponseHeader(t require.TestingT, resp *http.Response, name, expected string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if AssertResponseHeader(t, resp, name, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertResponseContentType asserts the media type of the response, ignoring parameters like the charset.
+func AssertResponseContentType(t assert.TestingT, resp *http.Response, expected string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	actual := resp.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(actual)
+	if err != nil || !strings.EqualFold(mediaType, expected) {
+		return failResponse(t, resp, fmt.Sprintf("Expecting content type %s but got %q", expected, actual), msgAndArgs...)
+	}
+	return true
+}
+
+func RequireResponseContentType(t require.TestingT, resp *http.Response, expected string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if AssertResponseContentType(t, resp, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertResponseJSON asserts that the body is a JSON document equivalent to expected,
+// whatever the key order and the formatting.
+func AssertResponseJSON(t assert.TestingT, resp *http.Response, expected string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	actual, err := responseJSON(resp)
+	if err != nil {
+		return failResponse(t, resp, err.Error(), msgAndArgs...)
+	}
+	var expectedValue interface{}
+	if err := json.Unmarshal([]byte(expected), &expectedValue); err != nil {
+		return assert.Fail(t, fmt.Sprintf("Expected value %q is not valid JSON: %s", expected, err), msgAndArgs...)
+	}
+	if !assert.ObjectsAreEqual(expectedValue, actual) {
+		return failResponse(t, resp, "Expecting JSON body "+expected, msgAndArgs...)
+	}
+	return true
+}
+
+func RequireResponseJSON(t require.TestingT, resp *http.Response, expected string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if AssertResponseJSON(t, resp, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// jsonSubsetMismatch returns the pointer of the first value of expected that is not in actual.
+// Objects can have more members than expected, arrays must have the same length.
+func jsonSubsetMismatch(expected, actual interface{}, pointer string) (string, bool) {
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			return pointer, false
+		}
+		for key, value := range e {
+			child, found := a[key]
+			if !found {
+				return pointer + "/" + key, false
+			}
+			if mismatch, ok := jsonSubsetMismatch(value, child, pointer+"/"+key); !ok {
+				return mismatch, false
+			}
+		}
+		return "", true
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok || len(a) != len(e) {
+			return pointer, false
+		}
+		for i := range e {
+			if mismatch, ok := jsonSubsetMismatch(e[i], a[i], fmt.Sprintf("%s/%d", pointer, i)); !ok {
+				return mismatch, false
+			}
+		}
+		return "", true
+	}
+	return pointer, assert.ObjectsAreEqual(expected, actual)
+}
+
+// AssertResponseJSONSubset asserts that the body is a JSON document containing expected.
+// The objects of the body can have more members than the expected ones.
+func AssertResponseJSONSubset(t assert.TestingT, resp *http.Response, expected string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	actual, err := responseJSON(resp)
+	if err != nil {
+		return failResponse(t, resp, err.Error(), msgAndArgs...)
+	}
+	var expectedValue interface{}
+	if err := json.Unmarshal([]byte(expected), &expectedValue); err != nil {
+		return assert.Fail(t, fmt.Sprintf("Expected value %q is not valid JSON: %s", expected, err), msgAndArgs...)
+	}
+	if mismatch, ok := jsonSubsetMismatch(expectedValue, actual, ""); !ok {
+		if mismatch == "" {
+			mismatch = "/"
+		}
+		return failResponse(t, resp, fmt.Sprintf("Expecting JSON body to contain %s, mismatch at %s", expected, mismatch), msgAndArgs...)
+	}
+	return true
+}
+
+func RequireResponseJSONSubset(t require.TestingT, resp *http.Response, expected string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if AssertResponseJSONSubset(t, resp, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertResponseJSONPath asserts that the JSONPath expression, as described in EvaluateJSONPath, selects the expected value.
+// Paths selecting a single node are compared to the value, other paths to the list of selected nodes.
+// The expected value is compared once encoded to JSON, so that 1 equals 1.0.
+func AssertResponseJSONPath(t assert.TestingT, resp *http.Response, path string, expected interface{}, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	document, err := responseJSON(resp)
+	if err != nil {
+		return failResponse(t, resp, err.Error(), msgAndArgs...)
+	}
+	actual, err := evaluateJSONPathValue(document, path)
+	if err != nil {
+		return failResponse(t, resp, fmt.Sprintf("Unable to evaluate %s: %s", path, err), msgAndArgs...)
+	}
+	normalized, err := normalizeJSON(expected)
+	if err != nil {
+		return assert.Fail(t, fmt.Sprintf("Unable to encode the expected value: %s", err), msgAndArgs...)
+	}
+	if !assert.ObjectsAreEqual(normalized, actual) {
+		return failResponse(t, resp, fmt.Sprintf("Expecting %s to be %#v but got %#v", path, normalized, actual), msgAndArgs...)
+	}
+	return true
+}
+
+func RequireResponseJSONPath(t require.TestingT, resp *http.Response, path string, expected interface{}, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if AssertResponseJSONPath(t, resp, path, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertResponseBodyMatches asserts that the body matches the regular expression.
+func AssertResponseBodyMatches(t assert.TestingT, resp *http.Response, expr string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return assert.Fail(t, fmt.Sprintf("Invalid regular expression %s: %s", expr, err), msgAndArgs...)
+	}
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return failResponse(t, resp, fmt.Sprintf("Unable to read the body: %s", err), msgAndArgs...)
+	}
+	if !re.Match(body) {
+		return failResponse(t, resp, fmt.Sprintf("Expecting the body to match %s", expr), msgAndArgs...)
+	}
+	return true
+}
+
+func RequireResponseBodyMatches(t require.TestingT, resp *http.Response, expr string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if AssertResponseBodyMatches(t, resp, expr, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertResponseJSONSchema asserts that the body is valid against the JSON schema, as described in ValidateJSONSchema.
+func AssertResponseJSONSchema(t assert.TestingT, resp *http.Response, schema string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	var schemaValue interface{}
+	if err := json.Unmarshal([]byte(schema), &schemaValue); err != nil {
+		return assert.Fail(t, fmt.Sprintf("Invalid JSON schema: %s", err), msgAndArgs...)
+	}
+	document, err := responseJSON(resp)
+	if err != nil {
+		return failResponse(t, resp, err.Error(), msgAndArgs...)
+	}
+	if violations := ValidateJSONSchema(schemaValue, document); len(violations) > 0 {
+		return failResponse(t, resp, "Expecting the body to match the JSON schema:\n\t"+strings.Join(violations, "\n\t"), msgAndArgs...)
+	}
+	return true
+}
+
+func RequireResponseJSONSchema(t require.TestingT, resp *http.Response, schema string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if AssertResponseJSONSchema(t, resp, schema, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
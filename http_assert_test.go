@@ -0,0 +1,88 @@
+package testutils_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const userSchema = `{
+	"type": "object",
+	"required": ["id", "name", "roles"],
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"name": {"type": "string", "minLength": 1},
+		"roles": {"type": "array", "items": {"enum": ["admin", "user"]}}
+	}
+}`
+
+func TestResponseAssertions(t *testing.T) {
+	req := testutils.NewHTTPRequestBuilder().WithURL("https://api.example.com/users/1").Build()
+	resp := testutils.NewHTTPResponseBuilder().WithTB(t).
+		WithRequest(req).
+		WithHeader("X-Request-Id", "42").
+		WithHeader("Content-Type", "application/json; charset=utf-8").
+		WithBody(io.NopCloser(strings.NewReader(`{"id": 1, "name": "alice", "roles": ["admin", "user"], "address": {"city": "Paris", "zip": "75001"}}`))).
+		Build()
+
+	testutils.RequireResponseStatus(t, resp, http.StatusOK)
+	testutils.AssertResponseHeader(t, resp, "x-request-id", "42")
+	testutils.AssertResponseContentType(t, resp, "application/json")
+	testutils.AssertResponseJSON(t, resp, `{"roles": ["admin", "user"], "name": "alice", "id": 1, "address": {"zip": "75001", "city": "Paris"}}`)
+	testutils.AssertResponseJSONSubset(t, resp, `{"name": "alice", "address": {"city": "Paris"}}`)
+	testutils.AssertResponseJSONPath(t, resp, "$.address.city", "Paris")
+	testutils.AssertResponseJSONPath(t, resp, "$.roles[*]", []string{"admin", "user"})
+	testutils.AssertResponseBodyMatches(t, resp, `"name":\s*"al`)
+	testutils.RequireResponseJSONSchema(t, resp, userSchema)
+
+	t.Run("When the assertions fail", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, testutils.AssertResponseStatus(fakeT, resp, http.StatusCreated))
+		assert.False(t, testutils.AssertResponseHeader(fakeT, resp, "X-Request-Id", "43"))
+		assert.False(t, testutils.AssertResponseContentType(fakeT, resp, "text/plain"))
+		assert.False(t, testutils.AssertResponseJSON(fakeT, resp, `{"id": 1}`))
+		assert.False(t, testutils.AssertResponseJSONSubset(fakeT, resp, `{"address": {"city": "Lyon"}}`))
+		assert.False(t, testutils.AssertResponseJSONSubset(fakeT, resp, `{"roles": ["admin"]}`))
+		assert.False(t, testutils.AssertResponseJSONPath(fakeT, resp, "$.name", "bob"))
+		assert.False(t, testutils.AssertResponseBodyMatches(fakeT, resp, `"name":\s*"bob"`))
+		assert.False(t, testutils.AssertResponseJSONSchema(fakeT, resp, `{"properties": {"id": {"type": "string"}, "roles": {"maxItems": 1}}}`))
+		require.Len(t, fakeT.ErrorMessages, 9)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Expecting status 201 but got 200")
+		assert.Contains(t, fakeT.ErrorMessages[0], "response to GET https://api.example.com/users/1:")
+		assert.Contains(t, fakeT.ErrorMessages[0], "HTTP/1.1 200 OK")
+		assert.Contains(t, fakeT.ErrorMessages[0], `"name": "alice"`)
+		assert.Contains(t, fakeT.ErrorMessages[1], `Expecting header X-Request-Id to be "43" but got ["42"]`)
+		assert.Contains(t, fakeT.ErrorMessages[2], `Expecting content type text/plain but got "application/json; charset=utf-8"`)
+		assert.Contains(t, fakeT.ErrorMessages[3], `Expecting JSON body {"id": 1}`)
+		assert.Contains(t, fakeT.ErrorMessages[4], "mismatch at /address/city")
+		assert.Contains(t, fakeT.ErrorMessages[5], "mismatch at /roles")
+		assert.Contains(t, fakeT.ErrorMessages[6], `Expecting $.name to be "bob" but got "alice"`)
+		assert.Contains(t, fakeT.ErrorMessages[7], `Expecting the body to match "name":\s*"bob"`)
+		assert.Contains(t, fakeT.ErrorMessages[8], "/id: expected string, got integer")
+		assert.Contains(t, fakeT.ErrorMessages[8], "/roles: 2 items, expected at most 1")
+
+		fakeT = &testutils.FakeTest{}
+		testutils.RequireResponseJSONSubset(fakeT, resp, `{"id": 2}`)
+		assert.True(t, fakeT.Failed)
+	})
+
+	t.Run("The body can be read after the assertions", func(t *testing.T) {
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), `"name": "alice"`)
+	})
+
+	t.Run("When the body is not JSON", func(t *testing.T) {
+		resp := testutils.NewHTTPResponseBuilder().WithBody(io.NopCloser(strings.NewReader("not json"))).Build()
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, testutils.AssertResponseJSONPath(fakeT, resp, "$.id", 1))
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "invalid JSON body")
+		assert.Contains(t, fakeT.ErrorMessages[0], "not json")
+	})
+}
@@ -0,0 +1,223 @@
+package testutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	ContentEncodingGzip    = "gzip"
+	ContentEncodingDeflate = "deflate"
+	ContentEncodingBrotli  = "br"
+)
+
+// ServerSentEvent is an event of a text/event-stream body.
+type ServerSentEvent struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// String returns the event as sent on the wire, including the blank line ending it.
+func (e ServerSentEvent) String() string {
+	s := strings.Builder{}
+	if e.ID != "" {
+		fmt.Fprintf(&s, "id: %s\n", e.ID)
+	}
+	if e.Event != "" {
+		fmt.Fprintf(&s, "event: %s\n", e.Event)
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&s, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	for _, line := range strings.Split(e.Data, "\n") {
+		fmt.Fprintf(&s, "data: %s\n", line)
+	}
+	s.WriteString("\n")
+	return s.String()
+}
+
+// bodyBytes reads the body set so far.
+func (b *HTTPResponseBuilder) bodyBytes() []byte {
+	var body io.ReadCloser
+	switch {
+	case b.newBody != nil:
+		body = b.newBody()
+	case b.resp.Body != nil:
+		body = b.resp.Body
+	default:
+		return nil
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	b.noError(err)
+	return data
+}
+
+// WithContentEncoding compresses the body set so far with the encoding and sets the Content-Encoding header.
+//
+// Supported encodings are ContentEncodingGzip, ContentEncodingDeflate and ContentEncodingBrotli.
+func (b *HTTPResponseBuilder) WithContentEncoding(encoding string) *HTTPResponseBuilder {
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	data := b.bodyBytes()
+	compressed := bytes.Buffer{}
+	var writer io.WriteCloser
+	switch encoding {
+	case ContentEncodingGzip:
+		writer = gzip.NewWriter(&compressed)
+	case ContentEncodingDeflate:
+		writer = zlib.NewWriter(&compressed)
+	case ContentEncodingBrotli:
+		writer = brotli.NewWriter(&compressed)
+	default:
+		b.noError(fmt.Errorf("unsupported content encoding %q", encoding))
+		return b
+	}
+	_, err := writer.Write(data)
+	b.noError(err)
+	b.noError(writer.Close())
+	b.withBytesBody(compressed.Bytes(), "")
+	b.resp.Header.Set("Content-Encoding", encoding)
+	return b
+}
+
+// WithChunkedBody answers with a chunked body made of the chunks, waiting interval before each of them.
+func (b *HTTPResponseBuilder) WithChunkedBody(interval time.Duration, chunks ...string) *HTTPResponseBuilder {
+	b.resp.Body = nil
+	b.resp.ContentLength = -1
+	b.resp.TransferEncoding = []string{"chunked"}
+	b.static = nil
+	b.newBody = func() io.ReadCloser {
+		return &chunkedReader{interval: interval, chunks: chunks}
+	}
+	return b
+}
+
+type chunkedReader struct {
+	interval time.Duration
+	chunks   []string
+	current  []byte
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.current) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		time.Sleep(r.interval)
+		r.current = []byte(r.chunks[0])
+		r.chunks = r.chunks[1:]
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+func (r *chunkedReader) Close() error {
+	return nil
+}
+
+// WithFailingBody answers with a body returning the content, then failing with err.
+func (b *HTTPResponseBuilder) WithFailingBody(content string, err error) *HTTPResponseBuilder {
+	b.resp.Body = nil
+	b.resp.ContentLength = -1
+	b.static = nil
+	b.newBody = func() io.ReadCloser {
+		return io.NopCloser(io.MultiReader(strings.NewReader(content), errorReader{err}))
+	}
+	return b
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// WithServerSentEvents answers with a text/event-stream body streaming the events received on the channel.
+// The body ends when the channel is closed.
+//
+// When the response is answered several times, as by a MockTransport, the events are split between the responses.
+func (b *HTTPResponseBuilder) WithServerSentEvents(events <-chan ServerSentEvent) *HTTPResponseBuilder {
+	b.resp.Body = nil
+	b.resp.ContentLength = -1
+	b.resp.Header.Set("Content-Type", "text/event-stream")
+	b.resp.Header.Set("Cache-Control", "no-cache")
+	b.static = nil
+	b.newBody = func() io.ReadCloser {
+		return &eventStreamReader{events: events}
+	}
+	return b
+}
+
+type eventStreamReader struct {
+	events  <-chan ServerSentEvent
+	current []byte
+}
+
+func (r *eventStreamReader) Read(p []byte) (int, error) {
+	if len(r.current) == 0 {
+		event, ok := <-r.events
+		if !ok {
+			return 0, io.EOF
+		}
+		r.current = []byte(event.String())
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+func (r *eventStreamReader) Close() error {
+	return nil
+}
+
+// WithDeclaredContentLength declares a content length that may not match the body.
+//
+// Like the bodies read by an http.Client, the body stops after length bytes,
+// and fails with io.ErrUnexpectedEOF when it ends before.
+func (b *HTTPResponseBuilder) WithDeclaredContentLength(length int64) *HTTPResponseBuilder {
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	data := b.bodyBytes()
+	b.resp.Body = nil
+	b.resp.ContentLength = length
+	b.resp.TransferEncoding = nil
+	b.resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	b.static = nil
+	b.newBody = func() io.ReadCloser {
+		return io.NopCloser(&declaredLengthReader{reader: io.LimitReader(bytes.NewReader(data), length), remaining: length})
+	}
+	return b
+}
+
+type declaredLengthReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *declaredLengthReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package testutils_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPResponseBuilderContentEncoding(t *testing.T) {
+	for encoding, decompress := range map[string]func(io.Reader) (io.Reader, error){
+		testutils.ContentEncodingGzip:    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		testutils.ContentEncodingDeflate: func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+		testutils.ContentEncodingBrotli:  func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	} {
+		t.Run(encoding, func(t *testing.T) {
+			resp := testutils.NewHTTPResponseBuilder().WithTB(t).
+				WithJsonBody(map[string]string{"hello": "world"}).
+				WithContentEncoding(encoding).
+				Build()
+			assert.Equal(t, encoding, resp.Header.Get("Content-Encoding"))
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			compressed, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.EqualValues(t, len(compressed), resp.ContentLength)
+			reader, err := decompress(bytes.NewReader(compressed))
+			require.NoError(t, err)
+			body, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"hello":"world"}`, string(body))
+		})
+	}
+}
+
+func TestHTTPResponseBuilderStreamingBodies(t *testing.T) {
+	t.Run("When the body is chunked", func(t *testing.T) {
+		resp := testutils.NewHTTPResponseBuilder().WithChunkedBody(10*time.Millisecond, "first,", "second,", "third").Build()
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+		assert.EqualValues(t, -1, resp.ContentLength)
+		start := time.Now()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "first,second,third", string(body))
+		assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+	})
+
+	t.Run("When the body fails", func(t *testing.T) {
+		failure := errors.New("connection lost")
+		mock := testutils.NewMockTransport(t)
+		mock.On(http.MethodGet, "/download").Respond(testutils.NewHTTPResponseBuilder().WithFailingBody("partial", failure)).Times(2)
+		for i := 0; i < 2; i++ {
+			resp, err := mock.Client().Get("http://api.example.com/download")
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			assert.ErrorIs(t, err, failure)
+			assert.Equal(t, "partial", string(body))
+		}
+	})
+
+	t.Run("When the body streams server-sent events", func(t *testing.T) {
+		events := make(chan testutils.ServerSentEvent)
+		resp := testutils.NewHTTPResponseBuilder().WithServerSentEvents(events).Build()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		go func() {
+			events <- testutils.ServerSentEvent{ID: "1", Event: "greeting", Data: "hello"}
+			events <- testutils.ServerSentEvent{Data: "multi\nline", Retry: time.Second}
+			close(events)
+		}()
+		scanner := bufio.NewScanner(resp.Body)
+		lines := []string{}
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		require.NoError(t, scanner.Err())
+		assert.Equal(t, []string{"id: 1", "event: greeting", "data: hello", "", "retry: 1000", "data: multi", "data: line", ""}, lines)
+	})
+
+	t.Run("When the declared length is longer than the body", func(t *testing.T) {
+		resp := testutils.NewHTTPResponseBuilder().WithBody(testutils.StringBody("short")).WithDeclaredContentLength(10).Build()
+		assert.EqualValues(t, 10, resp.ContentLength)
+		assert.Equal(t, "10", resp.Header.Get("Content-Length"))
+		body, err := io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Equal(t, "short", string(body))
+	})
+
+	t.Run("When the declared length is shorter than the body", func(t *testing.T) {
+		resp := testutils.NewHTTPResponseBuilder().WithBody(testutils.StringBody("longer body")).WithDeclaredContentLength(6).Build()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "longer", string(body))
+	})
+}
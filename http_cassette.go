@@ -0,0 +1,345 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// CassetteMode defines how a CassetteTransport uses its cassette.
+type CassetteMode int
+
+const (
+	// CassetteReplay answers requests from the cassette only. Requests missing from the cassette fail the test.
+	CassetteReplay CassetteMode = iota
+	// CassetteRecord sends all the requests and records them in a new cassette.
+	CassetteRecord
+	// CassetteRecordIfMissing answers requests from the cassette and records the missing ones.
+	CassetteRecordIfMissing
+)
+
+// Redacted is the value replacing secrets in cassettes.
+const Redacted = "REDACTED"
+
+type CassetteRequest struct {
+	Method string      `yaml:"method"`
+	URL    string      `yaml:"url"`
+	Header http.Header `yaml:"headers,omitempty"`
+	Body   string      `yaml:"body,omitempty"`
+}
+
+type CassetteResponse struct {
+	StatusCode int         `yaml:"status"`
+	Header     http.Header `yaml:"headers,omitempty"`
+	Body       string      `yaml:"body,omitempty"`
+}
+
+type CassetteInteraction struct {
+	Request  CassetteRequest  `yaml:"request"`
+	Response CassetteResponse `yaml:"response"`
+}
+
+// Cassette is the content of a cassette file.
+type Cassette struct {
+	Interactions []CassetteInteraction `yaml:"interactions"`
+}
+
+// CassetteMatcher tells whether a request, redacted as it would be recorded, matches a recorded request.
+type CassetteMatcher func(actual, recorded CassetteRequest) bool
+
+// MatchCassetteMethodAndURL matches requests with the same method and URL. It is the default matcher.
+func MatchCassetteMethodAndURL(actual, recorded CassetteRequest) bool {
+	return actual.Method == recorded.Method && actual.URL == recorded.URL
+}
+
+// MatchCassetteMethodURLAndBody matches requests with the same method, URL and body.
+func MatchCassetteMethodURLAndBody(actual, recorded CassetteRequest) bool {
+	return MatchCassetteMethodAndURL(actual, recorded) && actual.Body == recorded.Body
+}
+
+// CassetteTransport records HTTP interactions in a YAML cassette and replays them.
+//
+//	transport := testutils.NewCassetteTransport(t, afero.NewOsFs(), "testdata/users.yaml", testutils.CassetteRecordIfMissing).
+//		WithRedactedHeaders("Authorization").
+//		WithRedactedJSONFields("access_token")
+//	client := &http.Client{Transport: transport}
+//
+// Secrets are redacted before being written, and requests are redacted the same way before being matched.
+type CassetteTransport struct {
+	Transport http.RoundTripper
+
+	t                       require.TestingT
+	fs                      afero.Fs
+	path                    string
+	mode                    CassetteMode
+	matcher                 CassetteMatcher
+	redactedHeaders         []string
+	redactedQueryParameters []string
+	redactedJSONFields      []string
+
+	mu       sync.Mutex
+	cassette Cassette
+	replayed []bool
+}
+
+// CassetteTransport should implement the http.RoundTripper interface
+var _ http.RoundTripper = &CassetteTransport{}
+
+// NewCassetteTransport creates a transport using the cassette at path.
+// Recorded requests are sent with http.DefaultTransport.
+func NewCassetteTransport(t require.TestingT, fs afero.Fs, path string, mode CassetteMode) *CassetteTransport {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	c := &CassetteTransport{
+		Transport: http.DefaultTransport,
+		t:         t,
+		fs:        fs,
+		path:      path,
+		mode:      mode,
+		matcher:   MatchCassetteMethodAndURL,
+	}
+	if mode != CassetteRecord {
+		data, err := afero.ReadFile(fs, path)
+		switch {
+		case err == nil:
+			require.NoError(t, yaml.Unmarshal(data, &c.cassette), "invalid cassette %s", path)
+		case mode == CassetteReplay:
+			require.NoError(t, err, "cassette %s can't be replayed", path)
+		}
+	}
+	c.replayed = make([]bool, len(c.cassette.Interactions))
+	return c
+}
+
+func (c *CassetteTransport) WithTransport(transport http.RoundTripper) *CassetteTransport {
+	c.Transport = transport
+	return c
+}
+
+func (c *CassetteTransport) WithMatcher(matcher CassetteMatcher) *CassetteTransport {
+	c.matcher = matcher
+	return c
+}
+
+func (c *CassetteTransport) WithRedactedHeaders(names ...string) *CassetteTransport {
+	c.redactedHeaders = append(c.redactedHeaders, names...)
+	return c
+}
+
+func (c *CassetteTransport) WithRedactedQueryParameters(names ...string) *CassetteTransport {
+	c.redactedQueryParameters = append(c.redactedQueryParameters, names...)
+	return c
+}
+
+// WithRedactedJSONFields redacts the values of the JSON object members with these names, at any depth,
+// in request and response bodies.
+func (c *CassetteTransport) WithRedactedJSONFields(names ...string) *CassetteTransport {
+	c.redactedJSONFields = append(c.redactedJSONFields, names...)
+	return c
+}
+
+// Cassette returns the interactions currently in the cassette.
+func (c *CassetteTransport) Cassette() Cassette {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Cassette{Interactions: append([]CassetteInteraction{}, c.cassette.Interactions...)}
+}
+
+func (c *CassetteTransport) redactHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	header = header.Clone()
+	for _, name := range c.redactedHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			for i := range values {
+				values[i] = Redacted
+			}
+		}
+	}
+	return header
+}
+
+func (c *CassetteTransport) redactURL(u *url.URL) string {
+	if len(c.redactedQueryParameters) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+	redacted := *u
+	query := u.Query()
+	for _, name := range c.redactedQueryParameters {
+		if values, ok := query[name]; ok {
+			for i := range values {
+				values[i] = Redacted
+			}
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+func (c *CassetteTransport) redactBody(body []byte) string {
+	if len(c.redactedJSONFields) == 0 {
+		return string(body)
+	}
+	var document interface{}
+	if json.Unmarshal(body, &document) != nil {
+		return string(body)
+	}
+	if !redactJSONFields(document, c.redactedJSONFields) {
+		return string(body)
+	}
+	redacted, err := json.Marshal(document)
+	if err != nil {
+		return string(body)
+	}
+	return string(redacted)
+}
+
+func redactJSONFields(document interface{}, names []string) bool {
+	redacted := false
+	switch value := document.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if containsString(names, key) {
+				value[key] = Redacted
+				redacted = true
+				continue
+			}
+			redacted = redactJSONFields(child, names) || redacted
+		}
+	case []interface{}:
+		for _, child := range value {
+			redacted = redactJSONFields(child, names) || redacted
+		}
+	}
+	return redacted
+}
+
+func (c *CassetteTransport) cassetteRequest(req *http.Request, body []byte) CassetteRequest {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	return CassetteRequest{
+		Method: method,
+		URL:    c.redactURL(req.URL),
+		Header: c.redactHeader(req.Header),
+		Body:   c.redactBody(body),
+	}
+}
+
+// find returns the first interaction matching the request not replayed yet, or the last matching one.
+func (c *CassetteTransport) find(actual CassetteRequest) int {
+	found := -1
+	for i, interaction := range c.cassette.Interactions {
+		if !c.matcher(actual, interaction.Request) {
+			continue
+		}
+		if !c.replayed[i] {
+			return i
+		}
+		found = i
+	}
+	return found
+}
+
+func (c *CassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	actual := c.cassetteRequest(req, body)
+
+	c.mu.Lock()
+	if c.mode != CassetteRecord {
+		if i := c.find(actual); i >= 0 {
+			c.replayed[i] = true
+			response := c.cassette.Interactions[i].Response
+			c.mu.Unlock()
+			return replayCassetteResponse(req, response), nil
+		}
+	}
+	c.mu.Unlock()
+
+	if c.mode == CassetteReplay {
+		if h, ok := c.t.(TestHelper); ok {
+			h.Helper()
+		}
+		assert.Fail(c.t, fmt.Sprintf("No interaction of cassette %s matches the request %s", c.path, describeRequest(req)))
+		return nil, fmt.Errorf("no interaction of cassette %s matches %s", c.path, describeRequest(req))
+	}
+
+	resp, err := c.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cassette.Interactions = append(c.cassette.Interactions, CassetteInteraction{
+		Request: actual,
+		Response: CassetteResponse{
+			StatusCode: resp.StatusCode,
+			Header:     c.redactHeader(resp.Header),
+			Body:       c.redactBody(respBody),
+		},
+	})
+	c.replayed = append(c.replayed, true)
+	if err := c.save(); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *CassetteTransport) save() error {
+	data, err := yaml.Marshal(c.cassette)
+	if err != nil {
+		return err
+	}
+	if err := c.fs.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return afero.WriteFile(c.fs, c.path, data, 0644)
+}
+
+func replayCassetteResponse(req *http.Request, response CassetteResponse) *http.Response {
+	header := response.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if header.Get("Content-Length") != "" {
+		// redacted bodies can be shorter or longer than the recorded ones
+		header.Set("Content-Length", strconv.Itoa(len(response.Body)))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode)),
+		StatusCode:    response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(response.Body)),
+		ContentLength: int64(len(response.Body)),
+		Request:       req,
+	}
+}
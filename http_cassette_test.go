@@ -0,0 +1,123 @@
+package testutils_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCassetteTransport(t *testing.T) {
+	calls := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret-session")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"path":         r.URL.Path,
+			"access_token": "secret-token",
+			"request_size": len(body),
+		})
+	}))
+	defer server.Close()
+
+	fs := afero.NewMemMapFs()
+	newTransport := func(t require.TestingT, mode testutils.CassetteMode) *testutils.CassetteTransport {
+		return testutils.NewCassetteTransport(t, fs, "/testdata/cassettes/api.yaml", mode).
+			WithRedactedHeaders("Authorization", "Set-Cookie").
+			WithRedactedQueryParameters("api_key").
+			WithRedactedJSONFields("access_token", "password")
+	}
+	get := func(t *testing.T, client *http.Client, path string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret-bearer")
+		return client.Do(req)
+	}
+
+	t.Run("When recording", func(t *testing.T) {
+		client := &http.Client{Transport: newTransport(t, testutils.CassetteRecord)}
+		resp, err := get(t, client, "/users?api_key=secret-key&page=1")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "secret-token")
+
+		resp, err = client.Post(server.URL+"/login", "application/json", strings.NewReader(`{"user":"alice","password":"secret-password"}`))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		data, err := afero.ReadFile(fs, "/testdata/cassettes/api.yaml")
+		require.NoError(t, err)
+		for _, secret := range []string{"secret-key", "secret-token", "secret-bearer", "secret-session", "secret-password"} {
+			assert.NotContains(t, string(data), secret)
+		}
+		assert.Contains(t, string(data), "api_key=REDACTED&page=1")
+		assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	})
+
+	t.Run("When replaying", func(t *testing.T) {
+		transport := newTransport(t, testutils.CassetteReplay)
+		require.Len(t, transport.Cassette().Interactions, 2)
+		client := &http.Client{Transport: transport}
+		resp, err := get(t, client, "/users?api_key=another-key&page=1")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, testutils.Redacted, resp.Header.Get("Set-Cookie"))
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"path":"/users","access_token":"REDACTED","request_size":0}`, string(body))
+		assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+		fakeT := &testutils.FakeTest{}
+		client = &http.Client{Transport: newTransport(fakeT, testutils.CassetteReplay)}
+		_, err = get(t, client, "/groups")
+		require.Error(t, err)
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "No interaction of cassette /testdata/cassettes/api.yaml matches the request GET "+server.URL+"/groups")
+	})
+
+	t.Run("When recording missing interactions", func(t *testing.T) {
+		client := &http.Client{Transport: newTransport(t, testutils.CassetteRecordIfMissing)}
+		_, err := get(t, client, "/users?api_key=secret-key&page=1")
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+
+		_, err = get(t, client, "/groups")
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+
+		assert.Len(t, newTransport(t, testutils.CassetteReplay).Cassette().Interactions, 3)
+	})
+
+	t.Run("When matching request bodies", func(t *testing.T) {
+		transport := newTransport(t, testutils.CassetteReplay).WithMatcher(testutils.MatchCassetteMethodURLAndBody)
+		client := &http.Client{Transport: transport}
+		resp, err := client.Post(server.URL+"/login", "application/json", strings.NewReader(`{"password":"other-password","user":"alice"}`))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		fakeT := &testutils.FakeTest{}
+		transport = newTransport(fakeT, testutils.CassetteReplay).WithMatcher(testutils.MatchCassetteMethodURLAndBody)
+		client = &http.Client{Transport: transport}
+		_, err = client.Post(server.URL+"/login", "application/json", strings.NewReader(`{"user":"bob","password":"secret-password"}`))
+		require.Error(t, err)
+		assert.Len(t, fakeT.ErrorMessages, 1)
+	})
+
+	t.Run("When the cassette to replay is missing", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		testutils.NewCassetteTransport(fakeT, fs, "/missing.yaml", testutils.CassetteReplay)
+		assert.True(t, fakeT.Failed)
+	})
+}
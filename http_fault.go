@@ -0,0 +1,241 @@
+package testutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Fault is a failure injected by a FaultTransport.
+type Fault int
+
+const (
+	FaultNone Fault = iota
+	// FaultConnectionReset makes the request fail with ErrConnectionReset.
+	FaultConnectionReset
+	// FaultTimeout makes the request hang until its context is done or the configured timeout expires.
+	FaultTimeout
+	// FaultTruncatedBody cuts the response body in half, reading it then fails with io.ErrUnexpectedEOF.
+	FaultTruncatedBody
+	// FaultServerError replaces the response with a server error.
+	FaultServerError
+)
+
+func (f Fault) String() string {
+	switch f {
+	case FaultNone:
+		return "none"
+	case FaultConnectionReset:
+		return "connection reset"
+	case FaultTimeout:
+		return "timeout"
+	case FaultTruncatedBody:
+		return "truncated body"
+	case FaultServerError:
+		return "server error"
+	}
+	return "Fault(" + strconv.Itoa(int(f)) + ")"
+}
+
+// ErrConnectionReset is returned for FaultConnectionReset. It matches syscall.ECONNRESET with errors.Is.
+var ErrConnectionReset error = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+type faultTimeoutError struct{}
+
+func (faultTimeoutError) Error() string   { return "i/o timeout (injected)" }
+func (faultTimeoutError) Timeout() bool   { return true }
+func (faultTimeoutError) Temporary() bool { return true }
+
+// ErrFaultTimeout is returned for FaultTimeout when the request context is not done first.
+// It is a net.Error whose Timeout method returns true.
+var ErrFaultTimeout net.Error = faultTimeoutError{}
+
+// FaultTransport injects faults in the requests going through the wrapped transport.
+//
+// The random faults are drawn from the seed, so that a given sequence of requests always gets the same faults:
+//
+//	transport := testutils.NewFaultTransport(mock, 42).
+//		FailFirst(2, testutils.FaultServerError).
+//		WithConnectionResets(0.1)
+type FaultTransport struct {
+	Transport http.RoundTripper
+
+	mu                sync.Mutex
+	rand              *rand.Rand
+	latency           time.Duration
+	jitter            time.Duration
+	timeout           time.Duration
+	serverErrorStatus int
+	rates             map[Fault]float64
+	schedule          []Fault
+	injected          []Fault
+}
+
+// FaultTransport should implement the http.RoundTripper interface
+var _ http.RoundTripper = &FaultTransport{}
+
+// NewFaultTransport wraps the transport. When the transport is nil, http.DefaultTransport is used.
+func NewFaultTransport(transport http.RoundTripper, seed int64) *FaultTransport {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &FaultTransport{
+		Transport:         transport,
+		rand:              rand.New(rand.NewSource(seed)),
+		timeout:           time.Minute,
+		serverErrorStatus: http.StatusServiceUnavailable,
+		rates:             map[Fault]float64{},
+	}
+}
+
+// WithLatency delays every request by latency plus a random duration up to jitter.
+// The delay is interrupted when the request context is done.
+func (f *FaultTransport) WithLatency(latency, jitter time.Duration) *FaultTransport {
+	f.latency = latency
+	f.jitter = jitter
+	return f
+}
+
+// WithConnectionResets injects FaultConnectionReset in the given ratio of requests, between 0 and 1.
+func (f *FaultTransport) WithConnectionResets(rate float64) *FaultTransport {
+	f.rates[FaultConnectionReset] = rate
+	return f
+}
+
+// WithTimeouts injects FaultTimeout in the given ratio of requests.
+// Requests hang until their context is done, or fail with ErrFaultTimeout after timeout.
+func (f *FaultTransport) WithTimeouts(rate float64, timeout time.Duration) *FaultTransport {
+	f.rates[FaultTimeout] = rate
+	f.timeout = timeout
+	return f
+}
+
+// WithTruncatedBodies injects FaultTruncatedBody in the given ratio of requests.
+func (f *FaultTransport) WithTruncatedBodies(rate float64) *FaultTransport {
+	f.rates[FaultTruncatedBody] = rate
+	return f
+}
+
+// WithServerErrors injects FaultServerError in the given ratio of requests, answering with the status code.
+func (f *FaultTransport) WithServerErrors(rate float64, status int) *FaultTransport {
+	f.rates[FaultServerError] = rate
+	f.serverErrorStatus = status
+	return f
+}
+
+// WithSchedule forces the faults of the first requests, one per request.
+// FaultNone lets the request through, subject to the random faults.
+func (f *FaultTransport) WithSchedule(faults ...Fault) *FaultTransport {
+	f.schedule = append(f.schedule, faults...)
+	return f
+}
+
+// FailFirst makes the next n scheduled requests fail with the fault.
+func (f *FaultTransport) FailFirst(n int, fault Fault) *FaultTransport {
+	for i := 0; i < n; i++ {
+		f.schedule = append(f.schedule, fault)
+	}
+	return f
+}
+
+// Faults returns the fault injected in each request, in the order the requests were sent.
+func (f *FaultTransport) Faults() []Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Fault{}, f.injected...)
+}
+
+// Calls returns the number of requests sent through the transport.
+func (f *FaultTransport) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.injected)
+}
+
+// next draws the fault and the latency of the next request.
+func (f *FaultTransport) next() (Fault, time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	latency := f.latency
+	if f.jitter > 0 {
+		latency += time.Duration(f.rand.Int63n(int64(f.jitter)))
+	}
+	fault := FaultNone
+	if call := len(f.injected); call < len(f.schedule) {
+		fault = f.schedule[call]
+	}
+	// always draw the same number of values so the faults only depend on the seed and the request rank
+	for _, candidate := range []Fault{FaultConnectionReset, FaultTimeout, FaultServerError, FaultTruncatedBody} {
+		draw := f.rand.Float64()
+		if fault == FaultNone && draw < f.rates[candidate] {
+			fault = candidate
+		}
+	}
+	f.injected = append(f.injected, fault)
+	return fault, latency
+}
+
+func (f *FaultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fault, latency := f.next()
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+
+	switch fault {
+	case FaultConnectionReset:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrConnectionReset
+	case FaultTimeout:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		timer := time.NewTimer(f.timeout)
+		defer timer.Stop()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-timer.C:
+			return nil, ErrFaultTimeout
+		}
+	case FaultServerError:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return NewHTTPResponseBuilder().
+			WithRequest(req).
+			WithStatusCode(f.serverErrorStatus).
+			WithBody(StringBody(fmt.Sprintf("injected %s", http.StatusText(f.serverErrorStatus)))).
+			Build(), nil
+	}
+
+	resp, err := f.Transport.RoundTrip(req)
+	if err != nil || fault != FaultTruncatedBody || resp.Body == nil {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body[:len(body)/2]), errorReader{io.ErrUnexpectedEOF}))
+	return resp, nil
+}
@@ -0,0 +1,126 @@
+package testutils_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func okTransport() http.RoundTripper {
+	return testutils.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK).WithBody(testutils.StringBody("0123456789")).Build(), nil
+	})
+}
+
+func TestFaultTransport(t *testing.T) {
+	t.Run("When failing the first calls", func(t *testing.T) {
+		transport := testutils.NewFaultTransport(okTransport(), 1).FailFirst(2, testutils.FaultServerError)
+		client := &http.Client{Transport: transport}
+		for _, expected := range []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK} {
+			resp, err := client.Get("http://api.example.com/")
+			require.NoError(t, err)
+			assert.Equal(t, expected, resp.StatusCode)
+		}
+		assert.Equal(t, []testutils.Fault{testutils.FaultServerError, testutils.FaultServerError, testutils.FaultNone}, transport.Faults())
+	})
+
+	t.Run("When resetting connections", func(t *testing.T) {
+		transport := testutils.NewFaultTransport(okTransport(), 1).WithSchedule(testutils.FaultConnectionReset)
+		_, err := (&http.Client{Transport: transport}).Get("http://api.example.com/")
+		require.Error(t, err)
+		assert.ErrorIs(t, err, syscall.ECONNRESET)
+	})
+
+	t.Run("When timing out", func(t *testing.T) {
+		transport := testutils.NewFaultTransport(okTransport(), 1).WithTimeouts(1, time.Millisecond)
+		_, err := (&http.Client{Transport: transport}).Get("http://api.example.com/")
+		require.Error(t, err)
+		netErr := net.Error(nil)
+		require.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout())
+
+		transport = testutils.NewFaultTransport(okTransport(), 1).WithTimeouts(1, time.Hour)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://api.example.com/", nil)
+		require.NoError(t, err)
+		start := time.Now()
+		_, err = transport.RoundTrip(req)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), time.Minute)
+	})
+
+	t.Run("When failing requests with a body", func(t *testing.T) {
+		for _, transport := range []*testutils.FaultTransport{
+			testutils.NewFaultTransport(okTransport(), 1).WithSchedule(testutils.FaultConnectionReset),
+			testutils.NewFaultTransport(okTransport(), 1).WithTimeouts(1, time.Millisecond),
+		} {
+			body := &closeRecorder{Reader: strings.NewReader("payload")}
+			req, err := http.NewRequest(http.MethodPost, "http://api.example.com/", body)
+			require.NoError(t, err)
+			_, err = transport.RoundTrip(req)
+			require.Error(t, err)
+			assert.True(t, body.closed, "expecting the request body to be closed on %v", err)
+		}
+	})
+
+	t.Run("When truncating bodies", func(t *testing.T) {
+		transport := testutils.NewFaultTransport(okTransport(), 1).WithTruncatedBodies(1)
+		resp, err := (&http.Client{Transport: transport}).Get("http://api.example.com/")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Equal(t, "01234", string(body))
+	})
+
+	t.Run("When adding latency", func(t *testing.T) {
+		transport := testutils.NewFaultTransport(okTransport(), 1).WithLatency(20*time.Millisecond, 0)
+		start := time.Now()
+		_, err := (&http.Client{Transport: transport}).Get("http://api.example.com/")
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	})
+
+	t.Run("When injecting faults at random", func(t *testing.T) {
+		faults := func(seed int64) []testutils.Fault {
+			transport := testutils.NewFaultTransport(okTransport(), seed).WithServerErrors(0.3, http.StatusBadGateway).WithConnectionResets(0.2)
+			client := &http.Client{Transport: transport}
+			for i := 0; i < 50; i++ {
+				resp, err := client.Get("http://api.example.com/")
+				if err != nil {
+					assert.True(t, errors.Is(err, syscall.ECONNRESET))
+					continue
+				}
+				assert.Contains(t, []int{http.StatusOK, http.StatusBadGateway}, resp.StatusCode)
+			}
+			assert.Equal(t, 50, transport.Calls())
+			return transport.Faults()
+		}
+		first := faults(42)
+		assert.Equal(t, first, faults(42))
+		assert.NotEqual(t, first, faults(43))
+		assert.Contains(t, first, testutils.FaultServerError)
+		assert.Contains(t, first, testutils.FaultConnectionReset)
+		assert.Contains(t, first, testutils.FaultNone)
+	})
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
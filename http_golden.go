@@ -0,0 +1,194 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// GoldenIgnored replaces the values ignored in golden files.
+const GoldenIgnored = "<ignored>"
+
+// UpdateGoldenEnv is the environment variable rewriting golden files when set to true.
+const UpdateGoldenEnv = "UPDATE_GOLDEN"
+
+type goldenOptions struct {
+	ignoredHeaders []string
+	ignoredFields  []string
+}
+
+// GoldenOption customizes the serialization of responses by AssertHTTPGolden.
+type GoldenOption func(*goldenOptions)
+
+// IgnoreGoldenHeaders replaces the values of the headers with GoldenIgnored. The Date header is always ignored.
+func IgnoreGoldenHeaders(names ...string) GoldenOption {
+	return func(o *goldenOptions) {
+		o.ignoredHeaders = append(o.ignoredHeaders, names...)
+	}
+}
+
+// IgnoreGoldenJSONFields replaces the values of JSON fields with GoldenIgnored.
+// Fields are either JSON pointers like "/meta/requestId", or member names like "createdAt" ignored at any depth.
+func IgnoreGoldenJSONFields(fields ...string) GoldenOption {
+	return func(o *goldenOptions) {
+		o.ignoredFields = append(o.ignoredFields, fields...)
+	}
+}
+
+// updateGolden tells whether golden files must be rewritten, with the -update flag of the test binary
+// or the UPDATE_GOLDEN environment variable.
+func updateGolden() bool {
+	if f := flag.Lookup("update"); f != nil {
+		if update, err := strconv.ParseBool(f.Value.String()); err == nil && update {
+			return true
+		}
+	}
+	update, _ := strconv.ParseBool(os.Getenv(UpdateGoldenEnv))
+	return update
+}
+
+// goldenResponse serializes the response with its status line, its sorted headers and its body,
+// pretty-printed when it is JSON.
+func goldenResponse(resp *http.Response, options goldenOptions) (string, error) {
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return "", err
+	}
+	ignored := map[string]bool{"Date": true}
+	for _, name := range options.ignoredHeaders {
+		ignored[http.CanonicalHeaderKey(name)] = true
+	}
+	names := []string{}
+	for name := range resp.Header {
+		// the body is reformatted
+		if http.CanonicalHeaderKey(name) != "Content-Length" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	s := fmt.Sprintf("%s %d %s\n", proto, resp.StatusCode, http.StatusText(resp.StatusCode))
+	for _, name := range names {
+		for _, value := range resp.Header[name] {
+			if ignored[http.CanonicalHeaderKey(name)] {
+				value = GoldenIgnored
+			}
+			s += fmt.Sprintf("%s: %s\n", http.CanonicalHeaderKey(name), value)
+		}
+	}
+	if len(body) == 0 {
+		return s, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var document interface{}
+	if strings.Contains(mediaType, "json") && json.Unmarshal(body, &document) == nil {
+		pretty := &bytes.Buffer{}
+		encoder := json.NewEncoder(pretty)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(ignoreGoldenFields(document, options.ignoredFields)); err != nil {
+			return "", err
+		}
+		body = pretty.Bytes()
+	}
+	return s + "\n" + strings.TrimRight(string(body), "\n") + "\n", nil
+}
+
+func ignoreGoldenFields(document interface{}, fields []string) interface{} {
+	names := map[string]bool{}
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "/") {
+			names[field] = true
+			continue
+		}
+		if _, err := jsonPointerGet(document, field); err == nil {
+			document, _ = jsonPointerSet(document, field, GoldenIgnored, false)
+		}
+	}
+	var ignore func(value interface{})
+	ignore = func(value interface{}) {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			for name, child := range value {
+				if names[name] {
+					value[name] = GoldenIgnored
+					continue
+				}
+				ignore(child)
+			}
+		case []interface{}:
+			for _, child := range value {
+				ignore(child)
+			}
+		}
+	}
+	ignore(document)
+	return document
+}
+
+// AssertHTTPGolden asserts that the response matches the golden file, which contains its status,
+// its headers and its body, pretty-printed when it is JSON.
+//
+// Golden files are written instead of being compared when the test binary runs with an -update flag,
+// which the test package must declare, or when UPDATE_GOLDEN is true:
+//
+//	var _ = flag.Bool("update", false, "update the golden files")
+//
+// The body of the response is restored so it can be read again.
+func AssertHTTPGolden(t assert.TestingT, fs afero.Fs, path string, resp *http.Response, options ...GoldenOption) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	opts := goldenOptions{}
+	for _, option := range options {
+		option(&opts)
+	}
+	actual, err := goldenResponse(resp, opts)
+	if err != nil {
+		return assert.Fail(t, fmt.Sprintf("Unable to read the response: %s", err))
+	}
+	if updateGolden() {
+		if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return assert.Fail(t, fmt.Sprintf("Unable to update golden file %s: %s", path, err))
+		}
+		if err := afero.WriteFile(fs, path, []byte(actual), 0644); err != nil {
+			return assert.Fail(t, fmt.Sprintf("Unable to update golden file %s: %s", path, err))
+		}
+		return true
+	}
+	expected, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return assert.Fail(t, fmt.Sprintf("Unable to read golden file %s, run the test with -update or %s=true to create it: %s", path, UpdateGoldenEnv, err))
+	}
+	if string(expected) != actual {
+		return assert.Fail(t, fmt.Sprintf("Expecting the response to match golden file %s:\n%s", path, unifiedDiff(path, "actual", strings.TrimRight(string(expected), "\n"), strings.TrimRight(actual, "\n"))))
+	}
+	return true
+}
+
+func RequireHTTPGolden(t require.TestingT, fs afero.Fs, path string, resp *http.Response, options ...GoldenOption) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if AssertHTTPGolden(t, fs, path, resp, options...) {
+		return
+	}
+	t.FailNow()
+}
@@ -0,0 +1,98 @@
+package testutils_test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func goldenOrderResponse(requestID, createdAt string, total float64) *http.Response {
+	return testutils.NewHTTPResponseBuilder().
+		WithStatusCode(http.StatusCreated).
+		WithHeader("Date", "Mon, 02 Jan 2006 15:04:05 GMT").
+		WithHeader("X-Request-Id", requestID).
+		WithHeader("Content-Length", "120").
+		WithJsonBody(map[string]interface{}{
+			"id":        "ord-1",
+			"total":     total,
+			"createdAt": createdAt,
+			"items":     []map[string]interface{}{{"sku": "book", "createdAt": createdAt}},
+			"meta":      map[string]string{"requestId": requestID},
+		}).
+		Build()
+}
+
+func TestHTTPGolden(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	options := []testutils.GoldenOption{
+		testutils.IgnoreGoldenHeaders("x-request-id"),
+		testutils.IgnoreGoldenJSONFields("createdAt", "/meta/requestId"),
+	}
+
+	t.Run("When the golden file is missing", func(t *testing.T) {
+		t.Setenv(testutils.UpdateGoldenEnv, "false")
+		fakeT := &testutils.FakeTest{}
+		testutils.RequireHTTPGolden(fakeT, fs, "/testdata/order.golden", goldenOrderResponse("1", "2024-01-01", 10), options...)
+		assert.True(t, fakeT.Failed)
+		require.NotEmpty(t, fakeT.ErrorMessages)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Unable to read golden file /testdata/order.golden, run the test with -update or UPDATE_GOLDEN=true to create it")
+	})
+
+	t.Run("Updating the golden file", func(t *testing.T) {
+		t.Setenv(testutils.UpdateGoldenEnv, "true")
+		resp := goldenOrderResponse("1", "2024-01-01", 10)
+		testutils.RequireHTTPGolden(t, fs, "/testdata/order.golden", resp, options...)
+		testutils.AssertFileContents(t, fs, "/testdata/order.golden", `HTTP/1.1 201 Created
+Content-Type: application/json
+Date: <ignored>
+X-Request-Id: <ignored>
+
+{
+  "createdAt": "<ignored>",
+  "id": "ord-1",
+  "items": [
+    {
+      "createdAt": "<ignored>",
+      "sku": "book"
+    }
+  ],
+  "meta": {
+    "requestId": "<ignored>"
+  },
+  "total": 10
+}
+`)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), `"id":"ord-1"`)
+	})
+
+	t.Run("Comparing with the golden file", func(t *testing.T) {
+		t.Setenv(testutils.UpdateGoldenEnv, "false")
+		testutils.AssertHTTPGolden(t, fs, "/testdata/order.golden", goldenOrderResponse("2", "2024-02-02", 10), options...)
+
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, testutils.AssertHTTPGolden(fakeT, fs, "/testdata/order.golden", goldenOrderResponse("2", "2024-02-02", 12), options...))
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Expecting the response to match golden file /testdata/order.golden:")
+		assert.Contains(t, fakeT.ErrorMessages[0], `-  "total": 10`)
+		assert.Contains(t, fakeT.ErrorMessages[0], `+  "total": 12`)
+
+		fakeT = &testutils.FakeTest{}
+		assert.False(t, testutils.AssertHTTPGolden(fakeT, fs, "/testdata/order.golden", goldenOrderResponse("2", "2024-02-02", 10)))
+		require.NotEmpty(t, fakeT.ErrorMessages)
+		assert.Contains(t, fakeT.ErrorMessages[0], "+X-Request-Id: 2")
+	})
+
+	t.Run("Text bodies", func(t *testing.T) {
+		t.Setenv(testutils.UpdateGoldenEnv, "1")
+		resp := testutils.NewHTTPResponseBuilder().WithHeader("Content-Type", "text/plain").WithBody(testutils.StringBody("hello")).Build()
+		testutils.AssertHTTPGolden(t, fs, "/testdata/hello.golden", resp)
+		testutils.AssertFileContents(t, fs, "/testdata/hello.golden", "HTTP/1.1 200 OK\nContent-Type: text/plain\n\nhello\n")
+	})
+}
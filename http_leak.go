@@ -0,0 +1,126 @@
+package testutils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const packagePath = "github.com/adevinta/go-testutils-toolkit"
+
+// BodyLeakDetector tracks response bodies and fails the test for each body that was never closed,
+// or closed before being read until its end.
+//
+//	leaks := testutils.NewBodyLeakDetector(t)
+//	mock := testutils.NewMockTransport(t).WithBodyLeakDetector(leaks)
+//	client := &http.Client{Transport: leaks.Transport(http.DefaultTransport)}
+type BodyLeakDetector struct {
+	mu     sync.Mutex
+	bodies []*trackedBody
+}
+
+// NewBodyLeakDetector creates a detector checking the tracked bodies when the test completes.
+func NewBodyLeakDetector(t CleanupTest) *BodyLeakDetector {
+	t.Helper()
+	d := &BodyLeakDetector{}
+	t.Cleanup(func() {
+		d.AssertNoLeaks(t)
+	})
+	return d
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	callSite string
+	mu       sync.Mutex
+	drained  bool
+	closed   bool
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.mu.Lock()
+		b.drained = true
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// callSite returns the location of the first caller outside of this package and of net/http.
+func callSite() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		internal := strings.HasPrefix(frame.Function, packagePath+".") || strings.HasPrefix(frame.Function, "net/http.")
+		if !internal || !more {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+	}
+}
+
+// Track returns a body tracked by the detector, recording the call site of the code requesting it.
+// Empty bodies are not tracked.
+func (d *BodyLeakDetector) Track(body io.ReadCloser) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	if _, ok := body.(*trackedBody); ok {
+		return body
+	}
+	tracked := &trackedBody{ReadCloser: body, callSite: callSite()}
+	d.mu.Lock()
+	d.bodies = append(d.bodies, tracked)
+	d.mu.Unlock()
+	return tracked
+}
+
+// Transport wraps the transport so the bodies of its responses are tracked.
+func (d *BodyLeakDetector) Transport(transport http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := transport.RoundTrip(req)
+		if resp != nil {
+			resp.Body = d.Track(resp.Body)
+		}
+		return resp, err
+	})
+}
+
+// AssertNoLeaks asserts that all the tracked bodies were read until their end and closed.
+//
+// It is called automatically when the test completes.
+func (d *BodyLeakDetector) AssertNoLeaks(t assert.TestingT) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	leaks := []string{}
+	for _, body := range d.bodies {
+		body.mu.Lock()
+		switch {
+		case !body.closed:
+			leaks = append(leaks, fmt.Sprintf("\t%s: body never closed", body.callSite))
+		case !body.drained:
+			leaks = append(leaks, fmt.Sprintf("\t%s: body closed before being fully read", body.callSite))
+		}
+		body.mu.Unlock()
+	}
+	if len(leaks) > 0 {
+		return assert.Fail(t, fmt.Sprintf("Expecting all response bodies to be read and closed, but %d leaked:\n%s", len(leaks), strings.Join(leaks, "\n")))
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package testutils_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyLeakDetector(t *testing.T) {
+	t.Run("When the bodies are read and closed", func(t *testing.T) {
+		leaks := testutils.NewBodyLeakDetector(t)
+		mock := testutils.NewMockTransport(t).WithBodyLeakDetector(leaks)
+		mock.On(http.MethodGet, "/users").Respond(testutils.NewHTTPResponseBuilder().WithJsonBody([]string{"alice"})).Times(2)
+		mock.On(http.MethodGet, "/empty").Respond(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusNoContent))
+
+		for i := 0; i < 2; i++ {
+			resp, err := mock.Client().Get("http://api.example.com/users")
+			require.NoError(t, err)
+			_, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		_, err := mock.Client().Get("http://api.example.com/empty")
+		require.NoError(t, err)
+
+		resp := testutils.NewHTTPResponseBuilder().WithBodyLeakDetector(leaks).WithBody(testutils.StringBody("body")).Build()
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	})
+
+	t.Run("When bodies leak", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		leaks := testutils.NewBodyLeakDetector(fakeT)
+		mock := testutils.NewMockTransport(t).WithBodyLeakDetector(leaks)
+		mock.On(http.MethodGet, "/users").Respond(testutils.NewHTTPResponseBuilder().WithJsonBody([]string{"alice"})).Times(2)
+
+		_, err := mock.Client().Get("http://api.example.com/users")
+		require.NoError(t, err)
+		resp, err := mock.Client().Get("http://api.example.com/users")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		fakeT.RunCleanups()
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Expecting all response bodies to be read and closed, but 2 leaked")
+		assert.Regexp(t, `http_leak_test.go:\d+: body never closed`, fakeT.ErrorMessages[0])
+		assert.Regexp(t, `http_leak_test.go:\d+: body closed before being fully read`, fakeT.ErrorMessages[0])
+	})
+
+	t.Run("When wrapping a real transport", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		}))
+		defer server.Close()
+		leaks := &testutils.BodyLeakDetector{}
+		client := &http.Client{Transport: leaks.Transport(http.DefaultTransport)}
+
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, leaks.AssertNoLeaks(fakeT))
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.True(t, leaks.AssertNoLeaks(t))
+	})
+}
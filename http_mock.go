@@ -0,0 +1,592 @@
+package testutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// RequestMatcher matches HTTP requests.
+//
+// The String method describes the matcher in test failure messages.
+type RequestMatcher interface {
+	Match(req *http.Request) bool
+	String() string
+}
+
+type requestMatcher struct {
+	description string
+	match       func(req *http.Request) bool
+}
+
+func (m requestMatcher) Match(req *http.Request) bool {
+	return m.match(req)
+}
+
+func (m requestMatcher) String() string {
+	return m.description
+}
+
+// NewRequestMatcher creates a matcher from a function.
+func NewRequestMatcher(description string, match func(req *http.Request) bool) RequestMatcher {
+	return requestMatcher{description: description, match: match}
+}
+
+// MatchMethod matches requests using the method. An empty method or "*" matches any method.
+func MatchMethod(method string) RequestMatcher {
+	return NewRequestMatcher("method "+method, func(req *http.Request) bool {
+		if method == "" || method == "*" {
+			return true
+		}
+		reqMethod := req.Method
+		if reqMethod == "" {
+			reqMethod = http.MethodGet
+		}
+		return strings.EqualFold(method, reqMethod)
+	})
+}
+
+// MatchHost matches requests sent to the host. The host can contain the port.
+func MatchHost(host string) RequestMatcher {
+	return NewRequestMatcher("host "+host, func(req *http.Request) bool {
+		return req.URL.Host == host || req.URL.Hostname() == host
+	})
+}
+
+// MatchPath matches requests whose URL path matches the pattern.
+//
+// Pattern segments can be:
+//   - literals, or shell patterns as accepted by path.Match, like "*.json"
+//   - wildcards like "{id}", matching a single segment
+//   - a trailing wildcard like "{path...}", matching the remaining segments
+//
+// Matching does not modify the request. The values of the wildcards of a MockRoute pattern are available
+// in the PathValue method of the requests passed to its responder.
+func MatchPath(pattern string) RequestMatcher {
+	return NewRequestMatcher("path "+pattern, func(req *http.Request) bool {
+		_, ok := matchPathPattern(pattern, req.URL.Path)
+		return ok
+	})
+}
+
+func matchPathPattern(pattern, urlPath string) (map[string]string, bool) {
+	values := map[string]string{}
+	patternSegments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.TrimPrefix(urlPath, "/"), "/")
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "...}") && i == len(patternSegments)-1 {
+			if i < len(pathSegments) {
+				values[segment[1:len(segment)-4]] = strings.Join(pathSegments[i:], "/")
+			} else {
+				values[segment[1:len(segment)-4]] = ""
+			}
+			return values, true
+		}
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if pathSegments[i] == "" {
+				return nil, false
+			}
+			values[segment[1:len(segment)-1]] = pathSegments[i]
+			continue
+		}
+		if ok, err := path.Match(segment, pathSegments[i]); err != nil || !ok {
+			return nil, false
+		}
+	}
+	if len(pathSegments) != len(patternSegments) {
+		return nil, false
+	}
+	return values, true
+}
+
+// MatchQuery matches requests having the query parameter set to the value.
+func MatchQuery(name, value string) RequestMatcher {
+	return NewRequestMatcher(fmt.Sprintf("query %s=%s", name, value), func(req *http.Request) bool {
+		for _, v := range req.URL.Query()[name] {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// MatchHeader matches requests having the header set to the value.
+func MatchHeader(name, value string) RequestMatcher {
+	return NewRequestMatcher(fmt.Sprintf("header %s=%s", http.CanonicalHeaderKey(name), value), func(req *http.Request) bool {
+		for _, v := range req.Header.Values(name) {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// MatchHeaderPresent matches requests having the header, whatever its value.
+func MatchHeaderPresent(name string) RequestMatcher {
+	return NewRequestMatcher(fmt.Sprintf("header %s present", http.CanonicalHeaderKey(name)), func(req *http.Request) bool {
+		return len(req.Header.Values(name)) > 0
+	})
+}
+
+// readRequestBody reads the request body and restores it so it can be read again.
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, err
+}
+
+// MatchBody matches requests whose body is accepted by the function.
+// The body is restored after being read.
+func MatchBody(description string, match func(body []byte) bool) RequestMatcher {
+	return NewRequestMatcher("body "+description, func(req *http.Request) bool {
+		body, err := readRequestBody(req)
+		if err != nil {
+			return false
+		}
+		return match(body)
+	})
+}
+
+// MatchBodyString matches requests whose body is exactly the string.
+func MatchBodyString(expected string) RequestMatcher {
+	return MatchBody(fmt.Sprintf("%q", expected), func(body []byte) bool {
+		return string(body) == expected
+	})
+}
+
+// MatchBodyRegexp matches requests whose body matches the regular expression.
+func MatchBodyRegexp(expr string) RequestMatcher {
+	re := regexp.MustCompile(expr)
+	return MatchBody("matching "+expr, re.Match)
+}
+
+// MatchJSONBody matches requests whose body is a JSON document equivalent to expected once encoded,
+// whatever the key order and the formatting.
+func MatchJSONBody(expected interface{}) RequestMatcher {
+	var expectedValue interface{}
+	data, err := json.Marshal(expected)
+	if err == nil {
+		err = json.Unmarshal(data, &expectedValue)
+	}
+	return MatchBody("JSON "+string(data), func(body []byte) bool {
+		if err != nil {
+			return false
+		}
+		var actual interface{}
+		if json.Unmarshal(body, &actual) != nil {
+			return false
+		}
+		return assert.ObjectsAreEqual(expectedValue, actual)
+	})
+}
+
+// MatchRequest matches requests by method and path pattern, as described in MatchMethod and MatchPath.
+func MatchRequest(method, pathPattern string) RequestMatcher {
+	return MatchAll(MatchMethod(method), MatchPath(pathPattern))
+}
+
+// MatchAll matches requests matched by all the matchers.
+func MatchAll(matchers ...RequestMatcher) RequestMatcher {
+	descriptions := []string{}
+	for _, m := range matchers {
+		descriptions = append(descriptions, m.String())
+	}
+	return NewRequestMatcher(strings.Join(descriptions, ", "), func(req *http.Request) bool {
+		for _, m := range matchers {
+			if !m.Match(req) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// MockRoute is a route of a MockTransport. It answers the requests matching all its criteria.
+type MockRoute struct {
+	transport *MockTransport
+	method    string
+	pattern   string
+	matchers  []RequestMatcher
+	responder func(req *http.Request) (*http.Response, error)
+	sequence  []func(req *http.Request) (*http.Response, error)
+	// expected is the number of expected calls, -1 for at least one call, 0 for optional routes
+	expected int
+	limited  bool
+	calls    int
+}
+
+func (r *MockRoute) String() string {
+	descriptions := []string{}
+	for _, m := range r.matchers[2:] {
+		descriptions = append(descriptions, m.String())
+	}
+	s := strings.TrimSpace(r.method + " " + r.pattern)
+	if len(descriptions) > 0 {
+		s += " (" + strings.Join(descriptions, ", ") + ")"
+	}
+	return s
+}
+
+// Matching adds a criterion to the route.
+func (r *MockRoute) Matching(matcher RequestMatcher) *MockRoute {
+	r.matchers = append(r.matchers, matcher)
+	return r
+}
+
+func (r *MockRoute) MatchingHost(host string) *MockRoute {
+	return r.Matching(MatchHost(host))
+}
+
+func (r *MockRoute) MatchingQuery(name, value string) *MockRoute {
+	return r.Matching(MatchQuery(name, value))
+}
+
+func (r *MockRoute) MatchingHeader(name, value string) *MockRoute {
+	return r.Matching(MatchHeader(name, value))
+}
+
+func (r *MockRoute) MatchingBody(expected string) *MockRoute {
+	return r.Matching(MatchBodyString(expected))
+}
+
+func (r *MockRoute) MatchingJSONBody(expected interface{}) *MockRoute {
+	return r.Matching(MatchJSONBody(expected))
+}
+
+// Respond answers the matching requests with the response built by the builder.
+//
+// The body of the response is replayed for each call.
+func (r *MockRoute) Respond(b *HTTPResponseBuilder) *MockRoute {
+	respond := b.responder()
+	return r.RespondWith(func(req *http.Request) (*http.Response, error) {
+		return respond(req), nil
+	})
+}
+
+// RespondWith answers the matching requests with the function.
+func (r *MockRoute) RespondWith(f func(req *http.Request) (*http.Response, error)) *MockRoute {
+	r.responder = f
+	return r
+}
+
+// RespondError makes the transport return the error to the matching requests.
+func (r *MockRoute) RespondError(err error) *MockRoute {
+	return r.RespondWith(func(req *http.Request) (*http.Response, error) {
+		return nil, err
+	})
+}
+
+// Then appends the response built by the builder to the sequence of responses of the route.
+//
+// Each call consumes the next response of the sequence, and the test fails if the sequence is not fully
+// consumed. Once consumed, the route does not match requests anymore, unless Times allows more calls,
+// in which case the last response is repeated.
+//
+//	mock.On(http.MethodGet, "/status").
+//		Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusServiceUnavailable)).
+//		Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK))
+func (r *MockRoute) Then(b *HTTPResponseBuilder) *MockRoute {
+	respond := b.responder()
+	return r.ThenWith(func(req *http.Request) (*http.Response, error) {
+		return respond(req), nil
+	})
+}
+
+// ThenError appends the error to the sequence of responses of the route.
+func (r *MockRoute) ThenError(err error) *MockRoute {
+	return r.ThenWith(func(req *http.Request) (*http.Response, error) {
+		return nil, err
+	})
+}
+
+// ThenWith appends the function to the sequence of responses of the route.
+func (r *MockRoute) ThenWith(f func(req *http.Request) (*http.Response, error)) *MockRoute {
+	r.sequence = append(r.sequence, f)
+	return r
+}
+
+// Calls returns the number of requests the route answered.
+func (r *MockRoute) Calls() int {
+	r.transport.mu.Lock()
+	defer r.transport.mu.Unlock()
+	return r.calls
+}
+
+// Times sets the exact number of calls expected on the route.
+// Once called n times, the route does not match requests anymore.
+func (r *MockRoute) Times(n int) *MockRoute {
+	r.expected = n
+	r.limited = true
+	return r
+}
+
+func (r *MockRoute) Once() *MockRoute {
+	return r.Times(1)
+}
+
+// Maybe makes the route optional: the test does not fail when the route is never called.
+func (r *MockRoute) Maybe() *MockRoute {
+	r.expected = 0
+	r.limited = false
+	return r
+}
+
+// mismatches returns the criteria of the route the request does not match.
+func mismatches(matchers []RequestMatcher, req *http.Request) []RequestMatcher {
+	mismatches := []RequestMatcher{}
+	for _, m := range matchers {
+		if !m.Match(req) {
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches
+}
+
+func (r *MockRoute) exhausted() bool {
+	if r.limited {
+		return r.calls >= r.expected
+	}
+	return len(r.sequence) > 0 && r.calls >= len(r.sequence)
+}
+
+func (r *MockRoute) maxCalls() int {
+	if r.limited {
+		return r.expected
+	}
+	return len(r.sequence)
+}
+
+// next returns the function answering the next call.
+func (r *MockRoute) next() func(req *http.Request) (*http.Response, error) {
+	defer func() {
+		r.calls++
+	}()
+	switch {
+	case len(r.sequence) == 0:
+		return r.responder
+	case r.calls < len(r.sequence):
+		return r.sequence[r.calls]
+	default:
+		return r.sequence[len(r.sequence)-1]
+	}
+}
+
+// ErrNoMockRoute is returned by MockTransport for the requests no route matches.
+var ErrNoMockRoute = errors.New("no mock route matches")
+
+type unmatchedRequest struct {
+	description string
+	closest     *MockRoute
+	mismatches  []RequestMatcher
+}
+
+// MockTransport is an http.RoundTripper answering requests from declared routes.
+//
+//	mock := testutils.NewMockTransport(t)
+//	mock.On(http.MethodGet, "/users/{id}").
+//		MatchingHeader("Authorization", "Bearer token").
+//		Respond(testutils.NewHTTPResponseBuilder().WithJsonBody(user))
+//	client := &http.Client{Transport: mock}
+//
+// When the test completes, it fails for each request no route matched and for each route that was not called
+// as expected.
+type MockTransport struct {
+	mu        sync.Mutex
+	routes    []*MockRoute
+	unmatched []unmatchedRequest
+	// maxUnmatched is the number of unmatched requests kept, 0 for all of them
+	maxUnmatched int
+	leaks        *BodyLeakDetector
+}
+
+// MockTransport should implement the http.RoundTripper interface
+var _ http.RoundTripper = &MockTransport{}
+
+// NewMockTransport creates a transport checking its expectations when the test completes.
+//
+// When t is nil, the expectations are not checked.
+func NewMockTransport(t CleanupTest) *MockTransport {
+	m := &MockTransport{}
+	if t != nil {
+		t.Helper()
+		t.Cleanup(func() {
+			m.AssertExpectations(t)
+		})
+	}
+	return m
+}
+
+// On declares a route for the method and path pattern. The supported patterns are described in MatchPath.
+//
+// By default, the route must be called at least once and answers with 200 OK and an empty body.
+// The routes are evaluated in their declaration order.
+func (m *MockTransport) On(method, pathPattern string) *MockRoute {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	route := &MockRoute{
+		transport: m,
+		method:    method,
+		pattern:   pathPattern,
+		matchers:  []RequestMatcher{MatchMethod(method), MatchPath(pathPattern)},
+		expected:  -1,
+	}
+	route.Respond(NewHTTPResponseBuilder().WithStatusCode(http.StatusOK))
+	m.routes = append(m.routes, route)
+	return route
+}
+
+// WithMaxUnmatched keeps only the last n requests no route matched, for transports serving requests for long.
+// Zero keeps all of them.
+func (m *MockTransport) WithMaxUnmatched(n int) *MockTransport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxUnmatched = n
+	return m
+}
+
+// WithBodyLeakDetector tracks the bodies of the responses with the detector.
+func (m *MockTransport) WithBodyLeakDetector(detector *BodyLeakDetector) *MockTransport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leaks = detector
+	return m
+}
+
+// Client returns an HTTP client using the transport.
+func (m *MockTransport) Client() *http.Client {
+	return &http.Client{Transport: m}
+}
+
+func describeRequest(req *http.Request) string {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	return method + " " + req.URL.String()
+}
+
+func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// matchers run without the lock, as they may be slow or use the transport
+	m.mu.Lock()
+	routes := append([]*MockRoute{}, m.routes...)
+	routeMatchers := make([][]RequestMatcher, len(routes))
+	for i, route := range routes {
+		routeMatchers[i] = append([]RequestMatcher{}, route.matchers...)
+	}
+	m.mu.Unlock()
+	routeMismatches := make([][]RequestMatcher, len(routes))
+	routePathValues := make([]map[string]string, len(routes))
+	for i, route := range routes {
+		routeMismatches[i] = mismatches(routeMatchers[i], req)
+		routePathValues[i], _ = matchPathPattern(route.pattern, req.URL.Path)
+	}
+
+	m.mu.Lock()
+	var closest *MockRoute
+	var closestMismatches []RequestMatcher
+	closestScore := 0
+	for i, route := range routes {
+		mismatches := routeMismatches[i]
+		// a route only missing calls is closer than a route missing a criterion
+		score := 2 * len(mismatches)
+		if route.exhausted() {
+			mismatches = append(mismatches, NewRequestMatcher(fmt.Sprintf("at most %d calls", route.maxCalls()), nil))
+			score++
+		}
+		if len(mismatches) == 0 {
+			responder := route.next()
+			leaks := m.leaks
+			m.mu.Unlock()
+			// only the values of the chosen route are set, the other routes matching the path would overwrite them
+			for name, value := range routePathValues[i] {
+				req.SetPathValue(name, value)
+			}
+			resp, err := responder(req)
+			if leaks != nil && resp != nil {
+				resp.Body = leaks.Track(resp.Body)
+			}
+			return resp, err
+		}
+		if closest == nil || score < closestScore {
+			closest = route
+			closestMismatches = mismatches
+			closestScore = score
+		}
+	}
+	m.unmatched = append(m.unmatched, unmatchedRequest{
+		description: describeRequest(req),
+		closest:     closest,
+		mismatches:  closestMismatches,
+	})
+	if m.maxUnmatched > 0 && len(m.unmatched) > m.maxUnmatched {
+		m.unmatched = append([]unmatchedRequest{}, m.unmatched[len(m.unmatched)-m.maxUnmatched:]...)
+	}
+	m.mu.Unlock()
+	return nil, fmt.Errorf("%w %s", ErrNoMockRoute, describeRequest(req))
+}
+
+// AssertExpectations asserts that all the requests matched a route and all the routes were called as expected.
+//
+// It is called automatically when the test completes.
+func (m *MockTransport) AssertExpectations(t assert.TestingT) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ok := true
+	for _, unmatched := range m.unmatched {
+		msg := "No mock route matches the request " + unmatched.description
+		if unmatched.closest != nil {
+			reasons := []string{}
+			for _, mismatch := range unmatched.mismatches {
+				reasons = append(reasons, mismatch.String())
+			}
+			msg += fmt.Sprintf("\nclosest route: %s\nmismatched criteria: %s", unmatched.closest, strings.Join(reasons, ", "))
+		}
+		ok = assert.Fail(t, msg) && ok
+	}
+	for _, route := range m.routes {
+		switch {
+		case !route.limited && route.expected != 0 && len(route.sequence) > 0 && route.calls < len(route.sequence):
+			ok = assert.Fail(t, fmt.Sprintf("Expecting route %s to consume its %d responses but it was called %d times", route, len(route.sequence), route.calls)) && ok
+		case route.expected < 0 && route.calls == 0:
+			ok = assert.Fail(t, fmt.Sprintf("Expecting route %s to be called but it was never called", route)) && ok
+		case route.expected > 0 && route.calls != route.expected:
+			ok = assert.Fail(t, fmt.Sprintf("Expecting route %s to be called %d times but it was called %d times", route, route.expected, route.calls)) && ok
+		}
+	}
+	return ok
+}
+
+// CallCounts returns the number of requests answered by each route, indexed by the route description.
+func (m *MockTransport) CallCounts() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := map[string]int{}
+	for _, route := range m.routes {
+		counts[route.String()] += route.calls
+	}
+	return counts
+}
@@ -0,0 +1,189 @@
+package testutils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+// MockConfig declares the routes of a MockTransport in a YAML file, for tests and for the mockserver command.
+//
+//	routes:
+//	  - method: GET
+//	    path: /users/{id}
+//	    headers:
+//	      Authorization: Bearer token
+//	    response:
+//	      status: 200
+//	      json: {"id": 1, "name": "alice"}
+//	  - method: POST
+//	    path: /jobs
+//	    responses:
+//	      - status: 503
+//	      - status: 202
+//	        delay: 100ms
+type MockConfig struct {
+	Routes []MockRouteConfig `yaml:"routes"`
+}
+
+// MockRouteConfig declares a MockRoute. The criteria and responses have the meaning of the MockRoute methods.
+type MockRouteConfig struct {
+	Method   string            `yaml:"method"`
+	Path     string            `yaml:"path"`
+	Host     string            `yaml:"host,omitempty"`
+	Query    map[string]string `yaml:"query,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	Body     string            `yaml:"body,omitempty"`
+	JSONBody interface{}       `yaml:"jsonBody,omitempty"`
+	// Times sets the exact number of calls expected, Optional makes the route optional.
+	Times    int  `yaml:"times,omitempty"`
+	Optional bool `yaml:"optional,omitempty"`
+	// Response answers all the calls, Responses answers them in sequence.
+	Response  *MockResponseConfig  `yaml:"response,omitempty"`
+	Responses []MockResponseConfig `yaml:"responses,omitempty"`
+}
+
+// MockResponseConfig declares a response. Body, JSON and File are exclusive, File being relative to the configuration file.
+type MockResponseConfig struct {
+	Status  int               `yaml:"status,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Body    string            `yaml:"body,omitempty"`
+	JSON    interface{}       `yaml:"json,omitempty"`
+	File    string            `yaml:"file,omitempty"`
+	Delay   time.Duration     `yaml:"delay,omitempty"`
+	Error   string            `yaml:"error,omitempty"`
+}
+
+// ReadMockConfig reads and validates a mock configuration file.
+func ReadMockConfig(fs afero.Fs, path string) (MockConfig, error) {
+	config := MockConfig{}
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid mock configuration %s: %w", path, err)
+	}
+	for i := range config.Routes {
+		route := &config.Routes[i]
+		if route.Path == "" {
+			return config, fmt.Errorf("invalid mock configuration %s: route %d has no path", path, i)
+		}
+		if route.Response != nil && len(route.Responses) > 0 {
+			return config, fmt.Errorf("invalid mock configuration %s: route %s %s has both a response and responses", path, route.Method, route.Path)
+		}
+		responses := route.Responses
+		if route.Response != nil {
+			responses = []MockResponseConfig{*route.Response}
+		}
+		for j := range responses {
+			response := &responses[j]
+			bodies := 0
+			for _, set := range []bool{response.Body != "", response.JSON != nil, response.File != ""} {
+				if set {
+					bodies++
+				}
+			}
+			if bodies > 1 {
+				return config, fmt.Errorf("invalid mock configuration %s: route %s %s has a response with more than one of body, json and file", path, route.Method, route.Path)
+			}
+			if response.File == "" {
+				continue
+			}
+			if !filepath.IsAbs(response.File) {
+				response.File = filepath.Join(filepath.Dir(path), response.File)
+			}
+			if _, err := fs.Stat(response.File); err != nil {
+				return config, fmt.Errorf("invalid mock configuration %s: %w", path, err)
+			}
+		}
+		if route.Response != nil {
+			route.Response = &responses[0]
+		}
+	}
+	return config, nil
+}
+
+// Configure declares the routes of the configuration, reading response files from fs.
+func (m *MockTransport) Configure(fs afero.Fs, config MockConfig) []*MockRoute {
+	routes := []*MockRoute{}
+	for _, c := range config.Routes {
+		route := m.On(c.Method, c.Path)
+		if c.Host != "" {
+			route.MatchingHost(c.Host)
+		}
+		for _, name := range sortedKeys(c.Query) {
+			route.MatchingQuery(name, c.Query[name])
+		}
+		for _, name := range sortedKeys(c.Headers) {
+			route.MatchingHeader(name, c.Headers[name])
+		}
+		if c.Body != "" {
+			route.MatchingBody(c.Body)
+		}
+		if c.JSONBody != nil {
+			route.MatchingJSONBody(c.JSONBody)
+		}
+		if c.Response != nil {
+			route.RespondWith(c.Response.responder(fs))
+		}
+		for _, response := range c.Responses {
+			route.ThenWith(response.responder(fs))
+		}
+		switch {
+		case c.Times > 0:
+			route.Times(c.Times)
+		case c.Optional:
+			route.Maybe()
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c MockResponseConfig) responder(fs afero.Fs) func(req *http.Request) (*http.Response, error) {
+	b := NewHTTPResponseBuilder()
+	if c.Status != 0 {
+		b.WithStatusCode(c.Status)
+	}
+	switch {
+	case c.File != "":
+		b.WithFileBody(fs, c.File)
+	case c.JSON != nil:
+		b.WithJsonBody(c.JSON)
+	case c.Body != "":
+		b.WithBody(StringBody(c.Body))
+	}
+	for _, name := range sortedKeys(c.Headers) {
+		b.resp.Header.Set(name, c.Headers[name])
+	}
+	respond := b.responder()
+	return func(req *http.Request) (*http.Response, error) {
+		if c.Delay > 0 {
+			select {
+			case <-time.After(c.Delay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+		if c.Error != "" {
+			return nil, errors.New(c.Error)
+		}
+		return respond(req), nil
+	}
+}
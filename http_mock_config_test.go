@@ -0,0 +1,127 @@
+package testutils_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mockConfig = `
+routes:
+  - method: GET
+    path: /users/{id}
+    headers:
+      Authorization: Bearer token
+    response:
+      json: {"id": 1, "name": "alice"}
+  - method: POST
+    path: /users
+    jsonBody: {"name": "bob"}
+    times: 1
+    response:
+      status: 201
+      headers:
+        Location: /users/2
+  - method: POST
+    path: /jobs
+    responses:
+      - status: 503
+      - status: 202
+        body: accepted
+  - method: GET
+    path: /logo.svg
+    optional: true
+    response:
+      file: assets/logo.svg
+  - method: GET
+    path: /slow
+    optional: true
+    response:
+      delay: 1s
+  - method: GET
+    path: /broken
+    optional: true
+    response:
+      error: connection refused
+`
+
+func TestMockConfig(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, fs.MkdirAll("/mocks/assets", 0755))
+	testutils.EnsureFileContent(t, fs, "/mocks/routes.yaml", mockConfig)
+	testutils.EnsureFileContent(t, fs, "/mocks/assets/logo.svg", "<svg/>")
+
+	config, err := testutils.ReadMockConfig(fs, "/mocks/routes.yaml")
+	require.NoError(t, err)
+	require.Len(t, config.Routes, 6)
+	assert.Equal(t, "/mocks/assets/logo.svg", config.Routes[3].Response.File)
+
+	mock := testutils.NewMockTransport(t)
+	routes := mock.Configure(fs, config)
+	require.Len(t, routes, 6)
+	assert.Equal(t, "GET /users/{id} (header Authorization=Bearer token)", routes[0].String())
+	client := mock.Client()
+
+	req := testutils.NewHTTPRequestBuilder().WithURL("http://api/users/1").WithBearerToken("token").Build()
+	req.RequestURI = ""
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	testutils.AssertResponseJSON(t, resp, `{"id": 1, "name": "alice"}`)
+
+	resp, err = client.Post("http://api/users", "application/json", strings.NewReader(`{"name": "bob"}`))
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusCreated)
+	testutils.AssertResponseHeader(t, resp, "Location", "/users/2")
+
+	resp, err = client.Post("http://api/jobs", "text/plain", nil)
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusServiceUnavailable)
+	resp, err = client.Post("http://api/jobs", "text/plain", nil)
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusAccepted)
+	testutils.AssertResponseBodyMatches(t, resp, "^accepted$")
+
+	resp, err = client.Get("http://api/logo.svg")
+	require.NoError(t, err)
+	testutils.AssertResponseContentType(t, resp, "image/svg+xml")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "<svg/>", string(body))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://api/slow", nil)
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = client.Get("http://api/broken")
+	assert.ErrorContains(t, err, "connection refused")
+
+	t.Run("When the configuration is invalid", func(t *testing.T) {
+		for name, content := range map[string]string{
+			"missing path":  "routes:\n  - method: GET\n",
+			"missing file":  "routes:\n  - path: /\n    response:\n      file: missing.json\n",
+			"two responses": "routes:\n  - path: /\n    response: {}\n    responses: [{}]\n",
+			"body and json": "routes:\n  - path: /\n    response:\n      body: ok\n      json: {ok: true}\n",
+			"json and file": "routes:\n  - path: /\n    responses:\n      - json: []\n        file: users.json\n",
+			"invalid YAML":  "routes: {",
+		} {
+			testutils.EnsureFileContent(t, fs, "/mocks/invalid.yaml", content)
+			_, err := testutils.ReadMockConfig(fs, "/mocks/invalid.yaml")
+			assert.Error(t, err, name)
+		}
+
+		testutils.EnsureFileContent(t, fs, "/mocks/invalid.yaml", "routes:\n  - method: GET\n    path: /users\n    response:\n      body: ok\n      json: {ok: true}\n")
+		_, err := testutils.ReadMockConfig(fs, "/mocks/invalid.yaml")
+		assert.EqualError(t, err, "invalid mock configuration /mocks/invalid.yaml: route GET /users has a response with more than one of body, json and file")
+	})
+}
@@ -0,0 +1,346 @@
+package testutils_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchPath(t *testing.T) {
+	for name, tc := range map[string]struct {
+		pattern string
+		path    string
+		matches bool
+		values  map[string]string
+	}{
+		"literal":                     {pattern: "/users", path: "/users", matches: true},
+		"different literal":           {pattern: "/users", path: "/groups", matches: false},
+		"wildcard":                    {pattern: "/users/{id}", path: "/users/42", matches: true, values: map[string]string{"id": "42"}},
+		"wildcard with extra segment": {pattern: "/users/{id}", path: "/users/42/groups", matches: false},
+		"empty wildcard":              {pattern: "/users/{id}", path: "/users/", matches: false},
+		"remaining segments":          {pattern: "/files/{path...}", path: "/files/a/b/c.txt", matches: true, values: map[string]string{"path": "a/b/c.txt"}},
+		"no remaining segments":       {pattern: "/files/{path...}", path: "/files", matches: true, values: map[string]string{"path": ""}},
+		"glob":                        {pattern: "/data/*.json", path: "/data/users.json", matches: true},
+		"glob mismatch":               {pattern: "/data/*.json", path: "/data/users.yaml", matches: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://example.com"+tc.path, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tc.matches, testutils.MatchPath(tc.pattern).Match(req))
+			for key := range tc.values {
+				assert.Empty(t, req.PathValue(key), "matching must not modify the request")
+			}
+			if !tc.matches {
+				return
+			}
+
+			mock := testutils.NewMockTransport(nil)
+			mock.On(http.MethodGet, tc.pattern).RespondWith(func(req *http.Request) (*http.Response, error) {
+				for key, value := range tc.values {
+					assert.Equal(t, value, req.PathValue(key))
+				}
+				return testutils.NewHTTPResponseBuilder().Build(), nil
+			})
+			_, err = mock.RoundTrip(req)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRequestMatchers(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "http://example.com:8080/users?page=2&page=3", strings.NewReader(`{"name": "alice", "groups": ["devs"]}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+
+	assert.True(t, testutils.MatchMethod("post").Match(req))
+	assert.True(t, testutils.MatchMethod("*").Match(req))
+	assert.False(t, testutils.MatchMethod(http.MethodGet).Match(req))
+	assert.True(t, testutils.MatchHost("example.com").Match(req))
+	assert.True(t, testutils.MatchHost("example.com:8080").Match(req))
+	assert.True(t, testutils.MatchQuery("page", "3").Match(req))
+	assert.False(t, testutils.MatchQuery("page", "4").Match(req))
+	assert.True(t, testutils.MatchHeader("authorization", "Bearer token").Match(req))
+	assert.True(t, testutils.MatchHeaderPresent("Authorization").Match(req))
+	assert.False(t, testutils.MatchHeaderPresent("Cookie").Match(req))
+	assert.True(t, testutils.MatchJSONBody(map[string]interface{}{"groups": []string{"devs"}, "name": "alice"}).Match(req))
+	assert.False(t, testutils.MatchJSONBody(map[string]interface{}{"name": "alice"}).Match(req))
+	assert.True(t, testutils.MatchBodyRegexp(`"name":\s*"alice"`).Match(req))
+	assert.False(t, testutils.MatchBodyString("alice").Match(req))
+	assert.Equal(t, "method POST, path /users", testutils.MatchRequest(http.MethodPost, "/users").String())
+
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"name": "alice", "groups": ["devs"]}`, string(body))
+}
+
+func TestMockTransport(t *testing.T) {
+	t.Run("When requests match the routes", func(t *testing.T) {
+		mock := testutils.NewMockTransport(t)
+		mock.On(http.MethodGet, "/users/{id}").
+			MatchingHeader("Authorization", "Bearer token").
+			RespondWith(func(req *http.Request) (*http.Response, error) {
+				return testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK).WithBody(testutils.StringBody("user " + req.PathValue("id"))).Build(), nil
+			})
+		mock.On(http.MethodGet, "/users").
+			MatchingQuery("page", "2").
+			Respond(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK).WithJsonBody([]string{"alice"})).
+			Times(2)
+		mock.On(http.MethodPost, "/users").
+			MatchingJSONBody(map[string]string{"name": "bob"}).
+			Respond(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusCreated)).
+			Once()
+		mock.On(http.MethodDelete, "/users/{id}").Maybe()
+		mock.On(http.MethodGet, "/unavailable").RespondError(errors.New("connection refused"))
+		client := mock.Client()
+
+		req, err := http.NewRequest(http.MethodGet, "http://api.example.com/users/42", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "user 42", string(body))
+
+		for i := 0; i < 2; i++ {
+			resp, err = client.Get("http://api.example.com/users?page=2")
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			body, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.JSONEq(t, `["alice"]`, string(body))
+		}
+
+		resp, err = client.Post("http://api.example.com/users", "application/json", strings.NewReader(`{"name":"bob"}`))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		_, err = client.Get("http://api.example.com/unavailable")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection refused")
+	})
+
+	t.Run("When requests do not match any route", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		mock := testutils.NewMockTransport(fakeT)
+		mock.On(http.MethodGet, "/users/{id}").MatchingHeader("Authorization", "Bearer token")
+		mock.On(http.MethodPost, "/users")
+		mock.On(http.MethodGet, "/groups").Times(2)
+
+		_, err := mock.Client().Get("http://api.example.com/users/42")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no mock route matches GET http://api.example.com/users/42")
+		_, err = mock.Client().Get("http://api.example.com/groups")
+		require.NoError(t, err)
+
+		fakeT.RunCleanups()
+		require.Len(t, fakeT.ErrorMessages, 4)
+		assert.Contains(t, fakeT.ErrorMessages[0], "No mock route matches the request GET http://api.example.com/users/42")
+		assert.Contains(t, fakeT.ErrorMessages[0], "closest route: GET /users/{id} (header Authorization=Bearer token)")
+		assert.Contains(t, fakeT.ErrorMessages[0], "mismatched criteria: header Authorization=Bearer token")
+		assert.Contains(t, fakeT.ErrorMessages[1], "Expecting route GET /users/{id} (header Authorization=Bearer token) to be called but it was never called")
+		assert.Contains(t, fakeT.ErrorMessages[2], "Expecting route POST /users to be called but it was never called")
+		assert.Contains(t, fakeT.ErrorMessages[3], "Expecting route GET /groups to be called 2 times but it was called 1 times")
+	})
+
+	t.Run("When a route is called more than expected", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		mock := testutils.NewMockTransport(fakeT)
+		mock.On(http.MethodGet, "/users").Once()
+
+		_, err := mock.Client().Get("http://api.example.com/users")
+		require.NoError(t, err)
+		_, err = mock.Client().Get("http://api.example.com/users")
+		require.Error(t, err)
+
+		assert.False(t, mock.AssertExpectations(fakeT))
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "No mock route matches the request GET http://api.example.com/users")
+		assert.Contains(t, fakeT.ErrorMessages[0], "mismatched criteria: at most 1 calls")
+	})
+}
+
+func TestMockTransportOverlappingPatterns(t *testing.T) {
+	mock := testutils.NewMockTransport(t)
+	pathValues := func(names ...string) func(req *http.Request) (*http.Response, error) {
+		return func(req *http.Request) (*http.Response, error) {
+			values := []string{}
+			for _, name := range names {
+				values = append(values, name+"="+req.PathValue(name))
+			}
+			return testutils.NewHTTPResponseBuilder().WithBody(testutils.StringBody(strings.Join(values, ","))).Build(), nil
+		}
+	}
+	mock.On(http.MethodGet, "/files/{path...}").RespondWith(pathValues("path"))
+	mock.On(http.MethodGet, "/files/{dir}/{path...}").Maybe().RespondWith(pathValues("dir", "path"))
+
+	resp, err := mock.Client().Get("http://api.example.com/files/a/b.txt")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "path=a/b.txt", string(body))
+}
+
+func TestMockTransportMatchersRunConcurrently(t *testing.T) {
+	t.Run("When a matcher uses the transport", func(t *testing.T) {
+		mock := testutils.NewMockTransport(nil)
+		mock.On(http.MethodGet, "/quota").Matching(testutils.NewRequestMatcher("quota left", func(req *http.Request) bool {
+			return mock.CallCounts()["GET /quota (quota left)"] == 0
+		}))
+		_, err := mock.Client().Get("http://api.example.com/quota")
+		require.NoError(t, err)
+		_, err = mock.Client().Get("http://api.example.com/quota")
+		assert.ErrorIs(t, err, testutils.ErrNoMockRoute)
+	})
+
+	t.Run("When matchers are slow", func(t *testing.T) {
+		mock := testutils.NewMockTransport(t)
+		mu := sync.Mutex{}
+		waiting := 0
+		bothWaiting := make(chan struct{})
+		mock.On(http.MethodGet, "/slow").Times(2).Matching(testutils.NewRequestMatcher("concurrent", func(req *http.Request) bool {
+			mu.Lock()
+			waiting++
+			if waiting == 2 {
+				close(bothWaiting)
+			}
+			mu.Unlock()
+			select {
+			case <-bothWaiting:
+				return true
+			case <-time.After(5 * time.Second):
+				return false
+			}
+		}))
+
+		wg := sync.WaitGroup{}
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, errs[i] = mock.Client().Get("http://api.example.com/slow")
+			}()
+		}
+		wg.Wait()
+		assert.NoError(t, errs[0])
+		assert.NoError(t, errs[1])
+	})
+}
+
+func TestMockTransportSequences(t *testing.T) {
+	t.Run("When retrying until the service is available", func(t *testing.T) {
+		mock := testutils.NewMockTransport(t)
+		status := mock.On(http.MethodGet, "/status").
+			Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusServiceUnavailable)).
+			ThenError(errors.New("connection reset by peer")).
+			Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK))
+		client := mock.Client()
+
+		resp, err := client.Get("http://api.example.com/status")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		_, err = client.Get("http://api.example.com/status")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection reset by peer")
+		resp, err = client.Get("http://api.example.com/status")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 3, status.Calls())
+	})
+
+	t.Run("When paginating", func(t *testing.T) {
+		mock := testutils.NewMockTransport(t)
+		mock.On(http.MethodGet, "/users").
+			Then(testutils.NewHTTPResponseBuilder().
+				WithJsonBody([]string{"alice", "bob"}).
+				WithHeader("Link", `<http://api.example.com/users?page=2>; rel="next"`)).
+			Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK).WithJsonBody([]string{"carol"}))
+		client := mock.Client()
+
+		users := []string{}
+		next := "http://api.example.com/users"
+		for next != "" {
+			resp, err := client.Get(next)
+			require.NoError(t, err)
+			page := []string{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+			users = append(users, page...)
+			next = ""
+			if link := resp.Header.Get("Link"); link != "" {
+				next = strings.TrimPrefix(strings.Split(link, ">")[0], "<")
+			}
+		}
+		assert.Equal(t, []string{"alice", "bob", "carol"}, users)
+		assert.Equal(t, map[string]int{"GET /users": 2}, mock.CallCounts())
+	})
+
+	t.Run("When the sequence is not consumed", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		mock := testutils.NewMockTransport(fakeT)
+		mock.On(http.MethodGet, "/status").
+			Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusServiceUnavailable)).
+			Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK))
+		mock.On(http.MethodGet, "/health").
+			Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK))
+
+		_, err := mock.Client().Get("http://api.example.com/status")
+		require.NoError(t, err)
+		_, err = mock.Client().Get("http://api.example.com/health")
+		require.NoError(t, err)
+		_, err = mock.Client().Get("http://api.example.com/health")
+		require.Error(t, err)
+		assert.Equal(t, map[string]int{"GET /status": 1, "GET /health": 1}, mock.CallCounts())
+
+		fakeT.RunCleanups()
+		require.Len(t, fakeT.ErrorMessages, 2)
+		assert.Contains(t, fakeT.ErrorMessages[0], "mismatched criteria: at most 1 calls")
+		assert.Contains(t, fakeT.ErrorMessages[1], "Expecting route GET /status to consume its 2 responses but it was called 1 times")
+	})
+
+	t.Run("When keeping the last unmatched requests", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		mock := testutils.NewMockTransport(fakeT).WithMaxUnmatched(2)
+		for _, path := range []string{"/a", "/b", "/c"} {
+			_, err := mock.Client().Get("http://api.example.com" + path)
+			require.Error(t, err)
+		}
+		fakeT.RunCleanups()
+		require.Len(t, fakeT.ErrorMessages, 2)
+		assert.Contains(t, fakeT.ErrorMessages[0], "No mock route matches the request GET http://api.example.com/b")
+		assert.Contains(t, fakeT.ErrorMessages[1], "No mock route matches the request GET http://api.example.com/c")
+	})
+
+	t.Run("When an optional route with a sequence is never called", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		mock := testutils.NewMockTransport(fakeT)
+		mock.On(http.MethodGet, "/status").Maybe().
+			Respond(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusServiceUnavailable)).
+			Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK))
+		assert.True(t, mock.AssertExpectations(fakeT))
+		assert.Empty(t, fakeT.ErrorMessages)
+	})
+
+	t.Run("When the last response of the sequence is repeated", func(t *testing.T) {
+		mock := testutils.NewMockTransport(t)
+		mock.On(http.MethodGet, "/status").
+			Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusServiceUnavailable)).
+			Then(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK)).
+			Times(4)
+		for _, expected := range []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusOK, http.StatusOK} {
+			resp, err := mock.Client().Get("http://api.example.com/status")
+			require.NoError(t, err)
+			assert.Equal(t, expected, resp.StatusCode)
+		}
+	})
+}
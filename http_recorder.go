@@ -0,0 +1,271 @@
+package testutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RecordedRequest is a request recorded by a RecordingTransport.
+type RecordedRequest struct {
+	Method   string
+	URL      *url.URL
+	Header   http.Header
+	Body     []byte
+	Start    time.Time
+	Duration time.Duration
+	// Response is the response returned by the wrapped transport.
+	// Its body records what the client reads, as returned by ResponseBody.
+	Response     *http.Response
+	Err          error
+	request      *http.Request
+	responseBody *recordedBody
+}
+
+// Request returns a copy of the recorded request, with a body that can be read.
+func (r RecordedRequest) Request() *http.Request {
+	req := r.request.Clone(r.request.Context())
+	req.Body = io.NopCloser(bytes.NewReader(r.Body))
+	return req
+}
+
+// ResponseBody returns the part of the response body read by the client so far.
+func (r RecordedRequest) ResponseBody() []byte {
+	if r.responseBody == nil {
+		return nil
+	}
+	r.responseBody.mu.Lock()
+	defer r.responseBody.mu.Unlock()
+	return append([]byte{}, r.responseBody.data.Bytes()...)
+}
+
+// recordedBody keeps a copy of what is read from the body.
+type recordedBody struct {
+	io.ReadCloser
+	mu   sync.Mutex
+	data bytes.Buffer
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	b.data.Write(p[:n])
+	b.mu.Unlock()
+	return n, err
+}
+
+// recordedReadWriteBody keeps the Write method of bodies like the ones of 101 Switching Protocols responses.
+type recordedReadWriteBody struct {
+	*recordedBody
+	io.Writer
+}
+
+func (r RecordedRequest) String() string {
+	return r.Method + " " + r.URL.String()
+}
+
+// RecordingTransport records all the requests going through the wrapped transport.
+//
+//	recorder := testutils.NewRecordingTransport(mock)
+//	client := &http.Client{Transport: recorder}
+//	...
+//	recorder.AssertHeaderOnAll(t, "Authorization")
+type RecordingTransport struct {
+	Transport http.RoundTripper
+	mu        sync.Mutex
+	requests  []RecordedRequest
+}
+
+// RecordingTransport should implement the http.RoundTripper interface
+var _ http.RoundTripper = &RecordingTransport{}
+
+// NewRecordingTransport wraps the transport. When the transport is nil, http.DefaultTransport is used.
+func NewRecordingTransport(transport http.RoundTripper) *RecordingTransport {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &RecordingTransport{Transport: transport}
+}
+
+func (r *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	recorded := RecordedRequest{
+		Method:  method,
+		URL:     cloneURL(req.URL),
+		Header:  req.Header.Clone(),
+		Body:    body,
+		Start:   time.Now(),
+		request: req.Clone(req.Context()),
+	}
+	resp, err := r.Transport.RoundTrip(req)
+	recorded.Duration = time.Since(recorded.Start)
+	if resp != nil && resp.Body != nil && resp.Body != http.NoBody {
+		recorded.responseBody = &recordedBody{ReadCloser: resp.Body}
+		if writer, ok := resp.Body.(io.Writer); ok {
+			resp.Body = recordedReadWriteBody{recordedBody: recorded.responseBody, Writer: writer}
+		} else {
+			resp.Body = recorded.responseBody
+		}
+	}
+	recorded.Response = resp
+	recorded.Err = err
+	r.mu.Lock()
+	r.requests = append(r.requests, recorded)
+	r.mu.Unlock()
+	return resp, err
+}
+
+func cloneURL(u *url.URL) *url.URL {
+	copied := *u
+	if u.User != nil {
+		user := *u.User
+		copied.User = &user
+	}
+	return &copied
+}
+
+// Client returns an HTTP client using the transport.
+func (r *RecordingTransport) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+// Requests returns the recorded requests, in the order they were sent.
+func (r *RecordingTransport) Requests() []RecordedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedRequest{}, r.requests...)
+}
+
+// Matching returns the recorded requests matched by the matcher.
+func (r *RecordingTransport) Matching(matcher RequestMatcher) []RecordedRequest {
+	matching := []RecordedRequest{}
+	for _, recorded := range r.Requests() {
+		if matcher.Match(recorded.Request()) {
+			matching = append(matching, recorded)
+		}
+	}
+	return matching
+}
+
+// Reset forgets the recorded requests.
+func (r *RecordingTransport) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = nil
+}
+
+func describeRecordedRequests(requests []RecordedRequest) string {
+	descriptions := []string{}
+	for _, recorded := range requests {
+		descriptions = append(descriptions, "\t"+recorded.String())
+	}
+	return "recorded requests:\n" + strings.Join(descriptions, "\n")
+}
+
+// AssertCallCount asserts that exactly count requests were matched by the matcher.
+func (r *RecordingTransport) AssertCallCount(t assert.TestingT, matcher RequestMatcher, count int) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	matching := r.Matching(matcher)
+	if len(matching) != count {
+		return assert.Fail(t, fmt.Sprintf("Expecting %d requests matching %s but got %d\n%s", count, matcher, len(matching), describeRecordedRequests(r.Requests())))
+	}
+	return true
+}
+
+func (r *RecordingTransport) RequireCallCount(t require.TestingT, matcher RequestMatcher, count int) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertCallCount(t, matcher, count) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertAllMatch asserts that all the recorded requests were matched by the matcher.
+func (r *RecordingTransport) AssertAllMatch(t assert.TestingT, matcher RequestMatcher) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	ok := true
+	for _, recorded := range r.Requests() {
+		if !matcher.Match(recorded.Request()) {
+			ok = assert.Fail(t, fmt.Sprintf("Expecting request %s to match %s", recorded, matcher)) && ok
+		}
+	}
+	return ok
+}
+
+func (r *RecordingTransport) RequireAllMatch(t require.TestingT, matcher RequestMatcher) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertAllMatch(t, matcher) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertHeaderOnAll asserts that all the recorded requests have the header.
+func (r *RecordingTransport) AssertHeaderOnAll(t assert.TestingT, name string) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	return r.AssertAllMatch(t, MatchHeaderPresent(name))
+}
+
+func (r *RecordingTransport) RequireHeaderOnAll(t require.TestingT, name string) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertHeaderOnAll(t, name) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertOrder asserts that requests matching each of the matchers were sent in the given order.
+// Other requests can be sent in between.
+func (r *RecordingTransport) AssertOrder(t assert.TestingT, matchers ...RequestMatcher) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	requests := r.Requests()
+	next := 0
+	for _, recorded := range requests {
+		if next < len(matchers) && matchers[next].Match(recorded.Request()) {
+			next++
+		}
+	}
+	if next < len(matchers) {
+		return assert.Fail(t, fmt.Sprintf("Expecting a request matching %s after the requests matching the previous criteria\n%s", matchers[next], describeRecordedRequests(requests)))
+	}
+	return true
+}
+
+func (r *RecordingTransport) RequireOrder(t require.TestingT, matchers ...RequestMatcher) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertOrder(t, matchers...) {
+		return
+	}
+	t.FailNow()
+}
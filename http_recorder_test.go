@@ -0,0 +1,135 @@
+package testutils_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingTransport(t *testing.T) {
+	recorder := testutils.NewRecordingTransport(testutils.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body := []byte{}
+		if req.Body != nil {
+			var err error
+			body, err = io.ReadAll(req.Body)
+			require.NoError(t, err)
+		}
+		return testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK).WithBody(testutils.StringBody("echo " + string(body))).Build(), nil
+	}))
+	client := recorder.Client()
+
+	req, err := http.NewRequest(http.MethodPost, "http://api.example.com/users", strings.NewReader(`{"name":"alice"}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `echo {"name":"alice"}`, string(body))
+
+	req, err = http.NewRequest(http.MethodGet, "http://api.example.com/users/alice", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+	_, err = client.Do(req)
+	require.NoError(t, err)
+
+	_, err = client.Get("http://api.example.com/health")
+	require.NoError(t, err)
+
+	requests := recorder.Requests()
+	require.Len(t, requests, 3)
+	assert.Equal(t, http.MethodPost, requests[0].Method)
+	assert.Equal(t, "http://api.example.com/users", requests[0].URL.String())
+	assert.Equal(t, "Bearer token", requests[0].Header.Get("Authorization"))
+	assert.Equal(t, `{"name":"alice"}`, string(requests[0].Body))
+	assert.Equal(t, http.StatusOK, requests[0].Response.StatusCode)
+	assert.NoError(t, requests[0].Err)
+	assert.False(t, requests[0].Start.IsZero())
+	recordedBody, err := io.ReadAll(requests[0].Request().Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"alice"}`, string(recordedBody))
+
+	recorder.AssertCallCount(t, testutils.MatchRequest(http.MethodPost, "/users"), 1)
+	recorder.AssertCallCount(t, testutils.MatchJSONBody(map[string]string{"name": "alice"}), 1)
+	recorder.AssertCallCount(t, testutils.MatchPath("/users/{name}"), 1)
+	recorder.AssertOrder(t, testutils.MatchMethod(http.MethodPost), testutils.MatchPath("/health"))
+
+	t.Run("When the assertions are not met", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, recorder.AssertHeaderOnAll(fakeT, "Authorization"))
+		assert.False(t, recorder.AssertHeaderOnAll(fakeT, "Traceparent"))
+		require.Len(t, fakeT.ErrorMessages, 3)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Expecting request GET http://api.example.com/health to match header Authorization present")
+		assert.Contains(t, fakeT.ErrorMessages[1], "Expecting request GET http://api.example.com/users/alice to match header Traceparent present")
+
+		fakeT = &testutils.FakeTest{}
+		assert.False(t, recorder.AssertCallCount(fakeT, testutils.MatchMethod(http.MethodGet), 1))
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Expecting 1 requests matching method GET but got 2")
+		assert.Contains(t, fakeT.ErrorMessages[0], "\tPOST http://api.example.com/users\n")
+
+		fakeT = &testutils.FakeTest{}
+		recorder.RequireOrder(fakeT, testutils.MatchPath("/health"), testutils.MatchMethod(http.MethodPost))
+		assert.True(t, fakeT.Failed)
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Expecting a request matching method POST after the requests matching the previous criteria")
+	})
+
+	recorder.Reset()
+	assert.Empty(t, recorder.Requests())
+}
+
+func TestRecordingTransportWrapsMockTransport(t *testing.T) {
+	mock := testutils.NewMockTransport(t)
+	mock.On(http.MethodGet, "/users").Respond(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusNoContent))
+	recorder := testutils.NewRecordingTransport(mock)
+
+	_, err := recorder.Client().Get("http://api.example.com/users")
+	require.NoError(t, err)
+
+	requests := recorder.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, http.StatusNoContent, requests[0].Response.StatusCode)
+}
+
+func TestRecordingTransportUpgrades(t *testing.T) {
+	// echoes what the client writes once the connection is upgraded
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buffered.Flush()
+		io.CopyN(conn, buffered, 4)
+	}))
+	defer server.Close()
+
+	recorder := testutils.NewRecordingTransport(nil)
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	resp, err := recorder.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	require.True(t, ok, "the body of upgraded connections must be writable")
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	echo := make([]byte, 4)
+	_, err = io.ReadFull(conn, echo)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echo))
+	assert.Equal(t, "ping", string(recorder.Requests()[0].ResponseBody()))
+}
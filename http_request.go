@@ -0,0 +1,382 @@
+package testutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// HTTPRequestBuilder builds server-side requests to test HTTP handlers, as received by a server.
+//
+//	resp := testutils.NewHTTPRequestBuilder().WithTB(t).
+//		WithMethod(http.MethodPost).
+//		WithURL("/users").
+//		WithJsonBody(user).
+//		Serve(handler)
+//	resp.RequireStatus(t, http.StatusCreated)
+//	resp.AssertJSONPath(t, "$.name", "alice")
+type HTTPRequestBuilder struct {
+	tb         testing.TB
+	method     string
+	target     string
+	query      url.Values
+	header     http.Header
+	body       []byte
+	cookies    []*http.Cookie
+	tls        *tls.ConnectionState
+	remoteAddr string
+	ctx        context.Context
+}
+
+func NewHTTPRequestBuilder() *HTTPRequestBuilder {
+	return &HTTPRequestBuilder{
+		method: http.MethodGet,
+		target: "/",
+		query:  url.Values{},
+		header: http.Header{},
+		ctx:    context.Background(),
+	}
+}
+
+func (b *HTTPRequestBuilder) WithTB(tb testing.TB) *HTTPRequestBuilder {
+	b.tb = tb
+	return b
+}
+
+func (b *HTTPRequestBuilder) noError(err error) {
+	if b.tb != nil {
+		b.tb.Helper()
+		assert.NoError(b.tb, err)
+	}
+}
+
+func (b *HTTPRequestBuilder) WithMethod(method string) *HTTPRequestBuilder {
+	b.method = method
+	return b
+}
+
+// WithURL sets the request target, either a path like "/users?page=2" or an absolute URL.
+// Requests to https URLs have a TLS connection state.
+func (b *HTTPRequestBuilder) WithURL(target string) *HTTPRequestBuilder {
+	b.target = target
+	return b
+}
+
+// WithQuery adds the value to the query parameter.
+func (b *HTTPRequestBuilder) WithQuery(name, value string) *HTTPRequestBuilder {
+	b.query.Add(name, value)
+	return b
+}
+
+// WithHeader adds the value to the header.
+func (b *HTTPRequestBuilder) WithHeader(name, value string) *HTTPRequestBuilder {
+	b.header.Add(name, value)
+	return b
+}
+
+func (b *HTTPRequestBuilder) WithCookie(cookie *http.Cookie) *HTTPRequestBuilder {
+	b.cookies = append(b.cookies, cookie)
+	return b
+}
+
+func (b *HTTPRequestBuilder) WithBasicAuth(username, password string) *HTTPRequestBuilder {
+	req := http.Request{Header: http.Header{}}
+	req.SetBasicAuth(username, password)
+	b.header.Set("Authorization", req.Header.Get("Authorization"))
+	return b
+}
+
+func (b *HTTPRequestBuilder) WithBearerToken(token string) *HTTPRequestBuilder {
+	b.header.Set("Authorization", "Bearer "+token)
+	return b
+}
+
+func (b *HTTPRequestBuilder) WithBody(body io.Reader) *HTTPRequestBuilder {
+	data, err := io.ReadAll(body)
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	b.noError(err)
+	b.body = data
+	return b
+}
+
+func (b *HTTPRequestBuilder) withBytesBody(data []byte, contentType string) *HTTPRequestBuilder {
+	b.body = data
+	b.header.Set("Content-Type", contentType)
+	return b
+}
+
+func (b *HTTPRequestBuilder) WithJsonBody(body interface{}) *HTTPRequestBuilder {
+	data, err := json.Marshal(body)
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	b.noError(err)
+	return b.withBytesBody(data, "application/json")
+}
+
+func (b *HTTPRequestBuilder) WithYAMLBody(body interface{}) *HTTPRequestBuilder {
+	data, err := yaml.Marshal(body)
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	b.noError(err)
+	return b.withBytesBody(data, "application/yaml")
+}
+
+func (b *HTTPRequestBuilder) WithFormBody(values url.Values) *HTTPRequestBuilder {
+	return b.withBytesBody([]byte(values.Encode()), "application/x-www-form-urlencoded")
+}
+
+// WithMultipartBody sends a multipart/form-data body made of the fields, in alphabetical order,
+// followed by the files.
+func (b *HTTPRequestBuilder) WithMultipartBody(fields url.Values, files ...MultipartFile) *HTTPRequestBuilder {
+	data, contentType, err := encodeMultipart(fields, files)
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	b.noError(err)
+	return b.withBytesBody(data, contentType)
+}
+
+// WithTLS sets the TLS connection state of the request.
+// When state is nil, a completed TLS 1.3 handshake is used.
+func (b *HTTPRequestBuilder) WithTLS(state *tls.ConnectionState) *HTTPRequestBuilder {
+	if state == nil {
+		state = &tls.ConnectionState{Version: tls.VersionTLS13, HandshakeComplete: true}
+	}
+	b.tls = state
+	return b
+}
+
+// WithRemoteAddr sets the address of the client, like "203.0.113.7:5123".
+func (b *HTTPRequestBuilder) WithRemoteAddr(addr string) *HTTPRequestBuilder {
+	b.remoteAddr = addr
+	return b
+}
+
+func (b *HTTPRequestBuilder) WithContext(ctx context.Context) *HTTPRequestBuilder {
+	b.ctx = ctx
+	return b
+}
+
+// WithContextValue adds the value to the request context, as middlewares usually do.
+func (b *HTTPRequestBuilder) WithContextValue(key, value interface{}) *HTTPRequestBuilder {
+	b.ctx = context.WithValue(b.ctx, key, value)
+	return b
+}
+
+// Build returns the request, as received by an http.Handler.
+// When the method or the URL is invalid, the error is reported to the test and a GET / request is returned.
+func (b *HTTPRequestBuilder) Build() *http.Request {
+	if b.tb != nil {
+		b.tb.Helper()
+	}
+	req, err := http.NewRequestWithContext(b.ctx, b.method, b.target, bytes.NewReader(b.body))
+	b.noError(err)
+	if err != nil {
+		req, _ = http.NewRequestWithContext(b.ctx, http.MethodGet, "/", http.NoBody)
+	}
+	req.GetBody = nil
+	req.RequestURI = req.URL.RequestURI()
+	if req.URL.IsAbs() {
+		req.RequestURI = req.URL.String()
+	}
+	if req.Host == "" {
+		req.Host = "example.com"
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	if req.URL.Scheme == "https" {
+		req.TLS = &tls.ConnectionState{Version: tls.VersionTLS12, HandshakeComplete: true, ServerName: req.Host}
+	}
+	if len(b.query) > 0 {
+		query := req.URL.Query()
+		for name, values := range b.query {
+			query[name] = append(query[name], values...)
+		}
+		req.URL.RawQuery = query.Encode()
+		req.RequestURI = req.URL.RequestURI()
+	}
+	for name, values := range b.header {
+		req.Header[name] = append([]string{}, values...)
+	}
+	for _, cookie := range b.cookies {
+		req.AddCookie(cookie)
+	}
+	if b.tls != nil {
+		req.TLS = b.tls
+	}
+	if b.remoteAddr != "" {
+		req.RemoteAddr = b.remoteAddr
+	}
+	return req
+}
+
+// Serve builds the request and serves it with the handler wrapped by the middlewares.
+func (b *HTTPRequestBuilder) Serve(handler http.Handler, middlewares ...func(http.Handler) http.Handler) *HandlerResponse {
+	return ServeRequest(b.Build(), handler, middlewares...)
+}
+
+// Chain wraps the handler with the middlewares. The first middleware is the outermost one.
+func Chain(handler http.Handler, middlewares ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// HandlerResponse is the response of a handler served with ServeRequest.
+type HandlerResponse struct {
+	Request  *http.Request
+	Response *http.Response
+	Body     []byte
+}
+
+// ServeRequest serves the request with the handler wrapped by the middlewares and records the response.
+func ServeRequest(req *http.Request, handler http.Handler, middlewares ...func(http.Handler) http.Handler) *HandlerResponse {
+	recorder := httptest.NewRecorder()
+	Chain(handler, middlewares...).ServeHTTP(recorder, req)
+	resp := recorder.Result()
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return &HandlerResponse{Request: req, Response: resp, Body: body}
+}
+
+func (r *HandlerResponse) describe() string {
+	return fmt.Sprintf("response to %s %s: %s\n%s", r.Request.Method, r.Request.URL, r.Response.Status, string(r.Body))
+}
+
+// JSON decodes the body in v.
+func (r *HandlerResponse) JSON(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// JSONPath evaluates the JSONPath expression on the body, as described in EvaluateJSONPath.
+// Paths selecting a single node, like "$.items[0].name", return the node, other paths return the list of nodes.
+func (r *HandlerResponse) JSONPath(path string) (interface{}, error) {
+	var document interface{}
+	if err := r.JSON(&document); err != nil {
+		return nil, err
+	}
+	return evaluateJSONPathValue(document, path)
+}
+
+func (r *HandlerResponse) AssertStatus(t assert.TestingT, expected int, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.Response.StatusCode != expected {
+		return assert.Fail(t, fmt.Sprintf("Expecting status %d but got %d\n%s", expected, r.Response.StatusCode, r.describe()), msgAndArgs...)
+	}
+	return true
+}
+
+func (r *HandlerResponse) RequireStatus(t require.TestingT, expected int, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertStatus(t, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+func (r *HandlerResponse) AssertHeader(t assert.TestingT, name, expected string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if actual := r.Response.Header.Values(name); !containsString(actual, expected) {
+		return assert.Fail(t, fmt.Sprintf("Expecting header %s to be %q but got %q\n%s", http.CanonicalHeaderKey(name), expected, actual, r.describe()), msgAndArgs...)
+	}
+	return true
+}
+
+func (r *HandlerResponse) RequireHeader(t require.TestingT, name, expected string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertHeader(t, name, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+func (r *HandlerResponse) AssertBody(t assert.TestingT, expected string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	return assert.Equal(t, expected, string(r.Body), msgAndArgs...)
+}
+
+func (r *HandlerResponse) RequireBody(t require.TestingT, expected string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertBody(t, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+func (r *HandlerResponse) AssertBodyContains(t assert.TestingT, expected string, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if !strings.Contains(string(r.Body), expected) {
+		return assert.Fail(t, fmt.Sprintf("Expecting the body to contain %q\n%s", expected, r.describe()), msgAndArgs...)
+	}
+	return true
+}
+
+func (r *HandlerResponse) RequireBodyContains(t require.TestingT, expected string, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertBodyContains(t, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertJSONPath asserts that the JSONPath expression selects the expected value.
+// The expected value is compared once encoded to JSON, so that 1 equals 1.0.
+func (r *HandlerResponse) AssertJSONPath(t assert.TestingT, path string, expected interface{}, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	actual, err := r.JSONPath(path)
+	if err != nil {
+		return assert.Fail(t, fmt.Sprintf("Unable to evaluate %s: %s\n%s", path, err, r.describe()), msgAndArgs...)
+	}
+	normalized, err := normalizeJSON(expected)
+	if err != nil {
+		return assert.Fail(t, fmt.Sprintf("Unable to encode the expected value: %s", err), msgAndArgs...)
+	}
+	if !assert.ObjectsAreEqual(normalized, actual) {
+		return assert.Fail(t, fmt.Sprintf("Expecting %s to be %#v but got %#v\n%s", path, normalized, actual, r.describe()), msgAndArgs...)
+	}
+	return true
+}
+
+func (r *HandlerResponse) RequireJSONPath(t require.TestingT, path string, expected interface{}, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertJSONPath(t, path, expected, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
@@ -0,0 +1,157 @@
+package testutils_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type contextKey string
+
+func TestHTTPRequestBuilder(t *testing.T) {
+	req := testutils.NewHTTPRequestBuilder().WithTB(t).
+		WithMethod(http.MethodPost).
+		WithURL("https://api.example.com/users?page=1").
+		WithQuery("sort", "name").
+		WithHeader("X-Request-Id", "42").
+		WithCookie(&http.Cookie{Name: "session", Value: "abc"}).
+		WithBasicAuth("alice", "secret").
+		WithJsonBody(map[string]string{"name": "alice"}).
+		WithRemoteAddr("203.0.113.7:5123").
+		WithContextValue(contextKey("tenant"), "acme").
+		Build()
+
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "api.example.com", req.Host)
+	assert.Equal(t, "1", req.URL.Query().Get("page"))
+	assert.Equal(t, "name", req.URL.Query().Get("sort"))
+	assert.Equal(t, "/users?page=1&sort=name", req.RequestURI)
+	assert.Equal(t, "42", req.Header.Get("X-Request-Id"))
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	cookie, err := req.Cookie("session")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", cookie.Value)
+	username, password, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "alice", username)
+	assert.Equal(t, "secret", password)
+	assert.NotNil(t, req.TLS)
+	assert.Equal(t, "203.0.113.7:5123", req.RemoteAddr)
+	assert.Equal(t, "acme", req.Context().Value(contextKey("tenant")))
+	body := map[string]string{}
+	require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+	assert.Equal(t, map[string]string{"name": "alice"}, body)
+
+	req = testutils.NewHTTPRequestBuilder().WithURL("/login").WithFormBody(url.Values{"user": {"bob"}}).WithMethod(http.MethodPost).Build()
+	require.NoError(t, req.ParseForm())
+	assert.Equal(t, "bob", req.PostForm.Get("user"))
+	assert.Nil(t, req.TLS)
+
+	req = testutils.NewHTTPRequestBuilder().WithTB(t).WithMethod(http.MethodPost).WithMultipartBody(
+		url.Values{"name": {"alice"}},
+		testutils.MultipartFile{FieldName: "avatar", FileName: "alice.png", Content: []byte("png")},
+	).Build()
+	require.NoError(t, req.ParseMultipartForm(1024))
+	assert.Equal(t, "alice", req.FormValue("name"))
+	assert.Equal(t, "alice.png", req.MultipartForm.File["avatar"][0].Filename)
+
+	req = testutils.NewHTTPRequestBuilder().WithURL("/users/42").Build()
+	assert.Equal(t, "example.com", req.Host)
+	assert.Equal(t, "/users/42", req.RequestURI)
+	assert.Equal(t, "/users/42", req.URL.Path)
+
+	tb := &fakeTB{TB: t}
+	req = testutils.NewHTTPRequestBuilder().WithTB(tb).WithMethod("BAD METHOD").WithURL("/users").Build()
+	require.Len(t, tb.fake.ErrorMessages, 1)
+	assert.Contains(t, tb.fake.ErrorMessages[0], `invalid method "BAD METHOD"`)
+	assert.Equal(t, http.MethodGet, req.Method)
+	assert.Equal(t, "/", req.URL.Path)
+
+	tb = &fakeTB{TB: t}
+	testutils.NewHTTPRequestBuilder().WithTB(tb).WithURL("/%zz").Build()
+	require.Len(t, tb.fake.ErrorMessages, 1)
+	assert.Contains(t, tb.fake.ErrorMessages[0], "invalid URL escape")
+}
+
+// fakeTB records the errors reported to a testing.TB instead of failing the test.
+type fakeTB struct {
+	testing.TB
+	fake testutils.FakeTest
+}
+
+func (t *fakeTB) Errorf(msg string, args ...interface{}) {
+	t.fake.Errorf(msg, args...)
+}
+
+func (t *fakeTB) Helper() {}
+
+func TestServeRequest(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Context().Value(contextKey("user")) == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"user":   r.Context().Value(contextKey("user")),
+			"tenant": r.Header.Get("X-Tenant"),
+			"items":  []map[string]interface{}{{"id": 1, "tags": []string{"a"}}, {"id": 2}},
+		})
+	})
+	authenticate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, _, ok := r.BasicAuth(); ok {
+				r = r.WithContext(context.WithValue(r.Context(), contextKey("user"), user))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	tenant := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("X-Tenant", "acme")
+			w.Header().Set("X-Middleware", "tenant")
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	resp := testutils.NewHTTPRequestBuilder().WithURL("/me").WithBasicAuth("alice", "secret").Serve(handler, tenant, authenticate)
+	resp.RequireStatus(t, http.StatusOK)
+	resp.AssertHeader(t, "x-middleware", "tenant")
+	resp.AssertJSONPath(t, "$.user", "alice")
+	resp.AssertJSONPath(t, "$.tenant", "acme")
+	resp.AssertJSONPath(t, "$.items[1].id", 2)
+	resp.AssertJSONPath(t, "$.items[*].id", []int{1, 2})
+	resp.AssertBodyContains(t, `"tags":["a"]`)
+
+	resp = testutils.ServeRequest(testutils.NewHTTPRequestBuilder().WithURL("/me").Build(), handler, authenticate)
+	resp.AssertStatus(t, http.StatusUnauthorized)
+	resp.AssertBody(t, `{"error":"unauthorized"}`+"\n")
+
+	t.Run("When the assertions fail", func(t *testing.T) {
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, resp.AssertStatus(fakeT, http.StatusOK))
+		assert.False(t, resp.AssertHeader(fakeT, "Content-Type", "text/plain"))
+		assert.False(t, resp.AssertJSONPath(fakeT, "$.error", "forbidden"))
+		assert.False(t, resp.AssertJSONPath(fakeT, "$.missing", "value"))
+		assert.False(t, resp.AssertBodyContains(fakeT, "alice"))
+		require.Len(t, fakeT.ErrorMessages, 5)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Expecting status 200 but got 401")
+		assert.Contains(t, fakeT.ErrorMessages[0], "response to GET /me: 401 Unauthorized")
+		assert.Contains(t, fakeT.ErrorMessages[0], `{"error":"unauthorized"}`)
+		assert.Contains(t, fakeT.ErrorMessages[1], `Expecting header Content-Type to be "text/plain" but got ["application/json"]`)
+		assert.Contains(t, fakeT.ErrorMessages[2], `Expecting $.error to be "forbidden" but got "unauthorized"`)
+		assert.Contains(t, fakeT.ErrorMessages[3], "Unable to evaluate $.missing: no value at $.missing")
+		assert.Contains(t, fakeT.ErrorMessages[4], `Expecting the body to contain "alice"`)
+
+		fakeT = &testutils.FakeTest{}
+		resp.RequireStatus(fakeT, http.StatusOK)
+		assert.True(t, fakeT.Failed)
+	})
+}
@@ -1,11 +1,22 @@
 package testutils_test
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -19,3 +30,104 @@ func TestHTTPRresponseBuilder(t *testing.T) {
 	assert.JSONEq(t, `{"hello": "world"}`, string(body))
 	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
 }
+
+func TestHTTPResponseBuilderBuildsValidResponses(t *testing.T) {
+	resp := testutils.NewHTTPResponseBuilder().Build()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "200 OK", resp.Status)
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+	assert.NotNil(t, resp.Header)
+	assert.Equal(t, http.NoBody, resp.Body)
+	assert.EqualValues(t, 0, resp.ContentLength)
+
+	resp = testutils.NewHTTPResponseBuilder().
+		WithStatusCode(http.StatusCreated).
+		WithHeader("X-Request-Id", "42").
+		WithCookie(&http.Cookie{Name: "session", Value: "abc", HttpOnly: true}).
+		WithJsonBody(map[string]string{"hello": "world"}).
+		Build()
+	dump := bytes.Buffer{}
+	require.NoError(t, resp.Write(&dump))
+	parsed, err := http.ReadResponse(bufio.NewReader(&dump), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "201 Created", parsed.Status)
+	assert.Equal(t, "42", parsed.Header.Get("X-Request-Id"))
+	assert.EqualValues(t, len(`{"hello":"world"}`+"\n"), parsed.ContentLength)
+	require.Len(t, parsed.Cookies(), 1)
+	assert.Equal(t, "abc", parsed.Cookies()[0].Value)
+	body, err := io.ReadAll(parsed.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"hello":"world"}`, string(body))
+
+	resp = testutils.NewHTTPResponseBuilder().WithBody(testutils.StringBody("streamed")).WithTrailer("X-Checksum", "abc").Build()
+	dump = bytes.Buffer{}
+	require.NoError(t, resp.Write(&dump))
+	parsed, err = http.ReadResponse(bufio.NewReader(&dump), nil)
+	require.NoError(t, err)
+	body, err = io.ReadAll(parsed.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "streamed", string(body))
+	assert.Equal(t, "abc", parsed.Trailer.Get("X-Checksum"))
+}
+
+func TestHTTPResponseBuilderBodies(t *testing.T) {
+	readBody := func(t *testing.T, resp *http.Response) string {
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.EqualValues(t, len(body), resp.ContentLength)
+		return string(body)
+	}
+
+	resp := testutils.NewHTTPResponseBuilder().WithTB(t).WithYAMLBody(map[string]string{"hello": "world"}).Build()
+	assert.Equal(t, "application/yaml", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "hello: world\n", readBody(t, resp))
+
+	resp = testutils.NewHTTPResponseBuilder().WithTB(t).WithXMLBody(struct {
+		XMLName xml.Name `xml:"user"`
+		Name    string   `xml:"name"`
+	}{Name: "alice"}).Build()
+	assert.Equal(t, "application/xml", resp.Header.Get("Content-Type"))
+	assert.Equal(t, xml.Header+"<user><name>alice</name></user>", readBody(t, resp))
+
+	resp = testutils.NewHTTPResponseBuilder().WithFormBody(url.Values{"b": {"2"}, "a": {"1"}}).Build()
+	assert.Equal(t, "application/x-www-form-urlencoded", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "a=1&b=2", readBody(t, resp))
+
+	resp = testutils.NewHTTPResponseBuilder().WithTB(t).WithMultipartBody(
+		url.Values{"name": {"alice"}},
+		testutils.MultipartFile{FieldName: "avatar", FileName: "alice.png", ContentType: "image/png", Content: []byte("png")},
+	).Build()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/form-data", mediaType)
+	form, err := multipart.NewReader(resp.Body, params["boundary"]).ReadForm(1024)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, form.Value["name"])
+	require.Len(t, form.File["avatar"], 1)
+	assert.Equal(t, "alice.png", form.File["avatar"][0].Filename)
+	assert.Equal(t, "image/png", form.File["avatar"][0].Header.Get("Content-Type"))
+
+	fs := afero.NewMemMapFs()
+	testutils.EnsureFileContent(t, fs, "/users.json", `[{"name":"alice"}]`)
+	resp = testutils.NewHTTPResponseBuilder().WithTB(t).WithFileBody(fs, "/users.json").Build()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `[{"name":"alice"}]`, readBody(t, resp))
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/old", nil)
+	require.NoError(t, err)
+	resp = testutils.NewHTTPResponseBuilder().WithRedirect(http.StatusMovedPermanently, "/new").WithRequest(req).Build()
+	assert.Equal(t, "301 Moved Permanently", resp.Status)
+	assert.Equal(t, "/new", resp.Header.Get("Location"))
+	location, err := resp.Location()
+	require.NoError(t, err)
+	assert.Equal(t, "http://example.com/new", location.String())
+}
+
+func TestHTTPResponseBuilderReplayedBodyErrors(t *testing.T) {
+	tb := &fakeTB{TB: t}
+	body := io.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("connection reset"))))
+	mock := testutils.NewMockTransport(nil)
+	mock.On(http.MethodGet, "/users").Respond(testutils.NewHTTPResponseBuilder().WithTB(tb).WithBody(body))
+	require.Len(t, tb.fake.ErrorMessages, 1)
+	assert.Contains(t, tb.fake.ErrorMessages[0], "connection reset")
+}
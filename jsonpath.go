@@ -0,0 +1,449 @@
+package testutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// jsonPathSelector selects the children of a node.
+type jsonPathSelector func(node interface{}) []interface{}
+
+type jsonPathSegment struct {
+	selector   jsonPathSelector
+	descendant bool
+}
+
+type jsonPath struct {
+	segments []jsonPathSegment
+	// definite paths select at most one node
+	definite bool
+}
+
+// EvaluateJSONPath returns the nodes of the decoded JSON document selected by the JSONPath expression.
+//
+// The supported syntax covers the root "$", child members ".name" and "['name']", array indexes "[0]" and "[-1]",
+// unions "[0,2]", slices "[1:3]", wildcards ".*" and "[*]", recursive descent "..name",
+// and filters like "[?(@.price < 10)]", "[?(@.name == 'alice')]" or "[?(@.email)]".
+func EvaluateJSONPath(document interface{}, path string) ([]interface{}, error) {
+	parsed, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.evaluate(document), nil
+}
+
+func (p jsonPath) evaluate(document interface{}) []interface{} {
+	nodes := []interface{}{document}
+	for _, segment := range p.segments {
+		selected := []interface{}{}
+		for _, node := range nodes {
+			if segment.descendant {
+				for _, descendant := range jsonDescendants(node) {
+					selected = append(selected, segment.selector(descendant)...)
+				}
+			} else {
+				selected = append(selected, segment.selector(node)...)
+			}
+		}
+		nodes = selected
+	}
+	return nodes
+}
+
+// jsonDescendants returns the node and all its descendants, in document order.
+func jsonDescendants(node interface{}) []interface{} {
+	nodes := []interface{}{node}
+	for _, child := range jsonChildren(node) {
+		nodes = append(nodes, jsonDescendants(child)...)
+	}
+	return nodes
+}
+
+// jsonChildren returns the values of an object, sorted by key, or the elements of an array.
+func jsonChildren(node interface{}) []interface{} {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		children := make([]interface{}, 0, len(value))
+		for _, key := range keys {
+			children = append(children, value[key])
+		}
+		return children
+	case []interface{}:
+		return value
+	}
+	return nil
+}
+
+func selectMember(name string) jsonPathSelector {
+	return func(node interface{}) []interface{} {
+		if object, ok := node.(map[string]interface{}); ok {
+			if value, ok := object[name]; ok {
+				return []interface{}{value}
+			}
+		}
+		return nil
+	}
+}
+
+func selectIndex(index int) jsonPathSelector {
+	return func(node interface{}) []interface{} {
+		array, ok := node.([]interface{})
+		if !ok {
+			return nil
+		}
+		i := index
+		if i < 0 {
+			i += len(array)
+		}
+		if i < 0 || i >= len(array) {
+			return nil
+		}
+		return []interface{}{array[i]}
+	}
+}
+
+func selectSlice(start, end *int, step int) jsonPathSelector {
+	return func(node interface{}) []interface{} {
+		array, ok := node.([]interface{})
+		if !ok || step <= 0 {
+			return nil
+		}
+		bound := func(i *int, defaultValue int) int {
+			if i == nil {
+				return defaultValue
+			}
+			v := *i
+			if v < 0 {
+				v += len(array)
+			}
+			if v < 0 {
+				return 0
+			}
+			if v > len(array) {
+				return len(array)
+			}
+			return v
+		}
+		selected := []interface{}{}
+		for i := bound(start, 0); i < bound(end, len(array)); i += step {
+			selected = append(selected, array[i])
+		}
+		return selected
+	}
+}
+
+func selectUnion(selectors []jsonPathSelector) jsonPathSelector {
+	return func(node interface{}) []interface{} {
+		selected := []interface{}{}
+		for _, selector := range selectors {
+			selected = append(selected, selector(node)...)
+		}
+		return selected
+	}
+}
+
+func parseJSONPath(path string) (jsonPath, error) {
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "$") && !strings.HasPrefix(path, "@") {
+		return jsonPath{}, fmt.Errorf("invalid JSONPath %q: must start with $", path)
+	}
+	parsed := jsonPath{definite: true}
+	rest := path[1:]
+	for rest != "" {
+		descendant := false
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			descendant = true
+			parsed.definite = false
+			rest = rest[2:]
+			if strings.HasPrefix(rest, "[") {
+				break
+			}
+			fallthrough
+		case strings.HasPrefix(rest, "."):
+			rest = strings.TrimPrefix(rest, ".")
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			if name == "" {
+				return jsonPath{}, fmt.Errorf("invalid JSONPath %q: empty member name", path)
+			}
+			if name == "*" {
+				parsed.definite = false
+				parsed.segments = append(parsed.segments, jsonPathSegment{selector: jsonChildren, descendant: descendant})
+			} else {
+				parsed.segments = append(parsed.segments, jsonPathSegment{selector: selectMember(name), descendant: descendant})
+			}
+			continue
+		}
+		if !strings.HasPrefix(rest, "[") {
+			return jsonPath{}, fmt.Errorf("invalid JSONPath %q: unexpected %q", path, rest)
+		}
+		end := closingBracket(rest)
+		if end < 0 {
+			return jsonPath{}, fmt.Errorf("invalid JSONPath %q: missing ]", path)
+		}
+		selector, definite, err := parseJSONPathBracket(rest[1:end])
+		if err != nil {
+			return jsonPath{}, fmt.Errorf("invalid JSONPath %q: %w", path, err)
+		}
+		parsed.definite = parsed.definite && definite
+		parsed.segments = append(parsed.segments, jsonPathSegment{selector: selector, descendant: descendant})
+		rest = rest[end+1:]
+	}
+	return parsed, nil
+}
+
+// closingBracket returns the index of the bracket closing the one starting s, ignoring quoted strings and nested brackets.
+func closingBracket(s string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '\'' || s[i] == '"':
+			quote = s[i]
+		case s[i] == '[' || s[i] == '(':
+			depth++
+		case s[i] == ']' || s[i] == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func parseJSONPathBracket(content string) (jsonPathSelector, bool, error) {
+	content = strings.TrimSpace(content)
+	switch {
+	case content == "*":
+		return jsonChildren, false, nil
+	case strings.HasPrefix(content, "?"):
+		filter, err := parseJSONPathFilter(strings.TrimSpace(content[1:]))
+		return filter, false, err
+	case strings.Contains(content, ":") && !strings.ContainsAny(content, `'"`):
+		parts := strings.Split(content, ":")
+		if len(parts) > 3 {
+			return nil, false, fmt.Errorf("invalid slice [%s]", content)
+		}
+		bounds := []*int{nil, nil}
+		step := 1
+		for i, part := range parts {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			v, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid slice [%s]", content)
+			}
+			if i == 2 {
+				step = v
+			} else {
+				bounds[i] = &v
+			}
+		}
+		return selectSlice(bounds[0], bounds[1], step), false, nil
+	}
+	selectors := []jsonPathSelector{}
+	for _, item := range splitOutsideQuotes(content, ',') {
+		item = strings.TrimSpace(item)
+		if len(item) >= 2 && (item[0] == '\'' || item[0] == '"') && item[len(item)-1] == item[0] {
+			selectors = append(selectors, selectMember(unquoteJSONPathString(item)))
+			continue
+		}
+		index, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid selector [%s]", content)
+		}
+		selectors = append(selectors, selectIndex(index))
+	}
+	if len(selectors) == 1 {
+		return selectors[0], true, nil
+	}
+	return selectUnion(selectors), false, nil
+}
+
+func unquoteJSONPathString(s string) string {
+	s = s[1 : len(s)-1]
+	return strings.NewReplacer(`\'`, `'`, `\"`, `"`, `\\`, `\`).Replace(s)
+}
+
+func splitOutsideQuotes(s string, separator byte) []string {
+	parts := []string{}
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '\'' || s[i] == '"':
+			quote = s[i]
+		case s[i] == separator:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var jsonPathOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func parseJSONPathFilter(expression string) (jsonPathSelector, error) {
+	if !strings.HasPrefix(expression, "(") || !strings.HasSuffix(expression, ")") {
+		return nil, fmt.Errorf("invalid filter %q", expression)
+	}
+	expression = strings.TrimSpace(expression[1 : len(expression)-1])
+	operator := ""
+	left, right := expression, ""
+	for _, op := range jsonPathOperators {
+		parts := splitOutsideQuotesOn(expression, op)
+		if len(parts) == 2 {
+			operator = op
+			left, right = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			break
+		}
+	}
+	if !strings.HasPrefix(left, "@") {
+		return nil, fmt.Errorf("invalid filter %q: must start with @", expression)
+	}
+	relative, err := parseJSONPath(left)
+	if err != nil {
+		return nil, err
+	}
+	var literal interface{}
+	if operator != "" {
+		if len(right) >= 2 && right[0] == '\'' && right[len(right)-1] == '\'' {
+			literal = unquoteJSONPathString(right)
+		} else if err := json.Unmarshal([]byte(right), &literal); err != nil {
+			return nil, fmt.Errorf("invalid filter %q: invalid value %s", expression, right)
+		}
+	}
+	return func(node interface{}) []interface{} {
+		selected := []interface{}{}
+		for _, child := range jsonChildren(node) {
+			values := relative.evaluate(child)
+			if len(values) == 0 {
+				continue
+			}
+			if operator == "" || compareJSONValues(values[0], operator, literal) {
+				selected = append(selected, child)
+			}
+		}
+		return selected
+	}, nil
+}
+
+// splitOutsideQuotesOn splits s around the first occurrence of sep outside of quoted strings.
+func splitOutsideQuotesOn(s, sep string) []string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '\'' || s[i] == '"':
+			quote = s[i]
+		case strings.HasPrefix(s[i:], sep):
+			return []string{s[:i], s[i+len(sep):]}
+		}
+	}
+	return []string{s}
+}
+
+func compareJSONValues(actual interface{}, operator string, expected interface{}) bool {
+	switch operator {
+	case "==":
+		return assert.ObjectsAreEqual(expected, actual)
+	case "!=":
+		return !assert.ObjectsAreEqual(expected, actual)
+	}
+	switch a := actual.(type) {
+	case float64:
+		e, ok := expected.(float64)
+		if !ok {
+			return false
+		}
+		switch operator {
+		case "<":
+			return a < e
+		case "<=":
+			return a <= e
+		case ">":
+			return a > e
+		case ">=":
+			return a >= e
+		}
+	case string:
+		e, ok := expected.(string)
+		if !ok {
+			return false
+		}
+		switch operator {
+		case "<":
+			return a < e
+		case "<=":
+			return a <= e
+		case ">":
+			return a > e
+		case ">=":
+			return a >= e
+		}
+	}
+	return false
+}
+
+// normalizeJSON converts the value to the types encoding/json decodes into interface{} values.
+func normalizeJSON(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normalized interface{}
+	err = json.Unmarshal(data, &normalized)
+	return normalized, err
+}
+
+// evaluateJSONPathValue evaluates the path and returns a single node for definite paths,
+// or the list of selected nodes.
+func evaluateJSONPathValue(document interface{}, path string) (interface{}, error) {
+	parsed, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	nodes := parsed.evaluate(document)
+	if parsed.definite {
+		if len(nodes) == 0 {
+			return nil, fmt.Errorf("no value at %s", path)
+		}
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
@@ -0,0 +1,80 @@
+package testutils_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const jsonPathStore = `{
+	"store": {
+		"book": [
+			{"category": "reference", "author": "Nigel Rees", "title": "Sayings of the Century", "price": 8.95},
+			{"category": "fiction", "author": "Evelyn Waugh", "title": "Sword of Honour", "price": 12.99},
+			{"category": "fiction", "author": "Herman Melville", "title": "Moby Dick", "isbn": "0-553-21311-3", "price": 8.99},
+			{"category": "fiction", "author": "J. R. R. Tolkien", "title": "The Lord of the Rings", "isbn": "0-395-19395-8", "price": 22.99}
+		],
+		"bicycle": {"color": "red", "price": 19.95},
+		"the shop's name": "Books & Bikes"
+	}
+}`
+
+func TestEvaluateJSONPath(t *testing.T) {
+	var document interface{}
+	require.NoError(t, json.Unmarshal([]byte(jsonPathStore), &document))
+
+	for path, expected := range map[string]string{
+		"$.store.bicycle.color":                           `["red"]`,
+		"$['store']['bicycle']['price']":                  `[19.95]`,
+		`$.store["the shop's name"]`:                      `["Books & Bikes"]`,
+		"$.store.book[0].title":                           `["Sayings of the Century"]`,
+		"$.store.book[-1].title":                          `["The Lord of the Rings"]`,
+		"$.store.book[0,2].price":                         `[8.95, 8.99]`,
+		"$.store.book[1:3].author":                        `["Evelyn Waugh", "Herman Melville"]`,
+		"$.store.book[:2].price":                          `[8.95, 12.99]`,
+		"$.store.book[::2].price":                         `[8.95, 8.99]`,
+		"$.store.book[*].category":                        `["reference", "fiction", "fiction", "fiction"]`,
+		"$.store.bicycle.*":                               `["red", 19.95]`,
+		"$..isbn":                                         `["0-553-21311-3", "0-395-19395-8"]`,
+		"$..book[1].price":                                `[12.99]`,
+		"$.store.book[?(@.isbn)].title":                   `["Moby Dick", "The Lord of the Rings"]`,
+		"$.store.book[?(@.price < 10)].title":             `["Sayings of the Century", "Moby Dick"]`,
+		"$.store.book[?(@.price >= 12.99)].price":         `[12.99, 22.99]`,
+		"$..book[?(@.author == 'Herman Melville')].title": `["Moby Dick"]`,
+		"$..book[?(@.category != 'fiction')].title":       `["Sayings of the Century"]`,
+		"$.store.missing":                                 `[]`,
+		"$.store.book[10]":                                `[]`,
+		"$":                                               jsonPathStore,
+	} {
+		t.Run(path, func(t *testing.T) {
+			actual, err := testutils.EvaluateJSONPath(document, path)
+			require.NoError(t, err)
+			if path == "$" {
+				require.Len(t, actual, 1)
+				assert.Equal(t, document, actual[0])
+				return
+			}
+			data, err := json.Marshal(actual)
+			require.NoError(t, err)
+			assert.JSONEq(t, expected, string(data))
+		})
+	}
+
+	t.Run("When a negative index follows a wildcard over arrays of different lengths", func(t *testing.T) {
+		var items interface{}
+		require.NoError(t, json.Unmarshal([]byte(`{"items": [{"tags": ["a", "b", "c"]}, {"tags": ["d", "e", "f", "g", "h"]}]}`), &items))
+		actual, err := testutils.EvaluateJSONPath(items, "$.items[*].tags[-1]")
+		require.NoError(t, err)
+		assert.Equal(t, []interface{}{"c", "h"}, actual)
+	})
+
+	for _, path := range []string{"store", "$.", "$.store.book[", "$.store.book[a]", "$.store.book[?(price < 1)]"} {
+		t.Run("When the path is invalid: "+path, func(t *testing.T) {
+			_, err := testutils.EvaluateJSONPath(document, path)
+			assert.Error(t, err)
+		})
+	}
+}
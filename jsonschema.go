@@ -0,0 +1,280 @@
+package testutils
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ValidateJSONSchema validates a decoded JSON document against a decoded JSON schema,
+// and returns the violations found, prefixed with the JSON pointer of the invalid value.
+//
+// It supports a subset of JSON Schema, which covers most API descriptions:
+// type (including OpenAPI's nullable), enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, uniqueItems, minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum, multipleOf, allOf, anyOf, oneOf, not and local references like "#/components/schemas/User".
+func ValidateJSONSchema(schema, document interface{}) []string {
+	return validateJSONSchema(schema, schema, document)
+}
+
+// validateJSONSchema validates the document against a schema whose references are resolved in root.
+func validateJSONSchema(root, schema, document interface{}) []string {
+	v := schemaValidator{root: root}
+	v.validate(schema, document, "")
+	return v.violations
+}
+
+type schemaValidator struct {
+	root       interface{}
+	violations []string
+	depth      int
+}
+
+func (v *schemaValidator) fail(pointer, format string, args ...interface{}) {
+	if pointer == "" {
+		pointer = "/"
+	}
+	v.violations = append(v.violations, pointer+": "+fmt.Sprintf(format, args...))
+}
+
+// valid tells whether the document is valid against the schema, without reporting violations.
+func (v *schemaValidator) valid(schema, document interface{}) bool {
+	nested := schemaValidator{root: v.root, depth: v.depth}
+	nested.validate(schema, document, "")
+	return len(nested.violations) == 0
+}
+
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func matchesJSONType(expected, actual string) bool {
+	return expected == actual || (expected == "number" && actual == "integer")
+}
+
+func (v *schemaValidator) validate(schemaValue, document interface{}, pointer string) {
+	if accept, ok := schemaValue.(bool); ok {
+		if !accept {
+			v.fail(pointer, "no value is allowed")
+		}
+		return
+	}
+	schema, ok := schemaValue.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		v.depth++
+		defer func() { v.depth-- }()
+		if v.depth > 64 {
+			v.fail(pointer, "too many nested references")
+			return
+		}
+		resolved, err := jsonPointerGet(v.root, strings.TrimPrefix(ref, "#"))
+		if !strings.HasPrefix(ref, "#") || err != nil {
+			v.fail(pointer, "unresolved reference %s", ref)
+			return
+		}
+		v.validate(resolved, document, pointer)
+		return
+	}
+
+	actualType := jsonType(document)
+	if document == nil && schema["nullable"] == true {
+		return
+	}
+	switch expected := schema["type"].(type) {
+	case string:
+		if !matchesJSONType(expected, actualType) {
+			v.fail(pointer, "expected %s, got %s", expected, actualType)
+			return
+		}
+	case []interface{}:
+		types := []string{}
+		matched := false
+		for _, t := range expected {
+			if s, ok := t.(string); ok {
+				types = append(types, s)
+				matched = matched || matchesJSONType(s, actualType)
+			}
+		}
+		if !matched {
+			v.fail(pointer, "expected one of %s, got %s", strings.Join(types, ", "), actualType)
+			return
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, value := range enum {
+			found = found || assert.ObjectsAreEqual(value, document)
+		}
+		if !found {
+			v.fail(pointer, "%#v is not one of %#v", document, enum)
+		}
+	}
+	if value, ok := schema["const"]; ok && !assert.ObjectsAreEqual(value, document) {
+		v.fail(pointer, "expected %#v, got %#v", value, document)
+	}
+
+	switch value := document.(type) {
+	case map[string]interface{}:
+		v.validateObject(schema, value, pointer)
+	case []interface{}:
+		v.validateArray(schema, value, pointer)
+	case string:
+		length := float64(utf8.RuneCountInString(value))
+		if min, ok := schema["minLength"].(float64); ok && length < min {
+			v.fail(pointer, "length %v is shorter than %v", length, min)
+		}
+		if max, ok := schema["maxLength"].(float64); ok && length > max {
+			v.fail(pointer, "length %v is longer than %v", length, max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				v.fail(pointer, "invalid pattern %s: %s", pattern, err)
+			} else if !re.MatchString(value) {
+				v.fail(pointer, "%q does not match %s", value, pattern)
+			}
+		}
+	case float64:
+		v.validateNumber(schema, value, pointer)
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v.validate(sub, document, pointer)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			matched = matched || v.valid(sub, document)
+		}
+		if !matched {
+			v.fail(pointer, "does not match any schema of anyOf")
+		}
+	}
+	if one, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range one {
+			if v.valid(sub, document) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.fail(pointer, "matches %d schemas of oneOf instead of 1", matched)
+		}
+	}
+	if not, ok := schema["not"]; ok && v.valid(not, document) {
+		v.fail(pointer, "must not match the schema of not")
+	}
+}
+
+func (v *schemaValidator) validateObject(schema map[string]interface{}, object map[string]interface{}, pointer string) {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if s, ok := name.(string); ok {
+				if _, found := object[s]; !found {
+					v.fail(pointer, "missing required property %q", s)
+				}
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		childPointer := pointer + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+		if property, ok := properties[key]; ok {
+			v.validate(property, object[key], childPointer)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(pointer, "unexpected property %q", key)
+			}
+		case map[string]interface{}:
+			v.validate(additional, object[key], childPointer)
+		}
+	}
+}
+
+func (v *schemaValidator) validateArray(schema map[string]interface{}, array []interface{}, pointer string) {
+	length := float64(len(array))
+	if min, ok := schema["minItems"].(float64); ok && length < min {
+		v.fail(pointer, "%v items, expected at least %v", length, min)
+	}
+	if max, ok := schema["maxItems"].(float64); ok && length > max {
+		v.fail(pointer, "%v items, expected at most %v", length, max)
+	}
+	if schema["uniqueItems"] == true {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if assert.ObjectsAreEqual(array[i], array[j]) {
+					v.fail(pointer, "items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+	if items, ok := schema["items"]; ok {
+		for i, item := range array {
+			v.validate(items, item, fmt.Sprintf("%s/%d", pointer, i))
+		}
+	}
+}
+
+func (v *schemaValidator) validateNumber(schema map[string]interface{}, value float64, pointer string) {
+	if min, ok := schema["minimum"].(float64); ok {
+		// OpenAPI 3.0 uses booleans for exclusiveMinimum, JSON schema uses numbers
+		if schema["exclusiveMinimum"] == true && value <= min {
+			v.fail(pointer, "%v must be greater than %v", value, min)
+		} else if value < min {
+			v.fail(pointer, "%v must be at least %v", value, min)
+		}
+	}
+	if max, ok := schema["maximum"].(float64); ok {
+		if schema["exclusiveMaximum"] == true && value >= max {
+			v.fail(pointer, "%v must be less than %v", value, max)
+		} else if value > max {
+			v.fail(pointer, "%v must be at most %v", value, max)
+		}
+	}
+	if min, ok := schema["exclusiveMinimum"].(float64); ok && value <= min {
+		v.fail(pointer, "%v must be greater than %v", value, min)
+	}
+	if max, ok := schema["exclusiveMaximum"].(float64); ok && value >= max {
+		v.fail(pointer, "%v must be less than %v", value, max)
+	}
+	if multiple, ok := schema["multipleOf"].(float64); ok && multiple > 0 {
+		if quotient := value / multiple; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			v.fail(pointer, "%v is not a multiple of %v", value, multiple)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package testutils_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+	var schema interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"$ref": "#/definitions/Order",
+		"definitions": {
+			"Order": {
+				"type": "object",
+				"required": ["id", "items"],
+				"additionalProperties": false,
+				"properties": {
+					"id": {"type": "string", "pattern": "^ord-[0-9]+$"},
+					"status": {"enum": ["open", "closed"]},
+					"note": {"type": "string", "nullable": true, "maxLength": 10},
+					"items": {"type": "array", "minItems": 1, "uniqueItems": true, "items": {"$ref": "#/definitions/Item"}},
+					"discount": {"oneOf": [{"type": "integer"}, {"type": "string"}]}
+				}
+			},
+			"Item": {
+				"type": "object",
+				"required": ["sku", "quantity"],
+				"properties": {
+					"sku": {"type": "string"},
+					"quantity": {"type": "integer", "minimum": 1, "exclusiveMaximum": 100},
+					"price": {"type": "number", "minimum": 0, "exclusiveMinimum": true, "multipleOf": 0.01}
+				}
+			}
+		}
+	}`), &schema))
+
+	for name, test := range map[string]struct {
+		document   string
+		violations []string
+	}{
+		"valid document": {
+			document: `{"id": "ord-1", "status": "open", "note": null, "items": [{"sku": "a", "quantity": 2, "price": 9.99}], "discount": 5}`,
+		},
+		"invalid document": {
+			document: `{"id": "order", "status": "lost", "note": "a very long note", "items": [{"sku": 1, "quantity": 100, "price": 0}, {"quantity": 1.5}], "discount": true, "extra": 1}`,
+			violations: []string{
+				"/: unexpected property \"extra\"",
+				"/discount: matches 0 schemas of oneOf instead of 1",
+				"/id: \"order\" does not match ^ord-[0-9]+$",
+				"/items/0/price: 0 must be greater than 0",
+				"/items/0/quantity: 100 must be less than 100",
+				"/items/0/sku: expected string, got integer",
+				"/items/1: missing required property \"sku\"",
+				"/items/1/quantity: expected integer, got number",
+				"/note: length 16 is longer than 10",
+				"/status: \"lost\" is not one of []interface {}{\"open\", \"closed\"}",
+			},
+		},
+		"wrong root type": {
+			document:   `[]`,
+			violations: []string{"/: expected object, got array"},
+		},
+		"empty and duplicated items": {
+			document:   `{"id": "ord-1", "items": []}`,
+			violations: []string{"/items: 0 items, expected at least 1"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var document interface{}
+			require.NoError(t, json.Unmarshal([]byte(test.document), &document))
+			assert.ElementsMatch(t, test.violations, testutils.ValidateJSONSchema(schema, document))
+		})
+	}
+
+	t.Run("combinators", func(t *testing.T) {
+		var schema interface{}
+		require.NoError(t, json.Unmarshal([]byte(`{"allOf": [{"type": "number"}, {"maximum": 10}], "anyOf": [{"multipleOf": 2}, {"multipleOf": 3}], "not": {"const": 6}}`), &schema))
+		assert.Empty(t, testutils.ValidateJSONSchema(schema, 4.0))
+		assert.Empty(t, testutils.ValidateJSONSchema(schema, 9.0))
+		assert.Equal(t, []string{"/: 12 must be at most 10"}, testutils.ValidateJSONSchema(schema, 12.0))
+		assert.Equal(t, []string{"/: does not match any schema of anyOf"}, testutils.ValidateJSONSchema(schema, 5.0))
+		assert.Equal(t, []string{"/: must not match the schema of not"}, testutils.ValidateJSONSchema(schema, 6.0))
+		assert.Equal(t, []string{"/: unresolved reference #/missing"}, testutils.ValidateJSONSchema(map[string]interface{}{"$ref": "#/missing"}, 1.0))
+	})
+}
@@ -0,0 +1,629 @@
+package testutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// JWTAlgorithm is a JSON Web Signature algorithm, as registered in RFC 7518.
+type JWTAlgorithm string
+
+const (
+	JWTAlgorithmRS256 JWTAlgorithm = "RS256"
+	JWTAlgorithmES256 JWTAlgorithm = "ES256"
+	JWTAlgorithmES384 JWTAlgorithm = "ES384"
+	JWTAlgorithmES512 JWTAlgorithm = "ES512"
+	JWTAlgorithmEdDSA JWTAlgorithm = "EdDSA"
+	JWTAlgorithmNone  JWTAlgorithm = "none"
+)
+
+// DefaultJWTAudience is the audience of the tokens minted by a JWTKeySet unless configured otherwise.
+const DefaultJWTAudience = "adevinta-toolkit-integration-tests"
+
+// JWKSPath is the path the JWKS document is served on by a JWTKeySet.
+const JWKSPath = "/.well-known/jwks.json"
+
+func (a JWTAlgorithm) keyAlgorithm() (KeyAlgorithm, error) {
+	switch a {
+	case JWTAlgorithmRS256:
+		return KeyAlgorithmRSA2048, nil
+	case JWTAlgorithmES256:
+		return KeyAlgorithmECDSAP256, nil
+	case JWTAlgorithmES384:
+		return KeyAlgorithmECDSAP384, nil
+	case JWTAlgorithmES512:
+		return KeyAlgorithmECDSAP521, nil
+	case JWTAlgorithmEdDSA:
+		return KeyAlgorithmEd25519, nil
+	default:
+		return "", fmt.Errorf("unsupported JWT signing algorithm %q", a)
+	}
+}
+
+func (a JWTAlgorithm) hash() crypto.Hash {
+	switch a {
+	case JWTAlgorithmES384:
+		return crypto.SHA384
+	case JWTAlgorithmES512:
+		return crypto.SHA512
+	case JWTAlgorithmEdDSA:
+		return crypto.Hash(0)
+	default:
+		return crypto.SHA256
+	}
+}
+
+func digest(h crypto.Hash, data []byte) []byte {
+	switch h {
+	case crypto.SHA384:
+		d := sha512.Sum384(data)
+		return d[:]
+	case crypto.SHA512:
+		d := sha512.Sum512(data)
+		return d[:]
+	default:
+		d := sha256.Sum256(data)
+		return d[:]
+	}
+}
+
+// JSONWebKey is the public part of a signing key, as described in RFC 7517.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// PublicKey decodes the public key described by the JWK.
+func (k JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	decode := func(name, value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("invalid %s parameter in %s JWK", name, k.KeyType)
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode("n", k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e", k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported EC curve %q", k.Curve)
+		}
+		x, err := decode("x", k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y", k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the EC JWK point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || k.Curve != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 JWK")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported JWK key type %q", k.KeyType)
+	}
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key.
+func (k JSONWebKey) Thumbprint() string {
+	var canonical string
+	switch k.KeyType {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Curve, k.X, k.Y)
+	default:
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Curve, k.KeyType, k.X)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:])
+}
+
+// JSONWebKeySet is a JWKS document.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func paddedBytes(i *big.Int, size int) []byte {
+	b := make([]byte, size)
+	return i.FillBytes(b)
+}
+
+func newJSONWebKey(pub crypto.PublicKey) (JSONWebKey, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			KeyType: "RSA",
+			N:       b64(k.N.Bytes()),
+			E:       b64(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return JSONWebKey{
+			KeyType: "EC",
+			Curve:   k.Curve.Params().Name,
+			X:       b64(paddedBytes(k.X, size)),
+			Y:       b64(paddedBytes(k.Y, size)),
+		}, nil
+	case ed25519.PublicKey:
+		return JSONWebKey{
+			KeyType: "OKP",
+			Curve:   "Ed25519",
+			X:       b64(k),
+		}, nil
+	default:
+		return JSONWebKey{}, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+type jwtKey struct {
+	id        string
+	algorithm JWTAlgorithm
+	signer    crypto.Signer
+}
+
+func newJWTKey(id string, algorithm JWTAlgorithm) (*jwtKey, error) {
+	keyAlgorithm, err := algorithm.keyAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	signer, err := generatePrivateKey(keyAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtKey{id: id, algorithm: algorithm, signer: signer}, nil
+}
+
+func (k *jwtKey) sign(signingInput []byte) ([]byte, error) {
+	switch s := k.signer.(type) {
+	case *ecdsa.PrivateKey:
+		r, sig, err := ecdsa.Sign(rand.Reader, s, digest(k.algorithm.hash(), signingInput))
+		if err != nil {
+			return nil, err
+		}
+		size := (s.Curve.Params().BitSize + 7) / 8
+		return append(paddedBytes(r, size), paddedBytes(sig, size)...), nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(s, signingInput), nil
+	default:
+		return k.signer.Sign(rand.Reader, digest(k.algorithm.hash(), signingInput), k.algorithm.hash())
+	}
+}
+
+func (k *jwtKey) verify(signingInput, signature []byte) bool {
+	return verifySignature(k.signer.Public(), k.algorithm, signingInput, signature)
+}
+
+func verifySignature(pub crypto.PublicKey, algorithm JWTAlgorithm, signingInput, signature []byte) bool {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if algorithm != JWTAlgorithmRS256 {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(pub, algorithm.hash(), digest(algorithm.hash(), signingInput), signature) == nil
+	case *ecdsa.PublicKey:
+		if algorithm.hash() == crypto.Hash(0) || algorithm == JWTAlgorithmRS256 {
+			return false
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest(algorithm.hash(), signingInput), r, s)
+	case ed25519.PublicKey:
+		if algorithm != JWTAlgorithmEdDSA {
+			return false
+		}
+		return ed25519.Verify(pub, signingInput, signature)
+	default:
+		return false
+	}
+}
+
+func (k *jwtKey) jwk() JSONWebKey {
+	jwk, _ := newJSONWebKey(k.signer.Public())
+	jwk.KeyID = k.id
+	jwk.Use = "sig"
+	jwk.Algorithm = string(k.algorithm)
+	return jwk
+}
+
+// JWTKeySet holds signing keys, serves their public part as a JWKS document and mints tokens signed with them.
+//
+//	keys := testutils.NewJWTKeySet(t, testutils.JWTAlgorithmRS256)
+//	validator := NewValidator(keys.JWKSURL(), keys.Issuer, testutils.DefaultJWTAudience)
+//	token := keys.NewToken().WithSubject("user-1").Build()
+type JWTKeySet struct {
+	// Issuer is set in the iss claim of the minted tokens. It defaults to the JWKS server URL.
+	Issuer string
+	// Audience is set in the aud claim of the minted tokens. It defaults to DefaultJWTAudience.
+	Audience string
+	Server   *httptest.Server
+
+	mu        sync.Mutex
+	keys      []*jwtKey
+	generated int
+}
+
+// NewJWTKeySet generates a signing key for each algorithm and starts a server exposing them on JWKSPath.
+//
+// When no algorithm is provided, a single RS256 key is generated.
+func NewJWTKeySet(t CleanupTest, algorithms ...JWTAlgorithm) *JWTKeySet {
+	t.Helper()
+	if len(algorithms) == 0 {
+		algorithms = []JWTAlgorithm{JWTAlgorithmRS256}
+	}
+	k := &JWTKeySet{Audience: DefaultJWTAudience}
+	for _, algorithm := range algorithms {
+		k.AddKey(t, algorithm)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(JWKSPath, k.ServeJWKS)
+	k.Server = httptest.NewServer(mux)
+	k.Issuer = k.Server.URL
+	t.Cleanup(k.Server.Close)
+	return k
+}
+
+// AddKey generates a new signing key and publishes it in the JWKS document. It returns the key ID.
+//
+// The first key of the set signs the tokens unless the builder selects another one with WithKeyID.
+func (k *JWTKeySet) AddKey(t require.TestingT, algorithm JWTAlgorithm) string {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.generated++
+	key, err := newJWTKey(fmt.Sprintf("%s-%d", strings.ToLower(string(algorithm)), k.generated), algorithm)
+	require.NoError(t, err)
+	k.keys = append(k.keys, key)
+	return key.id
+}
+
+// RemoveKey removes the key from the JWKS document, as done when rotating keys.
+func (k *JWTKeySet) RemoveKey(keyID string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, key := range k.keys {
+		if key.id == keyID {
+			k.keys = append(k.keys[:i], k.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// KeyIDs returns the IDs of the keys published in the JWKS document.
+func (k *JWTKeySet) KeyIDs() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ids := []string{}
+	for _, key := range k.keys {
+		ids = append(ids, key.id)
+	}
+	return ids
+}
+
+// JWKSURL returns the URL of the JWKS document.
+func (k *JWTKeySet) JWKSURL() string {
+	return k.Server.URL + JWKSPath
+}
+
+// JWKS returns the JWKS document served by the key set.
+func (k *JWTKeySet) JWKS() JSONWebKeySet {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, key.jwk())
+	}
+	return set
+}
+
+// ServeJWKS writes the JWKS document. It allows serving the keys from another test server.
+func (k *JWTKeySet) ServeJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k.JWKS())
+}
+
+func (k *JWTKeySet) key(keyID string) *jwtKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range k.keys {
+		if keyID == "" || key.id == keyID {
+			return key
+		}
+	}
+	return nil
+}
+
+// NewToken returns a builder for a token signed by the key set.
+//
+// The token is pre-filled with the iss, aud, iat, nbf and exp claims and is valid for an hour.
+func (k *JWTKeySet) NewToken() *JWTBuilder {
+	now := time.Now()
+	return &JWTBuilder{
+		keySet: k,
+		header: map[string]interface{}{"typ": "JWT"},
+		claims: map[string]interface{}{
+			"iss": k.Issuer,
+			"aud": k.Audience,
+			"iat": now.Unix(),
+			"nbf": now.Unix(),
+			"exp": now.Add(time.Hour).Unix(),
+		},
+	}
+}
+
+// Verify checks the token signature against the keys of the set, as well as its iss, aud, exp and nbf claims.
+// It returns the token claims.
+func (k *JWTKeySet) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token: expecting 3 dot separated parts")
+	}
+	header := map[string]interface{}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	kid, _ := header["kid"].(string)
+	key := k.key(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	if alg, _ := header["alg"].(string); alg != string(key.algorithm) {
+		return nil, fmt.Errorf("unexpected signing algorithm %q for key %s", alg, key.id)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errors.New("invalid token signature")
+	}
+	if iss, _ := claims["iss"].(string); iss != k.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !audienceContains(claims["aud"], k.Audience) {
+		return nil, fmt.Errorf("token audience %v does not contain %q", claims["aud"], k.Audience)
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	return claims, nil
+}
+
+func audienceContains(aud interface{}, expected string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == expected
+	case []interface{}:
+		for _, v := range a {
+			if v == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// JWTBuilder mints a signed JWT.
+type JWTBuilder struct {
+	keySet   *JWTKeySet
+	tb       testing.TB
+	header   map[string]interface{}
+	claims   map[string]interface{}
+	keyID    string
+	wrongKey bool
+	unsigned bool
+}
+
+func (b *JWTBuilder) WithTB(tb testing.TB) *JWTBuilder {
+	b.tb = tb
+	return b
+}
+
+// WithClaim sets a claim of the token. A nil value removes the claim.
+func (b *JWTBuilder) WithClaim(name string, value interface{}) *JWTBuilder {
+	if value == nil {
+		delete(b.claims, name)
+		return b
+	}
+	b.claims[name] = value
+	return b
+}
+
+func (b *JWTBuilder) WithClaims(claims map[string]interface{}) *JWTBuilder {
+	for name, value := range claims {
+		b.WithClaim(name, value)
+	}
+	return b
+}
+
+// WithHeader sets a field of the JOSE header.
+func (b *JWTBuilder) WithHeader(name string, value interface{}) *JWTBuilder {
+	b.header[name] = value
+	return b
+}
+
+func (b *JWTBuilder) WithSubject(subject string) *JWTBuilder {
+	return b.WithClaim("sub", subject)
+}
+
+func (b *JWTBuilder) WithIssuer(issuer string) *JWTBuilder {
+	return b.WithClaim("iss", issuer)
+}
+
+// WithAudience sets the aud claim, as a single string when one audience is provided and as an array otherwise.
+func (b *JWTBuilder) WithAudience(audiences ...string) *JWTBuilder {
+	if len(audiences) == 1 {
+		return b.WithClaim("aud", audiences[0])
+	}
+	return b.WithClaim("aud", audiences)
+}
+
+// WithWrongAudience sets an audience the consumers of the key set do not expect.
+func (b *JWTBuilder) WithWrongAudience() *JWTBuilder {
+	return b.WithAudience("wrong-" + b.keySet.Audience)
+}
+
+func (b *JWTBuilder) WithExpiry(expiry time.Time) *JWTBuilder {
+	return b.WithClaim("exp", expiry.Unix())
+}
+
+// Expired makes the token expired since a minute.
+func (b *JWTBuilder) Expired() *JWTBuilder {
+	now := time.Now()
+	return b.WithClaim("iat", now.Add(-time.Hour).Unix()).
+		WithClaim("nbf", now.Add(-time.Hour).Unix()).
+		WithClaim("exp", now.Add(-time.Minute).Unix())
+}
+
+// NotYetValid makes the token valid in an hour only.
+func (b *JWTBuilder) NotYetValid() *JWTBuilder {
+	now := time.Now()
+	return b.WithClaim("nbf", now.Add(time.Hour).Unix()).
+		WithClaim("exp", now.Add(2*time.Hour).Unix())
+}
+
+// WithKeyID selects the key of the set signing the token.
+func (b *JWTBuilder) WithKeyID(keyID string) *JWTBuilder {
+	b.keyID = keyID
+	return b
+}
+
+// SignedWithWrongKey signs the token with a freshly generated key that is not part of the JWKS document.
+// The token still references the ID of a published key.
+func (b *JWTBuilder) SignedWithWrongKey() *JWTBuilder {
+	b.wrongKey = true
+	return b
+}
+
+// Unsigned produces an unsecured token, with alg=none and an empty signature.
+func (b *JWTBuilder) Unsigned() *JWTBuilder {
+	b.unsigned = true
+	return b
+}
+
+func (b *JWTBuilder) build() (string, error) {
+	key := b.keySet.key(b.keyID)
+	if key == nil {
+		return "", fmt.Errorf("unknown key ID %q", b.keyID)
+	}
+	header := map[string]interface{}{}
+	for name, value := range b.header {
+		header[name] = value
+	}
+	if b.unsigned {
+		header["alg"] = string(JWTAlgorithmNone)
+	} else {
+		header["alg"] = string(key.algorithm)
+		header["kid"] = key.id
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(b.claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64(headerJSON) + "." + b64(claimsJSON)
+	if b.unsigned {
+		return signingInput + ".", nil
+	}
+	if b.wrongKey {
+		key, err = newJWTKey(key.id, key.algorithm)
+		if err != nil {
+			return "", err
+		}
+	}
+	signature, err := key.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + b64(signature), nil
+}
+
+// Build returns the compact serialization of the token.
+func (b *JWTBuilder) Build() string {
+	token, err := b.build()
+	if b.tb != nil {
+		b.tb.Helper()
+		assert.NoError(b.tb, err)
+	}
+	return token
+}
@@ -0,0 +1,163 @@
+package testutils_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fetchJWKS(t *testing.T, url string) testutils.JSONWebKeySet {
+	t.Helper()
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	jwks := testutils.JSONWebKeySet{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&jwks))
+	return jwks
+}
+
+func decodeSegment(t *testing.T, segment string, v interface{}) {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, v))
+}
+
+func b64Int(t *testing.T, s string) *big.Int {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	require.NoError(t, err)
+	return new(big.Int).SetBytes(data)
+}
+
+// verifyWithJWKS validates the token independently from the toolkit implementation
+func verifyWithJWKS(t *testing.T, jwks testutils.JSONWebKeySet, token string) bool {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	header := map[string]string{}
+	decodeSegment(t, parts[0], &header)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	for _, key := range jwks.Keys {
+		if key.KeyID != header["kid"] {
+			continue
+		}
+		require.Equal(t, key.Algorithm, header["alg"])
+		switch key.KeyType {
+		case "RSA":
+			pub := &rsa.PublicKey{N: b64Int(t, key.N), E: int(b64Int(t, key.E).Int64())}
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature) == nil
+		case "EC":
+			require.Equal(t, "P-256", key.Curve)
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: b64Int(t, key.X), Y: b64Int(t, key.Y)}
+			return ecdsa.Verify(pub, hashed[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(key.X)
+			require.NoError(t, err)
+			return ed25519.Verify(ed25519.PublicKey(x), []byte(parts[0]+"."+parts[1]), signature)
+		}
+	}
+	return false
+}
+
+func TestJWTKeySet(t *testing.T) {
+	keys := testutils.NewJWTKeySet(t, testutils.JWTAlgorithmRS256, testutils.JWTAlgorithmES256, testutils.JWTAlgorithmEdDSA)
+	jwks := fetchJWKS(t, keys.JWKSURL())
+	require.Len(t, jwks.Keys, 3)
+	assert.Equal(t, keys.KeyIDs(), []string{jwks.Keys[0].KeyID, jwks.Keys[1].KeyID, jwks.Keys[2].KeyID})
+	assert.Equal(t, keys.JWKS(), jwks)
+
+	for _, keyID := range keys.KeyIDs() {
+		t.Run("When signing with key "+keyID, func(t *testing.T) {
+			token := keys.NewToken().WithTB(t).WithKeyID(keyID).WithSubject("user-1").WithClaim("scope", "read write").Build()
+			assert.True(t, verifyWithJWKS(t, jwks, token))
+
+			claims, err := keys.Verify(token)
+			require.NoError(t, err)
+			assert.Equal(t, "user-1", claims["sub"])
+			assert.Equal(t, "read write", claims["scope"])
+			assert.Equal(t, keys.Issuer, claims["iss"])
+			assert.Equal(t, testutils.DefaultJWTAudience, claims["aud"])
+		})
+	}
+
+	t.Run("When the token is expired", func(t *testing.T) {
+		token := keys.NewToken().WithTB(t).Expired().Build()
+		assert.True(t, verifyWithJWKS(t, jwks, token))
+		claims := map[string]interface{}{}
+		decodeSegment(t, strings.Split(token, ".")[1], &claims)
+		assert.Less(t, claims["exp"], float64(time.Now().Unix()))
+		_, err := keys.Verify(token)
+		assert.EqualError(t, err, "token is expired")
+	})
+
+	t.Run("When the token is not valid yet", func(t *testing.T) {
+		_, err := keys.Verify(keys.NewToken().WithTB(t).NotYetValid().Build())
+		assert.EqualError(t, err, "token is not valid yet")
+	})
+
+	t.Run("When the token has the wrong audience", func(t *testing.T) {
+		token := keys.NewToken().WithTB(t).WithWrongAudience().Build()
+		assert.True(t, verifyWithJWKS(t, jwks, token))
+		_, err := keys.Verify(token)
+		assert.EqualError(t, err, `token audience wrong-adevinta-toolkit-integration-tests does not contain "adevinta-toolkit-integration-tests"`)
+
+		_, err = keys.Verify(keys.NewToken().WithTB(t).WithAudience("other", testutils.DefaultJWTAudience).Build())
+		assert.NoError(t, err)
+	})
+
+	t.Run("When the token is signed with the wrong key", func(t *testing.T) {
+		token := keys.NewToken().WithTB(t).SignedWithWrongKey().Build()
+		header := map[string]string{}
+		decodeSegment(t, strings.Split(token, ".")[0], &header)
+		assert.Equal(t, keys.KeyIDs()[0], header["kid"])
+		assert.False(t, verifyWithJWKS(t, jwks, token))
+		_, err := keys.Verify(token)
+		assert.EqualError(t, err, "invalid token signature")
+	})
+
+	t.Run("When the token is unsigned", func(t *testing.T) {
+		token := keys.NewToken().WithTB(t).Unsigned().Build()
+		assert.True(t, strings.HasSuffix(token, "."))
+		header := map[string]string{}
+		decodeSegment(t, strings.Split(token, ".")[0], &header)
+		assert.Equal(t, map[string]string{"alg": "none", "typ": "JWT"}, header)
+		_, err := keys.Verify(token)
+		assert.Error(t, err)
+	})
+
+	t.Run("When keys are rotated", func(t *testing.T) {
+		keys := testutils.NewJWTKeySet(t)
+		old := keys.KeyIDs()[0]
+		token := keys.NewToken().WithTB(t).Build()
+		newKey := keys.AddKey(t, testutils.JWTAlgorithmES256)
+		keys.RemoveKey(old)
+		assert.Equal(t, []string{newKey}, keys.KeyIDs())
+		_, err := keys.Verify(token)
+		assert.EqualError(t, err, `unknown key ID "rs256-1"`)
+		_, err = keys.Verify(keys.NewToken().WithTB(t).Build())
+		assert.NoError(t, err)
+	})
+
+	t.Run("When the key does not exist", func(t *testing.T) {
+		token := keys.NewToken().WithKeyID("unknown").Build()
+		assert.Empty(t, token)
+	})
+}
@@ -0,0 +1,546 @@
+package testutils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// OIDCEndpoint identifies an endpoint served by the OIDCProvider.
+type OIDCEndpoint string
+
+const (
+	OIDCEndpointDiscovery OIDCEndpoint = "/.well-known/openid-configuration"
+	OIDCEndpointJWKS      OIDCEndpoint = JWKSPath
+	OIDCEndpointAuthorize OIDCEndpoint = "/authorize"
+	OIDCEndpointToken     OIDCEndpoint = "/token"
+	OIDCEndpointUserInfo  OIDCEndpoint = "/userinfo"
+)
+
+// OIDCUser is a user able to log in on the OIDCProvider.
+type OIDCUser struct {
+	Subject string
+	// Claims are added to the ID tokens and returned by the userinfo endpoint.
+	Claims map[string]interface{}
+}
+
+// OIDCClient is an OAuth2 client registered on the OIDCProvider.
+type OIDCClient struct {
+	ID string
+	// Secret authenticates confidential clients. Public clients have no secret and must use PKCE.
+	Secret       string
+	RedirectURIs []string
+	// Scopes lists the scopes the client may request. Any scope is allowed when empty.
+	Scopes []string
+}
+
+func (c OIDCClient) allowsScopes(scopes []string) bool {
+	if len(c.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		if !containsString(c.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// OIDCDiscovery is the OpenID provider metadata document.
+type OIDCDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// OIDCTokenResponse is the body of a successful token endpoint response.
+type OIDCTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+type oidcGrant struct {
+	client              OIDCClient
+	user                *OIDCUser
+	scopes              []string
+	redirectURI         string
+	nonce               string
+	codeChallenge       string
+	codeChallengeMethod string
+	authTime            time.Time
+}
+
+type oidcFailure struct {
+	statusCode int
+	errorCode  string
+}
+
+// OIDCProvider is an in-process OpenID Connect provider serving discovery, JWKS,
+// authorization code with PKCE, client credentials and refresh token flows over TLS.
+//
+//	provider := testutils.NewOIDCProvider(t)
+//	provider.AddClient(testutils.OIDCClient{ID: "my-app", RedirectURIs: []string{callbackURL}})
+//	provider.AddUser(testutils.OIDCUser{Subject: "user-1", Claims: map[string]interface{}{"email": "user@example.com"}})
+//	provider.LoginAs("user-1")
+//	app := NewApp(provider.Issuer, provider.Client())
+type OIDCProvider struct {
+	Issuer string
+	Server *httptest.Server
+	Keys   *JWTKeySet
+	CA     *CertificateAuthority
+	// AccessTokenTTL is the lifetime of the issued access and ID tokens. It defaults to one hour.
+	AccessTokenTTL time.Duration
+
+	mu            sync.Mutex
+	users         map[string]*OIDCUser
+	clients       map[string]OIDCClient
+	loggedIn      string
+	codes         map[string]*oidcGrant
+	refreshTokens map[string]*oidcGrant
+	failures      map[OIDCEndpoint][]oidcFailure
+	requests      map[OIDCEndpoint]int
+}
+
+// NewOIDCProvider starts an OpenID Connect provider over TLS, using a certificate issued by a dedicated authority.
+//
+// Use Client or CA to trust the provider.
+func NewOIDCProvider(t CleanupTest, algorithms ...JWTAlgorithm) *OIDCProvider {
+	t.Helper()
+	p := &OIDCProvider{
+		Keys:           NewJWTKeySet(t, algorithms...),
+		CA:             NewCertificateAuthority(t, afero.NewMemMapFs(), "/ca"),
+		AccessTokenTTL: time.Hour,
+		users:          map[string]*OIDCUser{},
+		clients:        map[string]OIDCClient{},
+		codes:          map[string]*oidcGrant{},
+		refreshTokens:  map[string]*oidcGrant{},
+		failures:       map[OIDCEndpoint][]oidcFailure{},
+		requests:       map[OIDCEndpoint]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(string(OIDCEndpointDiscovery), p.handle(OIDCEndpointDiscovery, p.serveDiscovery))
+	mux.HandleFunc(string(OIDCEndpointJWKS), p.handle(OIDCEndpointJWKS, p.Keys.ServeJWKS))
+	mux.HandleFunc(string(OIDCEndpointAuthorize), p.handle(OIDCEndpointAuthorize, p.serveAuthorize))
+	mux.HandleFunc(string(OIDCEndpointToken), p.handle(OIDCEndpointToken, p.serveToken))
+	mux.HandleFunc(string(OIDCEndpointUserInfo), p.handle(OIDCEndpointUserInfo, p.serveUserInfo))
+	p.Server = p.CA.NewTLSServer(t, mux)
+	p.Issuer = p.Server.URL
+	p.Keys.Issuer = p.Issuer
+	return p
+}
+
+// Client returns an HTTP client trusting the provider certificate.
+func (p *OIDCProvider) Client() *http.Client {
+	return p.Server.Client()
+}
+
+// URL returns the absolute URL of the endpoint.
+func (p *OIDCProvider) URL(endpoint OIDCEndpoint) string {
+	return p.Issuer + string(endpoint)
+}
+
+func (p *OIDCProvider) AddUser(user OIDCUser) *OIDCProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users[user.Subject] = &user
+	return p
+}
+
+func (p *OIDCProvider) AddClient(client OIDCClient) *OIDCProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients[client.ID] = client
+	return p
+}
+
+// LoginAs sets the user authenticated on the authorize endpoint, as if they had logged in through the provider UI.
+//
+// The login_hint parameter of the authorization request takes precedence over this user.
+// When no user is logged in, the authorize endpoint answers with the login_required error.
+func (p *OIDCProvider) LoginAs(subject string) *OIDCProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loggedIn = subject
+	return p
+}
+
+// Logout removes the user authenticated on the authorize endpoint.
+func (p *OIDCProvider) Logout() *OIDCProvider {
+	return p.LoginAs("")
+}
+
+// InjectFailure makes the next request to the endpoint fail with the OAuth2 error code.
+//
+// Several failures can be queued for the same endpoint, each of them being returned once.
+// The authorize endpoint redirects the failures to the client with the error parameter, other endpoints
+// answer with the status code and an OAuth2 error body.
+func (p *OIDCProvider) InjectFailure(endpoint OIDCEndpoint, statusCode int, errorCode string) *OIDCProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[endpoint] = append(p.failures[endpoint], oidcFailure{statusCode: statusCode, errorCode: errorCode})
+	return p
+}
+
+// Requests returns the number of requests received by the endpoint.
+func (p *OIDCProvider) Requests(endpoint OIDCEndpoint) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests[endpoint]
+}
+
+func (p *OIDCProvider) handle(endpoint OIDCEndpoint, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.requests[endpoint]++
+		var failure *oidcFailure
+		if failures := p.failures[endpoint]; len(failures) > 0 {
+			failure = &failures[0]
+			p.failures[endpoint] = failures[1:]
+		}
+		p.mu.Unlock()
+		if failure == nil {
+			handler(w, r)
+			return
+		}
+		if endpoint == OIDCEndpointAuthorize {
+			if redirectURI := r.URL.Query().Get("redirect_uri"); redirectURI != "" {
+				redirectError(w, r, redirectURI, r.URL.Query().Get("state"), failure.errorCode, "injected failure")
+				return
+			}
+		}
+		writeOAuth2Error(w, failure.statusCode, failure.errorCode, "injected failure")
+	}
+}
+
+func writeOAuth2Error(w http.ResponseWriter, statusCode int, errorCode, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if statusCode == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error=%q, error_description=%q`, errorCode, description))
+	}
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": errorCode, "error_description": description})
+}
+
+func redirectError(w http.ResponseWriter, r *http.Request, redirectURI, state, errorCode, description string) {
+	params := url.Values{"error": {errorCode}, "error_description": {description}}
+	if state != "" {
+		params.Set("state", state)
+	}
+	http.Redirect(w, r, appendQuery(redirectURI, params), http.StatusFound)
+}
+
+func appendQuery(rawURL string, params url.Values) string {
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return rawURL + separator + params.Encode()
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (p *OIDCProvider) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	algorithms := []string{}
+	for _, key := range p.Keys.JWKS().Keys {
+		if !containsString(algorithms, key.Algorithm) {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OIDCDiscovery{
+		Issuer:                            p.Issuer,
+		AuthorizationEndpoint:             p.URL(OIDCEndpointAuthorize),
+		TokenEndpoint:                     p.URL(OIDCEndpointToken),
+		UserInfoEndpoint:                  p.URL(OIDCEndpointUserInfo),
+		JWKSURI:                           p.URL(OIDCEndpointJWKS),
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "client_credentials", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  algorithms,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256", "plain"},
+	})
+}
+
+func (p *OIDCProvider) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	p.mu.Lock()
+	client, ok := p.clients[query.Get("client_id")]
+	p.mu.Unlock()
+	if !ok {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_client", "unknown client "+query.Get("client_id"))
+		return
+	}
+	redirectURI := query.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !containsString(client.RedirectURIs, redirectURI) {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_request", "unregistered redirect_uri "+redirectURI)
+		return
+	}
+	state := query.Get("state")
+	if query.Get("response_type") != "code" {
+		redirectError(w, r, redirectURI, state, "unsupported_response_type", "only the code response type is supported")
+		return
+	}
+	scopes := strings.Fields(query.Get("scope"))
+	if !client.allowsScopes(scopes) {
+		redirectError(w, r, redirectURI, state, "invalid_scope", "the client is not allowed the requested scopes")
+		return
+	}
+	challengeMethod := query.Get("code_challenge_method")
+	if query.Get("code_challenge") == "" {
+		if client.Secret == "" {
+			redirectError(w, r, redirectURI, state, "invalid_request", "public clients must use PKCE")
+			return
+		}
+	} else {
+		if challengeMethod == "" {
+			challengeMethod = "plain"
+		}
+		if challengeMethod != "S256" && challengeMethod != "plain" {
+			redirectError(w, r, redirectURI, state, "invalid_request", "unsupported code_challenge_method "+challengeMethod)
+			return
+		}
+	}
+
+	p.mu.Lock()
+	subject := query.Get("login_hint")
+	if subject == "" {
+		subject = p.loggedIn
+	}
+	user := p.users[subject]
+	p.mu.Unlock()
+	if user == nil {
+		redirectError(w, r, redirectURI, state, "login_required", "no user is logged in")
+		return
+	}
+
+	code := randomToken()
+	p.mu.Lock()
+	p.codes[code] = &oidcGrant{
+		client:              client,
+		user:                user,
+		scopes:              scopes,
+		redirectURI:         query.Get("redirect_uri"),
+		nonce:               query.Get("nonce"),
+		codeChallenge:       query.Get("code_challenge"),
+		codeChallengeMethod: challengeMethod,
+		authTime:            time.Now(),
+	}
+	p.mu.Unlock()
+	params := url.Values{"code": {code}}
+	if state != "" {
+		params.Set("state", state)
+	}
+	http.Redirect(w, r, appendQuery(redirectURI, params), http.StatusFound)
+}
+
+func (p *OIDCProvider) authenticateClient(r *http.Request) (OIDCClient, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	p.mu.Lock()
+	client, ok := p.clients[clientID]
+	p.mu.Unlock()
+	if !ok || client.Secret != secret {
+		return OIDCClient{}, false
+	}
+	return client, true
+}
+
+func verifyCodeChallenge(grant *oidcGrant, verifier string) bool {
+	if grant.codeChallenge == "" {
+		return verifier == ""
+	}
+	if grant.codeChallengeMethod == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		return base64.RawURLEncoding.EncodeToString(sum[:]) == grant.codeChallenge
+	}
+	return verifier == grant.codeChallenge
+}
+
+func (p *OIDCProvider) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOAuth2Error(w, http.StatusMethodNotAllowed, "invalid_request", "the token endpoint only accepts POST requests")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuth2Error(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	client, ok := p.authenticateClient(r)
+	if !ok {
+		writeOAuth2Error(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	var grant *oidcGrant
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		p.mu.Lock()
+		grant = p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.mu.Unlock()
+		if grant == nil || grant.client.ID != client.ID {
+			writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "unknown or already used authorization code")
+			return
+		}
+		if grant.redirectURI != r.PostForm.Get("redirect_uri") {
+			writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+			return
+		}
+		if !verifyCodeChallenge(grant, r.PostForm.Get("code_verifier")) {
+			writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+			return
+		}
+	case "refresh_token":
+		// the token is looked up and used in the same critical section for concurrent refreshes to fail
+		p.mu.Lock()
+		grant = p.refreshTokens[r.PostForm.Get("refresh_token")]
+		if grant == nil || grant.client.ID != client.ID {
+			p.mu.Unlock()
+			writeOAuth2Error(w, http.StatusBadRequest, "invalid_grant", "unknown or already used refresh token")
+			return
+		}
+		if scope := r.PostForm.Get("scope"); scope != "" {
+			scopes := strings.Fields(scope)
+			if !(OIDCClient{Scopes: grant.scopes}).allowsScopes(scopes) {
+				p.mu.Unlock()
+				writeOAuth2Error(w, http.StatusBadRequest, "invalid_scope", "the requested scopes exceed the original grant")
+				return
+			}
+			grant = &oidcGrant{client: grant.client, user: grant.user, scopes: scopes, authTime: grant.authTime}
+		}
+		delete(p.refreshTokens, r.PostForm.Get("refresh_token"))
+		p.mu.Unlock()
+	case "client_credentials":
+		if client.Secret == "" {
+			writeOAuth2Error(w, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client credentials grant")
+			return
+		}
+		scopes := strings.Fields(r.PostForm.Get("scope"))
+		if !client.allowsScopes(scopes) {
+			writeOAuth2Error(w, http.StatusBadRequest, "invalid_scope", "the client is not allowed the requested scopes")
+			return
+		}
+		grant = &oidcGrant{client: client, scopes: scopes}
+	default:
+		writeOAuth2Error(w, http.StatusBadRequest, "unsupported_grant_type", "unsupported grant type "+r.PostForm.Get("grant_type"))
+		return
+	}
+
+	response := p.issueTokens(grant)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (p *OIDCProvider) issueTokens(grant *oidcGrant) OIDCTokenResponse {
+	expiry := time.Now().Add(p.AccessTokenTTL)
+	subject := grant.client.ID
+	if grant.user != nil {
+		subject = grant.user.Subject
+	}
+	access := p.Keys.NewToken().
+		WithSubject(subject).
+		WithClaim("client_id", grant.client.ID).
+		WithExpiry(expiry)
+	if len(grant.scopes) > 0 {
+		access.WithClaim("scope", strings.Join(grant.scopes, " "))
+	}
+	response := OIDCTokenResponse{
+		AccessToken: access.Build(),
+		TokenType:   "Bearer",
+		ExpiresIn:   int(p.AccessTokenTTL.Seconds()),
+		Scope:       strings.Join(grant.scopes, " "),
+	}
+	if grant.user == nil {
+		return response
+	}
+	if containsString(grant.scopes, "openid") {
+		id := p.Keys.NewToken().
+			WithClaims(grant.user.Claims).
+			WithSubject(grant.user.Subject).
+			WithAudience(grant.client.ID).
+			WithClaim("azp", grant.client.ID).
+			WithClaim("auth_time", grant.authTime.Unix()).
+			WithExpiry(expiry)
+		if grant.nonce != "" {
+			id.WithClaim("nonce", grant.nonce)
+		}
+		response.IDToken = id.Build()
+	}
+	response.RefreshToken = randomToken()
+	p.mu.Lock()
+	p.refreshTokens[response.RefreshToken] = &oidcGrant{client: grant.client, user: grant.user, scopes: grant.scopes, authTime: grant.authTime}
+	p.mu.Unlock()
+	return response
+}
+
+func (p *OIDCProvider) serveUserInfo(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims, err := p.Keys.Verify(token)
+	if err != nil {
+		writeOAuth2Error(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	}
+	subject, _ := claims["sub"].(string)
+	p.mu.Lock()
+	user := p.users[subject]
+	p.mu.Unlock()
+	if user == nil {
+		writeOAuth2Error(w, http.StatusUnauthorized, "invalid_token", "the token was not issued to a user")
+		return
+	}
+	info := map[string]interface{}{}
+	for name, value := range user.Claims {
+		info[name] = value
+	}
+	info["sub"] = user.Subject
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
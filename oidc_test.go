@@ -0,0 +1,336 @@
+package testutils_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type oidcTestClient struct {
+	t        *testing.T
+	provider *testutils.OIDCProvider
+	http     *http.Client
+}
+
+func newOIDCTestClient(t *testing.T, provider *testutils.OIDCProvider) *oidcTestClient {
+	client := provider.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &oidcTestClient{t: t, provider: provider, http: client}
+}
+
+func (c *oidcTestClient) authorize(params url.Values) url.Values {
+	c.t.Helper()
+	resp, err := c.http.Get(c.provider.URL(testutils.OIDCEndpointAuthorize) + "?" + params.Encode())
+	require.NoError(c.t, err)
+	defer resp.Body.Close()
+	require.Equal(c.t, http.StatusFound, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(c.t, err)
+	assert.Equal(c.t, "https://app.example.com/callback", location.Scheme+"://"+location.Host+location.Path)
+	return location.Query()
+}
+
+func (c *oidcTestClient) token(form url.Values, clientID, secret string) (int, map[string]interface{}) {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, c.provider.URL(testutils.OIDCEndpointToken), strings.NewReader(form.Encode()))
+	require.NoError(c.t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		req.SetBasicAuth(clientID, secret)
+	}
+	resp, err := c.http.Do(req)
+	require.NoError(c.t, err)
+	defer resp.Body.Close()
+	body := map[string]interface{}{}
+	require.NoError(c.t, json.NewDecoder(resp.Body).Decode(&body))
+	return resp.StatusCode, body
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func newTestOIDCProvider(t *testing.T) *testutils.OIDCProvider {
+	provider := testutils.NewOIDCProvider(t)
+	provider.AddClient(testutils.OIDCClient{
+		ID:           "spa",
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		Scopes:       []string{"openid", "email", "offline_access"},
+	})
+	provider.AddClient(testutils.OIDCClient{
+		ID:           "backend",
+		Secret:       "s3cr3t",
+		RedirectURIs: []string{"https://app.example.com/callback"},
+	})
+	provider.AddUser(testutils.OIDCUser{Subject: "alice", Claims: map[string]interface{}{"email": "alice@example.com"}})
+	provider.AddUser(testutils.OIDCUser{Subject: "bob", Claims: map[string]interface{}{"email": "bob@example.com"}})
+	return provider
+}
+
+func TestOIDCProviderDiscovery(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	resp, err := provider.Client().Get(provider.URL(testutils.OIDCEndpointDiscovery))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	discovery := testutils.OIDCDiscovery{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&discovery))
+	assert.Equal(t, provider.Issuer, discovery.Issuer)
+	assert.True(t, strings.HasPrefix(provider.Issuer, "https://"))
+	assert.Equal(t, provider.Issuer+"/token", discovery.TokenEndpoint)
+	assert.Equal(t, []string{"RS256"}, discovery.IDTokenSigningAlgValuesSupported)
+
+	resp, err = provider.Client().Get(discovery.JWKSURI)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	jwks := testutils.JSONWebKeySet{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&jwks))
+	assert.Equal(t, provider.Keys.JWKS(), jwks)
+	assert.Equal(t, 1, provider.Requests(testutils.OIDCEndpointJWKS))
+}
+
+func TestOIDCProviderAuthorizationCode(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	client := newOIDCTestClient(t, provider)
+	verifier := "a-very-long-and-random-code-verifier-value"
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	t.Run("When no user is logged in", func(t *testing.T) {
+		query := client.authorize(params)
+		assert.Equal(t, "login_required", query.Get("error"))
+		assert.Equal(t, "xyz", query.Get("state"))
+	})
+
+	provider.LoginAs("alice")
+
+	t.Run("When the client requests scopes it is not allowed", func(t *testing.T) {
+		p := url.Values{}
+		for k, v := range params {
+			p[k] = v
+		}
+		p.Set("scope", "openid admin")
+		assert.Equal(t, "invalid_scope", client.authorize(p).Get("error"))
+	})
+
+	t.Run("When the public client does not use PKCE", func(t *testing.T) {
+		p := url.Values{}
+		for k, v := range params {
+			p[k] = v
+		}
+		p.Del("code_challenge")
+		assert.Equal(t, "invalid_request", client.authorize(p).Get("error"))
+	})
+
+	t.Run("When the code verifier does not match", func(t *testing.T) {
+		code := client.authorize(params).Get("code")
+		status, body := client.token(url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {"spa"},
+			"code":          {code},
+			"redirect_uri":  {"https://app.example.com/callback"},
+			"code_verifier": {"wrong"},
+		}, "", "")
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "invalid_grant", body["error"])
+	})
+
+	t.Run("When the flow succeeds", func(t *testing.T) {
+		query := client.authorize(params)
+		assert.Equal(t, "xyz", query.Get("state"))
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {"spa"},
+			"code":          {query.Get("code")},
+			"redirect_uri":  {"https://app.example.com/callback"},
+			"code_verifier": {verifier},
+		}
+		status, body := client.token(form, "", "")
+		require.Equal(t, http.StatusOK, status, body)
+		assert.Equal(t, "Bearer", body["token_type"])
+		assert.Equal(t, float64(3600), body["expires_in"])
+
+		claims, err := provider.Keys.Verify(body["access_token"].(string))
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims["sub"])
+		assert.Equal(t, "openid email", claims["scope"])
+
+		idToken := map[string]interface{}{}
+		decodeSegment(t, strings.Split(body["id_token"].(string), ".")[1], &idToken)
+		assert.Equal(t, "spa", idToken["aud"])
+		assert.Equal(t, "n-0S6", idToken["nonce"])
+		assert.Equal(t, "alice@example.com", idToken["email"])
+		assert.Equal(t, provider.Issuer, idToken["iss"])
+
+		req, err := http.NewRequest(http.MethodGet, provider.URL(testutils.OIDCEndpointUserInfo), nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+body["access_token"].(string))
+		resp, err := provider.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		info := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+		assert.Equal(t, map[string]interface{}{"sub": "alice", "email": "alice@example.com"}, info)
+
+		status, body = client.token(form, "", "")
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "invalid_grant", body["error"], "authorization codes are single use")
+	})
+
+	t.Run("When the login hint selects another user", func(t *testing.T) {
+		p := url.Values{}
+		for k, v := range params {
+			p[k] = v
+		}
+		p.Set("login_hint", "bob")
+		status, body := client.token(url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {"spa"},
+			"code":          {client.authorize(p).Get("code")},
+			"redirect_uri":  {"https://app.example.com/callback"},
+			"code_verifier": {verifier},
+		}, "", "")
+		require.Equal(t, http.StatusOK, status, body)
+		claims, err := provider.Keys.Verify(body["access_token"].(string))
+		require.NoError(t, err)
+		assert.Equal(t, "bob", claims["sub"])
+	})
+}
+
+func TestOIDCProviderRefreshToken(t *testing.T) {
+	provider := newTestOIDCProvider(t).LoginAs("alice")
+	client := newOIDCTestClient(t, provider)
+	query := client.authorize(url.Values{
+		"response_type": {"code"},
+		"client_id":     {"backend"},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"scope":         {"openid profile"},
+	})
+	status, body := client.token(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {query.Get("code")},
+		"redirect_uri": {"https://app.example.com/callback"},
+	}, "backend", "s3cr3t")
+	require.Equal(t, http.StatusOK, status, body)
+	refreshToken := body["refresh_token"].(string)
+	require.NotEmpty(t, refreshToken)
+
+	status, body = client.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}, "scope": {"admin"}}, "backend", "s3cr3t")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_scope", body["error"])
+
+	status, body = client.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}, "backend", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "invalid_client", body["error"])
+
+	status, body = client.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}, "backend", "s3cr3t")
+	require.Equal(t, http.StatusOK, status, body)
+	assert.NotEmpty(t, body["id_token"])
+	assert.NotEqual(t, refreshToken, body["refresh_token"], "refresh tokens are rotated")
+
+	status, body = client.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}, "backend", "s3cr3t")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", body["error"])
+}
+
+func TestOIDCProviderConcurrentRefreshes(t *testing.T) {
+	provider := newTestOIDCProvider(t).LoginAs("alice")
+	client := newOIDCTestClient(t, provider)
+	query := client.authorize(url.Values{
+		"response_type": {"code"},
+		"client_id":     {"backend"},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"scope":         {"openid"},
+	})
+	status, body := client.token(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {query.Get("code")},
+		"redirect_uri": {"https://app.example.com/callback"},
+	}, "backend", "s3cr3t")
+	require.Equal(t, http.StatusOK, status, body)
+	refreshToken := body["refresh_token"].(string)
+
+	statuses := make(chan int, 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _ := client.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}, "backend", "s3cr3t")
+			statuses <- status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	succeeded := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded, "refresh tokens can be used only once")
+}
+
+func TestOIDCProviderClientCredentials(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	client := newOIDCTestClient(t, provider)
+
+	status, body := client.token(url.Values{"grant_type": {"client_credentials"}, "scope": {"read"}}, "backend", "s3cr3t")
+	require.Equal(t, http.StatusOK, status, body)
+	assert.Nil(t, body["refresh_token"])
+	assert.Nil(t, body["id_token"])
+	claims, err := provider.Keys.Verify(body["access_token"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, "backend", claims["sub"])
+	assert.Equal(t, "read", claims["scope"])
+
+	status, body = client.token(url.Values{"grant_type": {"client_credentials"}, "client_id": {"spa"}}, "", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "unauthorized_client", body["error"])
+}
+
+func TestOIDCProviderFailureInjection(t *testing.T) {
+	provider := newTestOIDCProvider(t).LoginAs("alice")
+	client := newOIDCTestClient(t, provider)
+
+	provider.InjectFailure(testutils.OIDCEndpointToken, http.StatusServiceUnavailable, "temporarily_unavailable")
+	provider.InjectFailure(testutils.OIDCEndpointAuthorize, http.StatusInternalServerError, "server_error")
+
+	status, body := client.token(url.Values{"grant_type": {"client_credentials"}}, "backend", "s3cr3t")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "temporarily_unavailable", body["error"])
+
+	status, _ = client.token(url.Values{"grant_type": {"client_credentials"}}, "backend", "s3cr3t")
+	assert.Equal(t, http.StatusOK, status)
+
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {"backend"},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"state":         {"abc"},
+	}
+	query := client.authorize(params)
+	assert.Equal(t, "server_error", query.Get("error"))
+	assert.Equal(t, "abc", query.Get("state"))
+	assert.NotEmpty(t, client.authorize(params).Get("code"))
+	assert.Equal(t, 2, provider.Requests(testutils.OIDCEndpointToken))
+}
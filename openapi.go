@@ -0,0 +1,618 @@
+package testutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var openAPIMethods = []string{
+	http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete,
+	http.MethodOptions, http.MethodHead, http.MethodPatch, http.MethodTrace,
+}
+
+var openAPIPathParameter = regexp.MustCompile(`\{([^}]+)\}`)
+
+// OpenAPISpec is an OpenAPI 3 document, used to mock an API or to check that its clients follow it.
+//
+// Typical usage:
+//
+//	spec := testutils.LoadOpenAPISpec(t, fs, "/api/openapi.yaml")
+//	client := &http.Client{Transport: spec.ValidatingTransport(t, spec.Transport())}
+type OpenAPISpec struct {
+	document   map[string]interface{}
+	basePath   string
+	operations []*openAPIOperation
+}
+
+type openAPIOperation struct {
+	method     string
+	path       string
+	pattern    *regexp.Regexp
+	names      []string
+	parameters []map[string]interface{}
+	definition map[string]interface{}
+}
+
+func (o *openAPIOperation) String() string {
+	return o.method + " " + o.path
+}
+
+// LoadOpenAPISpec reads an OpenAPI 3 document, in YAML or JSON.
+func LoadOpenAPISpec(t require.TestingT, fs afero.Fs, path string) *OpenAPISpec {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	spec, err := newOpenAPISpec(readYAMLObject(t, fs, path))
+	require.NoError(t, err, "invalid OpenAPI specification %s", path)
+	return spec
+}
+
+func newOpenAPISpec(document map[string]interface{}) (*OpenAPISpec, error) {
+	if version, _ := document["openapi"].(string); !strings.HasPrefix(version, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q", version)
+	}
+	s := &OpenAPISpec{document: document}
+	if servers, ok := document["servers"].([]interface{}); ok && len(servers) > 0 {
+		server, _ := servers[0].(map[string]interface{})
+		rawURL, _ := server["url"].(string)
+		variables, _ := server["variables"].(map[string]interface{})
+		rawURL = openAPIPathParameter.ReplaceAllStringFunc(rawURL, func(name string) string {
+			variable, _ := variables[name[1:len(name)-1]].(map[string]interface{})
+			value, _ := variable["default"].(string)
+			return value
+		})
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server URL %q: %w", rawURL, err)
+		}
+		s.basePath = strings.TrimRight(u.Path, "/")
+	}
+	paths, _ := document["paths"].(map[string]interface{})
+	for path, value := range paths {
+		item := s.resolve(value)
+		pattern, names := openAPIPathPattern(path)
+		for _, method := range openAPIMethods {
+			definition := s.resolve(item[strings.ToLower(method)])
+			if definition == nil {
+				continue
+			}
+			s.operations = append(s.operations, &openAPIOperation{
+				method:     method,
+				path:       path,
+				pattern:    pattern,
+				names:      names,
+				parameters: s.parameters(item["parameters"], definition["parameters"]),
+				definition: definition,
+			})
+		}
+	}
+	// concrete paths take precedence over templated ones
+	sort.SliceStable(s.operations, func(i, j int) bool {
+		a, b := s.operations[i], s.operations[j]
+		if len(a.names) != len(b.names) {
+			return len(a.names) < len(b.names)
+		}
+		return a.path < b.path
+	})
+	return s, nil
+}
+
+func openAPIPathPattern(path string) (*regexp.Regexp, []string) {
+	expr := "^"
+	names := []string{}
+	last := 0
+	for _, match := range openAPIPathParameter.FindAllStringSubmatchIndex(path, -1) {
+		expr += regexp.QuoteMeta(path[last:match[0]]) + "([^/]+)"
+		names = append(names, path[match[2]:match[3]])
+		last = match[1]
+	}
+	return regexp.MustCompile(expr + regexp.QuoteMeta(path[last:]) + "$"), names
+}
+
+// resolve follows the local references of the value and returns it as an object.
+func (s *OpenAPISpec) resolve(value interface{}) map[string]interface{} {
+	for i := 0; i < 64; i++ {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		ref, ok := object["$ref"].(string)
+		if !ok {
+			return object
+		}
+		value, _ = jsonPointerGet(s.document, strings.TrimPrefix(ref, "#"))
+	}
+	return nil
+}
+
+// parameters merges the parameters of a path and of one of its operations, the latter overriding the former.
+func (s *OpenAPISpec) parameters(lists ...interface{}) []map[string]interface{} {
+	parameters := []map[string]interface{}{}
+	index := map[string]int{}
+	for _, list := range lists {
+		values, _ := list.([]interface{})
+		for _, value := range values {
+			parameter := s.resolve(value)
+			if parameter == nil {
+				continue
+			}
+			key := fmt.Sprintf("%v:%v", parameter["in"], parameter["name"])
+			if i, ok := index[key]; ok {
+				parameters[i] = parameter
+				continue
+			}
+			index[key] = len(parameters)
+			parameters = append(parameters, parameter)
+		}
+	}
+	return parameters
+}
+
+// operation returns the operation serving the request, and the values of its path parameters.
+func (s *OpenAPISpec) operation(req *http.Request) (*openAPIOperation, map[string]string) {
+	path := req.URL.Path
+	if s.basePath != "" {
+		if !strings.HasPrefix(path, s.basePath) {
+			return nil, nil
+		}
+		path = strings.TrimPrefix(path, s.basePath)
+		if path == "" {
+			path = "/"
+		}
+	}
+	for _, operation := range s.operations {
+		if operation.method != req.Method {
+			continue
+		}
+		if matches := operation.pattern.FindStringSubmatch(path); matches != nil {
+			values := map[string]string{}
+			for i, name := range operation.names {
+				values[name] = matches[i+1]
+			}
+			return operation, values
+		}
+	}
+	return nil, nil
+}
+
+// Handler answers the operations of the specification with their examples.
+//
+// The response with the lowest 2xx status code is used, unless the request asks for another one
+// with a "Prefer: code=404" header. A named example can be selected with "Prefer: example=name".
+// Examples are generated from the schemas when the specification has none.
+func (s *OpenAPISpec) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operation, _ := s.operation(r)
+		if operation == nil {
+			http.Error(w, fmt.Sprintf("no operation matches %s %s", r.Method, r.URL.Path), http.StatusNotFound)
+			return
+		}
+		preferences := map[string]string{}
+		for _, value := range r.Header.Values("Prefer") {
+			for _, preference := range strings.Split(value, ",") {
+				if name, value, ok := strings.Cut(strings.TrimSpace(preference), "="); ok {
+					preferences[name] = strings.Trim(value, `"`)
+				}
+			}
+		}
+		status, response := s.response(operation, preferences["code"])
+		if response == nil {
+			http.Error(w, fmt.Sprintf("%s has no response %s", operation, preferences["code"]), http.StatusInternalServerError)
+			return
+		}
+		headers, _ := response["headers"].(map[string]interface{})
+		for name, value := range headers {
+			header := s.resolve(value)
+			example, ok := header["example"]
+			if !ok {
+				example = s.example(header["schema"], 0)
+			}
+			if example != nil && !strings.EqualFold(name, "Content-Type") {
+				w.Header().Set(name, fmt.Sprint(example))
+			}
+		}
+		content, _ := response["content"].(map[string]interface{})
+		mediaType := openAPIMediaType(content)
+		if mediaType == "" {
+			w.WriteHeader(status)
+			return
+		}
+		body := s.mediaExample(s.resolve(content[mediaType]), preferences["example"])
+		data, isString := body.(string)
+		if !isString || strings.Contains(mediaType, "json") {
+			encoded, err := json.Marshal(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data = string(encoded)
+		}
+		if !strings.Contains(mediaType, "*") {
+			w.Header().Set("Content-Type", mediaType)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(data))
+	})
+}
+
+// Transport answers the requests with the Handler of the specification, without starting a server.
+func (s *OpenAPISpec) Transport() http.RoundTripper {
+	handler := s.Handler()
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		resp := recorder.Result()
+		resp.Request = req
+		return resp, nil
+	})
+}
+
+// NewServer serves the Handler of the specification.
+func (s *OpenAPISpec) NewServer(t CleanupTest) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(s.Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// response returns the status and the definition of the response to the operation.
+func (s *OpenAPISpec) response(operation *openAPIOperation, code string) (int, map[string]interface{}) {
+	responses, _ := operation.definition["responses"].(map[string]interface{})
+	if code != "" {
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			return 0, nil
+		}
+		return status, s.resolve(openAPIResponseFor(responses, status))
+	}
+	keys := make([]string, 0, len(responses))
+	for key := range responses {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if status, err := strconv.Atoi(key); err == nil && status >= 200 && status < 300 {
+			return status, s.resolve(responses[key])
+		}
+	}
+	for _, key := range []string{"2XX", "default"} {
+		if response, ok := responses[key]; ok {
+			return http.StatusOK, s.resolve(response)
+		}
+	}
+	for _, key := range keys {
+		if status, err := strconv.Atoi(key); err == nil {
+			return status, s.resolve(responses[key])
+		}
+	}
+	return 0, nil
+}
+
+func openAPIResponseFor(responses map[string]interface{}, status int) interface{} {
+	for _, key := range []string{strconv.Itoa(status), fmt.Sprintf("%dXX", status/100), "default"} {
+		if response, ok := responses[key]; ok {
+			return response
+		}
+	}
+	return nil
+}
+
+// openAPIMediaType returns the media type used by the mock: JSON when available, the first one otherwise.
+func openAPIMediaType(content map[string]interface{}) string {
+	if _, ok := content["application/json"]; ok {
+		return "application/json"
+	}
+	mediaTypes := make([]string, 0, len(content))
+	for mediaType := range content {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	if len(mediaTypes) == 0 {
+		return ""
+	}
+	return mediaTypes[0]
+}
+
+// openAPIContentFor returns the content definition matching the media type, including wildcards.
+func openAPIContentFor(content map[string]interface{}, mediaType string) (interface{}, bool) {
+	mediaType = strings.ToLower(mediaType)
+	for _, candidate := range []string{mediaType, strings.SplitN(mediaType, "/", 2)[0] + "/*", "*/*"} {
+		if definition, ok := content[candidate]; ok {
+			return definition, true
+		}
+	}
+	return nil, false
+}
+
+func (s *OpenAPISpec) mediaExample(media map[string]interface{}, name string) interface{} {
+	if example, ok := media["example"]; ok {
+		return example
+	}
+	if examples, ok := media["examples"].(map[string]interface{}); ok && len(examples) > 0 {
+		if _, ok := examples[name]; !ok {
+			names := make([]string, 0, len(examples))
+			for name := range examples {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			name = names[0]
+		}
+		return s.resolve(examples[name])["value"]
+	}
+	return s.example(media["schema"], 0)
+}
+
+// example generates a value valid against the schema, using its examples when available.
+func (s *OpenAPISpec) example(value interface{}, depth int) interface{} {
+	schema := s.resolve(value)
+	if schema == nil || depth > 8 {
+		return nil
+	}
+	for _, key := range []string{"example", "default", "const"} {
+		if example, ok := schema[key]; ok {
+			return example
+		}
+	}
+	for _, key := range []string{"examples", "enum"} {
+		if examples, ok := schema[key].([]interface{}); ok && len(examples) > 0 {
+			return examples[0]
+		}
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		merged := map[string]interface{}{}
+		for _, sub := range all {
+			if object, ok := s.example(sub, depth+1).(map[string]interface{}); ok {
+				for name, value := range object {
+					merged[name] = value
+				}
+			}
+		}
+		return merged
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		if subs, ok := schema[key].([]interface{}); ok && len(subs) > 0 {
+			return s.example(subs[0], depth+1)
+		}
+	}
+	schemaType, _ := schema["type"].(string)
+	if types, ok := schema["type"].([]interface{}); ok && len(types) > 0 {
+		schemaType, _ = types[0].(string)
+	}
+	switch schemaType {
+	case "array":
+		if items, ok := schema["items"]; ok {
+			return []interface{}{s.example(items, depth+1)}
+		}
+		return []interface{}{}
+	case "string":
+		switch schema["format"] {
+		case "date-time":
+			return "2006-01-02T15:04:05Z"
+		case "date":
+			return "2006-01-02"
+		case "uuid":
+			return "00000000-0000-0000-0000-000000000000"
+		case "email":
+			return "user@example.com"
+		case "uri", "url":
+			return "https://example.com"
+		}
+		return "string"
+	case "integer", "number":
+		if minimum, ok := schema["minimum"].(float64); ok {
+			return minimum
+		}
+		return 0
+	case "boolean":
+		return true
+	case "null":
+		return nil
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	object := map[string]interface{}{}
+	for name, property := range properties {
+		object[name] = s.example(property, depth+1)
+	}
+	return object
+}
+
+// ValidateRequest returns the violations of the specification by the request: unknown operations,
+// missing or invalid parameters and invalid bodies. The body is restored after being read.
+func (s *OpenAPISpec) ValidateRequest(req *http.Request) []string {
+	operation, pathValues := s.operation(req)
+	if operation == nil {
+		return []string{fmt.Sprintf("no operation matches %s %s", req.Method, req.URL.Path)}
+	}
+	violations := []string{}
+	query := req.URL.Query()
+	for _, parameter := range operation.parameters {
+		name, _ := parameter["name"].(string)
+		in, _ := parameter["in"].(string)
+		var values []string
+		switch in {
+		case "path":
+			if value, ok := pathValues[name]; ok {
+				values = []string{value}
+			}
+		case "query":
+			values = query[name]
+		case "header":
+			values = req.Header.Values(name)
+		case "cookie":
+			if cookie, err := req.Cookie(name); err == nil {
+				values = []string{cookie.Value}
+			}
+		}
+		prefix := fmt.Sprintf("%s parameter %q", in, name)
+		if len(values) == 0 {
+			if parameter["required"] == true {
+				violations = append(violations, prefix+" is required")
+			}
+			continue
+		}
+		if schema, ok := parameter["schema"]; ok {
+			value := s.parameterValue(schema, values)
+			violations = append(violations, prefixViolations(prefix, validateJSONSchema(s.document, schema, value))...)
+		}
+	}
+
+	body, err := readRequestBody(req)
+	if err != nil {
+		return append(violations, fmt.Sprintf("unable to read the request body: %s", err))
+	}
+	requestBody := s.resolve(operation.definition["requestBody"])
+	switch {
+	case requestBody == nil:
+	case len(body) == 0:
+		if requestBody["required"] == true {
+			violations = append(violations, "request body is required")
+		}
+	default:
+		content, _ := requestBody["content"].(map[string]interface{})
+		violations = append(violations, s.validateContent("request body", content, req.Header.Get("Content-Type"), body)...)
+	}
+	return violations
+}
+
+// ValidateResponse returns the violations of the specification by the response to resp.Request:
+// undeclared status codes, missing headers and invalid bodies. The body is restored after being read.
+func (s *OpenAPISpec) ValidateResponse(resp *http.Response) []string {
+	if resp.Request == nil {
+		return []string{"the response has no request"}
+	}
+	operation, _ := s.operation(resp.Request)
+	if operation == nil {
+		return []string{fmt.Sprintf("no operation matches %s %s", resp.Request.Method, resp.Request.URL.Path)}
+	}
+	responses, _ := operation.definition["responses"].(map[string]interface{})
+	response := s.resolve(openAPIResponseFor(responses, resp.StatusCode))
+	if response == nil {
+		return []string{fmt.Sprintf("status %d is not declared for %s", resp.StatusCode, operation)}
+	}
+	violations := []string{}
+	headers, _ := response["headers"].(map[string]interface{})
+	for name, value := range headers {
+		header := s.resolve(value)
+		values := resp.Header.Values(name)
+		if len(values) == 0 {
+			if header["required"] == true {
+				violations = append(violations, fmt.Sprintf("response header %q is required", name))
+			}
+			continue
+		}
+		if schema, ok := header["schema"]; ok {
+			prefix := fmt.Sprintf("response header %q", name)
+			violations = append(violations, prefixViolations(prefix, validateJSONSchema(s.document, schema, s.parameterValue(schema, values)))...)
+		}
+	}
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return append(violations, fmt.Sprintf("unable to read the response body: %s", err))
+	}
+	content, _ := response["content"].(map[string]interface{})
+	if len(body) > 0 && len(content) > 0 {
+		violations = append(violations, s.validateContent("response body", content, resp.Header.Get("Content-Type"), body)...)
+	}
+	return violations
+}
+
+func (s *OpenAPISpec) validateContent(prefix string, content map[string]interface{}, contentType string, body []byte) []string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return []string{fmt.Sprintf("%s has an invalid content type %q", prefix, contentType)}
+	}
+	definition, ok := openAPIContentFor(content, mediaType)
+	if !ok {
+		mediaTypes := make([]string, 0, len(content))
+		for mediaType := range content {
+			mediaTypes = append(mediaTypes, mediaType)
+		}
+		sort.Strings(mediaTypes)
+		return []string{fmt.Sprintf("%s content type %s is not one of %s", prefix, mediaType, strings.Join(mediaTypes, ", "))}
+	}
+	schema, ok := s.resolve(definition)["schema"]
+	if !ok || !strings.Contains(mediaType, "json") {
+		return nil
+	}
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return []string{fmt.Sprintf("%s is not valid JSON: %s", prefix, err)}
+	}
+	return prefixViolations(prefix, validateJSONSchema(s.document, schema, document))
+}
+
+// parameterValue converts the raw values of a parameter to the JSON types of its schema.
+// Values that can't be converted are kept as strings so that the validation reports them.
+func (s *OpenAPISpec) parameterValue(schema interface{}, values []string) interface{} {
+	resolved := s.resolve(schema)
+	if resolved["type"] == "array" {
+		items := []interface{}{}
+		for _, value := range values {
+			for _, item := range strings.Split(value, ",") {
+				items = append(items, s.parameterValue(resolved["items"], []string{item}))
+			}
+		}
+		return items
+	}
+	value := values[0]
+	switch resolved["type"] {
+	case "integer", "number":
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return number
+		}
+	case "boolean":
+		if boolean, err := strconv.ParseBool(value); err == nil {
+			return boolean
+		}
+	}
+	return value
+}
+
+// prefixViolations describes the subject of JSON schema violations, "/: expected integer" becoming "subject: expected integer".
+func prefixViolations(prefix string, violations []string) []string {
+	prefixed := make([]string, 0, len(violations))
+	for _, violation := range violations {
+		if strings.HasPrefix(violation, "/: ") {
+			prefixed = append(prefixed, prefix+violation[1:])
+			continue
+		}
+		prefixed = append(prefixed, prefix+" "+violation)
+	}
+	return prefixed
+}
+
+// ValidatingTransport sends the requests with transport, http.DefaultTransport when nil, and fails the test
+// when the requests or the responses violate the specification.
+func (s *OpenAPISpec) ValidatingTransport(t assert.TestingT, transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if violations := s.ValidateRequest(req); len(violations) > 0 {
+			assert.Fail(t, fmt.Sprintf("Request %s %s violates the OpenAPI specification:\n\t%s", req.Method, req.URL, strings.Join(violations, "\n\t")))
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+		if resp.Request == nil {
+			resp.Request = req
+		}
+		if violations := s.ValidateResponse(resp); len(violations) > 0 {
+			assert.Fail(t, fmt.Sprintf("Response %s to %s %s violates the OpenAPI specification:\n\t%s", resp.Status, req.Method, req.URL, strings.Join(violations, "\n\t")))
+		}
+		return resp, nil
+	})
+}
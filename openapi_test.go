@@ -0,0 +1,249 @@
+package testutils_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const petStoreSpec = `
+openapi: 3.0.3
+info:
+  title: Pet store
+  version: 1.0.0
+servers:
+  - url: https://api.example.com/{version}
+    variables:
+      version:
+        default: v1
+paths:
+  /pets:
+    get:
+      parameters:
+        - name: limit
+          in: query
+          schema:
+            type: integer
+            maximum: 100
+      responses:
+        200:
+          description: the pets
+          headers:
+            X-Total-Count:
+              required: true
+              schema:
+                type: integer
+              example: 2
+          content:
+            application/json:
+              schema:
+                type: array
+                items:
+                  $ref: '#/components/schemas/Pet'
+              examples:
+                cats:
+                  value: [{"id": 1, "name": "Tom", "tag": "cat"}]
+                dogs:
+                  value: [{"id": 2, "name": "Rex", "tag": "dog"}]
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/NewPet'
+      responses:
+        201:
+          description: the created pet
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/Pet'
+        400:
+          $ref: '#/components/responses/Error'
+  /pets/mine:
+    get:
+      responses:
+        200:
+          description: my pet
+          content:
+            application/json:
+              example: {"id": 0, "name": "Mine"}
+  /pets/{petId}:
+    parameters:
+      - name: petId
+        in: path
+        required: true
+        schema:
+          type: integer
+    get:
+      responses:
+        200:
+          description: a pet
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/Pet'
+        404:
+          $ref: '#/components/responses/Error'
+components:
+  schemas:
+    NewPet:
+      type: object
+      required: [name]
+      properties:
+        name:
+          type: string
+          example: Garfield
+        tag:
+          type: string
+          enum: [cat, dog]
+    Pet:
+      allOf:
+        - type: object
+          required: [id]
+          properties:
+            id:
+              type: integer
+              minimum: 1
+        - $ref: '#/components/schemas/NewPet'
+  responses:
+    Error:
+      description: an error
+      content:
+        application/json:
+          schema:
+            type: object
+            properties:
+              message:
+                type: string
+`
+
+func loadPetStoreSpec(t *testing.T) *testutils.OpenAPISpec {
+	fs := afero.NewMemMapFs()
+	testutils.EnsureFileContent(t, fs, "/api/openapi.yaml", petStoreSpec)
+	return testutils.LoadOpenAPISpec(t, fs, "/api/openapi.yaml")
+}
+
+func TestOpenAPISpecMock(t *testing.T) {
+	spec := loadPetStoreSpec(t)
+	client := &http.Client{Transport: spec.Transport()}
+
+	resp, err := client.Get("https://api.example.com/v1/pets")
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusOK)
+	testutils.AssertResponseHeader(t, resp, "X-Total-Count", "2")
+	testutils.AssertResponseJSON(t, resp, `[{"id": 1, "name": "Tom", "tag": "cat"}]`)
+
+	req, err := http.NewRequest(http.MethodGet, "https://api.example.com/v1/pets", nil)
+	require.NoError(t, err)
+	req.Header.Set("Prefer", "example=dogs")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	testutils.AssertResponseJSON(t, resp, `[{"id": 2, "name": "Rex", "tag": "dog"}]`)
+
+	resp, err = client.Get("https://api.example.com/v1/pets/mine")
+	require.NoError(t, err)
+	testutils.AssertResponseJSON(t, resp, `{"id": 0, "name": "Mine"}`)
+
+	resp, err = client.Get("https://api.example.com/v1/pets/42")
+	require.NoError(t, err)
+	testutils.AssertResponseJSON(t, resp, `{"id": 1, "name": "Garfield", "tag": "cat"}`)
+
+	req, err = http.NewRequest(http.MethodGet, "https://api.example.com/v1/pets/42", nil)
+	require.NoError(t, err)
+	req.Header.Set("Prefer", "code=404")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusNotFound)
+	testutils.AssertResponseJSON(t, resp, `{"message": "string"}`)
+
+	resp, err = client.Get("https://api.example.com/v1/owners")
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusNotFound)
+	testutils.AssertResponseBodyMatches(t, resp, "no operation matches GET /v1/owners")
+
+	server := spec.NewServer(t)
+	resp, err = http.Post(server.URL+"/v1/pets", "application/json", strings.NewReader(`{"name": "Tom"}`))
+	require.NoError(t, err)
+	testutils.AssertResponseStatus(t, resp, http.StatusCreated)
+	testutils.AssertResponseJSONSubset(t, resp, `{"id": 1, "name": "Garfield"}`)
+}
+
+func TestOpenAPISpecValidation(t *testing.T) {
+	spec := loadPetStoreSpec(t)
+
+	req := testutils.NewHTTPRequestBuilder().WithMethod(http.MethodPost).WithURL("https://api.example.com/v1/pets").WithJsonBody(map[string]string{"name": "Tom", "tag": "cat"}).Build()
+	assert.Empty(t, spec.ValidateRequest(req))
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "Tom", "tag": "cat"}`, string(body))
+
+	req = testutils.NewHTTPRequestBuilder().WithMethod(http.MethodPost).WithURL("https://api.example.com/v1/pets").WithJsonBody(map[string]interface{}{"tag": "bird", "age": 3}).Build()
+	assert.Equal(t, []string{
+		`request body: missing required property "name"`,
+		`request body /tag: "bird" is not one of []interface {}{"cat", "dog"}`,
+	}, spec.ValidateRequest(req))
+
+	req = testutils.NewHTTPRequestBuilder().WithMethod(http.MethodPost).WithURL("https://api.example.com/v1/pets").Build()
+	assert.Equal(t, []string{"request body is required"}, spec.ValidateRequest(req))
+
+	req = testutils.NewHTTPRequestBuilder().WithURL("https://api.example.com/v1/pets?limit=many").Build()
+	assert.Equal(t, []string{`query parameter "limit": expected integer, got string`}, spec.ValidateRequest(req))
+	req = testutils.NewHTTPRequestBuilder().WithURL("https://api.example.com/v1/pets?limit=500").Build()
+	assert.Equal(t, []string{`query parameter "limit": 500 must be at most 100`}, spec.ValidateRequest(req))
+	req = testutils.NewHTTPRequestBuilder().WithURL("https://api.example.com/v1/pets/abc").Build()
+	assert.Equal(t, []string{`path parameter "petId": expected integer, got string`}, spec.ValidateRequest(req))
+	req = testutils.NewHTTPRequestBuilder().WithMethod(http.MethodDelete).WithURL("https://api.example.com/v1/pets/1").Build()
+	assert.Equal(t, []string{"no operation matches DELETE /v1/pets/1"}, spec.ValidateRequest(req))
+
+	req = testutils.NewHTTPRequestBuilder().WithURL("https://api.example.com/v1/pets").Build()
+	resp := testutils.NewHTTPResponseBuilder().WithRequest(req).WithJsonBody([]map[string]interface{}{{"id": 0, "name": "Tom"}}).Build()
+	assert.Equal(t, []string{
+		`response header "X-Total-Count" is required`,
+		"response body /0/id: 0 must be at least 1",
+	}, spec.ValidateResponse(resp))
+	testutils.AssertResponseJSON(t, resp, `[{"id": 0, "name": "Tom"}]`)
+
+	resp = testutils.NewHTTPResponseBuilder().WithRequest(req).WithStatusCode(http.StatusInternalServerError).Build()
+	assert.Equal(t, []string{"status 500 is not declared for GET /pets"}, spec.ValidateResponse(resp))
+
+	t.Run("ValidatingTransport", func(t *testing.T) {
+		api := testutils.NewMockTransport(t)
+		api.On(http.MethodGet, "/v1/pets/1").Respond(testutils.NewHTTPResponseBuilder().WithJsonBody(map[string]interface{}{"id": 1, "name": "Tom"}))
+		api.On(http.MethodPost, "/v1/pets").Respond(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusCreated).WithBody(io.NopCloser(bytes.NewReader([]byte(`{"name": "Tom"}`)))).WithHeader("Content-Type", "text/plain"))
+
+		client := &http.Client{Transport: spec.ValidatingTransport(t, api)}
+		resp, err := client.Get("https://api.example.com/v1/pets/1")
+		require.NoError(t, err)
+		pet := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&pet))
+		assert.Equal(t, "Tom", pet["name"])
+
+		fakeT := &testutils.FakeTest{}
+		client = &http.Client{Transport: spec.ValidatingTransport(fakeT, api)}
+		_, err = client.Post("https://api.example.com/v1/pets", "application/json", strings.NewReader(`{"name": 1}`))
+		require.NoError(t, err)
+		require.Len(t, fakeT.ErrorMessages, 2)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Request POST https://api.example.com/v1/pets violates the OpenAPI specification:")
+		assert.Contains(t, fakeT.ErrorMessages[0], "request body /name: expected string, got integer")
+		assert.Contains(t, fakeT.ErrorMessages[1], "Response 201 Created to POST https://api.example.com/v1/pets violates the OpenAPI specification:")
+		assert.Contains(t, fakeT.ErrorMessages[1], "response body content type text/plain is not one of application/json")
+	})
+
+	t.Run("When the document is not an OpenAPI 3 specification", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		testutils.EnsureFileContent(t, fs, "/swagger.yaml", "swagger: '2.0'\n")
+		fakeT := &testutils.FakeTest{}
+		testutils.LoadOpenAPISpec(fakeT, fs, "/swagger.yaml")
+		assert.True(t, fakeT.Failed)
+	})
+}
@@ -0,0 +1,325 @@
+package testutils
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RateLimitHeaders selects the headers sent by the RateLimitServer.
+type RateLimitHeaders int
+
+const (
+	// RateLimitRetryAfter sends the Retry-After header, in seconds, with the 429 responses.
+	RateLimitRetryAfter RateLimitHeaders = 1 << iota
+	// RateLimitXRateLimit sends the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers
+	// with all the responses, the reset being a Unix time in seconds.
+	RateLimitXRateLimit
+)
+
+// RateLimitRequest is a request received by a RateLimitServer.
+type RateLimitRequest struct {
+	Method   string
+	URL      *url.URL
+	Arrived  time.Time
+	Answered time.Time
+	Status   int
+	// RetryAfter is the delay sent in the Retry-After header of a 429 response.
+	RetryAfter time.Duration
+	// Concurrent is the number of requests in flight when the request arrived, itself included.
+	Concurrent int
+}
+
+func (r RateLimitRequest) String() string {
+	return fmt.Sprintf("%s %s: %d", r.Method, r.URL, r.Status)
+}
+
+// RateLimitServer is a server enforcing a rate limit and recording the arrival of the requests,
+// to assert that clients honour Retry-After, back off exponentially and limit their concurrency.
+//
+//	server := testutils.NewRateLimitServer(t, nil).WithLimit(10, time.Second)
+//	server.ThrottleNext(3)
+//	client.Fetch(server.Server.URL)
+//	server.AssertExponentialBackoff(t, 100*time.Millisecond, 2, 0.2)
+type RateLimitServer struct {
+	Server *httptest.Server
+
+	handler http.Handler
+
+	mu          sync.Mutex
+	limit       int
+	window      time.Duration
+	retryAfter  time.Duration
+	headers     RateLimitHeaders
+	latency     time.Duration
+	throttled   int
+	windowStart time.Time
+	count       int
+	inFlight    int
+	requests    []*RateLimitRequest
+}
+
+// NewRateLimitServer starts a server answering the requests within the limit with the handler,
+// or with 200 OK when it is nil.
+//
+// Without limit, only the requests throttled with ThrottleNext are answered 429 Too Many Requests.
+func NewRateLimitServer(t CleanupTest, handler http.Handler) *RateLimitServer {
+	t.Helper()
+	if handler == nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	s := &RateLimitServer{handler: handler, headers: RateLimitRetryAfter | RateLimitXRateLimit}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Server.Close)
+	return s
+}
+
+// WithLimit accepts requests requests per window, the window starting with its first request.
+func (s *RateLimitServer) WithLimit(requests int, window time.Duration) *RateLimitServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = requests
+	s.window = window
+	return s
+}
+
+// WithRetryAfter sends the delay in the Retry-After header, rounded up to the second,
+// instead of the time left until the end of the window.
+func (s *RateLimitServer) WithRetryAfter(delay time.Duration) *RateLimitServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retryAfter = delay
+	return s
+}
+
+// WithHeaders selects the rate limit headers sent, both by default. Zero sends none of them.
+func (s *RateLimitServer) WithHeaders(headers RateLimitHeaders) *RateLimitServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.headers = headers
+	return s
+}
+
+// WithLatency delays all the responses, so that concurrent requests overlap.
+func (s *RateLimitServer) WithLatency(latency time.Duration) *RateLimitServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+	return s
+}
+
+// ThrottleNext answers 429 Too Many Requests to the next n requests, whatever the limit.
+func (s *RateLimitServer) ThrottleNext(n int) *RateLimitServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.throttled += n
+	return s
+}
+
+// Requests returns the received requests, in their arrival order.
+func (s *RateLimitServer) Requests() []RateLimitRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := []RateLimitRequest{}
+	for _, r := range s.requests {
+		requests = append(requests, *r)
+	}
+	return requests
+}
+
+func (s *RateLimitServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	s.mu.Lock()
+	s.inFlight++
+	request := &RateLimitRequest{Method: r.Method, URL: cloneURL(r.URL), Arrived: now, Concurrent: s.inFlight}
+	s.requests = append(s.requests, request)
+
+	if s.limit > 0 && (s.windowStart.IsZero() || now.Sub(s.windowStart) >= s.window) {
+		s.windowStart = now
+		s.count = 0
+	}
+	allowed := s.limit == 0 || s.count < s.limit
+	if s.throttled > 0 {
+		allowed = false
+		s.throttled--
+	}
+	if allowed && s.limit > 0 {
+		s.count++
+	}
+	reset := s.windowStart.Add(s.window)
+	if s.limit > 0 && s.headers&RateLimitXRateLimit != 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(s.limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(s.limit-s.count))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(reset.UnixNano())/float64(time.Second))), 10))
+	}
+	retryAfter := s.retryAfter
+	if retryAfter == 0 {
+		retryAfter = time.Second
+		if s.limit > 0 && reset.After(now) {
+			retryAfter = reset.Sub(now)
+		}
+	}
+	retryAfter = time.Duration(math.Ceil(retryAfter.Seconds())) * time.Second
+	headers, latency := s.headers, s.latency
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+		}
+	}
+	status := http.StatusOK
+	if allowed {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		s.handler.ServeHTTP(recorder, r)
+		status = recorder.status
+	} else {
+		status = http.StatusTooManyRequests
+		if headers&RateLimitRetryAfter != 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		} else {
+			retryAfter = 0
+		}
+		http.Error(w, http.StatusText(status), status)
+	}
+
+	s.mu.Lock()
+	s.inFlight--
+	request.Status = status
+	request.Answered = time.Now()
+	if !allowed {
+		request.RetryAfter = retryAfter
+	}
+	s.mu.Unlock()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController flush and hijack the wrapped writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func describeRateLimitRequests(requests []RateLimitRequest) string {
+	if len(requests) == 0 {
+		return "\t<none>"
+	}
+	start := requests[0].Arrived
+	lines := []string{}
+	for i, r := range requests {
+		lines = append(lines, fmt.Sprintf("\t%d. +%s %s", i+1, r.Arrived.Sub(start).Round(time.Millisecond), r))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// AssertRetryAfterHonored asserts that no request arrived before the delay of the Retry-After header
+// of a 429 response had elapsed since it was answered.
+func (s *RateLimitServer) AssertRetryAfterHonored(t assert.TestingT, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	requests := s.Requests()
+	for i, throttled := range requests {
+		if throttled.RetryAfter == 0 {
+			continue
+		}
+		for j, r := range requests[i+1:] {
+			if r.Arrived.After(throttled.Answered) && r.Arrived.Before(throttled.Answered.Add(throttled.RetryAfter)) {
+				return assert.Fail(t, fmt.Sprintf("Expecting request %d to wait %s after request %d was answered with Retry-After but it waited %s, received requests:\n%s",
+					i+j+2, throttled.RetryAfter, i+1, r.Arrived.Sub(throttled.Answered).Round(time.Millisecond), describeRateLimitRequests(requests)), msgAndArgs...)
+			}
+		}
+	}
+	return true
+}
+
+func (s *RateLimitServer) RequireRetryAfterHonored(t require.TestingT, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if s.AssertRetryAfterHonored(t, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertExponentialBackoff asserts that the requests following 429 and 5xx responses waited initial, then
+// initial*factor, initial*factor^2 and so on, within the tolerance, like 0.2 for ±20%. The delay is measured
+// from the previous response, and resets after a successful response. Requests are expected to be sequential.
+func (s *RateLimitServer) AssertExponentialBackoff(t assert.TestingT, initial time.Duration, factor, tolerance float64, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	requests := s.Requests()
+	retries := 0
+	for i := 1; i < len(requests); i++ {
+		previous := requests[i-1]
+		if previous.Status != http.StatusTooManyRequests && previous.Status < 500 {
+			retries = 0
+			continue
+		}
+		expected := time.Duration(float64(initial) * math.Pow(factor, float64(retries)))
+		waited := requests[i].Arrived.Sub(previous.Answered)
+		if float64(waited) < float64(expected)*(1-tolerance) || float64(waited) > float64(expected)*(1+tolerance) {
+			return assert.Fail(t, fmt.Sprintf("Expecting retry %d to wait %s ±%.0f%% but it waited %s, received requests:\n%s",
+				retries+1, expected, tolerance*100, waited.Round(time.Millisecond), describeRateLimitRequests(requests)), msgAndArgs...)
+		}
+		retries++
+	}
+	return true
+}
+
+func (s *RateLimitServer) RequireExponentialBackoff(t require.TestingT, initial time.Duration, factor, tolerance float64, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if s.AssertExponentialBackoff(t, initial, factor, tolerance, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
+
+// AssertMaxConcurrency asserts that there were never more than limit requests in flight.
+func (s *RateLimitServer) AssertMaxConcurrency(t assert.TestingT, limit int, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	requests := s.Requests()
+	for i, r := range requests {
+		if r.Concurrent > limit {
+			return assert.Fail(t, fmt.Sprintf("Expecting at most %d concurrent requests but request %d arrived with %d requests in flight, received requests:\n%s",
+				limit, i+1, r.Concurrent, describeRateLimitRequests(requests)), msgAndArgs...)
+		}
+	}
+	return true
+}
+
+func (s *RateLimitServer) RequireMaxConcurrency(t require.TestingT, limit int, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if s.AssertMaxConcurrency(t, limit, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
@@ -0,0 +1,148 @@
+package testutils_test
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rateLimitedGet(t *testing.T, url string) *http.Response {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+// retry retries the request after 429 responses, waiting the delays in order.
+func retry(t *testing.T, url string, delays ...time.Duration) *http.Response {
+	resp := rateLimitedGet(t, url)
+	for _, delay := range delays {
+		if resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+		time.Sleep(delay)
+		resp = rateLimitedGet(t, url)
+	}
+	return resp
+}
+
+func TestRateLimitServerLimit(t *testing.T) {
+	server := testutils.NewRateLimitServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})).WithLimit(2, time.Minute)
+
+	resp := rateLimitedGet(t, server.Server.URL+"/jobs")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", resp.Header.Get("X-RateLimit-Remaining"))
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), time.Unix(reset, 0), 2*time.Second)
+
+	resp = rateLimitedGet(t, server.Server.URL+"/jobs")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Remaining"))
+
+	resp = rateLimitedGet(t, server.Server.URL+"/jobs")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+
+	requests := server.Requests()
+	require.Len(t, requests, 3)
+	assert.Equal(t, "/jobs", requests[0].URL.Path)
+	assert.Equal(t, http.StatusAccepted, requests[0].Status)
+	assert.Equal(t, http.StatusTooManyRequests, requests[2].Status)
+	assert.Equal(t, time.Minute, requests[2].RetryAfter)
+
+	server.WithHeaders(testutils.RateLimitXRateLimit)
+	resp = rateLimitedGet(t, server.Server.URL+"/jobs")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Retry-After"))
+	assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Remaining"))
+}
+
+func TestRateLimitServerRetryAfter(t *testing.T) {
+	server := testutils.NewRateLimitServer(t, nil).WithRetryAfter(time.Second)
+
+	server.ThrottleNext(1)
+	resp := retry(t, server.Server.URL, time.Second)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	server.AssertRetryAfterHonored(t)
+
+	server.ThrottleNext(1)
+	resp = retry(t, server.Server.URL, 10*time.Millisecond)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	fakeT := &testutils.FakeTest{}
+	assert.False(t, server.AssertRetryAfterHonored(fakeT))
+	require.Len(t, fakeT.ErrorMessages, 1)
+	assert.Contains(t, fakeT.ErrorMessages[0], "Expecting request 4 to wait 1s after request 3 was answered with Retry-After")
+	assert.Contains(t, fakeT.ErrorMessages[0], "GET /: 429")
+
+	fakeT = &testutils.FakeTest{}
+	server.RequireRetryAfterHonored(fakeT)
+	assert.True(t, fakeT.Failed)
+}
+
+func TestRateLimitServerExponentialBackoff(t *testing.T) {
+	server := testutils.NewRateLimitServer(t, nil).ThrottleNext(3)
+	resp := retry(t, server.Server.URL, 50*time.Millisecond, 100*time.Millisecond, 200*time.Millisecond)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	server.AssertExponentialBackoff(t, 50*time.Millisecond, 2, 0.5)
+
+	server = testutils.NewRateLimitServer(t, nil).ThrottleNext(3)
+	retry(t, server.Server.URL, 50*time.Millisecond, 50*time.Millisecond, 50*time.Millisecond)
+	fakeT := &testutils.FakeTest{}
+	assert.False(t, server.AssertExponentialBackoff(fakeT, 50*time.Millisecond, 2, 0.3))
+	require.Len(t, fakeT.ErrorMessages, 1)
+	assert.Contains(t, fakeT.ErrorMessages[0], "Expecting retry 2 to wait 100ms ±30% but it waited")
+
+	fakeT = &testutils.FakeTest{}
+	server.RequireExponentialBackoff(fakeT, 50*time.Millisecond, 2, 0.3)
+	assert.True(t, fakeT.Failed)
+}
+
+func TestRateLimitServerConcurrency(t *testing.T) {
+	server := testutils.NewRateLimitServer(t, nil).WithLatency(100 * time.Millisecond)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := http.Get(server.Server.URL); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, server.Requests(), 3)
+	server.AssertMaxConcurrency(t, 3)
+
+	fakeT := &testutils.FakeTest{}
+	assert.False(t, server.AssertMaxConcurrency(fakeT, 1))
+	require.Len(t, fakeT.ErrorMessages, 1)
+	assert.Contains(t, fakeT.ErrorMessages[0], "Expecting at most 1 concurrent requests but request 2 arrived with 2 requests in flight")
+
+	fakeT = &testutils.FakeTest{}
+	server.RequireMaxConcurrency(fakeT, 1)
+	assert.True(t, fakeT.Failed)
+}
+
+func TestRateLimitServerFlushes(t *testing.T) {
+	flushed := make(chan error, 1)
+	server := testutils.NewRateLimitServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		flushed <- http.NewResponseController(w).Flush()
+	}))
+
+	resp := rateLimitedGet(t, server.Server.URL+"/events")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, <-flushed)
+}
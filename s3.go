@@ -0,0 +1,758 @@
+package testutils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// S3Operation identifies an operation served by the S3Server.
+type S3Operation string
+
+const (
+	S3OperationListBuckets             S3Operation = "ListBuckets"
+	S3OperationCreateBucket            S3Operation = "CreateBucket"
+	S3OperationHeadBucket              S3Operation = "HeadBucket"
+	S3OperationDeleteBucket            S3Operation = "DeleteBucket"
+	S3OperationListObjectsV2           S3Operation = "ListObjectsV2"
+	S3OperationPutObject               S3Operation = "PutObject"
+	S3OperationGetObject               S3Operation = "GetObject"
+	S3OperationHeadObject              S3Operation = "HeadObject"
+	S3OperationDeleteObject            S3Operation = "DeleteObject"
+	S3OperationCreateMultipartUpload   S3Operation = "CreateMultipartUpload"
+	S3OperationUploadPart              S3Operation = "UploadPart"
+	S3OperationCompleteMultipartUpload S3Operation = "CompleteMultipartUpload"
+	S3OperationAbortMultipartUpload    S3Operation = "AbortMultipartUpload"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// S3Region is the region of the presigned URLs of the S3Server.
+const S3Region = "us-east-1"
+
+// S3Error is an error document returned by the S3Server.
+type S3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+	Status   int      `xml:"-"`
+}
+
+type s3Object struct {
+	contentType string
+	metadata    map[string]string
+	etag        string
+	size        int64
+}
+
+type s3Upload struct {
+	bucket, key string
+	object      s3Object
+	parts       map[int][]byte
+}
+
+// S3Server is an S3-compatible server storing the objects in an afero.Fs, the object key of a bucket
+// being stored at <root>/<bucket>/<key>. Objects can be asserted with the fs assertions once uploaded,
+// and files written to the fs are served as objects.
+//
+// It supports buckets, PutObject, GetObject with ranges, HeadObject, DeleteObject, ListObjectsV2 and multipart uploads.
+// Only path-style requests are supported, AWS SDKs must be configured with the server URL as endpoint and path-style addressing.
+//
+//	s3Server := testutils.NewS3Server(t, fs, "/s3").WithCredentials(credentials)
+//	s3Server.CreateBucket(t, "uploads")
+//	upload(s3Server.Server.URL, "uploads", "report.csv")
+//	testutils.AssertFileContents(t, fs, s3Server.ObjectPath("uploads", "report.csv"), "id,name\n")
+type S3Server struct {
+	Server *httptest.Server
+
+	fs          afero.Fs
+	root        string
+	credentials []AWSCredentials
+	verifier    *SigV4Verifier
+
+	mu       sync.Mutex
+	objects  map[string]s3Object
+	uploads  map[string]*s3Upload
+	problems map[S3Operation][]S3Error
+}
+
+// NewS3Server starts an S3 server accepting unsigned requests.
+func NewS3Server(t CleanupTest, fs afero.Fs, root string) *S3Server {
+	t.Helper()
+	s := &S3Server{
+		fs:       fs,
+		root:     root,
+		objects:  map[string]s3Object{},
+		uploads:  map[string]*s3Upload{},
+		problems: map[S3Operation][]S3Error{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Server.Close)
+	return s
+}
+
+// WithCredentials only accepts the requests signed with SigV4 by one of the credentials, in headers or presigned URLs.
+func (s *S3Server) WithCredentials(credentials ...AWSCredentials) *S3Server {
+	s.credentials = credentials
+	s.verifier = NewSigV4Verifier(credentials...).WithScope("", "s3")
+	return s
+}
+
+// CreateBucket creates the buckets.
+func (s *S3Server) CreateBucket(t require.TestingT, buckets ...string) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	for _, bucket := range buckets {
+		require.NoError(t, s.fs.MkdirAll(filepath.Join(s.root, bucket), 0755))
+	}
+}
+
+// ObjectPath returns the path of the object in the fs.
+func (s *S3Server) ObjectPath(bucket, key string) string {
+	return filepath.Join(s.root, bucket, filepath.FromSlash(key))
+}
+
+// PresignedURL returns a URL valid for the duration, signed with the first credentials,
+// or with test credentials when the server accepts unsigned requests.
+func (s *S3Server) PresignedURL(method, bucket, key string, expires time.Duration) string {
+	credentials := AWSCredentials{AccessKeyID: "test", SecretAccessKey: "test"}
+	if len(s.credentials) > 0 {
+		credentials = s.credentials[0]
+	}
+	u, _ := url.Parse(s.Server.URL)
+	u.Path = "/" + bucket + "/" + key
+	req := &http.Request{Method: method, URL: u, Header: http.Header{}, Host: u.Host}
+	PresignSigV4Request(req, credentials, S3Region, "s3", time.Now(), expires)
+	return req.URL.String()
+}
+
+// InjectError makes the next request of the operation fail with the error.
+//
+// Several errors can be queued for the same operation, each of them being returned once.
+// When the error has no status, 500 Internal Server Error is used.
+func (s *S3Server) InjectError(operation S3Operation, err S3Error) *S3Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err.Status == 0 {
+		err.Status = http.StatusInternalServerError
+	}
+	s.problems[operation] = append(s.problems[operation], err)
+	return s
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err S3Error) {
+	err.Resource = r.URL.Path
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(err.Status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(err)
+}
+
+func writeS3Result(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(result)
+}
+
+func s3NotFound(code, message string) S3Error {
+	return S3Error{Code: code, Message: message, Status: http.StatusNotFound}
+}
+
+type s3Handler func(w http.ResponseWriter, r *http.Request, bucket, key string)
+
+func (s *S3Server) route(r *http.Request, bucket, key string) (S3Operation, s3Handler) {
+	query := r.URL.Query()
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		return S3OperationListBuckets, s.serveListBuckets
+	case key == "" && r.Method == http.MethodPut:
+		return S3OperationCreateBucket, s.serveCreateBucket
+	case key == "" && r.Method == http.MethodHead:
+		return S3OperationHeadBucket, s.serveHeadBucket
+	case key == "" && r.Method == http.MethodDelete:
+		return S3OperationDeleteBucket, s.serveDeleteBucket
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		return S3OperationListObjectsV2, s.serveListObjectsV2
+	case key == "":
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		return S3OperationCreateMultipartUpload, s.serveCreateMultipartUpload
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		return S3OperationUploadPart, s.serveUploadPart
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		return S3OperationCompleteMultipartUpload, s.serveCompleteMultipartUpload
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		return S3OperationAbortMultipartUpload, s.serveAbortMultipartUpload
+	case r.Method == http.MethodPut:
+		return S3OperationPutObject, s.servePutObject
+	case r.Method == http.MethodGet:
+		return S3OperationGetObject, s.serveGetObject
+	case r.Method == http.MethodHead:
+		return S3OperationHeadObject, s.serveGetObject
+	case r.Method == http.MethodDelete:
+		return S3OperationDeleteObject, s.serveDeleteObject
+	}
+	return "", nil
+}
+
+func (s *S3Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	operation, handler := s.route(r, bucket, key)
+	if handler == nil {
+		writeS3Error(w, r, S3Error{Code: "NotImplemented", Message: fmt.Sprintf("%s %s is not supported", r.Method, r.URL), Status: http.StatusNotImplemented})
+		return
+	}
+	s.mu.Lock()
+	var problem *S3Error
+	if problems := s.problems[operation]; len(problems) > 0 {
+		problem = &problems[0]
+		s.problems[operation] = problems[1:]
+	}
+	s.mu.Unlock()
+	if problem != nil {
+		writeS3Error(w, r, *problem)
+		return
+	}
+	if s.verifier != nil {
+		if err := s.verifier.Verify(r); err != nil {
+			code := "SignatureDoesNotMatch"
+			sigErr := &SigV4Error{}
+			errors.As(err, &sigErr)
+			switch sigErr.Component {
+			case "credential":
+				code = "InvalidAccessKeyId"
+			case "authorization", "date":
+				code = "AccessDenied"
+			}
+			writeS3Error(w, r, S3Error{Code: code, Message: err.Error(), Status: http.StatusForbidden})
+			return
+		}
+	}
+	if bucket != "" && operation != S3OperationCreateBucket && !s.bucketExists(bucket) {
+		writeS3Error(w, r, s3NotFound("NoSuchBucket", "The specified bucket does not exist"))
+		return
+	}
+	if strings.Contains("/"+key+"/", "/../") {
+		writeS3Error(w, r, S3Error{Code: "InvalidArgument", Message: "The key must not contain .. segments", Status: http.StatusBadRequest})
+		return
+	}
+	handler(w, r, bucket, key)
+}
+
+func (s *S3Server) bucketExists(bucket string) bool {
+	exists, _ := afero.DirExists(s.fs, filepath.Join(s.root, bucket))
+	return exists
+}
+
+// requestBody reads the body, decoding the aws-chunked encoding used by streaming signatures.
+func (s *S3Server) requestBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return body, err
+	}
+	decoded := []byte{}
+	reader := bufio.NewReader(bytes.NewReader(body))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked body: %w", err)
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked chunk size %q", size)
+		}
+		if n == 0 {
+			return decoded, nil
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked body: %w", err)
+		}
+		decoded = append(decoded, chunk...)
+		reader.ReadString('\n')
+	}
+}
+
+func s3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func s3ObjectFromRequest(r *http.Request) s3Object {
+	object := s3Object{contentType: r.Header.Get("Content-Type"), metadata: map[string]string{}}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			object.metadata[strings.ToLower(name)] = values[0]
+		}
+	}
+	return object
+}
+
+func (s *S3Server) writeObject(bucket, key string, data []byte, object s3Object) error {
+	path := s.ObjectPath(bucket, key)
+	if err := s.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(s.fs, path, data, 0644); err != nil {
+		return err
+	}
+	object.size = int64(len(data))
+	if object.etag == "" {
+		object.etag = s3ETag(data)
+	}
+	s.mu.Lock()
+	s.objects[bucket+"/"+key] = object
+	s.mu.Unlock()
+	return nil
+}
+
+// readObject returns the object content and its metadata, which are defaults for files written directly in the fs.
+func (s *S3Server) readObject(bucket, key string) ([]byte, s3Object, os.FileInfo, error) {
+	path := s.ObjectPath(bucket, key)
+	info, err := s.fs.Stat(path)
+	if err != nil || info.IsDir() {
+		return nil, s3Object{}, nil, os.ErrNotExist
+	}
+	data, err := afero.ReadFile(s.fs, path)
+	if err != nil {
+		return nil, s3Object{}, nil, err
+	}
+	s.mu.Lock()
+	object, ok := s.objects[bucket+"/"+key]
+	s.mu.Unlock()
+	if !ok || object.size != int64(len(data)) {
+		object = s3Object{etag: s3ETag(data)}
+	}
+	if object.contentType == "" {
+		object.contentType = "application/octet-stream"
+	}
+	return data, object, info, nil
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+func (s *S3Server) serveListBuckets(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	result := s3ListBucketsResult{Xmlns: s3Namespace, Buckets: []s3Bucket{}}
+	infos, err := afero.ReadDir(s.fs, s.root)
+	if err != nil && !os.IsNotExist(err) {
+		writeS3Error(w, r, S3Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			result.Buckets = append(result.Buckets, s3Bucket{Name: info.Name(), CreationDate: info.ModTime().UTC().Format(time.RFC3339)})
+		}
+	}
+	writeS3Result(w, result)
+}
+
+func (s *S3Server) serveCreateBucket(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if s.bucketExists(bucket) {
+		writeS3Error(w, r, S3Error{Code: "BucketAlreadyOwnedByYou", Message: "The bucket already exists", Status: http.StatusConflict})
+		return
+	}
+	if err := s.fs.MkdirAll(filepath.Join(s.root, bucket), 0755); err != nil {
+		writeS3Error(w, r, S3Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3Server) serveHeadBucket(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	w.Header().Set("X-Amz-Bucket-Region", S3Region)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3Server) serveDeleteBucket(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	keys, err := s.keys(bucket)
+	if err != nil {
+		writeS3Error(w, r, S3Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	if len(keys) > 0 {
+		writeS3Error(w, r, S3Error{Code: "BucketNotEmpty", Message: "The bucket you tried to delete is not empty", Status: http.StatusConflict})
+		return
+	}
+	if err := s.fs.RemoveAll(filepath.Join(s.root, bucket)); err != nil {
+		writeS3Error(w, r, S3Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keys lists the keys of the bucket in lexicographical order.
+func (s *S3Server) keys(bucket string) ([]string, error) {
+	dir := filepath.Join(s.root, bucket)
+	keys := []string{}
+	err := afero.Walk(s.fs, dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+type s3ListObjectsV2Result struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Contents              []s3ListObject   `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3ListObject struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+func (s *S3Server) serveListObjectsV2(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	query := r.URL.Query()
+	result := s3ListObjectsV2Result{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           1000,
+	}
+	if maxKeys := query.Get("max-keys"); maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, S3Error{Code: "InvalidArgument", Message: "Invalid max-keys " + maxKeys, Status: http.StatusBadRequest})
+			return
+		}
+		result.MaxKeys = n
+	}
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.StdEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			writeS3Error(w, r, S3Error{Code: "InvalidArgument", Message: "Invalid continuation token", Status: http.StatusBadRequest})
+			return
+		}
+		after = string(token)
+	}
+	keys, err := s.keys(bucket)
+	if err != nil {
+		writeS3Error(w, r, S3Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	last := ""
+	for _, k := range keys {
+		if !strings.HasPrefix(k, result.Prefix) || k <= after {
+			continue
+		}
+		// after a common prefix, its keys are skipped
+		if result.Delimiter != "" && strings.HasSuffix(after, result.Delimiter) && strings.HasPrefix(k, after) {
+			continue
+		}
+		if result.KeyCount == result.MaxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+			break
+		}
+		if result.Delimiter != "" {
+			if i := strings.Index(k[len(result.Prefix):], result.Delimiter); i >= 0 {
+				prefix := k[:len(result.Prefix)+i+len(result.Delimiter)]
+				if prefix != last {
+					result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: prefix})
+					result.KeyCount++
+					last = prefix
+				}
+				after = prefix
+				continue
+			}
+		}
+		_, object, info, err := s.readObject(bucket, k)
+		if err != nil {
+			continue
+		}
+		result.Contents = append(result.Contents, s3ListObject{
+			Key:          k,
+			LastModified: info.ModTime().UTC().Format(time.RFC3339),
+			ETag:         object.etag,
+			Size:         info.Size(),
+			StorageClass: "STANDARD",
+		})
+		result.KeyCount++
+		last = k
+	}
+	writeS3Result(w, result)
+}
+
+func (s *S3Server) servePutObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	data, err := s.requestBody(r)
+	if err != nil {
+		writeS3Error(w, r, S3Error{Code: "IncompleteBody", Message: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+	object := s3ObjectFromRequest(r)
+	if err := s.writeObject(bucket, key, data, object); err != nil {
+		writeS3Error(w, r, S3Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	w.Header().Set("ETag", s3ETag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseS3Range parses a single byte range, returning ok false when the header must be ignored.
+func parseS3Range(header string, size int64) (start, end int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, second, _ := strings.Cut(spec, "-")
+	switch {
+	case first == "":
+		n, err := strconv.ParseInt(second, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, nil
+		}
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	default:
+		start, err = strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			return 0, 0, false, nil
+		}
+		end = size - 1
+		if second != "" {
+			if end, err = strconv.ParseInt(second, 10, 64); err != nil || end < start {
+				return 0, 0, false, nil
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+	}
+	if start >= size || size == 0 {
+		return 0, 0, false, errors.New("The requested range is not satisfiable")
+	}
+	return start, end, true, nil
+}
+
+func (s *S3Server) serveGetObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	data, object, info, err := s.readObject(bucket, key)
+	if err != nil {
+		writeS3Error(w, r, s3NotFound("NoSuchKey", "The specified key does not exist."))
+		return
+	}
+	w.Header().Set("Content-Type", object.contentType)
+	w.Header().Set("ETag", object.etag)
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	for name, value := range object.metadata {
+		w.Header().Set(name, value)
+	}
+	status := http.StatusOK
+	if header := r.Header.Get("Range"); header != "" {
+		start, end, ok, err := parseS3Range(header, int64(len(data)))
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+			writeS3Error(w, r, S3Error{Code: "InvalidRange", Message: err.Error(), Status: http.StatusRequestedRangeNotSatisfiable})
+			return
+		}
+		if ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = http.StatusPartialContent
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+func (s *S3Server) serveDeleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	err := s.fs.Remove(s.ObjectPath(bucket, key))
+	if err != nil && !os.IsNotExist(err) {
+		writeS3Error(w, r, S3Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	s.mu.Lock()
+	delete(s.objects, bucket+"/"+key)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (s *S3Server) serveCreateMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	id := randomToken()
+	s.mu.Lock()
+	s.uploads[id] = &s3Upload{bucket: bucket, key: key, object: s3ObjectFromRequest(r), parts: map[int][]byte{}}
+	s.mu.Unlock()
+	writeS3Result(w, s3InitiateMultipartUploadResult{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: id})
+}
+
+// upload returns the multipart upload of the request, writing an error when it does not exist.
+func (s *S3Server) upload(w http.ResponseWriter, r *http.Request, bucket, key string) *s3Upload {
+	s.mu.Lock()
+	upload, ok := s.uploads[r.URL.Query().Get("uploadId")]
+	s.mu.Unlock()
+	if !ok || upload.bucket != bucket || upload.key != key {
+		writeS3Error(w, r, s3NotFound("NoSuchUpload", "The specified multipart upload does not exist."))
+		return nil
+	}
+	return upload
+}
+
+func (s *S3Server) serveUploadPart(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	upload := s.upload(w, r, bucket, key)
+	if upload == nil {
+		return
+	}
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		writeS3Error(w, r, S3Error{Code: "InvalidArgument", Message: "Part number must be an integer between 1 and 10000", Status: http.StatusBadRequest})
+		return
+	}
+	data, err := s.requestBody(r)
+	if err != nil {
+		writeS3Error(w, r, S3Error{Code: "IncompleteBody", Message: err.Error(), Status: http.StatusBadRequest})
+		return
+	}
+	s.mu.Lock()
+	upload.parts[number] = data
+	s.mu.Unlock()
+	w.Header().Set("ETag", s3ETag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3Server) serveCompleteMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	upload := s.upload(w, r, bucket, key)
+	if upload == nil {
+		return
+	}
+	complete := s3CompleteMultipartUpload{}
+	if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil || len(complete.Parts) == 0 {
+		writeS3Error(w, r, S3Error{Code: "MalformedXML", Message: "The XML you provided was not well-formed or did not validate against our published schema.", Status: http.StatusBadRequest})
+		return
+	}
+	s.mu.Lock()
+	data := []byte{}
+	sums := []byte{}
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			s.mu.Unlock()
+			writeS3Error(w, r, S3Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order.", Status: http.StatusBadRequest})
+			return
+		}
+		content, ok := upload.parts[part.PartNumber]
+		if !ok || strings.Trim(part.ETag, `"`) != strings.Trim(s3ETag(content), `"`) {
+			s.mu.Unlock()
+			writeS3Error(w, r, S3Error{Code: "InvalidPart", Message: fmt.Sprintf("Part %d could not be found or its ETag does not match.", part.PartNumber), Status: http.StatusBadRequest})
+			return
+		}
+		sum := md5.Sum(content)
+		sums = append(sums, sum[:]...)
+		data = append(data, content...)
+	}
+	delete(s.uploads, r.URL.Query().Get("uploadId"))
+	s.mu.Unlock()
+
+	sum := md5.Sum(sums)
+	object := upload.object
+	object.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(complete.Parts))
+	if err := s.writeObject(bucket, key, data, object); err != nil {
+		writeS3Error(w, r, S3Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError})
+		return
+	}
+	writeS3Result(w, s3CompleteMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: s.Server.URL + "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     object.etag,
+	})
+}
+
+func (s *S3Server) serveAbortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if s.upload(w, r, bucket, key) == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.uploads, r.URL.Query().Get("uploadId"))
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,272 @@
+package testutils_test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var s3Credentials = testutils.AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+
+func s3Request(t *testing.T, s3Server *testutils.S3Server, method, path, body string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, s3Server.Server.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	require.NoError(t, testutils.SignSigV4Request(req, s3Credentials, testutils.S3Region, "s3", time.Now()))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(data)
+}
+
+func TestS3ServerObjects(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s3Server := testutils.NewS3Server(t, fs, "/s3").WithCredentials(s3Credentials)
+
+	resp, _ := s3Request(t, s3Server, http.MethodPut, "/uploads", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body := s3Request(t, s3Server, http.MethodPut, "/uploads", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Contains(t, body, "<Code>BucketAlreadyOwnedByYou</Code>")
+	resp, _ = s3Request(t, s3Server, http.MethodHead, "/uploads", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = s3Request(t, s3Server, http.MethodPut, "/uploads/reports/2024.csv", "id,name\n1,alice\n", "Content-Type", "text/csv", "X-Amz-Meta-Owner", "alice")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+	testutils.AssertFileContents(t, fs, s3Server.ObjectPath("uploads", "reports/2024.csv"), "id,name\n1,alice\n")
+
+	resp, body = s3Request(t, s3Server, http.MethodGet, "/uploads/reports/2024.csv", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "id,name\n1,alice\n", body)
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "alice", resp.Header.Get("X-Amz-Meta-Owner"))
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp, body = s3Request(t, s3Server, http.MethodGet, "/uploads/reports/2024.csv", "", "Range", "bytes=3-6")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "name", body)
+	assert.Equal(t, "bytes 3-6/16", resp.Header.Get("Content-Range"))
+
+	resp, body = s3Request(t, s3Server, http.MethodGet, "/uploads/reports/2024.csv", "", "Range", "bytes=-6")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "alice\n", body)
+
+	resp, body = s3Request(t, s3Server, http.MethodGet, "/uploads/reports/2024.csv", "", "Range", "bytes=100-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	assert.Contains(t, body, "<Code>InvalidRange</Code>")
+
+	resp, body = s3Request(t, s3Server, http.MethodHead, "/uploads/reports/2024.csv", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "16", resp.Header.Get("Content-Length"))
+	assert.Empty(t, body)
+
+	testutils.EnsureFileContent(t, fs, s3Server.ObjectPath("uploads", "direct.txt"), "written in the fs")
+	resp, body = s3Request(t, s3Server, http.MethodGet, "/uploads/direct.txt", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "written in the fs", body)
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+
+	resp, body = s3Request(t, s3Server, http.MethodGet, "/uploads/missing.txt", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, body, "<Code>NoSuchKey</Code>")
+	resp, body = s3Request(t, s3Server, http.MethodGet, "/missing/key.txt", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, body, "<Code>NoSuchBucket</Code>")
+
+	resp, body = s3Request(t, s3Server, http.MethodDelete, "/uploads", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Contains(t, body, "<Code>BucketNotEmpty</Code>")
+
+	resp, _ = s3Request(t, s3Server, http.MethodDelete, "/uploads/direct.txt", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = s3Request(t, s3Server, http.MethodDelete, "/uploads/reports/2024.csv", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	exists, err := afero.Exists(fs, s3Server.ObjectPath("uploads", "direct.txt"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	resp, _ = s3Request(t, s3Server, http.MethodDelete, "/uploads", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = s3Request(t, s3Server, http.MethodHead, "/uploads", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (r listBucketResult) keys() []string {
+	keys := []string{}
+	for _, prefix := range r.CommonPrefixes {
+		keys = append(keys, prefix.Prefix)
+	}
+	for _, content := range r.Contents {
+		keys = append(keys, content.Key)
+	}
+	return keys
+}
+
+func TestS3ServerListObjectsV2(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s3Server := testutils.NewS3Server(t, fs, "/s3")
+	s3Server.CreateBucket(t, "photos")
+	for _, key := range []string{"2023/a.jpg", "2023/b.jpg", "2024/c.jpg", "index.html", "robots.txt"} {
+		testutils.EnsureFileContent(t, fs, s3Server.ObjectPath("photos", key), key)
+	}
+
+	list := func(query string) listBucketResult {
+		resp, body := s3Request(t, s3Server, http.MethodGet, "/photos?list-type=2&"+query, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		result := listBucketResult{}
+		require.NoError(t, xml.Unmarshal([]byte(body), &result))
+		return result
+	}
+
+	result := list("")
+	assert.Equal(t, []string{"2023/a.jpg", "2023/b.jpg", "2024/c.jpg", "index.html", "robots.txt"}, result.keys())
+	assert.Equal(t, int64(10), result.Contents[0].Size)
+	assert.False(t, result.IsTruncated)
+
+	assert.Equal(t, []string{"2023/a.jpg", "2023/b.jpg"}, list("prefix=2023/").keys())
+	assert.Equal(t, []string{"2023/", "2024/", "index.html", "robots.txt"}, list("delimiter=/").keys())
+	assert.Equal(t, []string{"index.html", "robots.txt"}, list("start-after=2024/c.jpg").keys())
+
+	keys := []string{}
+	query := "delimiter=/&max-keys=1"
+	for pages := 0; pages < 10; pages++ {
+		result := list(query)
+		keys = append(keys, result.keys()...)
+		if !result.IsTruncated {
+			break
+		}
+		query = "delimiter=/&max-keys=1&continuation-token=" + result.NextContinuationToken
+	}
+	assert.Equal(t, []string{"2023/", "2024/", "index.html", "robots.txt"}, keys)
+}
+
+func TestS3ServerMultipartUpload(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s3Server := testutils.NewS3Server(t, fs, "/s3")
+	s3Server.CreateBucket(t, "backups")
+
+	resp, body := s3Request(t, s3Server, http.MethodPost, "/backups/dump.sql?uploads", "", "Content-Type", "application/sql")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	initiated := struct{ UploadId string }{}
+	require.NoError(t, xml.Unmarshal([]byte(body), &initiated))
+	require.NotEmpty(t, initiated.UploadId)
+
+	etags := []string{}
+	for i, part := range []string{"CREATE TABLE users;\n", "INSERT INTO users;\n"} {
+		resp, _ := s3Request(t, s3Server, http.MethodPut, fmt.Sprintf("/backups/dump.sql?partNumber=%d&uploadId=%s", i+1, initiated.UploadId), part)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		etags = append(etags, resp.Header.Get("ETag"))
+	}
+
+	resp, body = s3Request(t, s3Server, http.MethodPost, "/backups/dump.sql?uploadId="+initiated.UploadId,
+		fmt.Sprintf(`<CompleteMultipartUpload><Part><PartNumber>2</PartNumber><ETag>%s</ETag></Part><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>`, etags[1], etags[0]))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, body, "<Code>InvalidPartOrder</Code>")
+
+	resp, body = s3Request(t, s3Server, http.MethodPost, "/backups/dump.sql?uploadId="+initiated.UploadId,
+		fmt.Sprintf(`<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part><Part><PartNumber>2</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>`, etags[0], etags[1]))
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.Contains(t, body, "-2&#34;</ETag>")
+	testutils.AssertFileContents(t, fs, s3Server.ObjectPath("backups", "dump.sql"), "CREATE TABLE users;\nINSERT INTO users;\n")
+
+	resp, _ = s3Request(t, s3Server, http.MethodHead, "/backups/dump.sql", "")
+	assert.Equal(t, "application/sql", resp.Header.Get("Content-Type"))
+	assert.True(t, strings.HasSuffix(resp.Header.Get("ETag"), `-2"`))
+
+	resp, body = s3Request(t, s3Server, http.MethodPut, "/backups/dump.sql?partNumber=3&uploadId="+initiated.UploadId, "late")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, body, "<Code>NoSuchUpload</Code>")
+
+	resp, body = s3Request(t, s3Server, http.MethodPost, "/backups/other.sql?uploads", "")
+	require.NoError(t, xml.Unmarshal([]byte(body), &initiated))
+	resp, _ = s3Request(t, s3Server, http.MethodDelete, "/backups/other.sql?uploadId="+initiated.UploadId, "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestS3ServerAuthentication(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s3Server := testutils.NewS3Server(t, fs, "/s3").WithCredentials(s3Credentials)
+	s3Server.CreateBucket(t, "private")
+	testutils.EnsureFileContent(t, fs, s3Server.ObjectPath("private", "secret.txt"), "secret")
+
+	resp, err := http.Get(s3Server.Server.URL + "/private/secret.txt")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = http.Get(s3Server.PresignedURL(http.MethodGet, "private", "secret.txt", time.Minute))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(body))
+
+	req, err := http.NewRequest(http.MethodPut, s3Server.PresignedURL(http.MethodPut, "private", "upload.txt", time.Minute), strings.NewReader("uploaded"))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	testutils.AssertFileContents(t, fs, s3Server.ObjectPath("private", "upload.txt"), "uploaded")
+
+	req, err = http.NewRequest(http.MethodGet, s3Server.Server.URL+"/private/secret.txt", nil)
+	require.NoError(t, err)
+	require.NoError(t, testutils.SignSigV4Request(req, testutils.AWSCredentials{AccessKeyID: "OTHER", SecretAccessKey: "secret"}, testutils.S3Region, "s3", time.Now()))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "<Code>InvalidAccessKeyId</Code>")
+}
+
+func TestS3ServerInjectError(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s3Server := testutils.NewS3Server(t, fs, "/s3").
+		InjectError(testutils.S3OperationPutObject, testutils.S3Error{Code: "SlowDown", Message: "Please reduce your request rate.", Status: http.StatusServiceUnavailable}).
+		InjectError(testutils.S3OperationPutObject, testutils.S3Error{Code: "InternalError", Message: "We encountered an internal error."})
+	s3Server.CreateBucket(t, "uploads")
+
+	resp, body := s3Request(t, s3Server, http.MethodPut, "/uploads/file.txt", "content")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Contains(t, body, "<Code>SlowDown</Code>")
+	assert.Contains(t, body, "<Resource>/uploads/file.txt</Resource>")
+
+	resp, body = s3Request(t, s3Server, http.MethodPut, "/uploads/file.txt", "content")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Contains(t, body, "<Code>InternalError</Code>")
+
+	resp, _ = s3Request(t, s3Server, http.MethodPut, "/uploads/file.txt", "content")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	testutils.AssertFileContents(t, fs, s3Server.ObjectPath("uploads", "file.txt"), "content")
+}
@@ -0,0 +1,501 @@
+package testutils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	sigV4Algorithm     = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat    = "20060102T150405Z"
+	sigV4UnsignedBody  = "UNSIGNED-PAYLOAD"
+	sigV4MaxClockSkew  = 15 * time.Minute
+	sigV4ScopeSuffix   = "aws4_request"
+	sigV4SignatureName = "X-Amz-Signature"
+)
+
+// AWSCredentials are the credentials signing requests, usually fake ones in tests.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// SigV4Error describes why a SigV4 signature is rejected.
+type SigV4Error struct {
+	// Component is the part of the signature that differs: "authorization", "credential", "credential scope", "date",
+	// "security token", "signed headers", "payload hash", "canonical URI", "canonical query string",
+	// "canonical headers" or "signature".
+	Component string
+	Reason    string
+	// Expected and Actual are the values computed by the verifier and used by the client, when they are known.
+	Expected string
+	Actual   string
+	// CanonicalRequest is the canonical request computed by the verifier, when the differing component is unknown.
+	CanonicalRequest string
+}
+
+func (e *SigV4Error) Error() string {
+	s := e.Component + ": " + e.Reason
+	if e.Expected != "" || e.Actual != "" {
+		s += fmt.Sprintf(", expected %q but got %q", e.Expected, e.Actual)
+	}
+	if e.CanonicalRequest != "" {
+		s += "\nexpected canonical request:\n" + e.CanonicalRequest
+	}
+	return s
+}
+
+type sigV4Canonical struct {
+	method, uri, query, headers, signedHeaders, payloadHash string
+}
+
+func (c sigV4Canonical) String() string {
+	return strings.Join([]string{c.method, c.uri, c.query, c.headers, c.signedHeaders, c.payloadHash}, "\n")
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape encodes all the characters but the unreserved ones, as required by SigV4.
+func awsEscape(s string, keepSlash bool) string {
+	b := strings.Builder{}
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || keepSlash && c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// sigV4URI encodes the path once for S3 and twice for the other services.
+func sigV4URI(u *url.URL, service string) string {
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	if service == "s3" {
+		return awsEscape(path, true)
+	}
+	return awsEscape(awsEscape(path, true), true)
+}
+
+func sigV4Query(values url.Values) string {
+	pairs := []string{}
+	for name, list := range values {
+		for _, value := range list {
+			pairs = append(pairs, awsEscape(name, false)+"="+awsEscape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func sigV4HeaderValues(req *http.Request, name string) []string {
+	switch name {
+	case "host":
+		if req.Host != "" {
+			return []string{req.Host}
+		}
+		return []string{req.URL.Host}
+	case "content-length":
+		if values := req.Header.Values(name); len(values) > 0 {
+			return values
+		}
+		return []string{strconv.FormatInt(req.ContentLength, 10)}
+	}
+	return req.Header.Values(name)
+}
+
+func sigV4Headers(req *http.Request, signedHeaders []string, trim bool) string {
+	s := ""
+	for _, name := range signedHeaders {
+		values := append([]string{}, sigV4HeaderValues(req, name)...)
+		if trim {
+			for i, value := range values {
+				values[i] = strings.Join(strings.Fields(value), " ")
+			}
+		}
+		s += name + ":" + strings.Join(values, ",") + "\n"
+	}
+	return s
+}
+
+func sigV4CanonicalRequest(req *http.Request, service string, query url.Values, signedHeaders []string, payloadHash string) sigV4Canonical {
+	return sigV4Canonical{
+		method:        req.Method,
+		uri:           sigV4URI(req.URL, service),
+		query:         sigV4Query(query),
+		headers:       sigV4Headers(req, signedHeaders, true),
+		signedHeaders: strings.Join(signedHeaders, ";"),
+		payloadHash:   payloadHash,
+	}
+}
+
+func sigV4Signature(secret, amzDate, scope string, canonical sigV4Canonical) string {
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, hexSHA256([]byte(canonical.String()))}, "\n")
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func sigV4Scope(now time.Time, region, service string) string {
+	return strings.Join([]string{now.UTC().Format("20060102"), region, service, sigV4ScopeSuffix}, "/")
+}
+
+// SignSigV4Request signs the request in its Authorization header, like the AWS SDKs do.
+// The host, the Content-Type and the X-Amz-* headers are signed. The body is restored after being read.
+func SignSigV4Request(req *http.Request, credentials AWSCredentials, region, service string, now time.Time) error {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return err
+	}
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = hexSHA256(body)
+		if service == "s3" {
+			req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		}
+	}
+	signedHeaders := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	scope := sigV4Scope(now, region, service)
+	canonical := sigV4CanonicalRequest(req, service, req.URL.Query(), signedHeaders, payloadHash)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, credentials.AccessKeyID, scope, canonical.signedHeaders, sigV4Signature(credentials.SecretAccessKey, amzDate, scope, canonical)))
+	return nil
+}
+
+// PresignSigV4Request signs the request in its query string, like presigned URLs. Only the host is signed.
+func PresignSigV4Request(req *http.Request, credentials AWSCredentials, region, service string, now time.Time, expires time.Duration) {
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	scope := sigV4Scope(now, region, service)
+	query := req.URL.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", credentials.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if credentials.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	canonical := sigV4CanonicalRequest(req, service, query, []string{"host"}, sigV4UnsignedBody)
+	query.Set(sigV4SignatureName, sigV4Signature(credentials.SecretAccessKey, amzDate, scope, canonical))
+	req.URL.RawQuery = sigV4Query(query)
+}
+
+type sigV4Authorization struct {
+	presigned     bool
+	accessKeyID   string
+	scope         []string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	expires       time.Duration
+	securityToken string
+}
+
+func parseSigV4Authorization(req *http.Request) (sigV4Authorization, *SigV4Error) {
+	auth := sigV4Authorization{}
+	credential := ""
+	signedHeaders := ""
+	query := req.URL.Query()
+	switch header := req.Header.Get("Authorization"); {
+	case strings.HasPrefix(header, sigV4Algorithm+" "):
+		for _, item := range strings.Split(strings.TrimPrefix(header, sigV4Algorithm+" "), ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				auth.signature = value
+			}
+		}
+		auth.amzDate = req.Header.Get("X-Amz-Date")
+		auth.securityToken = req.Header.Get("X-Amz-Security-Token")
+	case query.Get("X-Amz-Algorithm") == sigV4Algorithm:
+		auth.presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		auth.signature = query.Get(sigV4SignatureName)
+		auth.amzDate = query.Get("X-Amz-Date")
+		auth.securityToken = query.Get("X-Amz-Security-Token")
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds <= 0 {
+			return auth, &SigV4Error{Component: "date", Reason: fmt.Sprintf("invalid X-Amz-Expires %q", query.Get("X-Amz-Expires"))}
+		}
+		auth.expires = time.Duration(seconds) * time.Second
+	case header != "":
+		return auth, &SigV4Error{Component: "authorization", Reason: "unsupported Authorization header " + strings.Fields(header)[0]}
+	default:
+		return auth, &SigV4Error{Component: "authorization", Reason: "missing SigV4 Authorization header or X-Amz-Algorithm query parameter"}
+	}
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 {
+		return auth, &SigV4Error{Component: "credential", Reason: fmt.Sprintf("invalid credential %q", credential)}
+	}
+	auth.accessKeyID, auth.scope = parts[0], parts[1:]
+	if signedHeaders == "" || auth.signature == "" {
+		return auth, &SigV4Error{Component: "authorization", Reason: "missing SignedHeaders or Signature"}
+	}
+	auth.signedHeaders = strings.Split(signedHeaders, ";")
+	return auth, nil
+}
+
+// SigV4Verifier verifies the SigV4 signatures of requests against test credentials and reports
+// which component of the signature differs. It can verify requests received by a handler with Middleware,
+// requests sent through a transport with VerifyingTransport, or match requests of a MockTransport with Matcher.
+//
+//	verifier := testutils.NewSigV4Verifier(testutils.AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}).
+//		WithScope("eu-west-1", "execute-api")
+//	client := &http.Client{Transport: verifier.VerifyingTransport(t, mock)}
+type SigV4Verifier struct {
+	credentials map[string]AWSCredentials
+	region      string
+	service     string
+	now         func() time.Time
+}
+
+// NewSigV4Verifier accepts the requests signed with any of the credentials.
+func NewSigV4Verifier(credentials ...AWSCredentials) *SigV4Verifier {
+	v := &SigV4Verifier{credentials: map[string]AWSCredentials{}, now: time.Now}
+	for _, c := range credentials {
+		v.credentials[c.AccessKeyID] = c
+	}
+	return v
+}
+
+// WithScope only accepts the requests signed for the region and the service. Empty values accept any.
+func (v *SigV4Verifier) WithScope(region, service string) *SigV4Verifier {
+	v.region = region
+	v.service = service
+	return v
+}
+
+// WithClock sets the current time used to check the request dates, to verify requests signed at a fixed time.
+func (v *SigV4Verifier) WithClock(now func() time.Time) *SigV4Verifier {
+	v.now = now
+	return v
+}
+
+// Verify returns a *SigV4Error when the request is not correctly signed. The body is restored after being read.
+func (v *SigV4Verifier) Verify(req *http.Request) error {
+	auth, sigErr := parseSigV4Authorization(req)
+	if sigErr != nil {
+		return sigErr
+	}
+	credentials, ok := v.credentials[auth.accessKeyID]
+	if !ok {
+		return &SigV4Error{Component: "credential", Reason: fmt.Sprintf("unknown access key %q", auth.accessKeyID)}
+	}
+	date, region, service := auth.scope[0], auth.scope[1], auth.scope[2]
+	if auth.scope[3] != sigV4ScopeSuffix {
+		return &SigV4Error{Component: "credential scope", Reason: "invalid terminator", Expected: sigV4ScopeSuffix, Actual: auth.scope[3]}
+	}
+	if v.region != "" && region != v.region {
+		return &SigV4Error{Component: "credential scope", Reason: "unexpected region", Expected: v.region, Actual: region}
+	}
+	if v.service != "" && service != v.service {
+		return &SigV4Error{Component: "credential scope", Reason: "unexpected service", Expected: v.service, Actual: service}
+	}
+
+	signedAt, err := time.Parse(sigV4TimeFormat, auth.amzDate)
+	if err != nil {
+		return &SigV4Error{Component: "date", Reason: fmt.Sprintf("invalid X-Amz-Date %q", auth.amzDate)}
+	}
+	if date != signedAt.Format("20060102") {
+		return &SigV4Error{Component: "credential scope", Reason: "the date differs from X-Amz-Date", Expected: signedAt.Format("20060102"), Actual: date}
+	}
+	now := v.now()
+	switch {
+	case auth.presigned && now.After(signedAt.Add(auth.expires)):
+		return &SigV4Error{Component: "date", Reason: fmt.Sprintf("the presigned request expired at %s", signedAt.Add(auth.expires).Format(time.RFC3339))}
+	case !auth.presigned && (now.Sub(signedAt) > sigV4MaxClockSkew || signedAt.Sub(now) > sigV4MaxClockSkew):
+		return &SigV4Error{Component: "date", Reason: fmt.Sprintf("the request time %s is more than %s away from %s", auth.amzDate, sigV4MaxClockSkew, now.UTC().Format(sigV4TimeFormat))}
+	}
+	if credentials.SessionToken != "" && auth.securityToken != credentials.SessionToken {
+		return &SigV4Error{Component: "security token", Reason: "invalid X-Amz-Security-Token", Expected: credentials.SessionToken, Actual: auth.securityToken}
+	}
+
+	if sigErr := checkSigV4SignedHeaders(req, auth, service); sigErr != nil {
+		return sigErr
+	}
+
+	body, err := readRequestBody(req)
+	if err != nil {
+		return err
+	}
+	bodyHash := hexSHA256(body)
+	payloadHash := bodyHash
+	if header := req.Header.Get("X-Amz-Content-Sha256"); header != "" && !auth.presigned {
+		if header != sigV4UnsignedBody && !strings.HasPrefix(header, "STREAMING-") && header != bodyHash {
+			return &SigV4Error{Component: "payload hash", Reason: "X-Amz-Content-Sha256 does not match the body", Expected: bodyHash, Actual: header}
+		}
+		payloadHash = header
+	} else if auth.presigned {
+		payloadHash = sigV4UnsignedBody
+		if value := req.URL.Query().Get("X-Amz-Content-Sha256"); value != "" {
+			payloadHash = value
+		}
+	} else if service == "s3" {
+		return &SigV4Error{Component: "payload hash", Reason: "missing X-Amz-Content-Sha256 header"}
+	}
+
+	query := req.URL.Query()
+	query.Del(sigV4SignatureName)
+	expected := sigV4CanonicalRequest(req, service, query, auth.signedHeaders, payloadHash)
+	scope := strings.Join(auth.scope, "/")
+	signs := func(canonical sigV4Canonical) bool {
+		return hmac.Equal([]byte(sigV4Signature(credentials.SecretAccessKey, auth.amzDate, scope, canonical)), []byte(auth.signature))
+	}
+	if signs(expected) {
+		return nil
+	}
+	for _, alternative := range sigV4Alternatives(req, expected, body) {
+		if signs(alternative.canonical) {
+			return &SigV4Error{Component: alternative.component, Reason: "the request was signed with a different value", Expected: alternative.expected, Actual: alternative.actual}
+		}
+	}
+	return &SigV4Error{Component: "signature", Reason: "the signature does not match the canonical request or the secret access key", CanonicalRequest: expected.String()}
+}
+
+func checkSigV4SignedHeaders(req *http.Request, auth sigV4Authorization, service string) *SigV4Error {
+	signed := map[string]bool{}
+	for _, name := range auth.signedHeaders {
+		if name != strings.ToLower(name) || !sort.StringsAreSorted(auth.signedHeaders) {
+			return &SigV4Error{Component: "signed headers", Reason: "the names must be lowercase and sorted", Actual: strings.Join(auth.signedHeaders, ";")}
+		}
+		if name != "host" && name != "content-length" && len(req.Header.Values(name)) == 0 {
+			return &SigV4Error{Component: "signed headers", Reason: fmt.Sprintf("%s is signed but missing from the request", name)}
+		}
+		signed[name] = true
+	}
+	if !signed["host"] {
+		return &SigV4Error{Component: "signed headers", Reason: "host must be signed"}
+	}
+	// S3 requires all the x-amz-* headers to be signed
+	if service == "s3" && !auth.presigned {
+		for name := range req.Header {
+			name = strings.ToLower(name)
+			if strings.HasPrefix(name, "x-amz-") && !signed[name] {
+				return &SigV4Error{Component: "signed headers", Reason: fmt.Sprintf("%s must be signed", name)}
+			}
+		}
+	}
+	return nil
+}
+
+type sigV4Alternative struct {
+	component        string
+	expected, actual string
+	canonical        sigV4Canonical
+}
+
+// sigV4Alternatives lists the canonical requests clients usually compute by mistake, to tell which component differs.
+func sigV4Alternatives(req *http.Request, expected sigV4Canonical, body []byte) []sigV4Alternative {
+	alternatives := []sigV4Alternative{}
+	add := func(component string, get func(*sigV4Canonical) *string, values ...string) {
+		for _, value := range values {
+			canonical := expected
+			field := get(&canonical)
+			if *field == value {
+				continue
+			}
+			expectedValue := *field
+			*field = value
+			alternatives = append(alternatives, sigV4Alternative{component: component, expected: expectedValue, actual: value, canonical: canonical})
+		}
+	}
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	add("canonical URI", func(c *sigV4Canonical) *string { return &c.uri },
+		req.URL.EscapedPath(), path, awsEscape(path, true), awsEscape(awsEscape(path, true), true))
+
+	rawQuery := []string{}
+	for _, pair := range strings.Split(req.URL.RawQuery, "&") {
+		if pair != "" && !strings.HasPrefix(pair, sigV4SignatureName+"=") {
+			rawQuery = append(rawQuery, pair)
+		}
+	}
+	query := req.URL.Query()
+	query.Del(sigV4SignatureName)
+	add("canonical query string", func(c *sigV4Canonical) *string { return &c.query },
+		strings.Join(rawQuery, "&"), query.Encode())
+
+	add("canonical headers", func(c *sigV4Canonical) *string { return &c.headers },
+		sigV4Headers(req, strings.Split(expected.signedHeaders, ";"), false))
+
+	add("payload hash", func(c *sigV4Canonical) *string { return &c.payloadHash },
+		hexSHA256(body), hexSHA256(nil), sigV4UnsignedBody)
+	return alternatives
+}
+
+// Middleware answers 403 Forbidden with the verification error to the requests that are not correctly signed.
+func (v *SigV4Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := v.Verify(req); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Matcher matches the correctly signed requests, to declare MockTransport routes answering only them.
+func (v *SigV4Verifier) Matcher() RequestMatcher {
+	return NewRequestMatcher("SigV4 signature", func(req *http.Request) bool {
+		return v.Verify(req) == nil
+	})
+}
+
+// VerifyingTransport fails the test when a request sent through the transport is not correctly signed.
+// The request is sent anyway.
+func (v *SigV4Verifier) VerifyingTransport(t assert.TestingT, transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if err := v.Verify(req); err != nil {
+			assert.Fail(t, fmt.Sprintf("Request %s %s is not correctly signed: %s", req.Method, req.URL, err))
+		}
+		return transport.RoundTrip(req)
+	})
+}
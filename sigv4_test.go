@@ -0,0 +1,194 @@
+package testutils_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// credentials and requests of the AWS SigV4 documentation and test suite
+var awsExampleCredentials = testutils.AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+var awsExampleTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+func newAWSExampleVerifier() *testutils.SigV4Verifier {
+	return testutils.NewSigV4Verifier(awsExampleCredentials).WithClock(func() time.Time { return awsExampleTime })
+}
+
+func requireSigV4Error(t *testing.T, err error, component string) *testutils.SigV4Error {
+	t.Helper()
+	sigErr := &testutils.SigV4Error{}
+	require.True(t, errors.As(err, &sigErr), "expecting a SigV4Error, got %v", err)
+	assert.Equal(t, component, sigErr.Component, sigErr.Error())
+	return sigErr
+}
+
+func TestSigV4Verifier(t *testing.T) {
+	t.Run("AWS test suite", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Amz-Date", "20150830T123600Z")
+		req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31")
+		assert.NoError(t, newAWSExampleVerifier().Verify(req))
+
+		req, err = http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+		req.Header.Set("X-Amz-Date", "20150830T123600Z")
+		req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7")
+		assert.NoError(t, newAWSExampleVerifier().WithScope("us-east-1", "iam").Verify(req))
+
+		err = newAWSExampleVerifier().WithScope("eu-west-1", "iam").Verify(req)
+		sigErr := requireSigV4Error(t, err, "credential scope")
+		assert.Equal(t, "credential scope: unexpected region, expected \"eu-west-1\" but got \"us-east-1\"", sigErr.Error())
+	})
+
+	t.Run("signed requests", func(t *testing.T) {
+		credentials := testutils.AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}
+		for _, service := range []string{"execute-api", "s3"} {
+			req, err := http.NewRequest(http.MethodPut, "https://bucket.example.com/path with spaces/é?b=2&a=1&a=0", strings.NewReader("data"))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "text/plain")
+			req.Header.Set("X-Amz-Meta-Note", "  some   note ")
+			require.NoError(t, testutils.SignSigV4Request(req, credentials, "eu-west-1", service, time.Now()))
+
+			assert.NoError(t, testutils.NewSigV4Verifier(credentials).WithScope("eu-west-1", service).Verify(req), service)
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "data", string(body))
+		}
+	})
+
+	t.Run("presigned requests", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "https://bucket.s3.amazonaws.com/key.txt?versionId=1", nil)
+		require.NoError(t, err)
+		testutils.PresignSigV4Request(req, awsExampleCredentials, "us-east-1", "s3", awsExampleTime, time.Hour)
+		assert.Equal(t, "AKIDEXAMPLE/20150830/us-east-1/s3/aws4_request", req.URL.Query().Get("X-Amz-Credential"))
+		assert.NotEmpty(t, req.URL.Query().Get("X-Amz-Signature"))
+
+		assert.NoError(t, newAWSExampleVerifier().Verify(req))
+
+		expired := testutils.NewSigV4Verifier(awsExampleCredentials).WithClock(func() time.Time { return awsExampleTime.Add(2 * time.Hour) })
+		sigErr := requireSigV4Error(t, expired.Verify(req), "date")
+		assert.Equal(t, "the presigned request expired at 2015-08-30T13:36:00Z", sigErr.Reason)
+
+		req.URL.RawQuery += "&versionId=2"
+		requireSigV4Error(t, newAWSExampleVerifier().Verify(req), "signature")
+	})
+
+	t.Run("differing components", func(t *testing.T) {
+		sign := func(method, url, body string) *http.Request {
+			req, err := http.NewRequest(method, url, strings.NewReader(body))
+			require.NoError(t, err)
+			require.NoError(t, testutils.SignSigV4Request(req, awsExampleCredentials, "us-east-1", "execute-api", awsExampleTime))
+			return req
+		}
+
+		req := sign(http.MethodPost, "https://api.example.com/items", "")
+		req.Body = io.NopCloser(strings.NewReader(`{"name":"item"}`))
+		sigErr := requireSigV4Error(t, newAWSExampleVerifier().Verify(req), "payload hash")
+		assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", sigErr.Actual)
+
+		req = sign(http.MethodGet, "https://api.example.com/a%20b", "")
+		req.URL.Path = "/a%20b"
+		sigErr = requireSigV4Error(t, newAWSExampleVerifier().Verify(req), "canonical URI")
+		assert.Equal(t, "/a%252520b", sigErr.Expected)
+		assert.Equal(t, "/a%2520b", sigErr.Actual)
+
+		req = sign(http.MethodGet, "https://api.example.com/items?limit=10", "")
+		req.URL.RawQuery = "limit=20"
+		sigErr = requireSigV4Error(t, newAWSExampleVerifier().Verify(req), "signature")
+		assert.Contains(t, sigErr.Error(), "expected canonical request:\nGET\n/items\nlimit=20\nhost:api.example.com\n")
+
+		req = sign(http.MethodGet, "https://api.example.com/items", "")
+		req.Header.Set("X-Amz-Date", "20150830T123700Z")
+		requireSigV4Error(t, newAWSExampleVerifier().Verify(req), "signature")
+
+		req = sign(http.MethodGet, "https://api.example.com/items", "")
+		req.Header.Del("X-Amz-Date")
+		requireSigV4Error(t, newAWSExampleVerifier().Verify(req), "date")
+
+		req = sign(http.MethodGet, "https://api.example.com/items", "")
+		sigErr = requireSigV4Error(t, testutils.NewSigV4Verifier(awsExampleCredentials).Verify(req), "date")
+		assert.Contains(t, sigErr.Reason, "the request time 20150830T123600Z is more than 15m0s away from")
+
+		req = sign(http.MethodGet, "https://api.example.com/items", "")
+		sigErr = requireSigV4Error(t, testutils.NewSigV4Verifier().Verify(req), "credential")
+		assert.Equal(t, `unknown access key "AKIDEXAMPLE"`, sigErr.Reason)
+
+		req = sign(http.MethodGet, "https://api.example.com/items", "")
+		req.Header.Set("Authorization", strings.Replace(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date", "SignedHeaders=host;x-amz-date;x-amz-meta", 1))
+		sigErr = requireSigV4Error(t, newAWSExampleVerifier().Verify(req), "signed headers")
+		assert.Equal(t, "x-amz-meta is signed but missing from the request", sigErr.Reason)
+
+		req, err := http.NewRequest(http.MethodGet, "https://bucket.s3.amazonaws.com/key.txt", nil)
+		require.NoError(t, err)
+		require.NoError(t, testutils.SignSigV4Request(req, awsExampleCredentials, "us-east-1", "s3", awsExampleTime))
+		req.Header.Set("X-Amz-Acl", "private")
+		sigErr = requireSigV4Error(t, newAWSExampleVerifier().Verify(req), "signed headers")
+		assert.Equal(t, "x-amz-acl must be signed", sigErr.Reason)
+
+		req.Header.Del("Authorization")
+		requireSigV4Error(t, newAWSExampleVerifier().Verify(req), "authorization")
+	})
+}
+
+func TestSigV4VerifierIntegrations(t *testing.T) {
+	credentials := testutils.AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	verifier := testutils.NewSigV4Verifier(credentials)
+
+	t.Run("middleware", func(t *testing.T) {
+		server := httptest.NewServer(verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})))
+		defer server.Close()
+
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/items", strings.NewReader(`{"name":"item"}`))
+		require.NoError(t, err)
+		require.NoError(t, testutils.SignSigV4Request(req, credentials, "eu-west-1", "execute-api", time.Now()))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp, err = http.Post(server.URL+"/items", "application/json", strings.NewReader(`{"name":"item"}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "authorization: missing SigV4 Authorization header")
+	})
+
+	t.Run("mock transport", func(t *testing.T) {
+		// the unsigned request must not fail the test when it reaches the mock
+		mock := testutils.NewMockTransport(nil)
+		mock.On(http.MethodGet, "/items").Matching(verifier.Matcher()).Respond(testutils.NewHTTPResponseBuilder().WithStatusCode(http.StatusOK))
+
+		fakeT := &testutils.FakeTest{}
+		client := &http.Client{Transport: verifier.VerifyingTransport(fakeT, mock)}
+		req, err := http.NewRequest(http.MethodGet, "https://api.example.com/items", nil)
+		require.NoError(t, err)
+		require.NoError(t, testutils.SignSigV4Request(req, credentials, "eu-west-1", "execute-api", time.Now()))
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Empty(t, fakeT.ErrorMessages)
+
+		req, err = http.NewRequest(http.MethodGet, "https://api.example.com/items", nil)
+		require.NoError(t, err)
+		require.NoError(t, testutils.SignSigV4Request(req, testutils.AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "other"}, "eu-west-1", "execute-api", time.Now()))
+		_, err = client.Do(req)
+		assert.ErrorIs(t, err, testutils.ErrNoMockRoute)
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Request GET https://api.example.com/items is not correctly signed: signature: the signature does not match")
+	})
+}
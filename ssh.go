@@ -0,0 +1,414 @@
+package testutils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func sshKeyFileName(algorithm KeyAlgorithm) string {
+	switch algorithm {
+	case KeyAlgorithmRSA2048, KeyAlgorithmRSA4096:
+		return "id_rsa"
+	case KeyAlgorithmECDSAP256, KeyAlgorithmECDSAP384, KeyAlgorithmECDSAP521:
+		return "id_ecdsa"
+	default:
+		return "id_" + string(algorithm)
+	}
+}
+
+func writeSSHKeyPair(t require.TestingT, fs afero.Fs, privateKeyPath string, algorithm KeyAlgorithm) ssh.Signer {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	require.NoError(t, fs.MkdirAll(filepath.Dir(privateKeyPath), 0700))
+	priv, err := generatePrivateKey(algorithm)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromSigner(priv)
+	require.NoError(t, err)
+
+	block, err := ssh.MarshalPrivateKey(priv, "adevinta-toolkit-integration-tests")
+	require.NoError(t, err)
+	keyFD, err := fs.OpenFile(privateKeyPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	defer keyFD.Close()
+	require.NoError(t, pem.Encode(keyFD, block))
+
+	pubFD, err := fs.OpenFile(privateKeyPath+".pub", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	defer pubFD.Close()
+	_, err = pubFD.Write(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	require.NoError(t, err)
+	return signer
+}
+
+// NewSSHKeyPair generates a new SSH key pair in the destination folder.
+//
+// The files are named after the OpenSSH defaults for the key algorithm.
+// For example with KeyAlgorithmEd25519, the private key is stored in destinationFolder/id_ed25519
+// and the public key in destinationFolder/id_ed25519.pub
+func NewSSHKeyPair(t require.TestingT, fs afero.Fs, destinationFolder string, algorithm KeyAlgorithm) ssh.Signer {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	return writeSSHKeyPair(t, fs, filepath.Join(destinationFolder, sshKeyFileName(algorithm)), algorithm)
+}
+
+func appendLine(t require.TestingT, fs afero.Fs, path string, line []byte) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	require.NoError(t, fs.MkdirAll(filepath.Dir(path), 0700))
+	fd, err := fs.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	defer fd.Close()
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		line = append(line, '\n')
+	}
+	_, err = fd.Write(line)
+	require.NoError(t, err)
+}
+
+// AddSSHAuthorizedKey appends the public key to an authorized_keys file.
+//
+//	AddSSHAuthorizedKey(t, fs, "/home/user/.ssh/authorized_keys", key.PublicKey(), `command="git-shell"`, "no-pty")
+//
+// The options, when provided, are prepended to the key as described in sshd(8).
+func AddSSHAuthorizedKey(t require.TestingT, fs afero.Fs, path string, key ssh.PublicKey, options ...string) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	line := ssh.MarshalAuthorizedKey(key)
+	if len(options) > 0 {
+		line = append([]byte(strings.Join(options, ",")+" "), line...)
+	}
+	appendLine(t, fs, path, line)
+}
+
+// AddSSHKnownHost appends an entry for the host key to a known_hosts file.
+//
+// Addresses can be hostnames or host:port pairs, as accepted by knownhosts.Normalize.
+func AddSSHKnownHost(t require.TestingT, fs afero.Fs, path string, addresses []string, key ssh.PublicKey) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	appendLine(t, fs, path, []byte(knownhosts.Line(addresses, key)))
+}
+
+// SSHCertificateAuthority signs OpenSSH user and host certificates.
+type SSHCertificateAuthority struct {
+	Signer ssh.Signer
+	serial uint64
+	mu     sync.Mutex
+}
+
+// NewSSHCertificateAuthority generates a new SSH certificate authority in the destination folder.
+//
+// The private key is stored in destinationFolder/ca
+// The public key in destinationFolder/ca.pub
+func NewSSHCertificateAuthority(t require.TestingT, fs afero.Fs, destinationFolder string) *SSHCertificateAuthority {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	return &SSHCertificateAuthority{
+		Signer: writeSSHKeyPair(t, fs, filepath.Join(destinationFolder, "ca"), KeyAlgorithmEd25519),
+	}
+}
+
+// PublicKey returns the key clients and servers need to trust the authority.
+func (ca *SSHCertificateAuthority) PublicKey() ssh.PublicKey {
+	return ca.Signer.PublicKey()
+}
+
+// SignUserKey issues a user certificate for the public key stored in publicKeyPath.
+//
+// As ssh-keygen does, the certificate is stored next to the public key, replacing the .pub suffix by -cert.pub.
+func (ca *SSHCertificateAuthority) SignUserKey(t require.TestingT, fs afero.Fs, publicKeyPath string, principals ...string) *ssh.Certificate {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	return ca.sign(t, fs, publicKeyPath, ssh.UserCert, principals)
+}
+
+// SignHostKey issues a host certificate for the public key stored in publicKeyPath.
+//
+// As ssh-keygen does, the certificate is stored next to the public key, replacing the .pub suffix by -cert.pub.
+func (ca *SSHCertificateAuthority) SignHostKey(t require.TestingT, fs afero.Fs, publicKeyPath string, hostnames ...string) *ssh.Certificate {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	return ca.sign(t, fs, publicKeyPath, ssh.HostCert, hostnames)
+}
+
+func (ca *SSHCertificateAuthority) sign(t require.TestingT, fs afero.Fs, publicKeyPath string, certType uint32, principals []string) *ssh.Certificate {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	data, err := afero.ReadFile(fs, publicKeyPath)
+	require.NoError(t, err)
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+	require.NoError(t, err)
+
+	ca.mu.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mu.Unlock()
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          serial,
+		CertType:        certType,
+		KeyId:           comment,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour * 24 * 180).Unix()),
+	}
+	if certType == ssh.UserCert {
+		cert.Permissions = ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":              "",
+				"permit-port-forwarding":  "",
+				"permit-agent-forwarding": "",
+			},
+		}
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca.Signer))
+
+	certPath := strings.TrimSuffix(publicKeyPath, ".pub") + "-cert.pub"
+	fd, err := fs.OpenFile(certPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	defer fd.Close()
+	_, err = fd.Write(ssh.MarshalAuthorizedKey(cert))
+	require.NoError(t, err)
+	return cert
+}
+
+// AddSSHAuthorizedCertificateAuthority trusts the authority to sign user certificates in an authorized_keys file.
+func AddSSHAuthorizedCertificateAuthority(t require.TestingT, fs afero.Fs, path string, ca *SSHCertificateAuthority) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	AddSSHAuthorizedKey(t, fs, path, ca.PublicKey(), "cert-authority")
+}
+
+// AddSSHKnownHostCertificateAuthority trusts the authority to sign host certificates
+// for hosts matching the pattern in a known_hosts file.
+func AddSSHKnownHostCertificateAuthority(t require.TestingT, fs afero.Fs, path string, hostPattern string, ca *SSHCertificateAuthority) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	appendLine(t, fs, path, []byte("@cert-authority "+hostPattern+" "+string(ssh.MarshalAuthorizedKey(ca.PublicKey()))))
+}
+
+// SSHExecHandler handles a command executed on the SSH server and returns its exit status.
+type SSHExecHandler func(command string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// SSHCommand is a command received by the SSH server.
+type SSHCommand struct {
+	User       string
+	Command    string
+	ExitStatus int
+}
+
+// SSHServer is an in-process SSH server accepting public key authentication
+// and handing the executed commands to an SSHExecHandler.
+type SSHServer struct {
+	// Addr is the host:port the server listens on
+	Addr    string
+	HostKey ssh.Signer
+
+	handler     SSHExecHandler
+	listener    net.Listener
+	mu          sync.Mutex
+	keys        []ssh.PublicKey
+	authorities []ssh.PublicKey
+	commands    []SSHCommand
+	conns       map[net.Conn]struct{}
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// NewSSHServer starts an SSH server listening on the loopback interface.
+//
+// Clients are rejected until their key or certificate authority is authorized.
+func NewSSHServer(t CleanupTest, hostKey ssh.Signer, handler SSHExecHandler) *SSHServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &SSHServer{
+		Addr:     listener.Addr().String(),
+		HostKey:  hostKey,
+		handler:  handler,
+		listener: listener,
+		conns:    map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// AuthorizeKey accepts clients authenticating with the public key.
+func (s *SSHServer) AuthorizeKey(key ssh.PublicKey) *SSHServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+	return s
+}
+
+// AuthorizeCertificateAuthority accepts clients presenting a user certificate signed by the authority.
+func (s *SSHServer) AuthorizeCertificateAuthority(ca *SSHCertificateAuthority) *SSHServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorities = append(s.authorities, ca.PublicKey())
+	return s
+}
+
+// Commands returns the commands executed on the server so far.
+func (s *SSHServer) Commands() []SSHCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SSHCommand{}, s.commands...)
+}
+
+// Close stops the server, disconnects the clients and waits for the running sessions to complete.
+func (s *SSHServer) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *SSHServer) isAuthority(key ssh.PublicKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, authority := range s.authorities {
+		if bytes.Equal(authority.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SSHServer) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if _, ok := key.(*ssh.Certificate); ok {
+		checker := &ssh.CertChecker{IsUserAuthority: s.isAuthority}
+		return checker.Authenticate(conn, key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, authorized := range s.keys {
+		if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			return &ssh.Permissions{}, nil
+		}
+	}
+	return nil, fmt.Errorf("unauthorized key %s for user %s", ssh.FingerprintSHA256(key), conn.User())
+}
+
+func (s *SSHServer) serve() {
+	defer s.wg.Done()
+	config := &ssh.ServerConfig{PublicKeyCallback: s.authenticate}
+	config.AddHostKey(s.HostKey)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn, config)
+		}()
+	}
+}
+
+func (s *SSHServer) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleSession(serverConn.User(), channel, requests)
+		}()
+	}
+}
+
+func (s *SSHServer) handleSession(user string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			status := s.exec(user, payload.Command, channel)
+			exitStatus := make([]byte, 4)
+			binary.BigEndian.PutUint32(exitStatus, uint32(status))
+			channel.SendRequest("exit-status", false, exitStatus)
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *SSHServer) exec(user, command string, channel ssh.Channel) int {
+	status := 0
+	if s.handler != nil {
+		status = s.handler(command, channel, channel, channel.Stderr())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, SSHCommand{User: user, Command: command, ExitStatus: status})
+	return status
+}
@@ -0,0 +1,193 @@
+package testutils_test
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestNewSSHKeyPair(t *testing.T) {
+	for algorithm, name := range map[testutils.KeyAlgorithm]string{
+		testutils.KeyAlgorithmEd25519:   "id_ed25519",
+		testutils.KeyAlgorithmRSA2048:   "id_rsa",
+		testutils.KeyAlgorithmECDSAP256: "id_ecdsa",
+	} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			signer := testutils.NewSSHKeyPair(t, fs, "/home/user/.ssh", algorithm)
+
+			testutils.AssertFileExists(t, fs, "/home/user/.ssh/"+name)
+			testutils.AssertFileContents(t, fs, "/home/user/.ssh/"+name+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()))
+
+			private, err := afero.ReadFile(fs, "/home/user/.ssh/"+name)
+			require.NoError(t, err)
+			parsed, err := ssh.ParsePrivateKey(private)
+			require.NoError(t, err)
+			assert.Equal(t, signer.PublicKey().Marshal(), parsed.PublicKey().Marshal())
+
+			stat, err := fs.Stat("/home/user/.ssh/" + name)
+			require.NoError(t, err)
+			assert.Equal(t, "-rw-------", stat.Mode().String())
+		})
+	}
+}
+
+func TestAddSSHAuthorizedKey(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	first := testutils.NewSSHKeyPair(t, fs, "/keys/first", testutils.KeyAlgorithmEd25519)
+	second := testutils.NewSSHKeyPair(t, fs, "/keys/second", testutils.KeyAlgorithmEd25519)
+
+	testutils.AddSSHAuthorizedKey(t, fs, "/home/git/.ssh/authorized_keys", first.PublicKey())
+	testutils.AddSSHAuthorizedKey(t, fs, "/home/git/.ssh/authorized_keys", second.PublicKey(), `command="git-shell"`, "no-pty")
+
+	testutils.AssertFileContents(t, fs, "/home/git/.ssh/authorized_keys",
+		string(ssh.MarshalAuthorizedKey(first.PublicKey()))+
+			`command="git-shell",no-pty `+string(ssh.MarshalAuthorizedKey(second.PublicKey())),
+	)
+}
+
+func TestSSHServer(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	hostKey := testutils.NewSSHKeyPair(t, fs, "/etc/ssh", testutils.KeyAlgorithmEd25519)
+	clientKey := testutils.NewSSHKeyPair(t, fs, "/home/user/.ssh", testutils.KeyAlgorithmECDSAP256)
+
+	server := testutils.NewSSHServer(t, hostKey, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if command != "git-upload-pack 'repo.git'" {
+			io.WriteString(stderr, "unknown command")
+			return 127
+		}
+		input, _ := io.ReadAll(stdin)
+		io.WriteString(stdout, "received "+string(input))
+		return 0
+	})
+
+	run := func(t *testing.T, signer ssh.Signer, command string) (string, error) {
+		t.Helper()
+		client, err := ssh.Dial("tcp", server.Addr, &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		})
+		if err != nil {
+			return "", err
+		}
+		defer client.Close()
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		session.Stdin = strings.NewReader("want HEAD")
+		out, err := session.Output(command)
+		return string(out), err
+	}
+
+	t.Run("When the client key is not authorized", func(t *testing.T) {
+		_, err := run(t, clientKey, "git-upload-pack 'repo.git'")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unable to authenticate")
+	})
+
+	t.Run("When the client key is authorized", func(t *testing.T) {
+		server.AuthorizeKey(clientKey.PublicKey())
+		out, err := run(t, clientKey, "git-upload-pack 'repo.git'")
+		require.NoError(t, err)
+		assert.Equal(t, "received want HEAD", out)
+
+		_, err = run(t, clientKey, "rm -rf /")
+		require.Error(t, err)
+		exitErr := &ssh.ExitError{}
+		require.ErrorAs(t, err, &exitErr)
+		assert.Equal(t, 127, exitErr.ExitStatus())
+	})
+
+	t.Run("When the client presents a certificate signed by an authorized authority", func(t *testing.T) {
+		ca := testutils.NewSSHCertificateAuthority(t, fs, "/etc/ssh/ca")
+		userKey := testutils.NewSSHKeyPair(t, fs, "/home/other/.ssh", testutils.KeyAlgorithmEd25519)
+		cert := ca.SignUserKey(t, fs, "/home/other/.ssh/id_ed25519.pub", "git")
+		testutils.AssertFileContents(t, fs, "/home/other/.ssh/id_ed25519-cert.pub", ssh.MarshalAuthorizedKey(cert))
+
+		certSigner, err := ssh.NewCertSigner(cert, userKey)
+		require.NoError(t, err)
+
+		_, err = run(t, certSigner, "git-upload-pack 'repo.git'")
+		require.Error(t, err)
+
+		server.AuthorizeCertificateAuthority(ca)
+		out, err := run(t, certSigner, "git-upload-pack 'repo.git'")
+		require.NoError(t, err)
+		assert.Equal(t, "received want HEAD", out)
+	})
+
+	commands := server.Commands()
+	require.Len(t, commands, 3)
+	assert.Equal(t, testutils.SSHCommand{User: "git", Command: "git-upload-pack 'repo.git'", ExitStatus: 0}, commands[0])
+	assert.Equal(t, testutils.SSHCommand{User: "git", Command: "rm -rf /", ExitStatus: 127}, commands[1])
+	assert.Equal(t, testutils.SSHCommand{User: "git", Command: "git-upload-pack 'repo.git'", ExitStatus: 0}, commands[2])
+}
+
+func TestSSHServerCloseDisconnectsClients(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	hostKey := testutils.NewSSHKeyPair(t, fs, "/etc/ssh", testutils.KeyAlgorithmEd25519)
+	clientKey := testutils.NewSSHKeyPair(t, fs, "/home/user/.ssh", testutils.KeyAlgorithmEd25519)
+	server := testutils.NewSSHServer(t, hostKey, nil).AuthorizeKey(clientKey.PublicKey())
+
+	client, err := ssh.Dial("tcp", server.Addr, &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	require.NoError(t, err)
+	_, err = client.NewSession()
+	require.NoError(t, err)
+
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return while a client was connected")
+	}
+	assert.Error(t, client.Wait())
+}
+
+func TestSSHKnownHosts(t *testing.T) {
+	fs := afero.NewOsFs()
+	dir := t.TempDir()
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+
+	hostKey := testutils.NewSSHKeyPair(t, fs, dir, testutils.KeyAlgorithmEd25519)
+	otherKey := testutils.NewSSHKeyPair(t, fs, filepath.Join(dir, "other"), testutils.KeyAlgorithmEd25519)
+	ca := testutils.NewSSHCertificateAuthority(t, fs, filepath.Join(dir, "ca"))
+	hostCert := ca.SignHostKey(t, fs, filepath.Join(dir, "other", "id_ed25519.pub"), "git.example.com")
+
+	server := testutils.NewSSHServer(t, hostKey, nil)
+	testutils.AddSSHKnownHost(t, fs, knownHostsPath, []string{server.Addr}, hostKey.PublicKey())
+	testutils.AddSSHKnownHostCertificateAuthority(t, fs, knownHostsPath, "*.example.com", ca)
+
+	callback, err := knownhosts.New(knownHostsPath)
+	require.NoError(t, err)
+
+	addr := testutils.NewSSHServer(t, hostKey, nil).Addr
+	assert.NoError(t, callback(server.Addr, fakeAddr(server.Addr), hostKey.PublicKey()))
+	assert.Error(t, callback(addr, fakeAddr(addr), hostKey.PublicKey()))
+	assert.Error(t, callback(server.Addr, fakeAddr(server.Addr), otherKey.PublicKey()))
+
+	assert.NoError(t, callback("git.example.com:22", fakeAddr("127.0.0.1:22"), hostCert))
+	assert.Error(t, callback("git.example.org:22", fakeAddr("127.0.0.1:22"), hostCert))
+}
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
@@ -2,6 +2,7 @@ package testutils
 
 import (
 	"fmt"
+	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -11,6 +12,17 @@ type TestHelper interface {
 	Helper()
 }
 
+// CleanupTest is implemented by tests able to run functions once they complete.
+// Helpers starting servers or checking expectations at the end of the test rely on it:
+// the servers started with a CleanupTest are stopped when the test completes.
+type CleanupTest interface {
+	require.TestingT
+	Helper()
+	Cleanup(func())
+}
+
+var _ CleanupTest = &testing.T{}
+
 type MsgAndArgs struct {
 	MSG  string
 	Args []interface{}
@@ -20,6 +32,7 @@ type FakeTest struct {
 	ErrorMessages []string
 	Failed        bool
 	Name          string
+	cleanups      []func()
 }
 
 func (t *FakeTest) Errorf(msg string, args ...interface{}) {
@@ -33,6 +46,23 @@ func (t *FakeTest) FailNow() {
 	t.Failed = true
 }
 
+func (t *FakeTest) Helper() {}
+
+// Cleanup registers a function to be called by RunCleanups.
+func (t *FakeTest) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+// RunCleanups calls the registered cleanup functions in the reverse order they were added,
+// as the go test framework does once a test completes.
+func (t *FakeTest) RunCleanups() {
+	for len(t.cleanups) > 0 {
+		f := t.cleanups[len(t.cleanups)-1]
+		t.cleanups = t.cleanups[:len(t.cleanups)-1]
+		f()
+	}
+}
+
 func (t *FakeTest) String() string {
 	s := "--- PASS: "
 	if t.Failed || len(t.ErrorMessages) > 0 {
@@ -43,3 +73,4 @@ func (t *FakeTest) String() string {
 
 var _ assert.TestingT = &FakeTest{}
 var _ require.TestingT = &FakeTest{}
+var _ CleanupTest = &FakeTest{}
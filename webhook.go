@@ -0,0 +1,302 @@
+package testutils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// WebhookScheme is a style of webhook HMAC signature.
+type WebhookScheme string
+
+const (
+	// WebhookGitHub signs the body in the X-Hub-Signature-256 header.
+	WebhookGitHub WebhookScheme = "github"
+	// WebhookStripe signs the timestamp and the body in the Stripe-Signature header.
+	WebhookStripe WebhookScheme = "stripe"
+	// WebhookSlack signs the timestamp and the body in the X-Slack-Signature and X-Slack-Request-Timestamp headers.
+	WebhookSlack WebhookScheme = "slack"
+)
+
+// WebhookTimestampTolerance is the maximum age of the timestamps of Stripe and Slack signatures.
+const WebhookTimestampTolerance = 5 * time.Minute
+
+func webhookHMAC(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, part := range parts {
+		mac.Write([]byte(part))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignWebhookRequest signs the request with the secret in the style of the scheme.
+// The body is restored after being read.
+func SignWebhookRequest(req *http.Request, scheme WebhookScheme, secret string) error {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	switch scheme {
+	case WebhookGitHub:
+		req.Header.Set("X-Hub-Signature-256", "sha256="+webhookHMAC(secret, string(body)))
+	case WebhookStripe:
+		req.Header.Set("Stripe-Signature", fmt.Sprintf("t=%s,v1=%s", timestamp, webhookHMAC(secret, timestamp, ".", string(body))))
+	case WebhookSlack:
+		req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+		req.Header.Set("X-Slack-Signature", "v0="+webhookHMAC(secret, "v0:", timestamp, ":", string(body)))
+	default:
+		return fmt.Errorf("unknown webhook scheme %q", scheme)
+	}
+	return nil
+}
+
+// VerifyWebhookSignature verifies the signature of the request in the style of the scheme.
+// The body is restored after being read.
+func VerifyWebhookSignature(req *http.Request, scheme WebhookScheme, secret string) error {
+	body, err := readRequestBody(req)
+	if err != nil {
+		return err
+	}
+	switch scheme {
+	case WebhookGitHub:
+		signature := req.Header.Get("X-Hub-Signature-256")
+		if signature == "" {
+			return errors.New("missing X-Hub-Signature-256 header")
+		}
+		if !hmac.Equal([]byte(signature), []byte("sha256="+webhookHMAC(secret, string(body)))) {
+			return errors.New("invalid X-Hub-Signature-256 signature")
+		}
+		return nil
+	case WebhookStripe:
+		header := req.Header.Get("Stripe-Signature")
+		if header == "" {
+			return errors.New("missing Stripe-Signature header")
+		}
+		timestamp := ""
+		signatures := []string{}
+		for _, item := range strings.Split(header, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+			switch key {
+			case "t":
+				timestamp = value
+			case "v1":
+				signatures = append(signatures, value)
+			}
+		}
+		if err := checkWebhookTimestamp(timestamp); err != nil {
+			return err
+		}
+		expected := webhookHMAC(secret, timestamp, ".", string(body))
+		for _, signature := range signatures {
+			if hmac.Equal([]byte(signature), []byte(expected)) {
+				return nil
+			}
+		}
+		return errors.New("invalid Stripe-Signature signature")
+	case WebhookSlack:
+		timestamp := req.Header.Get("X-Slack-Request-Timestamp")
+		if err := checkWebhookTimestamp(timestamp); err != nil {
+			return err
+		}
+		signature := req.Header.Get("X-Slack-Signature")
+		if signature == "" {
+			return errors.New("missing X-Slack-Signature header")
+		}
+		if !hmac.Equal([]byte(signature), []byte("v0="+webhookHMAC(secret, "v0:", timestamp, ":", string(body)))) {
+			return errors.New("invalid X-Slack-Signature signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown webhook scheme %q", scheme)
+}
+
+func checkWebhookTimestamp(timestamp string) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid signature timestamp %q", timestamp)
+	}
+	if age := time.Since(time.Unix(seconds, 0)); math.Abs(float64(age)) > float64(WebhookTimestampTolerance) {
+		return fmt.Errorf("signature timestamp %s is outside the %s tolerance", timestamp, WebhookTimestampTolerance)
+	}
+	return nil
+}
+
+// WebhookDelivery is a request received by a WebhookReceiver.
+type WebhookDelivery struct {
+	Method   string
+	URL      *url.URL
+	Header   http.Header
+	Body     []byte
+	Received time.Time
+	// Status is the status code the receiver answered.
+	Status int
+	// SignatureError is the reason the signature was rejected, when the receiver verifies signatures.
+	SignatureError error
+	request        *http.Request
+}
+
+// Request returns a copy of the delivered request, with a body that can be read.
+func (d WebhookDelivery) Request() *http.Request {
+	req := d.request.Clone(d.request.Context())
+	req.Body = io.NopCloser(strings.NewReader(string(d.Body)))
+	return req
+}
+
+func (d WebhookDelivery) String() string {
+	s := fmt.Sprintf("%s %s: %d", d.Method, d.URL, d.Status)
+	if d.SignatureError != nil {
+		s += " (" + d.SignatureError.Error() + ")"
+	}
+	return s
+}
+
+// WebhookReceiver is a server collecting webhook deliveries.
+//
+//	receiver := testutils.NewWebhookReceiver(t).
+//		WithSignature(testutils.WebhookGitHub, "secret").
+//		WithStatusCodes(http.StatusInternalServerError, http.StatusOK)
+//	sender.Notify(receiver.Server.URL + "/hooks")
+//	receiver.RequireDelivered(t, ctx, testutils.MatchHeader("X-GitHub-Event", "push"))
+type WebhookReceiver struct {
+	Server *httptest.Server
+
+	mu         sync.Mutex
+	scheme     WebhookScheme
+	secret     string
+	statuses   []int
+	deliveries []WebhookDelivery
+	delivered  chan struct{}
+}
+
+// NewWebhookReceiver starts a receiver answering 200 OK to all the deliveries.
+func NewWebhookReceiver(t CleanupTest) *WebhookReceiver {
+	t.Helper()
+	r := &WebhookReceiver{delivered: make(chan struct{})}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.Server.Close)
+	return r
+}
+
+// WithSignature makes the receiver answer 401 Unauthorized to deliveries not signed with the secret.
+func (r *WebhookReceiver) WithSignature(scheme WebhookScheme, secret string) *WebhookReceiver {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scheme = scheme
+	r.secret = secret
+	return r
+}
+
+// WithStatusCodes sets the status codes answered to the next deliveries, in order.
+// The last one is answered to the following deliveries.
+// Deliveries rejected for their signature are answered with 401 and don't consume a status code.
+func (r *WebhookReceiver) WithStatusCodes(codes ...int) *WebhookReceiver {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses = codes
+	return r
+}
+
+func (r *WebhookReceiver) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := readRequestBody(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	delivery := WebhookDelivery{
+		Method:   req.Method,
+		URL:      cloneURL(req.URL),
+		Header:   req.Header.Clone(),
+		Body:     body,
+		Received: time.Now(),
+		Status:   http.StatusOK,
+		request:  req.Clone(context.Background()),
+	}
+	if r.scheme != "" {
+		if err := VerifyWebhookSignature(req, r.scheme, r.secret); err != nil {
+			delivery.SignatureError = err
+			delivery.Status = http.StatusUnauthorized
+		}
+	}
+	if delivery.SignatureError == nil && len(r.statuses) > 0 {
+		delivery.Status = r.statuses[0]
+		if len(r.statuses) > 1 {
+			r.statuses = r.statuses[1:]
+		}
+	}
+	r.deliveries = append(r.deliveries, delivery)
+	close(r.delivered)
+	r.delivered = make(chan struct{})
+	r.mu.Unlock()
+	w.WriteHeader(delivery.Status)
+}
+
+// Deliveries returns the received deliveries, in order.
+func (r *WebhookReceiver) Deliveries() []WebhookDelivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]WebhookDelivery{}, r.deliveries...)
+}
+
+// WaitForDelivery returns the first delivery matched by the matcher, waiting for it until the context is done.
+func (r *WebhookReceiver) WaitForDelivery(ctx context.Context, matcher RequestMatcher) (WebhookDelivery, error) {
+	checked := 0
+	for {
+		r.mu.Lock()
+		deliveries := r.deliveries[checked:]
+		delivered := r.delivered
+		r.mu.Unlock()
+		for _, delivery := range deliveries {
+			if matcher.Match(delivery.Request()) {
+				return delivery, nil
+			}
+		}
+		checked += len(deliveries)
+		select {
+		case <-delivered:
+		case <-ctx.Done():
+			return WebhookDelivery{}, fmt.Errorf("no delivery matching %s: %w", matcher, ctx.Err())
+		}
+	}
+}
+
+// AssertDelivered asserts that a delivery matched by the matcher is received before the context is done.
+func (r *WebhookReceiver) AssertDelivered(t assert.TestingT, ctx context.Context, matcher RequestMatcher, msgAndArgs ...interface{}) bool {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if _, err := r.WaitForDelivery(ctx, matcher); err != nil {
+		descriptions := []string{}
+		for _, delivery := range r.Deliveries() {
+			descriptions = append(descriptions, "\t"+delivery.String())
+		}
+		return assert.Fail(t, fmt.Sprintf("Expecting a delivery matching %s but got none before %s, received deliveries:\n%s", matcher, ctx.Err(), strings.Join(descriptions, "\n")), msgAndArgs...)
+	}
+	return true
+}
+
+func (r *WebhookReceiver) RequireDelivered(t require.TestingT, ctx context.Context, matcher RequestMatcher, msgAndArgs ...interface{}) {
+	if h, ok := t.(TestHelper); ok {
+		h.Helper()
+	}
+	if r.AssertDelivered(t, ctx, matcher, msgAndArgs...) {
+		return
+	}
+	t.FailNow()
+}
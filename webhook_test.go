@@ -0,0 +1,151 @@
+package testutils_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	testutils "github.com/adevinta/go-testutils-toolkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func deliverWebhook(t *testing.T, url string, scheme testutils.WebhookScheme, secret, event, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("X-Event", event)
+	if scheme != "" {
+		require.NoError(t, testutils.SignWebhookRequest(req, scheme, secret))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebhookSignatures(t *testing.T) {
+	for _, scheme := range []testutils.WebhookScheme{testutils.WebhookGitHub, testutils.WebhookStripe, testutils.WebhookSlack} {
+		t.Run(string(scheme), func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "http://example.com/hooks", strings.NewReader(`{"action":"opened"}`))
+			require.NoError(t, err)
+			require.NoError(t, testutils.SignWebhookRequest(req, scheme, "secret"))
+
+			assert.NoError(t, testutils.VerifyWebhookSignature(req, scheme, "secret"))
+			assert.Error(t, testutils.VerifyWebhookSignature(req, scheme, "other"))
+
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, `{"action":"opened"}`, string(body))
+
+			req.Body = io.NopCloser(strings.NewReader(`{"action":"closed"}`))
+			assert.Error(t, testutils.VerifyWebhookSignature(req, scheme, "secret"))
+		})
+	}
+
+	t.Run("github header", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/hooks", strings.NewReader("Hello, World!"))
+		require.NoError(t, err)
+		// example from the GitHub documentation
+		req.Header.Set("X-Hub-Signature-256", "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17")
+		assert.NoError(t, testutils.VerifyWebhookSignature(req, testutils.WebhookGitHub, "It's a Secret to Everybody"))
+	})
+
+	t.Run("missing signatures", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/hooks", strings.NewReader("{}"))
+		require.NoError(t, err)
+		assert.EqualError(t, testutils.VerifyWebhookSignature(req, testutils.WebhookGitHub, "secret"), "missing X-Hub-Signature-256 header")
+		assert.EqualError(t, testutils.VerifyWebhookSignature(req, testutils.WebhookStripe, "secret"), "missing Stripe-Signature header")
+		assert.EqualError(t, testutils.VerifyWebhookSignature(req, testutils.WebhookSlack, "secret"), `invalid signature timestamp ""`)
+		assert.EqualError(t, testutils.VerifyWebhookSignature(req, "unknown", "secret"), `unknown webhook scheme "unknown"`)
+	})
+
+	t.Run("expired timestamps", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/hooks", strings.NewReader("{}"))
+		require.NoError(t, err)
+		require.NoError(t, testutils.SignWebhookRequest(req, testutils.WebhookStripe, "secret"))
+		signature := req.Header.Get("Stripe-Signature")
+		req.Header.Set("Stripe-Signature", "t=1492774577"+signature[strings.Index(signature, ","):])
+		err = testutils.VerifyWebhookSignature(req, testutils.WebhookStripe, "secret")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "outside the 5m0s tolerance")
+	})
+}
+
+func TestWebhookReceiver(t *testing.T) {
+	receiver := testutils.NewWebhookReceiver(t).
+		WithSignature(testutils.WebhookStripe, "secret").
+		WithStatusCodes(http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK)
+
+	assert.Equal(t, http.StatusServiceUnavailable, deliverWebhook(t, receiver.Server.URL+"/hooks", testutils.WebhookStripe, "secret", "created", `{"id":1}`))
+	assert.Equal(t, http.StatusInternalServerError, deliverWebhook(t, receiver.Server.URL+"/hooks", testutils.WebhookStripe, "secret", "created", `{"id":1}`))
+	assert.Equal(t, http.StatusOK, deliverWebhook(t, receiver.Server.URL+"/hooks", testutils.WebhookStripe, "secret", "created", `{"id":1}`))
+	assert.Equal(t, http.StatusOK, deliverWebhook(t, receiver.Server.URL+"/hooks", testutils.WebhookStripe, "secret", "updated", `{"id":1}`))
+	assert.Equal(t, http.StatusUnauthorized, deliverWebhook(t, receiver.Server.URL+"/hooks", testutils.WebhookStripe, "other", "deleted", `{"id":1}`))
+	assert.Equal(t, http.StatusUnauthorized, deliverWebhook(t, receiver.Server.URL+"/hooks", "", "", "deleted", `{"id":1}`))
+
+	deliveries := receiver.Deliveries()
+	require.Len(t, deliveries, 6)
+	assert.Equal(t, http.MethodPost, deliveries[0].Method)
+	assert.Equal(t, "/hooks", deliveries[0].URL.Path)
+	assert.Equal(t, `{"id":1}`, string(deliveries[0].Body))
+	assert.NoError(t, deliveries[0].SignatureError)
+	assert.EqualError(t, deliveries[4].SignatureError, "invalid Stripe-Signature signature")
+	assert.EqualError(t, deliveries[5].SignatureError, "missing Stripe-Signature header")
+
+	t.Run("rejected signatures do not consume status codes", func(t *testing.T) {
+		receiver := testutils.NewWebhookReceiver(t).
+			WithSignature(testutils.WebhookStripe, "secret").
+			WithStatusCodes(http.StatusServiceUnavailable, http.StatusOK)
+
+		assert.Equal(t, http.StatusUnauthorized, deliverWebhook(t, receiver.Server.URL+"/hooks", testutils.WebhookStripe, "other", "created", `{"id":1}`))
+		assert.Equal(t, http.StatusServiceUnavailable, deliverWebhook(t, receiver.Server.URL+"/hooks", testutils.WebhookStripe, "secret", "created", `{"id":1}`))
+		assert.Equal(t, http.StatusOK, deliverWebhook(t, receiver.Server.URL+"/hooks", testutils.WebhookStripe, "secret", "created", `{"id":1}`))
+	})
+
+	t.Run("wait for past deliveries", func(t *testing.T) {
+		delivery, err := receiver.WaitForDelivery(context.Background(), testutils.MatchHeader("X-Event", "updated"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, delivery.Status)
+		body, err := io.ReadAll(delivery.Request().Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"id":1}`, string(body))
+	})
+
+	t.Run("wait for future deliveries", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, receiver.Server.URL+"/hooks", strings.NewReader(`{"id":2}`))
+		require.NoError(t, err)
+		req.Header.Set("X-Event", "refunded")
+		require.NoError(t, testutils.SignWebhookRequest(req, testutils.WebhookStripe, "secret"))
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		receiver.RequireDelivered(t, ctx, testutils.MatchAll(testutils.MatchHeader("X-Event", "refunded"), testutils.MatchBodyString(`{"id":2}`)))
+	})
+
+	t.Run("missing deliveries", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := receiver.WaitForDelivery(ctx, testutils.MatchHeader("X-Event", "disputed"))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		fakeT := &testutils.FakeTest{}
+		assert.False(t, receiver.AssertDelivered(fakeT, ctx, testutils.MatchHeader("X-Event", "disputed")))
+		require.Len(t, fakeT.ErrorMessages, 1)
+		assert.Contains(t, fakeT.ErrorMessages[0], "Expecting a delivery matching header X-Event=disputed but got none before context deadline exceeded")
+		assert.Contains(t, fakeT.ErrorMessages[0], "POST /hooks: 503")
+		assert.Contains(t, fakeT.ErrorMessages[0], "POST /hooks: 401 (invalid Stripe-Signature signature)")
+
+		fakeT = &testutils.FakeTest{}
+		receiver.RequireDelivered(fakeT, ctx, testutils.MatchHeader("X-Event", "disputed"))
+		assert.True(t, fakeT.Failed)
+	})
+}